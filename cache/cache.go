@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	BackendMemory = "memory"
+	BackendMongo  = "mongo"
+)
+
+const (
+	DefaultTTL        = 3600
+	DefaultMaxEntries = 10000
+)
+
+var ErrUnknownBackend = errors.New("unknown cache backend")
+
+type Config struct {
+	Enable     bool   `yaml:"enable"`
+	Backend    string `yaml:"backend"`
+	TTL        int    `yaml:"ttl"` //seconds
+	MaxEntries int    `yaml:"max_entries"`
+}
+
+// Entry is a cached answer. Message and conversation ids are not cached,
+// every hit is given fresh ones by the caller.
+type Entry struct {
+	Text  string `json:"text" bson:"text"`
+	Model string `json:"model" bson:"model"`
+	Url   string `json:"url" bson:"url"`
+}
+
+type Backend interface {
+	Get(key string) (*Entry, bool)
+	Set(key string, entry Entry)
+}
+
+// Params are the sampling params that change the answer for a prompt.
+type Params struct {
+	Temperature float32 `json:"temperature"`
+	TopP        float32 `json:"top_p"`
+}
+
+func New(conf Config) (Backend, error) {
+	if conf.TTL <= 0 {
+		conf.TTL = DefaultTTL
+	}
+	if conf.MaxEntries <= 0 {
+		conf.MaxEntries = DefaultMaxEntries
+	}
+	ttl := time.Second * time.Duration(conf.TTL)
+	switch conf.Backend {
+	case "", BackendMemory:
+		return NewLRU(conf.MaxEntries, ttl), nil
+	case BackendMongo:
+		return NewMongo(conf.MaxEntries, ttl)
+	}
+	return nil, ErrUnknownBackend
+}
+
+// Key hashes model, the normalized prompt history and sampling params.
+func Key(model string, prompt []openai.ChatCompletionMessage, params Params) string {
+	normalized := make([][2]string, 0, len(prompt))
+	for _, msg := range prompt {
+		normalized = append(normalized, [2]string{msg.Role, normalize(msg.Content)})
+	}
+	data, _ := json.Marshal(struct {
+		Model  string      `json:"model"`
+		Prompt [][2]string `json:"prompt"`
+		Params Params      `json:"params"`
+	}{model, normalized, params})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalize folds whitespace runs and case so trivial variants share a key.
+func normalize(content string) string {
+	return strings.ToLower(strings.Join(strings.Fields(content), " "))
+}
@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestLRUEvict(t *testing.T) {
+	c := NewLRU(2, time.Minute)
+	c.Set("a", Entry{Text: "a"})
+	c.Set("b", Entry{Text: "b"})
+	c.Get("a")
+	c.Set("c", Entry{Text: "c"})
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("least recently used entry not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if e, ok := c.Get(key); !ok || e.Text != key {
+			t.Fatal("entry missing", key)
+		}
+	}
+}
+
+func TestLRUExpire(t *testing.T) {
+	c := NewLRU(10, time.Millisecond)
+	c.Set("a", Entry{Text: "a"})
+	time.Sleep(time.Millisecond * 5)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("expired entry returned")
+	}
+	if c.Len() != 0 {
+		t.Fatal("expired entry not removed")
+	}
+}
+
+func TestKey(t *testing.T) {
+	prompt := func(content string) []openai.ChatCompletionMessage {
+		return []openai.ChatCompletionMessage{{Role: "user", Content: content}}
+	}
+	params := Params{}
+	if Key("m", prompt("How  does lane keeping work?"), params) != Key("m", prompt("how does lane keeping work? "), params) {
+		t.Fatal("normalized prompts should share a key")
+	}
+	if Key("m", prompt("a"), params) == Key("n", prompt("a"), params) {
+		t.Fatal("models should not share a key")
+	}
+	if Key("m", prompt("a"), params) == Key("m", prompt("a"), Params{Temperature: 0.5}) {
+		t.Fatal("sampling params should not share a key")
+	}
+}
+
+func TestVectorIndexNearest(t *testing.T) {
+	idx := NewVectorIndex(2, time.Minute)
+	idx.Add("t1", "m", []float32{1, 0}, Entry{Text: "x"}, "msg-x")
+	idx.Add("t1", "m", []float32{0, 1}, Entry{Text: "y"}, "msg-y")
+	idx.Add("t1", "n", []float32{1, 1}, Entry{Text: "z"}, "msg-z")
+	if idx.Len() != 2 {
+		t.Fatal("index not bounded", idx.Len())
+	}
+	match := idx.Nearest("t1", "m", []float32{0.1, 2})
+	if match == nil || match.Source != "msg-y" || match.Similarity < 0.99 {
+		t.Fatalf("unexpected match %+v", match)
+	}
+	if match := idx.Nearest("t1", "other", []float32{1, 0}); match != nil {
+		t.Fatal("matched entry of another model")
+	}
+	if match := idx.Nearest("t2", "m", []float32{0, 1}); match != nil {
+		t.Fatal("matched entry of another tenant")
+	}
+}
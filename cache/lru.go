@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type lruItem struct {
+	key      string
+	entry    Entry
+	expireAt time.Time
+}
+
+// LRU is an in-process cache bounded by entry count, entries expire after ttl.
+type LRU struct {
+	lock       sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+func NewLRU(maxEntries int, ttl time.Duration) *LRU {
+	return &LRU{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (c *LRU) Get(key string) (*Entry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := elem.Value.(*lruItem)
+	if time.Now().After(item.expireAt) {
+		c.removeElement(elem)
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	entry := item.entry
+	return &entry, true
+}
+
+func (c *LRU) Set(key string, entry Entry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expireAt := time.Now().Add(c.ttl)
+	if elem, ok := c.items[key]; ok {
+		item := elem.Value.(*lruItem)
+		item.entry = entry
+		item.expireAt = expireAt
+		c.ll.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruItem{key, entry, expireAt})
+	for c.ll.Len() > c.maxEntries {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *LRU) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ll.Len()
+}
+
+func (c *LRU) removeElement(elem *list.Element) {
+	c.ll.Remove(elem)
+	delete(c.items, elem.Value.(*lruItem).key)
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gateway/db"
+	"gateway/log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const mongoCollection = "response_cache"
+
+const mongoTimeout = time.Second * 5
+
+// mongoEntry holds Entry in the clear, or Sealed when stored turns are
+// encrypted.
+type mongoEntry struct {
+	Key        string       `bson:"_id"`
+	Entry      *Entry       `bson:"entry,omitempty"`
+	Sealed     []byte       `bson:"sealed,omitempty"`
+	Encryption *db.Envelope `bson:"encryption,omitempty"`
+	ExpireAt   time.Time    `bson:"expireAt"`
+}
+
+// Mongo shares cached answers between gateway replicas. Expired entries are
+// removed by a TTL index, the size bound is enforced on write. Answers are
+// encrypted like stored turns when encryption is on.
+type Mongo struct {
+	collection *mongo.Collection
+	maxEntries int
+	ttl        time.Duration
+}
+
+func NewMongo(maxEntries int, ttl time.Duration) (*Mongo, error) {
+	if db.MgoCli == nil {
+		return nil, errors.New("mongo cache backend needs a mongo connection")
+	}
+	c := &Mongo{
+		collection: db.MgoCli.Database(db.DatabaseName).Collection(mongoCollection),
+		maxEntries: maxEntries,
+		ttl:        ttl,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := c.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expireAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Mongo) Get(key string) (*Entry, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	var doc mongoEntry
+	filter := bson.D{{Key: "_id", Value: key}, {Key: "expireAt", Value: bson.D{{Key: "$gt", Value: time.Now()}}}}
+	if err := c.collection.FindOne(ctx, filter).Decode(&doc); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Warn("response cache get error", err)
+		}
+		return nil, false
+	}
+	if doc.Encryption == nil {
+		//entries written in the clear are not served once encryption is on
+		if doc.Entry == nil || db.EncryptionEnabled() {
+			return nil, false
+		}
+		return doc.Entry, true
+	}
+	data, err := db.OpenValue(key, doc.Encryption, doc.Sealed)
+	if err != nil {
+		log.Warn("response cache decrypt error", err)
+		return nil, false
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		log.Warn("response cache decode error", err)
+		return nil, false
+	}
+	return &entry, true
+}
+
+func (c *Mongo) Set(key string, entry Entry) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	doc := mongoEntry{Key: key, ExpireAt: time.Now().Add(c.ttl)}
+	if db.EncryptionEnabled() {
+		data, err := json.Marshal(&entry)
+		if err != nil {
+			log.Warn("response cache encode error", err)
+			return
+		}
+		if doc.Encryption, doc.Sealed, err = db.SealValue(key, data); err != nil {
+			log.Warn("response cache encrypt error", err)
+			return
+		}
+	} else {
+		doc.Entry = &entry
+	}
+	_, err := c.collection.ReplaceOne(ctx, bson.D{{Key: "_id", Value: key}}, doc, options.Replace().SetUpsert(true))
+	if err != nil {
+		log.Warn("response cache set error", err)
+		return
+	}
+	c.trim(ctx)
+}
+
+// trim drops the entries closest to expiry once the bound is exceeded.
+func (c *Mongo) trim(ctx context.Context) {
+	count, err := c.collection.EstimatedDocumentCount(ctx)
+	if err != nil || count <= int64(c.maxEntries) {
+		return
+	}
+	opt := options.Find().SetSort(bson.D{{Key: "expireAt", Value: 1}}).SetLimit(count - int64(c.maxEntries)).SetProjection(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := c.collection.Find(ctx, bson.D{}, opt)
+	if err != nil {
+		return
+	}
+	defer cursor.Close(ctx)
+	keys := bson.A{}
+	for cursor.Next(ctx) {
+		var doc mongoEntry
+		if err := cursor.Decode(&doc); err == nil {
+			keys = append(keys, doc.Key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	c.collection.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: keys}}}})
+}
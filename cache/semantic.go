@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const DefaultSimilarityThreshold = 0.95
+
+type SemanticConfig struct {
+	Enable         bool               `yaml:"enable"`
+	EmbeddingUrl   string             `yaml:"embedding_url"`
+	EmbeddingModel string             `yaml:"embedding_model"`
+	Threshold      float32            `yaml:"threshold"`
+	ModelThreshold map[string]float32 `yaml:"model_threshold"`
+	TTL            int                `yaml:"ttl"` //seconds
+	MaxEntries     int                `yaml:"max_entries"`
+}
+
+func (conf SemanticConfig) ThresholdFor(model string) float32 {
+	if t, ok := conf.ModelThreshold[model]; ok && t > 0 {
+		return t
+	}
+	if conf.Threshold > 0 {
+		return conf.Threshold
+	}
+	return DefaultSimilarityThreshold
+}
+
+type vectorEntry struct {
+	tenant   string
+	model    string
+	vector   []float32
+	entry    Entry
+	source   string
+	expireAt time.Time
+}
+
+// Match is the nearest stored answer for a question.
+type Match struct {
+	Entry      Entry
+	Source     string //message id the answer was first given in
+	Similarity float32
+}
+
+// VectorIndex is an in-process index of question embeddings, searched by
+// cosine similarity. It is bounded by entry count, the oldest entry goes first.
+// Entries only match questions of the same tenant and model.
+type VectorIndex struct {
+	lock       sync.RWMutex
+	maxEntries int
+	ttl        time.Duration
+	entries    []vectorEntry
+}
+
+func NewVectorIndex(maxEntries int, ttl time.Duration) *VectorIndex {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	if ttl <= 0 {
+		ttl = time.Second * DefaultTTL
+	}
+	return &VectorIndex{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+	}
+}
+
+func (idx *VectorIndex) Add(tenant, model string, vector []float32, entry Entry, source string) {
+	vector = normalizeVector(vector)
+	if vector == nil {
+		return
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.entries = append(idx.entries, vectorEntry{
+		tenant:   tenant,
+		model:    model,
+		vector:   vector,
+		entry:    entry,
+		source:   source,
+		expireAt: time.Now().Add(idx.ttl),
+	})
+	if over := len(idx.entries) - idx.maxEntries; over > 0 {
+		idx.entries = append(idx.entries[:0:0], idx.entries[over:]...)
+	}
+}
+
+// Nearest returns the most similar live entry for tenant and model, or nil if
+// the index holds none.
+func (idx *VectorIndex) Nearest(tenant, model string, vector []float32) *Match {
+	vector = normalizeVector(vector)
+	if vector == nil {
+		return nil
+	}
+	now := time.Now()
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	var best *Match
+	for i := range idx.entries {
+		e := &idx.entries[i]
+		if e.tenant != tenant || e.model != model || now.After(e.expireAt) || len(e.vector) != len(vector) {
+			continue
+		}
+		sim := dot(e.vector, vector)
+		if best == nil || sim > best.Similarity {
+			best = &Match{Entry: e.entry, Source: e.source, Similarity: sim}
+		}
+	}
+	return best
+}
+
+func (idx *VectorIndex) Len() int {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	return len(idx.entries)
+}
+
+func dot(a, b []float32) float32 {
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+func normalizeVector(v []float32) []float32 {
+	var norm float64
+	for _, x := range v {
+		norm += float64(x) * float64(x)
+	}
+	if norm == 0 {
+		return nil
+	}
+	norm = math.Sqrt(norm)
+	out := make([]float32, len(v))
+	for i, x := range v {
+		out[i] = float32(float64(x) / norm)
+	}
+	return out
+}
@@ -8,6 +8,7 @@ import (
 	"gateway/db"
 	"gateway/log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -31,6 +32,20 @@ var SystemMessage = openai.ChatCompletionMessage{
 var CheckMsgLogDuration = time.Minute * 2
 var MaxConversactionSuspend = 60 * 20
 
+var (
+	sharedHttpClient *common.HttpClient
+	sharedHttpOnce   sync.Once
+)
+
+// pooledHttpClient lazily builds the transport shared by all api keys, after
+// the upstream config has been loaded.
+func pooledHttpClient() *common.HttpClient {
+	sharedHttpOnce.Do(func() {
+		sharedHttpClient = common.NewHttpClient(common.Upstream.HttpConfig)
+	})
+	return sharedHttpClient
+}
+
 type Client struct {
 	apiKey        string
 	logUpdateTime map[string]int64
@@ -39,7 +54,9 @@ type Client struct {
 }
 
 func NewClient(apiKey string, ctx context.Context) *Client {
-	gptClient := openai.NewClient(apiKey)
+	conf := openai.DefaultConfig(apiKey)
+	conf.HTTPClient = pooledHttpClient().StdClient()
+	gptClient := openai.NewClientWithConfig(conf)
 	c := &Client{
 		apiKey:        apiKey,
 		logUpdateTime: make(map[string]int64),
@@ -57,7 +74,8 @@ func NewClient(apiKey string, ctx context.Context) *Client {
 	return c
 }
 
-func (c *Client) buildPromt(q *common.Question) []openai.ChatCompletionMessage {
+// BuildPrompt assembles the recent conversation history and the question.
+func BuildPrompt(q *common.Question) []openai.ChatCompletionMessage {
 	promtLen := 0
 	promt := []openai.ChatCompletionMessage{}
 	conversationFrom := time.Now().Unix() - int64(MaxConversactionSuspend)
@@ -68,6 +86,10 @@ func (c *Client) buildPromt(q *common.Question) []openai.ChatCompletionMessage {
 	if err == nil {
 		for i := len(msgLog) - 1; i >= 0; i-- {
 			msg := msgLog[i]
+			//failed turns have no answer to continue from
+			if msg.Error != "" {
+				continue
+			}
 			userMsg := openai.ChatCompletionMessage{
 				Role:    UserRole,
 				Content: msg.Prompt,
@@ -108,7 +130,10 @@ func (C *Client) GetAnswer(ctx context.Context, q common.Question) (*common.QA,
 		}
 		return &qa, nil
 	}
-	prompt := C.buildPromt(&q)
+	prompt := q.Prompt
+	if prompt == nil {
+		prompt = BuildPrompt(&q)
+	}
 	log.Debug("prompt:\n", fmt.Sprintf("%v", prompt))
 	resp, err := C.gptClient.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
 		Model:    openai.GPT3Dot5Turbo,
@@ -145,6 +170,9 @@ func (C *Client) GetAnswer(ctx context.Context, q common.Question) (*common.QA,
 		MessageId:      resp.ID,
 		ConversationId: q.ConversationId,
 		Model:          resp.Model,
+		Prompt:         prompt,
+		FinishReason:   resp.Choices[0].FinishReason,
+		Usage:          resp.Usage,
 	}
 	return &qa, nil
 }
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gateway/dataset"
+	"gateway/db"
+	"gateway/log"
+	"gateway/trie"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	dryRunFlag = cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "report without changing anything",
+	}
+	migrateToFlag = cli.IntFlag{
+		Name:  "to",
+		Usage: "target schema version",
+		Value: -1,
+	}
+	migrateStepsFlag = cli.IntFlag{
+		Name:  "steps",
+		Usage: "number of migrations to revert",
+		Value: 1,
+	}
+)
+
+var commandReEncrypt = cli.Command{
+	Name:  "reencrypt",
+	Usage: "move stored conversations to the active encryption key",
+	Flags: []cli.Flag{
+		configPathFlag,
+		logLevelFlag,
+		dryRunFlag,
+	},
+	Action: ReEncrypt,
+}
+
+var (
+	formatFlag = cli.StringFlag{
+		Name:  "format",
+		Usage: "sharegpt, openai or alpaca",
+		Value: dataset.FormatShareGPT,
+	}
+	modelFlag = cli.StringSliceFlag{
+		Name:  "model",
+		Usage: "only turns of the model, repeatable",
+	}
+	fromFlag = cli.StringFlag{
+		Name:  "from",
+		Usage: "only turns since, unix seconds or 2006-01-02",
+	}
+	toFlag = cli.StringFlag{
+		Name:  "to",
+		Usage: "only turns before, unix seconds or 2006-01-02",
+	}
+	minScoreFlag = cli.Float64Flag{
+		Name:  "min-score",
+		Usage: "drop judged conversations with a lower mean feedback score (1-5)",
+	}
+	requireFeedbackFlag = cli.BoolFlag{
+		Name:  "require-feedback",
+		Usage: "drop conversations without feedback",
+	}
+	sensitiveFlag = cli.StringFlag{
+		Name:  "sensitive",
+		Usage: "conversations with sensitive words: exclude, include or only",
+		Value: dataset.SensitiveExclude,
+	}
+	noDedupFlag = cli.BoolFlag{
+		Name:  "no-dedup",
+		Usage: "keep conversations with the same content",
+	}
+	valRatioFlag = cli.Float64Flag{
+		Name:  "val-ratio",
+		Usage: "share of conversations in the validation split",
+		Value: 0.1,
+	}
+	systemFlag = cli.StringFlag{
+		Name:  "system",
+		Usage: "system prompt put before each conversation",
+	}
+	outFlag = cli.StringFlag{
+		Name:  "out",
+		Usage: "output directory",
+		Value: "./data/dataset",
+	}
+)
+
+var commandExportDataset = cli.Command{
+	Name:  "export-dataset",
+	Usage: "export stored conversations as a fine-tuning dataset",
+	Flags: []cli.Flag{
+		configPathFlag,
+		logLevelFlag,
+		formatFlag,
+		modelFlag,
+		fromFlag,
+		toFlag,
+		minScoreFlag,
+		requireFeedbackFlag,
+		sensitiveFlag,
+		noDedupFlag,
+		valRatioFlag,
+		systemFlag,
+		outFlag,
+	},
+	Action: ExportDataset,
+}
+
+var commandPurge = cli.Command{
+	Name:  "purge",
+	Usage: "purge conversations past their retention",
+	Flags: []cli.Flag{
+		configPathFlag,
+		logLevelFlag,
+		dryRunFlag,
+	},
+	Action: Purge,
+}
+
+var commandMigrate = cli.Command{
+	Name:  "migrate",
+	Usage: "apply or revert database schema migrations",
+	Subcommands: []cli.Command{
+		{
+			Name:   "status",
+			Usage:  "list migrations and whether they are applied",
+			Flags:  []cli.Flag{configPathFlag, logLevelFlag},
+			Action: MigrateStatus,
+		},
+		{
+			Name:   "up",
+			Usage:  "apply pending migrations, up to --to if set",
+			Flags:  []cli.Flag{configPathFlag, logLevelFlag, migrateToFlag},
+			Action: MigrateUp,
+		},
+		{
+			Name:   "down",
+			Usage:  "revert the last --steps migrations, or down to --to",
+			Flags:  []cli.Flag{configPathFlag, logLevelFlag, migrateStepsFlag, migrateToFlag},
+			Action: MigrateDown,
+		},
+	},
+}
+
+// initStore loads the config and opens the conversation store for the
+// one-shot commands, logging to stdout.
+func initStore(ctx *cli.Context, skipMigrations bool) ProxyConfig {
+	log.InitLog(ctx.Int(logLevelFlag.Name), os.Stdout)
+	conf := loadConfig(ctx)
+	if conf.MongoURI != "" {
+		db.MongoURI = conf.MongoURI
+	}
+	//one-shot commands need the real store, not the degraded fallback
+	conf.Store.Degraded.Enable = false
+	conf.Store.SkipMigrations = conf.Store.SkipMigrations || skipMigrations
+	if err := db.Init(conf.Store); err != nil {
+		log.Fatal("init store error", err)
+		os.Exit(1)
+	}
+	return conf
+}
+
+func Purge(ctx *cli.Context) error {
+	conf := initStore(ctx, false)
+	defer db.Close()
+	dryRun := ctx.Bool(dryRunFlag.Name) || conf.Retention.DryRun
+	report, err := db.Purge(context.Background(), db.Store, conf.Retention, dryRun)
+	if err != nil {
+		return err
+	}
+	return printJSON(report)
+}
+
+func initMigrator(ctx *cli.Context) (db.Migrator, error) {
+	//migrate decides itself which steps to run
+	initStore(ctx, true)
+	return db.StoreMigrator()
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func MigrateStatus(ctx *cli.Context) error {
+	migrator, err := initMigrator(ctx)
+	defer db.Close()
+	if err != nil {
+		return err
+	}
+	states, err := migrator.Migrations(context.Background())
+	if err != nil {
+		return err
+	}
+	return printJSON(states)
+}
+
+func MigrateUp(ctx *cli.Context) error {
+	migrator, err := initMigrator(ctx)
+	defer db.Close()
+	if err != nil {
+		return err
+	}
+	steps, err := migrator.MigrateTo(context.Background(), ctx.Int(migrateToFlag.Name))
+	if perr := printJSON(steps); err == nil {
+		err = perr
+	}
+	return err
+}
+
+func MigrateDown(ctx *cli.Context) error {
+	migrator, err := initMigrator(ctx)
+	defer db.Close()
+	if err != nil {
+		return err
+	}
+	target := ctx.Int(migrateToFlag.Name)
+	if !ctx.IsSet(migrateToFlag.Name) {
+		states, err := migrator.Migrations(context.Background())
+		if err != nil {
+			return err
+		}
+		current := 0
+		for _, state := range states {
+			if state.Applied {
+				current = state.Version
+			}
+		}
+		target = current - ctx.Int(migrateStepsFlag.Name)
+		if target < 0 {
+			target = 0
+		}
+	}
+	if target < 0 {
+		return fmt.Errorf("invalid target version %d", target)
+	}
+	steps, err := migrator.MigrateTo(context.Background(), target)
+	if perr := printJSON(steps); err == nil {
+		err = perr
+	}
+	return err
+}
+
+func ReEncrypt(ctx *cli.Context) error {
+	conf := initStore(ctx, false)
+	defer db.Close()
+	if !conf.Store.Encryption.Enable {
+		return errors.New("store.encryption is not enabled")
+	}
+	report, err := db.ReEncrypt(context.Background(), conf.Retention.BatchSize, ctx.Bool(dryRunFlag.Name))
+	if perr := printJSON(report); err == nil {
+		err = perr
+	}
+	return err
+}
+
+func ExportDataset(ctx *cli.Context) error {
+	opts := dataset.Options{
+		Format:          ctx.String(formatFlag.Name),
+		Models:          ctx.StringSlice(modelFlag.Name),
+		MinScore:        ctx.Float64(minScoreFlag.Name),
+		RequireFeedback: ctx.Bool(requireFeedbackFlag.Name),
+		Sensitive:       ctx.String(sensitiveFlag.Name),
+		Dedup:           !ctx.Bool(noDedupFlag.Name),
+		ValRatio:        ctx.Float64(valRatioFlag.Name),
+		System:          ctx.String(systemFlag.Name),
+	}
+	var err error
+	if opts.From, err = dataset.ParseTime(ctx.String(fromFlag.Name)); err != nil {
+		return err
+	}
+	if opts.To, err = dataset.ParseTime(ctx.String(toFlag.Name)); err != nil {
+		return err
+	}
+	conf := initStore(ctx, false)
+	defer db.Close()
+	if conf.Sensitive != "" {
+		if err := trie.LoadSensitive(conf.Sensitive); err != nil {
+			return err
+		}
+		opts.IsSensitive = trie.IsSensitive
+	}
+
+	dir := ctx.String(outFlag.Name)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	train, err := os.Create(filepath.Join(dir, "train"+dataset.Ext(opts.Format)))
+	if err != nil {
+		return err
+	}
+	defer train.Close()
+	var validation *os.File
+	if opts.ValRatio > 0 {
+		validation, err = os.Create(filepath.Join(dir, "validation"+dataset.Ext(opts.Format)))
+		if err != nil {
+			return err
+		}
+		defer validation.Close()
+	}
+	var valWriter io.Writer
+	if validation != nil {
+		valWriter = validation
+	}
+	report, err := dataset.Export(context.Background(), opts, train, valWriter)
+	if err != nil {
+		return err
+	}
+	return printJSON(report)
+}
+
+var (
+	keyNameFlag = cli.StringFlag{
+		Name:  "name",
+		Usage: "what the key is for",
+	}
+	tenantFlag = cli.StringFlag{
+		Name:  "tenant",
+		Usage: "tenant the key's conversations are stored under",
+	}
+	keyModelFlag = cli.StringSliceFlag{
+		Name:  "model",
+		Usage: "model the key may ask, repeatable, all if not set",
+	}
+	scopeFlag = cli.StringSliceFlag{
+		Name:  "scope",
+		Usage: "chat, worker or admin, repeatable, chat if not set",
+	}
+	roleFlag = cli.StringFlag{
+		Name:  "role",
+		Usage: "viewer, operator or admin, what the admin scope allows, admin if not set",
+	}
+	expiresInFlag = cli.DurationFlag{
+		Name:  "expires-in",
+		Usage: "key lifetime, e.g. 720h, never expires if not set",
+	}
+)
+
+var commandAPIKey = cli.Command{
+	Name:  "apikey",
+	Usage: "issue and manage api keys",
+	Subcommands: []cli.Command{
+		{
+			Name:   "create",
+			Usage:  "issue a key and print its secret once",
+			Flags:  []cli.Flag{configPathFlag, logLevelFlag, keyNameFlag, tenantFlag, keyModelFlag, scopeFlag, roleFlag, expiresInFlag},
+			Action: APIKeyCreate,
+		},
+		{
+			Name:   "list",
+			Usage:  "list the issued keys",
+			Flags:  []cli.Flag{configPathFlag, logLevelFlag},
+			Action: APIKeyList,
+		},
+		{
+			Name:      "disable",
+			Usage:     "stop accepting a key",
+			ArgsUsage: "<key id>",
+			Flags:     []cli.Flag{configPathFlag, logLevelFlag},
+			Action:    apiKeySetEnabled(false),
+		},
+		{
+			Name:      "enable",
+			Usage:     "accept a disabled key again",
+			ArgsUsage: "<key id>",
+			Flags:     []cli.Flag{configPathFlag, logLevelFlag},
+			Action:    apiKeySetEnabled(true),
+		},
+	},
+}
+
+func APIKeyCreate(ctx *cli.Context) error {
+	key := db.APIKey{
+		Name:   ctx.String(keyNameFlag.Name),
+		Tenant: ctx.String(tenantFlag.Name),
+		Models: ctx.StringSlice(keyModelFlag.Name),
+		Scopes: ctx.StringSlice(scopeFlag.Name),
+		Role:   ctx.String(roleFlag.Name),
+	}
+	if ttl := ctx.Duration(expiresInFlag.Name); ttl > 0 {
+		key.ExpiresAt = time.Now().Add(ttl).Unix()
+	}
+	initStore(ctx, false)
+	defer db.Close()
+	secret, created, err := db.CreateAPIKey(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	//the hash is all the store keeps
+	created.Hash = ""
+	return printJSON(struct {
+		Key string `json:"key"`
+		*db.APIKey
+	}{secret, created})
+}
+
+func APIKeyList(ctx *cli.Context) error {
+	initStore(ctx, false)
+	defer db.Close()
+	keys, err := db.ListAPIKeys(context.Background())
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+	return printJSON(keys)
+}
+
+func apiKeySetEnabled(enabled bool) func(ctx *cli.Context) error {
+	return func(ctx *cli.Context) error {
+		id := ctx.Args().First()
+		if id == "" {
+			return errors.New("key id required")
+		}
+		initStore(ctx, false)
+		defer db.Close()
+		key, err := db.GetAPIKey(context.Background(), id)
+		if err != nil {
+			return err
+		}
+		key.Enabled = enabled
+		if err := db.UpdateAPIKey(context.Background(), *key); err != nil {
+			return err
+		}
+		key.Hash = ""
+		return printJSON(key)
+	}
+}
+
+var (
+	periodFlag = cli.StringFlag{
+		Name:  "period",
+		Usage: "hour, day or month",
+		Value: db.UsageDay,
+	}
+	usageTenantFlag = cli.StringFlag{
+		Name:  "tenant",
+		Usage: "only usage of the tenant",
+	}
+	usageModelFlag = cli.StringFlag{
+		Name:  "model",
+		Usage: "only usage of the model",
+	}
+	outputFlag = cli.StringFlag{
+		Name:  "output",
+		Usage: "csv file to write, stdout if not set",
+	}
+)
+
+var commandUsage = cli.Command{
+	Name:  "usage",
+	Usage: "report metered usage",
+	Subcommands: []cli.Command{
+		{
+			Name:   "report",
+			Usage:  "export usage buckets as csv",
+			Flags:  []cli.Flag{configPathFlag, logLevelFlag, periodFlag, fromFlag, toFlag, usageTenantFlag, usageModelFlag, outputFlag},
+			Action: UsageReport,
+		},
+	},
+}
+
+func UsageReport(ctx *cli.Context) error {
+	q := db.UsageQuery{
+		Period: ctx.String(periodFlag.Name),
+		Tenant: ctx.String(usageTenantFlag.Name),
+		Model:  ctx.String(usageModelFlag.Name),
+	}
+	if err := db.ValidatePeriod(q.Period); err != nil {
+		return err
+	}
+	var err error
+	if q.From, err = dataset.ParseTime(ctx.String(fromFlag.Name)); err != nil {
+		return err
+	}
+	if q.To, err = dataset.ParseTime(ctx.String(toFlag.Name)); err != nil {
+		return err
+	}
+	initStore(ctx, false)
+	defer db.Close()
+	buckets, err := db.GetUsage(context.Background(), q)
+	if err != nil {
+		return err
+	}
+	var out io.Writer = os.Stdout
+	if path := ctx.String(outputFlag.Name); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	return db.WriteUsageCSV(out, buckets)
+}
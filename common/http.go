@@ -0,0 +1,238 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 16
+	DefaultIdleConnTimeout     = 90
+	DefaultDialTimeout         = 10
+	DefaultRequestTimeout      = 180
+	DefaultMaxResponseBytes    = 8 * 1024 * 1024
+	maxErrorBodyLength         = 512
+)
+
+var (
+	ErrRateLimited      = errors.New("upstream rate limited")
+	ErrOverloaded       = errors.New("upstream overloaded")
+	ErrBadRequest       = errors.New("upstream bad request")
+	ErrServerError      = errors.New("upstream server error")
+	ErrResponseTooLarge = errors.New("upstream response too large")
+)
+
+// HttpConfig tunes the pooled transport shared by all calls of one HttpClient.
+// Durations are in seconds, zero values fall back to the defaults above.
+type HttpConfig struct {
+	MaxIdleConns        int   `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int   `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeout     int   `yaml:"idle_conn_timeout"`
+	DialTimeout         int   `yaml:"dial_timeout"`
+	Timeout             int   `yaml:"timeout"`
+	MaxResponseBytes    int64 `yaml:"max_response_bytes"`
+	EnableHTTP2         bool  `yaml:"http2"`
+}
+
+// UpstreamError is returned when the upstream answers with a non-2xx status.
+// errors.Is matches it against ErrRateLimited, ErrOverloaded, ErrBadRequest
+// and ErrServerError according to the status code.
+type UpstreamError struct {
+	Url        string
+	StatusCode int
+	Body       string
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("upstream %s status %d: %s", e.Url, e.StatusCode, e.Body)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.StatusCode == http.StatusServiceUnavailable || e.StatusCode == http.StatusBadGateway || e.StatusCode == http.StatusGatewayTimeout:
+		return ErrOverloaded
+	case e.StatusCode >= 500:
+		return ErrServerError
+	case e.StatusCode >= 400:
+		return ErrBadRequest
+	}
+	return nil
+}
+
+// IsStatusError reports whether err carries an upstream http status, which
+// means the upstream is reachable even though the call failed.
+func IsStatusError(err error) bool {
+	var upErr *UpstreamError
+	return errors.As(err, &upErr)
+}
+
+type HttpClient struct {
+	client           *http.Client
+	timeout          time.Duration
+	maxResponseBytes int64
+}
+
+func NewHttpClient(conf HttpConfig) *HttpClient {
+	conf = conf.withDefaults()
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   time.Second * time.Duration(conf.DialTimeout),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:   conf.EnableHTTP2,
+		MaxIdleConns:        conf.MaxIdleConns,
+		MaxIdleConnsPerHost: conf.MaxIdleConnsPerHost,
+		IdleConnTimeout:     time.Second * time.Duration(conf.IdleConnTimeout),
+	}
+	if !conf.EnableHTTP2 {
+		//a non-nil empty map disables the automatic h2 upgrade
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &HttpClient{
+		client:           &http.Client{Transport: transport},
+		timeout:          time.Second * time.Duration(conf.Timeout),
+		maxResponseBytes: conf.MaxResponseBytes,
+	}
+}
+
+func (conf HttpConfig) withDefaults() HttpConfig {
+	if conf.MaxIdleConns <= 0 {
+		conf.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if conf.MaxIdleConnsPerHost <= 0 {
+		conf.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+	if conf.IdleConnTimeout <= 0 {
+		conf.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	if conf.DialTimeout <= 0 {
+		conf.DialTimeout = DefaultDialTimeout
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = DefaultRequestTimeout
+	}
+	if conf.MaxResponseBytes <= 0 {
+		conf.MaxResponseBytes = DefaultMaxResponseBytes
+	}
+	return conf
+}
+
+// StdClient exposes the pooled client for sdks that take an *http.Client.
+func (c *HttpClient) StdClient() *http.Client {
+	return c.client
+}
+
+// Post sends body to requrl. A zero timeout uses the client default.
+func (c *HttpClient) Post(ctx context.Context, requrl string, body []byte, timeout time.Duration, headerMap map[string]string) ([]byte, error) {
+	return c.Do(ctx, http.MethodPost, requrl, body, timeout, headerMap)
+}
+
+func (c *HttpClient) Get(ctx context.Context, requrl string, timeout time.Duration) ([]byte, error) {
+	return c.Do(ctx, http.MethodGet, requrl, nil, timeout, nil)
+}
+
+func (c *HttpClient) Do(ctx context.Context, method, requrl string, body []byte, timeout time.Duration, headerMap map[string]string) ([]byte, error) {
+	if timeout <= 0 {
+		timeout = c.timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, requrl, reader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headerMap {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	//read one extra byte to tell a full body from a truncated one
+	payload, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.maxResponseBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(payload)) > c.maxResponseBytes {
+		return nil, fmt.Errorf("%w: %s over %d bytes", ErrResponseTooLarge, requrl, c.maxResponseBytes)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		errBody := payload
+		if len(errBody) > maxErrorBodyLength {
+			errBody = errBody[:maxErrorBodyLength]
+		}
+		return nil, &UpstreamError{
+			Url:        requrl,
+			StatusCode: resp.StatusCode,
+			Body:       string(errBody),
+		}
+	}
+	return payload, nil
+}
+
+// UpstreamConfig is the upstream section of the gateway config.
+// ModelTimeout overrides the request timeout in seconds per model name.
+type UpstreamConfig struct {
+	HttpConfig   `yaml:",inline"`
+	ModelTimeout map[string]int `yaml:"model_timeout"`
+}
+
+var Upstream UpstreamConfig
+
+func (conf UpstreamConfig) TimeoutFor(model string) time.Duration {
+	if t, ok := conf.ModelTimeout[model]; ok && t > 0 {
+		return time.Second * time.Duration(t)
+	}
+	return time.Second * time.Duration(conf.withDefaults().Timeout)
+}
+
+// TraceFirstByte returns a context that records when the first response
+// byte of a request made with it arrives, and a func reporting the time from
+// now until then. It reports zero if no byte arrived.
+func TraceFirstByte(ctx context.Context) (context.Context, func() time.Duration) {
+	start := time.Now()
+	var lock sync.Mutex
+	var firstByte time.Duration
+	trace := &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			lock.Lock()
+			defer lock.Unlock()
+			if firstByte == 0 {
+				firstByte = time.Since(start)
+			}
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace), func() time.Duration {
+		lock.Lock()
+		defer lock.Unlock()
+		return firstByte
+	}
+}
+
+// KeyHash identifies an api key in logs and records without storing it.
+func KeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHttpClientStatusErrors(t *testing.T) {
+	cases := map[int]error{
+		http.StatusTooManyRequests:     ErrRateLimited,
+		http.StatusServiceUnavailable:  ErrOverloaded,
+		http.StatusBadRequest:          ErrBadRequest,
+		http.StatusInternalServerError: ErrServerError,
+	}
+	for code, want := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+			w.Write([]byte("boom"))
+		}))
+		_, err := NewHttpClient(HttpConfig{}).Post(context.Background(), srv.URL, []byte("{}"), 0, nil)
+		srv.Close()
+		if !errors.Is(err, want) {
+			t.Fatalf("status %d: got %v, want %v", code, err, want)
+		}
+		if !IsStatusError(err) {
+			t.Fatalf("status %d: not a status error", code)
+		}
+	}
+}
+
+func TestHttpClientResponseLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 64)))
+	}))
+	defer srv.Close()
+	cli := NewHttpClient(HttpConfig{MaxResponseBytes: 32})
+	if _, err := cli.Get(context.Background(), srv.URL, 0); !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("got %v, want ErrResponseTooLarge", err)
+	}
+	cli = NewHttpClient(HttpConfig{MaxResponseBytes: 64})
+	payload, err := cli.Get(context.Background(), srv.URL, 0)
+	if err != nil || len(payload) != 64 {
+		t.Fatalf("got %d bytes, err %v", len(payload), err)
+	}
+}
+
+func TestHttpPostUsesUpstreamConfig(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 64)))
+	}))
+	defer srv.Close()
+	Upstream = UpstreamConfig{HttpConfig: HttpConfig{MaxResponseBytes: 32}}
+	defer func() { Upstream = UpstreamConfig{} }()
+	if _, err := HttpPost(srv.URL, "{}", 0, nil); !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("got %v, want ErrResponseTooLarge", err)
+	}
+}
@@ -1,11 +1,25 @@
 package common
 
+import "github.com/sashabaranov/go-openai"
+
 type Question struct {
-	Message        string `json:"message"`
-	MessageId      string `json:"messageId"`
-	ConversationId string `json:"conversationId"`
-	OpenAIKey      string `json:"openaiKey"`
-	Model          string `json:"model"`
+	Message        string  `json:"message"`
+	MessageId      string  `json:"messageId"`
+	ConversationId string  `json:"conversationId"`
+	OpenAIKey      string  `json:"openaiKey"`
+	Model          string  `json:"model"`
+	Temperature    float32 `json:"temperature"`
+	TopP           float32 `json:"topP"`
+	SessionId      string  `json:"-"`
+	Tenant         string  `json:"-"`
+	UserId         string  `json:"-"`
+	//Prompt is the assembled prompt history, built by the client when empty
+	Prompt []openai.ChatCompletionMessage `json:"-"`
+}
+
+// Deterministic reports whether the sampling params give a repeatable answer.
+func (q *Question) Deterministic() bool {
+	return q.Temperature == 0
 }
 
 type QA struct {
@@ -15,4 +29,8 @@ type QA struct {
 	MessageId      string   `json:"messageId"`
 	ConversationId string   `json:"conversationId"`
 	Model          string   `json:"model"`
+	//Prompt is the prompt as sent upstream, after history assembly
+	Prompt       []openai.ChatCompletionMessage `json:"-"`
+	FinishReason string                         `json:"finishReason"`
+	Usage        openai.Usage                   `json:"usage"`
 }
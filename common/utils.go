@@ -1,33 +1,27 @@
 package common
 
 import (
-	"bytes"
-	"gateway/log"
-	"io/ioutil"
-	"net/http"
+	"context"
+	"sync"
 	"time"
 )
 
-func HttpPost(requrl, body string, timeoutS int, headerMap map[string]string) (payload []byte, err error) {
-	req, err := http.NewRequest("POST", requrl, bytes.NewBufferString(body))
-	if err != nil {
-		log.Error("Failed to new http request:", err.Error())
-		return
-	}
-
-	for k, v := range headerMap {
-		req.Header.Set(k, v)
-	}
-
-	client := &http.Client{Timeout: time.Second * time.Duration(timeoutS)}
-
-	resp, err := client.Do(req)
-	if resp == nil {
-		return
-	}
+var (
+	defaultHttpClient *HttpClient
+	defaultHttpOnce   sync.Once
+)
 
-	defer resp.Body.Close()
+// pooledHttpClient lazily builds the shared client, after the upstream config
+// has been loaded.
+func pooledHttpClient() *HttpClient {
+	defaultHttpOnce.Do(func() {
+		defaultHttpClient = NewHttpClient(Upstream.HttpConfig)
+	})
+	return defaultHttpClient
+}
 
-	payload, err = ioutil.ReadAll(resp.Body)
-	return
+// HttpPost posts through a shared pooled client. Non-2xx statuses are
+// returned as *UpstreamError.
+func HttpPost(requrl, body string, timeoutS int, headerMap map[string]string) (payload []byte, err error) {
+	return pooledHttpClient().Post(context.Background(), requrl, []byte(body), time.Second*time.Duration(timeoutS), headerMap)
 }
@@ -0,0 +1,277 @@
+package dataset
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gateway/db"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SensitiveExclude = "exclude"
+	SensitiveInclude = "include"
+	SensitiveOnly    = "only"
+)
+
+const scanBatchSize = 1000
+
+var ErrInvalidRatio = errors.New("validation ratio must be between 0 and 1")
+
+// Options select the conversations of an export. Model and time filters pick
+// turns, failed turns are always left out. Feedback and sensitive word
+// filters then judge each rebuilt conversation as a whole.
+type Options struct {
+	Format string
+	Models []string
+	From   int64 //unix seconds, turns starting at or after
+	To     int64 //unix seconds, turns starting before
+	// MinScore drops judged conversations whose mean feedback score is
+	// lower, see Conversation.Score.
+	MinScore        float64
+	RequireFeedback bool
+	Sensitive       string //exclude, include or only, default exclude
+	IsSensitive     func(text string) bool
+	Dedup           bool
+	ValRatio        float64 //share of conversations in the validation split
+	System          string  //system prompt put before each conversation
+}
+
+// Validate checks the options and fills in the defaults.
+func (o *Options) Validate() error {
+	if _, ok := formats[o.Format]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknownFormat, o.Format)
+	}
+	if o.ValRatio < 0 || o.ValRatio >= 1 {
+		return ErrInvalidRatio
+	}
+	switch o.Sensitive {
+	case "":
+		o.Sensitive = SensitiveExclude
+	case SensitiveExclude, SensitiveInclude, SensitiveOnly:
+	default:
+		return fmt.Errorf("unknown sensitive filter %q, want exclude, include or only", o.Sensitive)
+	}
+	return nil
+}
+
+func (o *Options) matches(msg *db.Message) bool {
+	if msg.Error != "" || msg.Text == "" {
+		return false
+	}
+	if o.From > 0 && msg.StartTime < o.From {
+		return false
+	}
+	if o.To > 0 && msg.StartTime >= o.To {
+		return false
+	}
+	if len(o.Models) == 0 {
+		return true
+	}
+	for _, model := range o.Models {
+		if msg.Model == model {
+			return true
+		}
+	}
+	return false
+}
+
+// Conversation is a stored conversation rebuilt in turn order.
+type Conversation struct {
+	Id    string
+	Turns []db.Message
+}
+
+// Score is the mean feedback score of the judged turns: the rating if given,
+// otherwise 5 for a thumb up and 1 for a thumb down. ok is false if no turn
+// was judged.
+func (c *Conversation) Score() (score float64, ok bool) {
+	total, n := 0, 0
+	for _, turn := range c.Turns {
+		fb := turn.Feedback
+		switch {
+		case fb == nil:
+			continue
+		case fb.Rating > 0:
+			total += fb.Rating
+		case fb.Thumb == db.ThumbUp:
+			total += 5
+		case fb.Thumb == db.ThumbDown:
+			total += 1
+		default:
+			continue
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return float64(total) / float64(n), true
+}
+
+func (c *Conversation) sensitive(isSensitive func(string) bool) bool {
+	for _, turn := range c.Turns {
+		if isSensitive(turn.Prompt) || isSensitive(turn.Text) {
+			return true
+		}
+	}
+	return false
+}
+
+// hash identifies the content of a conversation, for dedup and for a split
+// that stays the same across exports.
+func (c *Conversation) hash() [sha256.Size]byte {
+	h := sha256.New()
+	for _, turn := range c.Turns {
+		io.WriteString(h, strings.TrimSpace(turn.Prompt))
+		h.Write([]byte{0})
+		io.WriteString(h, strings.TrimSpace(turn.Text))
+		h.Write([]byte{0})
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// Report counts what an export kept and dropped.
+type Report struct {
+	Format      string `json:"format"`
+	Turns       int    `json:"turns"` //turns passing the model and time filters
+	Found       int    `json:"conversations"`
+	NoFeedback  int    `json:"noFeedback"`
+	LowScore    int    `json:"lowScore"`
+	Sensitive   int    `json:"sensitive"`
+	Duplicates  int    `json:"duplicates"`
+	Train       int    `json:"train"`
+	Validation  int    `json:"validation"`
+	ElapsedSecs int64  `json:"elapsedSecs"`
+}
+
+// Export writes the selected conversations to train and validation in the
+// format of opts. validation may be nil when opts.ValRatio is 0.
+func Export(ctx context.Context, opts Options, train, validation io.Writer) (*Report, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.ValRatio > 0 && validation == nil {
+		return nil, errors.New("validation split needs a writer")
+	}
+	start := time.Now()
+	report := &Report{Format: opts.Format}
+	turns := make(map[string][]db.Message)
+	err := db.ScanTurns(ctx, scanBatchSize, func(batch []db.Message) error {
+		for _, msg := range batch {
+			if opts.matches(&msg) {
+				turns[msg.ConversationId] = append(turns[msg.ConversationId], msg)
+				report.Turns++
+			}
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	convs := make([]*Conversation, 0, len(turns))
+	for id, msgs := range turns {
+		sort.SliceStable(msgs, func(i, j int) bool {
+			if msgs[i].Seq != msgs[j].Seq {
+				return msgs[i].Seq < msgs[j].Seq
+			}
+			return msgs[i].StartTimeMs < msgs[j].StartTimeMs
+		})
+		convs = append(convs, &Conversation{Id: id, Turns: msgs})
+	}
+	//oldest conversation first, so repeated exports list them the same way
+	sort.Slice(convs, func(i, j int) bool {
+		a, b := convs[i].Turns[0], convs[j].Turns[0]
+		if a.StartTimeMs != b.StartTimeMs {
+			return a.StartTimeMs < b.StartTimeMs
+		}
+		return convs[i].Id < convs[j].Id
+	})
+	report.Found = len(convs)
+
+	trainEnc := formats[opts.Format](train, opts.System)
+	var valEnc encoder
+	if validation != nil {
+		valEnc = formats[opts.Format](validation, opts.System)
+	}
+	seen := make(map[[sha256.Size]byte]bool)
+	for _, conv := range convs {
+		score, judged := conv.Score()
+		switch {
+		case !judged && opts.RequireFeedback:
+			report.NoFeedback++
+			continue
+		case judged && score < opts.MinScore:
+			report.LowScore++
+			continue
+		}
+		if opts.IsSensitive != nil && opts.Sensitive != SensitiveInclude {
+			if conv.sensitive(opts.IsSensitive) != (opts.Sensitive == SensitiveOnly) {
+				report.Sensitive++
+				continue
+			}
+		}
+		sum := conv.hash()
+		if opts.Dedup {
+			if seen[sum] {
+				report.Duplicates++
+				continue
+			}
+			seen[sum] = true
+		}
+		enc := trainEnc
+		if inValidation(sum, opts.ValRatio) {
+			enc = valEnc
+			report.Validation++
+		} else {
+			report.Train++
+		}
+		if err := enc.write(conv); err != nil {
+			return nil, err
+		}
+	}
+	if err := trainEnc.close(); err != nil {
+		return nil, err
+	}
+	if valEnc != nil {
+		if err := valEnc.close(); err != nil {
+			return nil, err
+		}
+	}
+	report.ElapsedSecs = int64(time.Since(start).Seconds())
+	return report, nil
+}
+
+// inValidation splits by content hash, a conversation stays in its split
+// when later exports add more conversations.
+func inValidation(sum [sha256.Size]byte, ratio float64) bool {
+	if ratio <= 0 {
+		return false
+	}
+	const buckets = 1 << 20
+	return float64(binary.BigEndian.Uint64(sum[:8])%buckets) < ratio*buckets
+}
+
+// ParseTime reads a date as unix seconds or as 2006-01-02 in local time.
+func ParseTime(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return 0, fmt.Errorf("invalid date %q, want unix seconds or 2006-01-02", value)
+	}
+	return t.Unix(), nil
+}
@@ -0,0 +1,137 @@
+package dataset
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"gateway/db"
+	"strings"
+	"testing"
+)
+
+func seed(t *testing.T) {
+	store := db.NewMemoryStore()
+	msgs := []db.Message{
+		//judged well, two turns inserted out of order
+		{ConversationId: "c1", MessageId: "m2", Seq: 2, Prompt: "And at night?", Text: "Use high beams.", Model: "v1", StartTime: 200, StartTimeMs: 200000,
+			Feedback: &db.Feedback{Thumb: db.ThumbUp}},
+		{ConversationId: "c1", MessageId: "m1", Seq: 1, Prompt: "How to drive in fog?", Text: "Slow down.", Model: "v1", StartTime: 100, StartTimeMs: 100000},
+		//same content as c1
+		{ConversationId: "c2", MessageId: "m3", Seq: 1, Prompt: "How to drive in fog?", Text: "Slow down.", Model: "v1", StartTime: 300, StartTimeMs: 300000},
+		{ConversationId: "c2", MessageId: "m4", Seq: 2, Prompt: "And at night?", Text: "Use high beams.", Model: "v1", StartTime: 301, StartTimeMs: 301000},
+		//judged badly
+		{ConversationId: "c3", MessageId: "m5", Seq: 1, Prompt: "Park here?", Text: "Yes.", Model: "v1", StartTime: 400, StartTimeMs: 400000,
+			Feedback: &db.Feedback{Rating: 2}},
+		//sensitive
+		{ConversationId: "c4", MessageId: "m6", Seq: 1, Prompt: "forbidden topic", Text: "No.", Model: "v1", StartTime: 500, StartTimeMs: 500000},
+		//other model and a failed turn
+		{ConversationId: "c5", MessageId: "m7", Seq: 1, Prompt: "Hi", Text: "Hello", Model: "v3", StartTime: 600, StartTimeMs: 600000},
+		{ConversationId: "c5", MessageId: "m8", Seq: 2, Prompt: "Still there?", Model: "v3", StartTime: 601, StartTimeMs: 601000,
+			Telemetry: db.Telemetry{Error: "timeout"}},
+	}
+	if err := store.InsertConversations(context.Background(), msgs); err != nil {
+		t.Fatal(err)
+	}
+	db.Store = store
+}
+
+func isSensitive(text string) bool {
+	return strings.Contains(text, "forbidden")
+}
+
+func TestExportFilters(t *testing.T) {
+	seed(t)
+	var train bytes.Buffer
+	report, err := Export(context.Background(), Options{
+		Format:      FormatOpenAI,
+		Models:      []string{"v1"},
+		MinScore:    3,
+		IsSensitive: isSensitive,
+		Dedup:       true,
+		System:      "You drive.",
+	}, &train, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Found != 4 || report.LowScore != 1 || report.Sensitive != 1 || report.Duplicates != 1 || report.Train != 1 {
+		t.Fatal("unexpected report", report)
+	}
+	var record struct {
+		Messages []openAIMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(train.Bytes(), &record); err != nil {
+		t.Fatal(err, train.String())
+	}
+	want := []openAIMessage{
+		{"system", "You drive."},
+		{"user", "How to drive in fog?"}, {"assistant", "Slow down."},
+		{"user", "And at night?"}, {"assistant", "Use high beams."},
+	}
+	if len(record.Messages) != len(want) {
+		t.Fatal("unexpected messages", record.Messages)
+	}
+	for i := range want {
+		if record.Messages[i] != want[i] {
+			t.Fatal("unexpected message", i, record.Messages[i])
+		}
+	}
+
+	//only the sensitive ones, and failed turns never count
+	train.Reset()
+	report, err = Export(context.Background(), Options{Format: FormatShareGPT, Sensitive: SensitiveOnly, IsSensitive: isSensitive}, &train, nil)
+	if err != nil || report.Train != 1 || report.Turns != 7 {
+		t.Fatal("unexpected report", report, err)
+	}
+	var records []shareGPTRecord
+	if err := json.Unmarshal(train.Bytes(), &records); err != nil || len(records) != 1 || records[0].Id != "c4" {
+		t.Fatal("unexpected sharegpt", train.String(), err)
+	}
+}
+
+func TestExportSplit(t *testing.T) {
+	seed(t)
+	var train, validation bytes.Buffer
+	opts := Options{Format: FormatAlpaca, ValRatio: 0.5}
+	report, err := Export(context.Background(), opts, &train, &validation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trainSet, valSet []alpacaRecord
+	if err := json.Unmarshal(train.Bytes(), &trainSet); err != nil {
+		t.Fatal(err, train.String())
+	}
+	if err := json.Unmarshal(validation.Bytes(), &valSet); err != nil {
+		t.Fatal(err, validation.String())
+	}
+	if len(trainSet) != report.Train || len(valSet) != report.Validation || report.Train+report.Validation != 5 {
+		t.Fatal("unexpected split", report)
+	}
+	for _, record := range append(trainSet, valSet...) {
+		if record.Instruction == "And at night?" && (len(record.History) != 1 || record.History[0][0] != "How to drive in fog?") {
+			t.Fatal("unexpected history", record)
+		}
+	}
+
+	//the same content lands in the same split every time
+	var train2, validation2 bytes.Buffer
+	if _, err := Export(context.Background(), opts, &train2, &validation2); err != nil {
+		t.Fatal(err)
+	}
+	if train.String() != train2.String() || validation.String() != validation2.String() {
+		t.Fatal("split not stable")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	for _, opts := range []Options{{Format: "csv"}, {Format: FormatOpenAI, ValRatio: 1}, {Format: FormatOpenAI, Sensitive: "some"}} {
+		if err := opts.Validate(); err == nil {
+			t.Fatal("invalid options accepted", opts)
+		}
+	}
+	if ts, err := ParseTime("1700000000"); err != nil || ts != 1700000000 {
+		t.Fatal("unexpected time", ts, err)
+	}
+	if _, err := ParseTime("2024-13-01"); err == nil {
+		t.Fatal("invalid date accepted")
+	}
+}
@@ -0,0 +1,192 @@
+package dataset
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+const (
+	FormatShareGPT = "sharegpt"
+	FormatOpenAI   = "openai"
+	FormatAlpaca   = "alpaca"
+)
+
+var ErrUnknownFormat = errors.New("unknown dataset format, want sharegpt, openai or alpaca")
+
+type encoder interface {
+	write(conv *Conversation) error
+	close() error
+}
+
+var formats = map[string]func(w io.Writer, system string) encoder{
+	FormatShareGPT: newShareGPTEncoder,
+	FormatOpenAI:   newOpenAIEncoder,
+	FormatAlpaca:   newAlpacaEncoder,
+}
+
+// Ext is the file extension of a format.
+func Ext(format string) string {
+	if format == FormatOpenAI {
+		return ".jsonl"
+	}
+	return ".json"
+}
+
+// ContentType is the mime type of a format.
+func ContentType(format string) string {
+	if format == FormatOpenAI {
+		return "application/x-ndjson"
+	}
+	return "application/json"
+}
+
+// arrayEncoder writes one json array of records, element by element, so
+// exports do not have to fit in memory.
+type arrayEncoder struct {
+	w     *bufio.Writer
+	count int
+}
+
+func newArrayEncoder(w io.Writer) *arrayEncoder {
+	return &arrayEncoder{w: bufio.NewWriter(w)}
+}
+
+func (e *arrayEncoder) add(record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if e.count == 0 {
+		sep = "[\n"
+	}
+	e.count++
+	if _, err := e.w.WriteString(sep); err != nil {
+		return err
+	}
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *arrayEncoder) close() error {
+	end := "\n]\n"
+	if e.count == 0 {
+		end = "[]\n"
+	}
+	if _, err := e.w.WriteString(end); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+type shareGPTMessage struct {
+	From  string `json:"from"`
+	Value string `json:"value"`
+}
+
+type shareGPTRecord struct {
+	Id            string            `json:"id"`
+	Model         string            `json:"model,omitempty"`
+	System        string            `json:"system,omitempty"`
+	Conversations []shareGPTMessage `json:"conversations"`
+}
+
+type shareGPTEncoder struct {
+	*arrayEncoder
+	system string
+}
+
+func newShareGPTEncoder(w io.Writer, system string) encoder {
+	return &shareGPTEncoder{arrayEncoder: newArrayEncoder(w), system: system}
+}
+
+func (e *shareGPTEncoder) write(conv *Conversation) error {
+	record := shareGPTRecord{
+		Id:            conv.Id,
+		Model:         conv.Turns[len(conv.Turns)-1].Model,
+		System:        e.system,
+		Conversations: make([]shareGPTMessage, 0, 2*len(conv.Turns)),
+	}
+	for _, turn := range conv.Turns {
+		record.Conversations = append(record.Conversations,
+			shareGPTMessage{From: "human", Value: turn.Prompt},
+			shareGPTMessage{From: "gpt", Value: turn.Text})
+	}
+	return e.add(record)
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// openAIEncoder writes the chat fine-tuning format, one conversation per
+// line.
+type openAIEncoder struct {
+	w      *bufio.Writer
+	system string
+}
+
+func newOpenAIEncoder(w io.Writer, system string) encoder {
+	return &openAIEncoder{w: bufio.NewWriter(w), system: system}
+}
+
+func (e *openAIEncoder) write(conv *Conversation) error {
+	messages := make([]openAIMessage, 0, 2*len(conv.Turns)+1)
+	if e.system != "" {
+		messages = append(messages, openAIMessage{Role: "system", Content: e.system})
+	}
+	for _, turn := range conv.Turns {
+		messages = append(messages,
+			openAIMessage{Role: "user", Content: turn.Prompt},
+			openAIMessage{Role: "assistant", Content: turn.Text})
+	}
+	data, err := json.Marshal(struct {
+		Messages []openAIMessage `json:"messages"`
+	}{messages})
+	if err != nil {
+		return err
+	}
+	if _, err := e.w.Write(data); err != nil {
+		return err
+	}
+	return e.w.WriteByte('\n')
+}
+
+func (e *openAIEncoder) close() error {
+	return e.w.Flush()
+}
+
+// alpacaRecord puts the last turn in instruction and output and the earlier
+// ones in history, as multi-turn alpaca loaders expect.
+type alpacaRecord struct {
+	Instruction string      `json:"instruction"`
+	Input       string      `json:"input"`
+	Output      string      `json:"output"`
+	System      string      `json:"system,omitempty"`
+	History     [][2]string `json:"history,omitempty"`
+}
+
+type alpacaEncoder struct {
+	*arrayEncoder
+	system string
+}
+
+func newAlpacaEncoder(w io.Writer, system string) encoder {
+	return &alpacaEncoder{arrayEncoder: newArrayEncoder(w), system: system}
+}
+
+func (e *alpacaEncoder) write(conv *Conversation) error {
+	last := conv.Turns[len(conv.Turns)-1]
+	record := alpacaRecord{
+		Instruction: last.Prompt,
+		Output:      last.Text,
+		System:      e.system,
+	}
+	for _, turn := range conv.Turns[:len(conv.Turns)-1] {
+		record.History = append(record.History, [2]string{turn.Prompt, turn.Text})
+	}
+	return e.add(record)
+}
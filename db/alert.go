@@ -0,0 +1,39 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const AlertCollection = "alerts"
+
+var ErrAlertUnsupported = errors.New("store backend does not support alerts")
+
+// Alert records a notification that must go out once, however many gateways
+// notice its cause. Its id names the cause, e.g. a budget threshold in a
+// month.
+type Alert struct {
+	Id        string    `json:"id" bson:"_id"`
+	Kind      string    `json:"kind" bson:"kind"`
+	Tenant    string    `json:"tenant,omitempty" bson:"tenant,omitempty"`
+	Message   string    `json:"message" bson:"message"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// AlertStore is implemented by stores that record sent alerts.
+type AlertStore interface {
+	// ClaimAlert stores alert unless one with its id exists, and reports
+	// whether it did.
+	ClaimAlert(ctx context.Context, alert Alert) (bool, error)
+}
+
+// ClaimAlert reports whether the caller is first to raise alert and should
+// send it.
+func ClaimAlert(ctx context.Context, alert Alert) (bool, error) {
+	store, err := capability[AlertStore](Store, ErrAlertUnsupported)
+	if err != nil {
+		return false, err
+	}
+	return store.ClaimAlert(ctx, alert)
+}
@@ -0,0 +1,25 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClaimAlert(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		Store = store
+		alert := Alert{Id: "budget|acme|2024-05|80", Kind: "budget", Tenant: "acme", Message: "80% of the budget spent", CreatedAt: time.Now()}
+		if ok, err := ClaimAlert(ctx, alert); err != nil || !ok {
+			t.Fatal(name, "first claim refused", err)
+		}
+		if ok, err := ClaimAlert(ctx, alert); err != nil || ok {
+			t.Fatal(name, "alert claimed twice", err)
+		}
+		alert.Id = "budget|acme|2024-05|100"
+		if ok, err := ClaimAlert(ctx, alert); err != nil || !ok {
+			t.Fatal(name, "other alert refused", err)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+const APIKeyCollection = "api_keys"
+
+const (
+	// ScopeChat allows the question, conversation and feedback endpoints.
+	ScopeChat = "chat"
+	// ScopeWorker allows the worker registration endpoints.
+	ScopeWorker = "worker"
+	// ScopeAdmin allows the /admin endpoints.
+	ScopeAdmin = "admin"
+)
+
+// Roles grade what the admin scope allows, each allows what the ones before
+// it do. Credentials with the admin scope and no role are admins.
+const (
+	// RoleViewer reads workers, models, the queue, usage and costs.
+	RoleViewer = "viewer"
+	// RoleOperator also manages workers, models and the sensitive list.
+	RoleOperator = "operator"
+	// RoleAdmin also manages api keys, exports datasets and reads the audit
+	// log.
+	RoleAdmin = "admin"
+)
+
+var roleRanks = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+const (
+	// KeySessionPrefix starts the session id of turns asked with an api key.
+	KeySessionPrefix = "key:"
+	// UserSessionPrefix starts the session id of turns asked with a jwt,
+	// followed by the user id.
+	UserSessionPrefix = "user:"
+)
+
+// apiKeyPrefix starts every key secret, keys look like gw_<id>_<secret>.
+const apiKeyPrefix = "gw_"
+
+const (
+	apiKeyIdBytes     = 6
+	apiKeySecretBytes = 24
+)
+
+var (
+	ErrAPIKeyUnsupported = errors.New("store backend does not support api keys")
+	ErrInvalidAPIKey     = errors.New("invalid api key")
+	ErrAPIKeyDisabled    = errors.New("api key disabled")
+	ErrAPIKeyExpired     = errors.New("api key expired")
+	ErrUnknownScope      = errors.New("unknown api key scope, want chat, worker or admin")
+	ErrUnknownRole       = errors.New("unknown admin role, want viewer, operator or admin")
+)
+
+// APIKey is an issued key. Only the sha256 of the secret is stored, the
+// secret is shown once when the key is created.
+type APIKey struct {
+	Id        string   `json:"id" bson:"_id"`
+	Hash      string   `json:"hash,omitempty" bson:"hash"` //sha256 of the whole key
+	Name      string   `json:"name,omitempty" bson:"name,omitempty"`
+	Tenant    string   `json:"tenant,omitempty" bson:"tenant,omitempty"`
+	Models    []string `json:"models,omitempty" bson:"models,omitempty"` //empty allows every model
+	Scopes    []string `json:"scopes" bson:"scopes"`
+	Role      string   `json:"role,omitempty" bson:"role,omitempty"` //of the admin scope, empty is admin
+	Enabled   bool     `json:"enabled" bson:"enabled"`
+	CreatedAt int64    `json:"createdAt" bson:"createdAt"`
+	ExpiresAt int64    `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"` //0 never
+}
+
+// APIKeyStore is implemented by stores that keep api keys.
+type APIKeyStore interface {
+	InsertAPIKey(ctx context.Context, key APIKey) error
+	// GetAPIKey returns ErrNotFound if there is no key with id.
+	GetAPIKey(ctx context.Context, id string) (*APIKey, error)
+	// ListAPIKeys returns all keys, oldest first.
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	// UpdateAPIKey replaces a key, it returns ErrNotFound if there is none.
+	UpdateAPIKey(ctx context.Context, key APIKey) error
+}
+
+func apiKeyHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Session is the session id that scopes the conversations of a key.
+func (k *APIKey) Session() string {
+	return KeySessionPrefix + k.Id
+}
+
+// AllowsModel reports whether the key may ask model.
+func (k *APIKey) AllowsModel(model string) bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+	for _, allowed := range k.Models {
+		if allowed == model {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns why the key can not be used at now, nil if it can.
+func (k *APIKey) Check(now time.Time) error {
+	if !k.Enabled {
+		return ErrAPIKeyDisabled
+	}
+	if k.ExpiresAt != 0 && now.Unix() >= k.ExpiresAt {
+		return ErrAPIKeyExpired
+	}
+	return nil
+}
+
+// ValidateRole checks an admin role, empty is allowed.
+func ValidateRole(role string) error {
+	if _, ok := roleRanks[role]; !ok && role != "" {
+		return ErrUnknownRole
+	}
+	return nil
+}
+
+// RoleAllows reports whether role may do what need may. Empty and unknown
+// roles may do nothing.
+func RoleAllows(role, need string) bool {
+	rank, ok := roleRanks[role]
+	return ok && rank >= roleRanks[need]
+}
+
+// AdminRole is the role key grants, keys issued before roles existed are
+// admins.
+func (key *APIKey) AdminRole() string {
+	if key.Role == "" {
+		return RoleAdmin
+	}
+	return key.Role
+}
+
+// ValidateScopes checks scopes and defaults them to chat.
+func ValidateScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return []string{ScopeChat}, nil
+	}
+	for _, scope := range scopes {
+		switch scope {
+		case ScopeChat, ScopeWorker, ScopeAdmin:
+		default:
+			return nil, ErrUnknownScope
+		}
+	}
+	return scopes, nil
+}
+
+func sortAPIKeys(keys []APIKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt != keys[j].CreatedAt {
+			return keys[i].CreatedAt < keys[j].CreatedAt
+		}
+		return keys[i].Id < keys[j].Id
+	})
+}
+
+// CreateAPIKey issues a key with the name, tenant, models, scopes, role and
+// expiry of key and returns its secret.
+func CreateAPIKey(ctx context.Context, key APIKey) (string, *APIKey, error) {
+	store, err := capability[APIKeyStore](Store, ErrAPIKeyUnsupported)
+	if err != nil {
+		return "", nil, err
+	}
+	scopes, err := ValidateScopes(key.Scopes)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := ValidateRole(key.Role); err != nil {
+		return "", nil, err
+	}
+	id, err := randomHex(apiKeyIdBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomHex(apiKeySecretBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	secret = apiKeyPrefix + id + "_" + secret
+	key.Id = id
+	key.Hash = apiKeyHash(secret)
+	key.Scopes = scopes
+	key.Enabled = true
+	key.CreatedAt = time.Now().Unix()
+	if err := store.InsertAPIKey(ctx, key); err != nil {
+		return "", nil, err
+	}
+	return secret, &key, nil
+}
+
+// VerifyAPIKey returns the key of secret if it is usable now.
+func VerifyAPIKey(ctx context.Context, secret string) (*APIKey, error) {
+	store, err := capability[APIKeyStore](Store, ErrAPIKeyUnsupported)
+	if err != nil {
+		return nil, err
+	}
+	rest := strings.TrimPrefix(secret, apiKeyPrefix)
+	sep := strings.IndexByte(rest, '_')
+	if rest == secret || sep <= 0 {
+		return nil, ErrInvalidAPIKey
+	}
+	key, err := store.GetAPIKey(ctx, rest[:sep])
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(apiKeyHash(secret)), []byte(key.Hash)) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	if err := key.Check(time.Now()); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	store, err := capability[APIKeyStore](Store, ErrAPIKeyUnsupported)
+	if err != nil {
+		return nil, err
+	}
+	return store.GetAPIKey(ctx, id)
+}
+
+func ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	store, err := capability[APIKeyStore](Store, ErrAPIKeyUnsupported)
+	if err != nil {
+		return nil, err
+	}
+	return store.ListAPIKeys(ctx)
+}
+
+// UpdateAPIKey stores the changed models, scopes, role, enabled flag and
+// expiry of key, the secret and creation time stay.
+func UpdateAPIKey(ctx context.Context, key APIKey) error {
+	store, err := capability[APIKeyStore](Store, ErrAPIKeyUnsupported)
+	if err != nil {
+		return err
+	}
+	scopes, err := ValidateScopes(key.Scopes)
+	if err != nil {
+		return err
+	}
+	if err := ValidateRole(key.Role); err != nil {
+		return err
+	}
+	stored, err := store.GetAPIKey(ctx, key.Id)
+	if err != nil {
+		return err
+	}
+	key.Scopes = scopes
+	key.Hash = stored.Hash
+	key.CreatedAt = stored.CreatedAt
+	return store.UpdateAPIKey(ctx, key)
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKey(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		Store = store
+
+		secret, key, err := CreateAPIKey(ctx, APIKey{Name: "ci", Tenant: "acme", Models: []string{"m1"}})
+		if err != nil || !strings.HasPrefix(secret, apiKeyPrefix+key.Id+"_") || !key.Enabled {
+			t.Fatal(name, "unexpected key", secret, key, err)
+		}
+		if strings.Contains(key.Hash, secret) || len(key.Scopes) != 1 || key.Scopes[0] != ScopeChat {
+			t.Fatal(name, "unexpected stored key", key)
+		}
+		got, err := VerifyAPIKey(ctx, secret)
+		if err != nil || got.Tenant != "acme" || !got.AllowsModel("m1") || got.AllowsModel("m2") || got.Session() != "key:"+key.Id {
+			t.Fatal(name, "unexpected verified key", got, err)
+		}
+		for _, wrong := range []string{"", "gw_", secret + "x", apiKeyPrefix + "nokey_" + secret[len(apiKeyPrefix+key.Id+"_"):]} {
+			if _, err := VerifyAPIKey(ctx, wrong); !errors.Is(err, ErrInvalidAPIKey) {
+				t.Fatal(name, "accepted wrong key", wrong, err)
+			}
+		}
+
+		key.Enabled = false
+		key.Hash = "tampered"
+		if err := UpdateAPIKey(ctx, *key); err != nil {
+			t.Fatal(name, err)
+		}
+		if _, err := VerifyAPIKey(ctx, secret); !errors.Is(err, ErrAPIKeyDisabled) {
+			t.Fatal(name, "disabled key accepted", err)
+		}
+		key.Enabled = true
+		key.ExpiresAt = time.Now().Unix() - 1
+		if err := UpdateAPIKey(ctx, *key); err != nil {
+			t.Fatal(name, err)
+		}
+		if _, err := VerifyAPIKey(ctx, secret); !errors.Is(err, ErrAPIKeyExpired) {
+			t.Fatal(name, "expired key accepted", err)
+		}
+
+		if _, _, err := CreateAPIKey(ctx, APIKey{Scopes: []string{"root"}}); !errors.Is(err, ErrUnknownScope) {
+			t.Fatal(name, "unknown scope accepted", err)
+		}
+		if err := UpdateAPIKey(ctx, APIKey{Id: "missing"}); !errors.Is(err, ErrNotFound) {
+			t.Fatal(name, "updated a missing key", err)
+		}
+		if _, _, err := CreateAPIKey(ctx, APIKey{Name: "worker", Scopes: []string{ScopeWorker}}); err != nil {
+			t.Fatal(name, err)
+		}
+		keys, err := ListAPIKeys(ctx)
+		if err != nil || len(keys) != 2 {
+			t.Fatal(name, "unexpected key list", keys, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+const AuditCollection = "audit_log"
+
+const (
+	DefaultAuditLimit = 100
+	MaxAuditLimit     = 1000
+)
+
+var ErrAuditUnsupported = errors.New("store backend does not support the audit log")
+
+// AuditEntry records a mutating admin call.
+type AuditEntry struct {
+	Id       string    `json:"id" bson:"_id"`
+	At       time.Time `json:"at" bson:"at"`
+	Actor    string    `json:"actor" bson:"actor"` //session of the key or user, empty without auth
+	Role     string    `json:"role,omitempty" bson:"role,omitempty"`
+	Method   string    `json:"method" bson:"method"`
+	Path     string    `json:"path" bson:"path"`
+	Body     string    `json:"body,omitempty" bson:"body,omitempty"` //request body, cut off at a few KB
+	Status   int       `json:"status" bson:"status"`
+	ClientIP string    `json:"clientIp,omitempty" bson:"clientIp,omitempty"`
+}
+
+// AuditQuery selects entries at or after From and before To, unix seconds,
+// 0 leaves a bound open.
+type AuditQuery struct {
+	From  int64
+	To    int64
+	Actor string
+	Limit int //default 100, at most 1000
+}
+
+func (q AuditQuery) matches(e *AuditEntry) bool {
+	return (q.From == 0 || e.At.Unix() >= q.From) &&
+		(q.To == 0 || e.At.Unix() < q.To) &&
+		(q.Actor == "" || e.Actor == q.Actor)
+}
+
+// AuditStore is implemented by stores that keep the audit log.
+type AuditStore interface {
+	InsertAudit(ctx context.Context, entry AuditEntry) error
+	// AuditEntries returns the newest entries of q first.
+	AuditEntries(ctx context.Context, q AuditQuery) ([]AuditEntry, error)
+}
+
+// sortAuditEntries orders entries newest first and cuts them to limit.
+func sortAuditEntries(entries []AuditEntry, limit int) []AuditEntry {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].At.After(entries[j].At) })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+func InsertAudit(ctx context.Context, entry AuditEntry) error {
+	store, err := capability[AuditStore](Store, ErrAuditUnsupported)
+	if err != nil {
+		return err
+	}
+	return store.InsertAudit(ctx, entry)
+}
+
+func GetAuditLog(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	store, err := capability[AuditStore](Store, ErrAuditUnsupported)
+	if err != nil {
+		return nil, err
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultAuditLimit
+	}
+	if q.Limit > MaxAuditLimit {
+		q.Limit = MaxAuditLimit
+	}
+	return store.AuditEntries(ctx, q)
+}
@@ -0,0 +1,33 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	ctx := context.Background()
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for name, store := range testStores(t) {
+		Store = store
+		for i, actor := range []string{"key:a", "key:b", "key:a"} {
+			entry := AuditEntry{Id: string(rune('1' + i)), At: at.Add(time.Duration(i) * time.Minute), Actor: actor, Role: RoleAdmin, Method: "POST", Path: "/admin/workers", Status: 200}
+			if err := InsertAudit(ctx, entry); err != nil {
+				t.Fatal(name, err)
+			}
+		}
+		entries, err := GetAuditLog(ctx, AuditQuery{})
+		if err != nil || len(entries) != 3 || entries[0].Id != "3" || entries[2].Id != "1" {
+			t.Fatal(name, "unexpected audit log", entries, err)
+		}
+		entries, err = GetAuditLog(ctx, AuditQuery{Actor: "key:a", Limit: 1})
+		if err != nil || len(entries) != 1 || entries[0].Id != "3" {
+			t.Fatal(name, "unexpected entries of key:a", entries, err)
+		}
+		entries, err = GetAuditLog(ctx, AuditQuery{From: at.Add(time.Minute).Unix(), To: at.Add(2 * time.Minute).Unix()})
+		if err != nil || len(entries) != 1 || entries[0].Id != "2" || entries[0].Path != "/admin/workers" {
+			t.Fatal(name, "unexpected entries in range", entries, err)
+		}
+	}
+}
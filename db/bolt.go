@@ -0,0 +1,784 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltConversationBucket = []byte("conversation")
+	boltMessageBucket      = []byte("message")
+	boltMetaBucket         = []byte("meta")
+	boltSearchBucket       = []byte("search")
+	boltShareBucket        = []byte("shares")
+	boltAPIKeyBucket       = []byte("api_keys")
+	boltSessionBucket      = []byte("sessions")
+	boltUsageBucket        = []byte("usage")
+	boltAlertBucket        = []byte("alerts")
+	boltAuditBucket        = []byte("audit_log")
+	boltLayoutKey          = []byte("layout")
+	boltLayoutSeq          = []byte("seq")
+	boltSearchKey          = []byte("search_index")
+	boltSearchBuilt        = []byte("1")
+)
+
+// boltStore keeps conversations in an embedded file. Every conversation is a
+// nested bucket keyed by sequence and message id, so turns iterate in order.
+// The bucket sequence is the last sequence handed out.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*boltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltConversationBucket, boltMessageBucket, boltMetaBucket, boltSearchBucket, boltShareBucket, boltAPIKeyBucket, boltSessionBucket, boltUsageBucket, boltAlertBucket, boltAuditBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if err := migrateBoltSequence(tx); err != nil {
+			return err
+		}
+		return buildBoltSearchIndex(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func boltTurnKey(msg Message) []byte {
+	key := make([]byte, 8, 8+len(msg.MessageId))
+	binary.BigEndian.PutUint64(key, uint64(msg.Seq))
+	return append(key, msg.MessageId...)
+}
+
+// migrateBoltSequence rekeys files written when turns were keyed by start
+// time, numbering every conversation in its stored order.
+func migrateBoltSequence(tx *bolt.Tx) error {
+	meta := tx.Bucket(boltMetaBucket)
+	if bytes.Equal(meta.Get(boltLayoutKey), boltLayoutSeq) {
+		return nil
+	}
+	convs := tx.Bucket(boltConversationBucket)
+	index := tx.Bucket(boltMessageBucket)
+	names := make([][]byte, 0)
+	err := convs.ForEach(func(name, _ []byte) error {
+		names = append(names, append([]byte{}, name...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	search := tx.Bucket(boltSearchBucket)
+	for _, name := range names {
+		turns := make([]Message, 0)
+		err := convs.Bucket(name).ForEach(func(k, v []byte) error {
+			var msg Message
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return nil
+			}
+			turns = append(turns, msg)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := convs.DeleteBucket(name); err != nil {
+			return err
+		}
+		conv, err := convs.CreateBucket(name)
+		if err != nil {
+			return err
+		}
+		for i := range turns {
+			turns[i].Seq = int64(i + 1)
+			if turns[i].StartTimeMs == 0 {
+				turns[i].StartTimeMs = turns[i].StartTime * 1000
+			}
+			if err := putBoltTurn(conv, index, search, turns[i]); err != nil {
+				return err
+			}
+		}
+		if err := conv.SetSequence(uint64(len(turns))); err != nil {
+			return err
+		}
+	}
+	return meta.Put(boltLayoutKey, boltLayoutSeq)
+}
+
+func putBoltTurn(conv, index, search *bolt.Bucket, msg Message) error {
+	data, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+	key := boltTurnKey(msg)
+	if err := conv.Put(key, data); err != nil {
+		return err
+	}
+	ref := append([]byte(msg.ConversationId+"\x00"), key...)
+	if err := index.Put([]byte(msg.MessageId), ref); err != nil {
+		return err
+	}
+	return indexBoltTurn(search, &msg)
+}
+
+// The search bucket is an inverted index, term\x00messageId -> term count.
+func boltPostingKey(term, messageId string) []byte {
+	return []byte(term + "\x00" + messageId)
+}
+
+func indexBoltTurn(search *bolt.Bucket, msg *Message) error {
+	for term, n := range termCounts(msg) {
+		count := make([]byte, binary.MaxVarintLen64)
+		count = count[:binary.PutUvarint(count, uint64(n))]
+		if err := search.Put(boltPostingKey(term, msg.MessageId), count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unindexBoltTurn(search *bolt.Bucket, data []byte) error {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil
+	}
+	for term := range termCounts(&msg) {
+		if err := search.Delete(boltPostingKey(term, msg.MessageId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildBoltSearchIndex indexes files written before search existed.
+func buildBoltSearchIndex(tx *bolt.Tx) error {
+	meta := tx.Bucket(boltMetaBucket)
+	if bytes.Equal(meta.Get(boltSearchKey), boltSearchBuilt) {
+		return nil
+	}
+	convs := tx.Bucket(boltConversationBucket)
+	search := tx.Bucket(boltSearchBucket)
+	err := convs.ForEach(func(name, _ []byte) error {
+		return convs.Bucket(name).ForEach(func(k, v []byte) error {
+			var msg Message
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return nil
+			}
+			return indexBoltTurn(search, &msg)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return meta.Put(boltSearchKey, boltSearchBuilt)
+}
+
+func (s *boltStore) InsertConversation(ctx context.Context, msg Message) error {
+	return s.InsertConversations(ctx, []Message{msg})
+}
+
+func (s *boltStore) InsertConversations(ctx context.Context, msgs []Message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		convs := tx.Bucket(boltConversationBucket)
+		index := tx.Bucket(boltMessageBucket)
+		search := tx.Bucket(boltSearchBucket)
+		for _, msg := range msgs {
+			if msg.ConversationId == "" {
+				return ErrConversationIdEmpty
+			}
+			conv, err := convs.CreateBucketIfNotExists([]byte(msg.ConversationId))
+			if err != nil {
+				return err
+			}
+			if msg.Seq == 0 {
+				seq, err := conv.NextSequence()
+				if err != nil {
+					return err
+				}
+				msg.Seq = int64(seq)
+			} else if uint64(msg.Seq) > conv.Sequence() {
+				if err := conv.SetSequence(uint64(msg.Seq)); err != nil {
+					return err
+				}
+			}
+			if err := putBoltTurn(conv, index, search, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) GetRecentConversation(ctx context.Context, conversationId string, startTime int64, limit int) ([]Message, error) {
+	if conversationId == "" {
+		return nil, ErrConversationIdEmpty
+	}
+	msgLog := make([]Message, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		conv := tx.Bucket(boltConversationBucket).Bucket([]byte(conversationId))
+		if conv == nil {
+			return nil
+		}
+		cursor := conv.Cursor()
+		for k, v := cursor.Last(); k != nil && len(msgLog) < limit; k, v = cursor.Prev() {
+			var msg Message
+			if err := json.Unmarshal(v, &msg); err != nil || msg.StartTime <= startTime {
+				continue
+			}
+			msgLog = append(msgLog, msg)
+		}
+		return nil
+	})
+	return msgLog, err
+}
+
+func (s *boltStore) GetConversation(ctx context.Context, conversationId string) ([]Message, error) {
+	if conversationId == "" {
+		return nil, ErrConversationIdEmpty
+	}
+	msgLog := make([]Message, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		conv := tx.Bucket(boltConversationBucket).Bucket([]byte(conversationId))
+		if conv == nil {
+			return nil
+		}
+		return conv.ForEach(func(k, v []byte) error {
+			var msg Message
+			if err := json.Unmarshal(v, &msg); err == nil {
+				msgLog = append(msgLog, msg)
+			}
+			return nil
+		})
+	})
+	return msgLog, err
+}
+
+func (s *boltStore) GetMessage(ctx context.Context, messageId string) (*Message, error) {
+	var msg *Message
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ref := tx.Bucket(boltMessageBucket).Get([]byte(messageId))
+		sep := bytes.IndexByte(ref, 0)
+		if sep < 0 {
+			return ErrNotFound
+		}
+		conv := tx.Bucket(boltConversationBucket).Bucket(ref[:sep])
+		if conv == nil {
+			return ErrNotFound
+		}
+		data := conv.Get(ref[sep+1:])
+		if data == nil {
+			return ErrNotFound
+		}
+		msg = new(Message)
+		return json.Unmarshal(data, msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *boltStore) DeleteConversation(ctx context.Context, conversationId string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		convs := tx.Bucket(boltConversationBucket)
+		conv := convs.Bucket([]byte(conversationId))
+		if conv == nil {
+			return nil
+		}
+		index := tx.Bucket(boltMessageBucket)
+		search := tx.Bucket(boltSearchBucket)
+		err := conv.ForEach(func(k, v []byte) error {
+			if err := unindexBoltTurn(search, v); err != nil {
+				return err
+			}
+			return index.Delete(k[8:])
+		})
+		if err != nil {
+			return err
+		}
+		return convs.DeleteBucket([]byte(conversationId))
+	})
+}
+
+func (s *boltStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *boltStore) Close(ctx context.Context) error {
+	return s.db.Close()
+}
+
+func (s *boltStore) ScanBefore(ctx context.Context, before int64, batchSize int, fn func([]Message) error) error {
+	old := make([]Message, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		convs := tx.Bucket(boltConversationBucket)
+		return convs.ForEach(func(name, _ []byte) error {
+			return convs.Bucket(name).ForEach(func(k, v []byte) error {
+				var msg Message
+				if err := json.Unmarshal(v, &msg); err == nil && msg.StartTime < before {
+					old = append(old, msg)
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return scanInBatches(old, batchSize, fn)
+}
+
+func (s *boltStore) ReplaceMessages(ctx context.Context, msgs []Message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		convs := tx.Bucket(boltConversationBucket)
+		index := tx.Bucket(boltMessageBucket)
+		search := tx.Bucket(boltSearchBucket)
+		for _, msg := range msgs {
+			ref := index.Get([]byte(msg.MessageId))
+			sep := bytes.IndexByte(ref, 0)
+			if sep < 0 {
+				continue
+			}
+			conv := convs.Bucket(ref[:sep])
+			if conv == nil {
+				continue
+			}
+			key := append([]byte{}, ref[sep+1:]...)
+			if data := conv.Get(key); data != nil {
+				if err := unindexBoltTurn(search, data); err != nil {
+					return err
+				}
+			}
+			if err := conv.Delete(key); err != nil {
+				return err
+			}
+			if err := putBoltTurn(conv, index, search, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) DeleteMessages(ctx context.Context, messageIds []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		convs := tx.Bucket(boltConversationBucket)
+		index := tx.Bucket(boltMessageBucket)
+		for _, messageId := range messageIds {
+			ref := index.Get([]byte(messageId))
+			sep := bytes.IndexByte(ref, 0)
+			if sep < 0 {
+				continue
+			}
+			convName := append([]byte{}, ref[:sep]...)
+			key := append([]byte{}, ref[sep+1:]...)
+			if err := index.Delete([]byte(messageId)); err != nil {
+				return err
+			}
+			conv := convs.Bucket(convName)
+			if conv == nil {
+				continue
+			}
+			if data := conv.Get(key); data != nil {
+				if err := unindexBoltTurn(tx.Bucket(boltSearchBucket), data); err != nil {
+					return err
+				}
+			}
+			if err := conv.Delete(key); err != nil {
+				return err
+			}
+			if k, _ := conv.Cursor().First(); k == nil {
+				if err := convs.DeleteBucket(convName); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Search(ctx context.Context, q SearchQuery) (*SearchResult, error) {
+	q = q.withDefaults()
+	terms := searchTerms(q.Text)
+	hits := make([]SearchHit, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		convs := tx.Bucket(boltConversationBucket)
+		if len(terms) == 0 {
+			return convs.ForEach(func(name, _ []byte) error {
+				return convs.Bucket(name).ForEach(func(k, v []byte) error {
+					var msg Message
+					if err := json.Unmarshal(v, &msg); err == nil && q.matches(&msg) {
+						hits = append(hits, SearchHit{Message: msg})
+					}
+					return nil
+				})
+			})
+		}
+		search := tx.Bucket(boltSearchBucket)
+		scores := intersectPostings(terms, func(term string) map[string]int {
+			postings := make(map[string]int)
+			prefix := boltPostingKey(term, "")
+			cursor := search.Cursor()
+			for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+				n, _ := binary.Uvarint(v)
+				postings[string(k[len(prefix):])] = int(n)
+			}
+			return postings
+		})
+		index := tx.Bucket(boltMessageBucket)
+		for messageId, score := range scores {
+			ref := index.Get([]byte(messageId))
+			sep := bytes.IndexByte(ref, 0)
+			if sep < 0 {
+				continue
+			}
+			conv := convs.Bucket(ref[:sep])
+			if conv == nil {
+				continue
+			}
+			var msg Message
+			if err := json.Unmarshal(conv.Get(ref[sep+1:]), &msg); err != nil || !q.matches(&msg) {
+				continue
+			}
+			hits = append(hits, SearchHit{Message: msg, Score: score})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rankHits(hits, q, terms), nil
+}
+
+func (s *boltStore) SetFeedback(ctx context.Context, messageId string, fb Feedback) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		ref := tx.Bucket(boltMessageBucket).Get([]byte(messageId))
+		sep := bytes.IndexByte(ref, 0)
+		if sep < 0 {
+			return ErrNotFound
+		}
+		conv := tx.Bucket(boltConversationBucket).Bucket(ref[:sep])
+		if conv == nil {
+			return ErrNotFound
+		}
+		key := append([]byte{}, ref[sep+1:]...)
+		var msg Message
+		if err := json.Unmarshal(conv.Get(key), &msg); err != nil {
+			return ErrNotFound
+		}
+		//the prompt and answer are unchanged, so is the search index
+		msg.Feedback = &fb
+		data, err := json.Marshal(&msg)
+		if err != nil {
+			return err
+		}
+		return conv.Put(key, data)
+	})
+}
+
+func (s *boltStore) FeedbackStats(ctx context.Context, q FeedbackQuery) ([]FeedbackStats, error) {
+	agg := newFeedbackAggregator(q)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		convs := tx.Bucket(boltConversationBucket)
+		return convs.ForEach(func(name, _ []byte) error {
+			return convs.Bucket(name).ForEach(func(k, v []byte) error {
+				//skip decoding the turns nobody judged
+				if !bytes.Contains(v, []byte(`"feedback":`)) {
+					return nil
+				}
+				var msg Message
+				if err := json.Unmarshal(v, &msg); err == nil {
+					agg.add(&msg)
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return agg.result(), nil
+}
+
+func (s *boltStore) InsertShare(ctx context.Context, share Share) error {
+	data, err := json.Marshal(&share)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltShareBucket).Put([]byte(share.Id), data)
+	})
+}
+
+func (s *boltStore) GetShare(ctx context.Context, id string) (*Share, error) {
+	var share *Share
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltShareBucket).Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		share = new(Share)
+		return json.Unmarshal(data, share)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return share, nil
+}
+
+func (s *boltStore) RevokeShare(ctx context.Context, id string, revokedAt int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		shares := tx.Bucket(boltShareBucket)
+		data := shares.Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		var share Share
+		if err := json.Unmarshal(data, &share); err != nil {
+			return err
+		}
+		share.RevokedAt = revokedAt
+		data, err := json.Marshal(&share)
+		if err != nil {
+			return err
+		}
+		return shares.Put([]byte(id), data)
+	})
+}
+
+func (s *boltStore) InsertAPIKey(ctx context.Context, key APIKey) error {
+	data, err := json.Marshal(&key)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAPIKeyBucket).Put([]byte(key.Id), data)
+	})
+}
+
+func (s *boltStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	var key *APIKey
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltAPIKeyBucket).Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		key = new(APIKey)
+		return json.Unmarshal(data, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *boltStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	keys := make([]APIKey, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAPIKeyBucket).ForEach(func(_, data []byte) error {
+			var key APIKey
+			if err := json.Unmarshal(data, &key); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortAPIKeys(keys)
+	return keys, nil
+}
+
+func (s *boltStore) UpdateAPIKey(ctx context.Context, key APIKey) error {
+	data, err := json.Marshal(&key)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(boltAPIKeyBucket)
+		if keys.Get([]byte(key.Id)) == nil {
+			return ErrNotFound
+		}
+		return keys.Put([]byte(key.Id), data)
+	})
+}
+
+func (s *boltStore) PutSession(ctx context.Context, session Session) error {
+	data, err := json.Marshal(&session)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessionBucket).Put([]byte(session.Id), data)
+	})
+}
+
+func (s *boltStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	var session *Session
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltSessionBucket).Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		session = new(Session)
+		return json.Unmarshal(data, session)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *boltStore) DeleteSession(ctx context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessionBucket).Delete([]byte(id))
+	})
+}
+
+func (s *boltStore) DeleteExpiredSessions(ctx context.Context, now time.Time) (int, error) {
+	deleted := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(boltSessionBucket)
+		expired := make([][]byte, 0)
+		err := sessions.ForEach(func(id, data []byte) error {
+			var session Session
+			if err := json.Unmarshal(data, &session); err != nil {
+				return err
+			}
+			if !session.ExpiresAt.After(now) {
+				expired = append(expired, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range expired {
+			if err := sessions.Delete(id); err != nil {
+				return err
+			}
+		}
+		deleted = len(expired)
+		return nil
+	})
+	return deleted, err
+}
+
+func (s *boltStore) AddUsage(ctx context.Context, buckets []UsageBucket) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		usage := tx.Bucket(boltUsageBucket)
+		for _, b := range buckets {
+			id := []byte(b.id())
+			stored := UsageBucket{UsageKey: b.UsageKey}
+			if data := usage.Get(id); data != nil {
+				if err := json.Unmarshal(data, &stored); err != nil {
+					return err
+				}
+			}
+			stored.add(b.UsageCounts)
+			data, err := json.Marshal(&stored)
+			if err != nil {
+				return err
+			}
+			if err := usage.Put(id, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) UsageBuckets(ctx context.Context, q UsageQuery) ([]UsageBucket, error) {
+	buckets := make([]UsageBucket, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		//ids start with the period
+		c := tx.Bucket(boltUsageBucket).Cursor()
+		prefix := []byte(q.Period + "|")
+		for id, data := c.Seek(prefix); id != nil && bytes.HasPrefix(id, prefix); id, data = c.Next() {
+			var b UsageBucket
+			if err := json.Unmarshal(data, &b); err != nil {
+				return err
+			}
+			if q.matches(b.UsageKey) {
+				buckets = append(buckets, b)
+			}
+		}
+		return nil
+	})
+	return buckets, err
+}
+
+func (s *boltStore) ClaimAlert(ctx context.Context, alert Alert) (bool, error) {
+	data, err := json.Marshal(&alert)
+	if err != nil {
+		return false, err
+	}
+	claimed := false
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		alerts := tx.Bucket(boltAlertBucket)
+		if alerts.Get([]byte(alert.Id)) != nil {
+			return nil
+		}
+		claimed = true
+		return alerts.Put([]byte(alert.Id), data)
+	})
+	return claimed, err
+}
+
+// auditKey orders entries by time, so the log is read backwards from the
+// newest.
+func auditKey(entry *AuditEntry) []byte {
+	key := make([]byte, 8, 8+len(entry.Id))
+	binary.BigEndian.PutUint64(key, uint64(entry.At.UnixNano()))
+	return append(key, entry.Id...)
+}
+
+func (s *boltStore) InsertAudit(ctx context.Context, entry AuditEntry) error {
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAuditBucket).Put(auditKey(&entry), data)
+	})
+}
+
+func (s *boltStore) AuditEntries(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	entries := make([]AuditEntry, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltAuditBucket).Cursor()
+		for key, data := c.Last(); key != nil && len(entries) < q.Limit; key, data = c.Prev() {
+			var entry AuditEntry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return err
+			}
+			if q.From > 0 && entry.At.Unix() < q.From {
+				break
+			}
+			if q.matches(&entry) {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
@@ -2,31 +2,207 @@ package db
 
 import (
 	"context"
-	"fmt"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"gateway/log"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
+
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func TestInsert(t *testing.T) {
-	defer MgoCli.Disconnect(context.Background())
-	msg := Message{
-		ConversationId: "123",
-		MessageId:      "123",
-		Prompt:         "test prompt",
-		Text:           "test answer",
-		StartTime:      time.Now().Unix(),
-	}
-	err := InsertSingleConversation(msg)
+func init() {
+	log.InitLog(log.InfoLog)
+}
+
+func testStores(t *testing.T) map[string]ConversationStore {
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "gateway.db"))
 	if err != nil {
 		t.Fatal(err)
 	}
+	stores := map[string]ConversationStore{
+		BackendMemory: NewMemoryStore(),
+		BackendBolt:   bolt,
+	}
+	//mongo runs only against a live server, e.g. after docker compose up
+	if uri := os.Getenv("MONGO_URI"); uri != "" {
+		mongo, err := openMongoStore(uri, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores[BackendMongo] = mongo
+	}
+	t.Cleanup(func() {
+		for _, store := range stores {
+			store.Close(context.Background())
+		}
+	})
+	return stores
+}
+
+func TestInsert(t *testing.T) {
+	for name, store := range testStores(t) {
+		Store = store
+		msg := Message{
+			ConversationId: "123",
+			MessageId:      "123",
+			Prompt:         "test prompt",
+			Text:           "test answer",
+			StartTime:      time.Now().Unix(),
+		}
+		err := InsertSingleConversation(msg)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		got, err := store.GetMessage(context.Background(), "123")
+		if err != nil || got.Text != msg.Text {
+			t.Fatal(name, "message not stored", got, err)
+		}
+		store.DeleteConversation(context.Background(), "123")
+		if _, err := store.GetMessage(context.Background(), "123"); err != ErrNotFound {
+			t.Fatal(name, "message not deleted", err)
+		}
+	}
 }
 
 func TestQuery(t *testing.T) {
-	defer MgoCli.Disconnect(context.Background())
-	msgLog, err := GetResentConversation("3ad2929f-ff4c-4a28-8c28-d81abe3b7d7d", 1679399242)
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		Store = store
+		convId := "3ad2929f-ff4c-4a28-8c28-d81abe3b7d7d"
+		now := time.Now().Unix()
+		msgs := []Message{
+			{ConversationId: convId, MessageId: "m1", Prompt: "p1", Text: "t1", StartTime: now - 100},
+			{ConversationId: convId, MessageId: "m2", Prompt: "p2", Text: "t2", StartTime: now - 10},
+			{ConversationId: convId, MessageId: "m3", Prompt: "p3", Text: "t3", StartTime: now},
+			{ConversationId: "other", MessageId: "m4", Prompt: "p4", Text: "t4", StartTime: now},
+		}
+		if err := store.InsertConversations(ctx, msgs); err != nil {
+			t.Fatal(name, err)
+		}
+		msgLog, err := GetResentConversation(convId, now-50)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if len(msgLog) != 2 || msgLog[0].MessageId != "m3" || msgLog[1].MessageId != "m2" {
+			t.Fatalf("%s: unexpected recent conversation %v", name, msgLog)
+		}
+		all, err := store.GetConversation(ctx, convId)
+		if err != nil || len(all) != 3 || all[0].MessageId != "m1" {
+			t.Fatalf("%s: unexpected conversation %v %v", name, all, err)
+		}
+		if _, err := GetResentConversation("", now); err == nil {
+			t.Fatal(name, "empty conversation id accepted")
+		}
+		store.DeleteConversation(ctx, convId)
+		store.DeleteConversation(ctx, "other")
+	}
+}
+
+func TestSequenceOrder(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		convId := "seq-" + name
+		now := time.Now().Unix()
+		//same second, message ids sort against insertion order
+		ids := []string{"z1", "y2", "x3", "w4"}
+		if err := store.InsertConversation(ctx, Message{ConversationId: convId, MessageId: ids[0], StartTime: now}); err != nil {
+			t.Fatal(name, err)
+		}
+		batch := make([]Message, 0)
+		for _, id := range ids[1:] {
+			batch = append(batch, Message{ConversationId: convId, MessageId: id, StartTime: now})
+		}
+		if err := store.InsertConversations(ctx, batch); err != nil {
+			t.Fatal(name, err)
+		}
+		all, err := store.GetConversation(ctx, convId)
+		if err != nil || len(all) != len(ids) {
+			t.Fatal(name, "unexpected conversation", all, err)
+		}
+		for i, msg := range all {
+			if msg.MessageId != ids[i] || msg.Seq != int64(i+1) {
+				t.Fatalf("%s: turn %d is %s seq %d", name, i, msg.MessageId, msg.Seq)
+			}
+		}
+		recent, err := store.GetRecentConversation(ctx, convId, now-1, 2)
+		if err != nil || len(recent) != 2 || recent[0].MessageId != "w4" || recent[1].MessageId != "x3" {
+			t.Fatal(name, "unexpected recent turns", recent, err)
+		}
+		store.DeleteConversation(ctx, convId)
+	}
+}
+
+func TestBoltSequenceMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.db")
+	legacy, err := bbolt.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	err = legacy.Update(func(tx *bbolt.Tx) error {
+		convs, _ := tx.CreateBucket(boltConversationBucket)
+		index, _ := tx.CreateBucket(boltMessageBucket)
+		conv, _ := convs.CreateBucket([]byte("c1"))
+		for i, id := range []string{"b", "a"} {
+			msg := Message{ConversationId: "c1", MessageId: id, StartTime: now + int64(i)}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(msg.StartTime))
+			key = append(key, id...)
+			data, _ := json.Marshal(&msg)
+			conv.Put(key, data)
+			index.Put([]byte(id), append([]byte("c1\x00"), key...))
+		}
+		return nil
+	})
+	legacy.Close()
 	if err != nil {
 		t.Fatal(err)
 	}
-	fmt.Printf("%v", msgLog)
+
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+	all, err := store.GetConversation(context.Background(), "c1")
+	if err != nil || len(all) != 2 || all[0].MessageId != "b" || all[0].Seq != 1 || all[1].Seq != 2 {
+		t.Fatal("legacy turns not numbered", all, err)
+	}
+	if all[0].StartTimeMs != now*1000 {
+		t.Fatal("start time ms not backfilled", all[0].StartTimeMs)
+	}
+	if msg, err := store.GetMessage(context.Background(), "a"); err != nil || msg.Seq != 2 {
+		t.Fatal("message index not rekeyed", msg, err)
+	}
+	if err := store.InsertConversation(context.Background(), Message{ConversationId: "c1", MessageId: "c", StartTime: now}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := store.GetMessage(context.Background(), "c"); msg == nil || msg.Seq != 3 {
+		t.Fatal("sequence not continued after migration", msg)
+	}
+}
+
+func TestInsertError(t *testing.T) {
+	msgs := []Message{{MessageId: "m1", Seq: 1}, {MessageId: "m2", Seq: 2}, {MessageId: "m3", Seq: 3}}
+	dup := "E11000 duplicate key error collection: aos.conversation index: " + messageIdUniqueIndexName + " dup key: { messageId: \"m1\" }"
+	err := mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{
+		{WriteError: mongo.WriteError{Index: 0, Code: codeDuplicateKey, Message: dup}},
+		{WriteError: mongo.WriteError{Index: 2, Code: 121, Message: "Document failed validation"}},
+	}}
+	var failed *InsertError
+	if !errors.As(insertError(msgs, err), &failed) || len(failed.Failed) != 1 || failed.Failed[0] != 2 || failed.Seq[0] != 3 {
+		t.Fatalf("stored turn not told apart from the refused one: %+v", failed)
+	}
+	err.WriteErrors = err.WriteErrors[:1]
+	if err := insertError(msgs, err); err != nil {
+		t.Fatal("turn already stored reported as failed", err)
+	}
+	if !errors.As(insertError(msgs, context.DeadlineExceeded), &failed) || len(failed.Failed) != 3 {
+		t.Fatalf("unknown outcome should fail the whole batch: %+v", failed)
+	}
 }
@@ -0,0 +1,300 @@
+package db
+
+import (
+	"context"
+	"math"
+)
+
+// maxEncryptedSearchScan bounds the turns a text search decrypts, newest
+// first, since the store indexes can not see into encrypted fields.
+const maxEncryptedSearchScan = 10000
+
+// MessageUpdater is implemented by stores that can rewrite stored turns in
+// place, matched by message id.
+type MessageUpdater interface {
+	ReplaceMessages(ctx context.Context, msgs []Message) error
+}
+
+// encryptedStore encrypts turns on the way in and decrypts them on the way
+// out. It wraps the outermost store so the write-ahead log and the recent
+// turns cache of degraded mode only ever hold ciphertext.
+type encryptedStore struct {
+	ConversationStore
+	keys *keyring
+}
+
+func newEncryptedStore(store ConversationStore, conf EncryptionConfig) (*encryptedStore, error) {
+	keys, err := loadKeyring(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedStore{ConversationStore: store, keys: keys}, nil
+}
+
+// EncryptionEnabled tells whether stored turns are encrypted, data kept
+// next to them should be too.
+func EncryptionEnabled() bool {
+	_, ok := Store.(*encryptedStore)
+	return ok
+}
+
+// SealValue encrypts data kept outside the conversation store, like cached
+// answers, with its own data key. id is bound to the ciphertext. With
+// encryption off data is returned as is and the envelope is nil.
+func SealValue(id string, data []byte) (*Envelope, []byte, error) {
+	enc, ok := Store.(*encryptedStore)
+	if !ok {
+		return nil, data, nil
+	}
+	aead, env, err := enc.keys.newDataKey(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	sealed, err := seal(aead, data, []byte(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	return env, sealed, nil
+}
+
+// OpenValue decrypts what SealValue sealed.
+func OpenValue(id string, env *Envelope, sealed []byte) ([]byte, error) {
+	if env == nil {
+		return sealed, nil
+	}
+	enc, ok := Store.(*encryptedStore)
+	if !ok {
+		return nil, ErrNoKeys
+	}
+	key, err := enc.keys.unwrap(env, id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return unseal(aead, sealed, []byte(id))
+}
+
+func (s *encryptedStore) Unwrap() ConversationStore {
+	return s.ConversationStore
+}
+
+func (s *encryptedStore) encryptAll(msgs []Message) ([]Message, error) {
+	sealed := make([]Message, len(msgs))
+	for i, msg := range msgs {
+		if err := s.keys.encrypt(&msg); err != nil {
+			return nil, err
+		}
+		sealed[i] = msg
+	}
+	return sealed, nil
+}
+
+func (s *encryptedStore) decryptAll(msgs []Message) ([]Message, error) {
+	for i := range msgs {
+		if err := s.keys.decrypt(&msgs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+func (s *encryptedStore) InsertConversation(ctx context.Context, msg Message) error {
+	if err := s.keys.encrypt(&msg); err != nil {
+		return err
+	}
+	return s.ConversationStore.InsertConversation(ctx, msg)
+}
+
+func (s *encryptedStore) InsertConversations(ctx context.Context, msgs []Message) error {
+	sealed, err := s.encryptAll(msgs)
+	if err != nil {
+		return err
+	}
+	return s.ConversationStore.InsertConversations(ctx, sealed)
+}
+
+func (s *encryptedStore) GetRecentConversation(ctx context.Context, conversationId string, startTime int64, limit int) ([]Message, error) {
+	msgLog, err := s.ConversationStore.GetRecentConversation(ctx, conversationId, startTime, limit)
+	if err != nil {
+		return nil, err
+	}
+	return s.decryptAll(msgLog)
+}
+
+func (s *encryptedStore) GetConversation(ctx context.Context, conversationId string) ([]Message, error) {
+	msgLog, err := s.ConversationStore.GetConversation(ctx, conversationId)
+	if err != nil {
+		return nil, err
+	}
+	return s.decryptAll(msgLog)
+}
+
+func (s *encryptedStore) GetMessage(ctx context.Context, messageId string) (*Message, error) {
+	msg, err := s.ConversationStore.GetMessage(ctx, messageId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.keys.decrypt(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// InsertShare encrypts the snapshot turns like stored turns.
+func (s *encryptedStore) InsertShare(ctx context.Context, share Share) error {
+	store, err := capability[ShareStore](s.ConversationStore, ErrShareUnsupported)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.encryptAll(share.Turns)
+	if err != nil {
+		return err
+	}
+	share.Turns = sealed
+	return store.InsertShare(ctx, share)
+}
+
+func (s *encryptedStore) GetShare(ctx context.Context, id string) (*Share, error) {
+	store, err := capability[ShareStore](s.ConversationStore, ErrShareUnsupported)
+	if err != nil {
+		return nil, err
+	}
+	share, err := store.GetShare(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if share.Turns, err = s.decryptAll(share.Turns); err != nil {
+		return nil, err
+	}
+	return share, nil
+}
+
+func (s *encryptedStore) RevokeShare(ctx context.Context, id string, revokedAt int64) error {
+	store, err := capability[ShareStore](s.ConversationStore, ErrShareUnsupported)
+	if err != nil {
+		return err
+	}
+	return store.RevokeShare(ctx, id, revokedAt)
+}
+
+// Search filters in the store and matches the text after decrypting, over
+// the newest maxEncryptedSearchScan turns that pass the filters.
+func (s *encryptedStore) Search(ctx context.Context, q SearchQuery) (*SearchResult, error) {
+	searcher, err := capability[Searcher](s.ConversationStore, ErrSearchUnsupported)
+	if err != nil {
+		return nil, err
+	}
+	q = q.withDefaults()
+	terms := searchTerms(q.Text)
+	if len(terms) == 0 {
+		result, err := searcher.Search(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		for i := range result.Hits {
+			if err := s.keys.decrypt(&result.Hits[i].Message); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+
+	filters := q
+	filters.Text = ""
+	filters.PageSize = MaxSearchPageSize
+	hits := make([]SearchHit, 0)
+	for filters.Page = 1; filters.skip() < maxEncryptedSearchScan; filters.Page++ {
+		page, err := searcher.Search(ctx, filters)
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range page.Hits {
+			if err := s.keys.decrypt(&hit.Message); err != nil {
+				return nil, err
+			}
+			if score := termScore(&hit.Message, terms); score > 0 {
+				hits = append(hits, SearchHit{Message: hit.Message, Score: score})
+			}
+		}
+		if len(page.Hits) < filters.PageSize {
+			break
+		}
+	}
+	return rankHits(hits, q, terms), nil
+}
+
+// termScore is the total count of terms in a turn, or 0 unless all of them
+// occur.
+func termScore(msg *Message, terms []string) float64 {
+	counts := termCounts(msg)
+	score := 0
+	for _, term := range terms {
+		if counts[term] == 0 {
+			return 0
+		}
+		score += counts[term]
+	}
+	return float64(score)
+}
+
+// RotationReport counts the turns a key rotation touched.
+type RotationReport struct {
+	ActiveKey string `json:"activeKey"`
+	DryRun    bool   `json:"dryRun"`
+	Scanned   int    `json:"scanned"`
+	Encrypted int    `json:"encrypted"` //stored in plain text before
+	Rewrapped int    `json:"rewrapped"` //data key moved to the active key
+}
+
+// ReEncrypt moves every turn to the active key: the data keys of encrypted
+// turns are sealed again and plain turns are encrypted. Field ciphertext is
+// not touched, so rotation cost does not depend on the turn size.
+func ReEncrypt(ctx context.Context, batchSize int, dryRun bool) (*RotationReport, error) {
+	enc, ok := Store.(*encryptedStore)
+	if !ok {
+		return nil, ErrNoKeys
+	}
+	purger, err := capability[Purger](enc.ConversationStore, ErrStoreUnavailable)
+	if err != nil {
+		return nil, err
+	}
+	updater, err := capability[MessageUpdater](enc.ConversationStore, ErrStoreUnavailable)
+	if err != nil {
+		return nil, err
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultPurgeBatchSize
+	}
+	report := &RotationReport{ActiveKey: enc.keys.active, DryRun: dryRun}
+	err = purger.ScanBefore(ctx, math.MaxInt64, batchSize, func(batch []Message) error {
+		changed := make([]Message, 0, len(batch))
+		for _, msg := range batch {
+			report.Scanned++
+			switch {
+			case msg.Encryption == nil:
+				if err := enc.keys.encrypt(&msg); err != nil {
+					return err
+				}
+				report.Encrypted++
+			case msg.Encryption.KeyId != enc.keys.active:
+				env, err := enc.keys.rewrap(msg.Encryption, msg.MessageId)
+				if err != nil {
+					return err
+				}
+				msg.Encryption = env
+				report.Rewrapped++
+			default:
+				continue
+			}
+			changed = append(changed, msg)
+		}
+		if dryRun || len(changed) == 0 {
+			return nil
+		}
+		return updater.ReplaceMessages(ctx, changed)
+	})
+	return report, err
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKey(t *testing.T, id string) string {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return id + "=" + base64.StdEncoding.EncodeToString(key)
+}
+
+func TestEncryptedStore(t *testing.T) {
+	ctx := context.Background()
+	k1 := testKey(t, "k1")
+	t.Setenv(DefaultKeyEnv, k1)
+	for name, inner := range testStores(t) {
+		store, err := newEncryptedStore(inner, EncryptionConfig{Enable: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		Store = store
+		msg := Message{
+			ConversationId: "enc-" + name,
+			MessageId:      "enc-m1-" + name,
+			Prompt:         "vehicle log 42",
+			Text:           "lane keeping fault",
+			StartTime:      time.Now().Unix(),
+			Telemetry:      Telemetry{PromptSent: []PromptMessage{{Role: "user", Content: "vehicle log 42"}}},
+		}
+		if err := store.InsertConversation(ctx, msg); err != nil {
+			t.Fatal(name, err)
+		}
+		raw, err := inner.GetMessage(ctx, msg.MessageId)
+		if err != nil || raw.Encryption == nil || raw.Encryption.KeyId != "k1" {
+			t.Fatal(name, "turn not encrypted", raw, err)
+		}
+		if strings.Contains(raw.Prompt, "vehicle") || strings.Contains(raw.Text, "lane") || strings.Contains(raw.PromptSent[0].Content, "vehicle") {
+			t.Fatal(name, "plain text at rest", raw)
+		}
+
+		msgLog, err := GetResentConversation(msg.ConversationId, 0)
+		if err != nil || len(msgLog) != 1 || msgLog[0].Prompt != msg.Prompt || msgLog[0].PromptSent[0].Content != msg.Prompt {
+			t.Fatal(name, "history not decrypted", msgLog, err)
+		}
+		res, err := Search(ctx, SearchQuery{Text: "lane keeping"})
+		if err != nil || res.Total != 1 || res.Hits[0].Message.Text != msg.Text {
+			t.Fatal(name, "encrypted search failed", res, err)
+		}
+
+		//a plain turn written before encryption was enabled
+		inner.InsertConversation(ctx, Message{ConversationId: msg.ConversationId, MessageId: "plain-" + name, Prompt: "old", StartTime: msg.StartTime})
+
+		//rotate to k2 keeping k1 for reading
+		store.keys, err = parseKeyring(k1+"\n"+testKey(t, "k2"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := ReEncrypt(ctx, 10, false)
+		if err != nil || report.Rewrapped != 1 || report.Encrypted != 1 {
+			t.Fatal(name, "unexpected rotation", report, err)
+		}
+		raw, _ = inner.GetMessage(ctx, msg.MessageId)
+		if raw.Encryption.KeyId != "k2" {
+			t.Fatal(name, "key not rotated", raw.Encryption.KeyId)
+		}
+		//k1 can be dropped once nothing uses it
+		store.keys.keys = map[string]cipher.AEAD{"k2": store.keys.keys["k2"]}
+		got, err := store.GetMessage(ctx, msg.MessageId)
+		if err != nil || got.Text != msg.Text {
+			t.Fatal(name, "not readable after rotation", got, err)
+		}
+		if got, err := store.GetMessage(ctx, "plain-"+name); err != nil || got.Prompt != "old" || got.Encryption != nil {
+			t.Fatal(name, "plain turn not encrypted in rotation", got, err)
+		}
+		store.DeleteConversation(ctx, msg.ConversationId)
+	}
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+	ring, err := parseKeyring(testKey(t, "k1"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := Message{MessageId: "m1", Prompt: "secret"}
+	if err := ring.encrypt(&msg); err != nil {
+		t.Fatal(err)
+	}
+	//a ciphertext moved to another turn does not open
+	moved := msg
+	moved.MessageId = "m2"
+	if err := ring.decrypt(&moved); err == nil {
+		t.Fatal("moved ciphertext decrypted")
+	}
+	if _, err := parseKeyring("", ""); err != ErrNoKeys {
+		t.Fatal("empty keyring accepted", err)
+	}
+	if _, err := parseKeyring("k1=c2hvcnQ=", ""); err == nil {
+		t.Fatal("short key accepted")
+	}
+}
+
+func TestSealValue(t *testing.T) {
+	t.Setenv(DefaultKeyEnv, testKey(t, "k1"))
+	prev := Store
+	defer func() { Store = prev }()
+	Store = NewMemoryStore()
+	if env, data, err := SealValue("cache-key", []byte("answer")); err != nil || env != nil || string(data) != "answer" {
+		t.Fatal("value sealed without encryption", env, err)
+	}
+	store, err := newEncryptedStore(NewMemoryStore(), EncryptionConfig{Enable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Store = store
+	env, sealed, err := SealValue("cache-key", []byte("answer"))
+	if err != nil || env == nil || strings.Contains(string(sealed), "answer") {
+		t.Fatal("value not sealed", env, err)
+	}
+	if plain, err := OpenValue("cache-key", env, sealed); err != nil || string(plain) != "answer" {
+		t.Fatal("value not opened", string(plain), err)
+	}
+	if _, err := OpenValue("other-key", env, sealed); err == nil {
+		t.Fatal("value opened under another id")
+	}
+}
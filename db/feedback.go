@@ -0,0 +1,221 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	ThumbDown = -1
+	ThumbNone = 0
+	ThumbUp   = 1
+)
+
+const (
+	FeedbackByModel    = "model"
+	FeedbackByUpstream = "upstream" //worker url, or api key hash for openai
+)
+
+const (
+	MaxFeedbackTags          = 20
+	MaxFeedbackCommentLength = 4096
+)
+
+var (
+	ErrInvalidFeedback      = errors.New("invalid feedback")
+	ErrFeedbackUnsupported  = errors.New("store backend does not support feedback")
+	ErrUnknownFeedbackGroup = errors.New("unknown feedback group, want model or upstream")
+)
+
+// Feedback is the judgement of a user on one answer. A later feedback on the
+// same turn replaces the earlier one.
+type Feedback struct {
+	Thumb     int      `json:"thumb" bson:"thumb"`                       //1 up, -1 down, 0 none
+	Rating    int      `json:"rating,omitempty" bson:"rating,omitempty"` //1 to 5, 0 if not rated
+	Comment   string   `json:"comment,omitempty" bson:"comment,omitempty"`
+	Tags      []string `json:"tags,omitempty" bson:"tags,omitempty"`
+	SessionId string   `json:"sessionId,omitempty" bson:"sessionId,omitempty"`
+	UpdatedAt int64    `json:"updatedAt" bson:"updatedAt"`
+}
+
+func (f *Feedback) Validate() error {
+	switch {
+	case f.Thumb < ThumbDown || f.Thumb > ThumbUp:
+		return fmt.Errorf("%w: thumb must be -1, 0 or 1", ErrInvalidFeedback)
+	case f.Rating < 0 || f.Rating > 5:
+		return fmt.Errorf("%w: rating must be 1 to 5", ErrInvalidFeedback)
+	case f.Thumb == ThumbNone && f.Rating == 0 && f.Comment == "" && len(f.Tags) == 0:
+		return fmt.Errorf("%w: empty", ErrInvalidFeedback)
+	case len(f.Comment) > MaxFeedbackCommentLength:
+		return fmt.Errorf("%w: comment over %d bytes", ErrInvalidFeedback, MaxFeedbackCommentLength)
+	case len(f.Tags) > MaxFeedbackTags:
+		return fmt.Errorf("%w: more than %d tags", ErrInvalidFeedback, MaxFeedbackTags)
+	}
+	return nil
+}
+
+// FeedbackStore is implemented by stores that keep feedback on turns.
+type FeedbackStore interface {
+	// SetFeedback stores fb on the turn, ErrNotFound if there is none.
+	SetFeedback(ctx context.Context, messageId string, fb Feedback) error
+	FeedbackStats(ctx context.Context, q FeedbackQuery) ([]FeedbackStats, error)
+}
+
+// FeedbackQuery selects the turns with feedback to aggregate, From and To
+// bound the turn start time in unix seconds.
+type FeedbackQuery struct {
+	GroupBy string `json:"groupBy"`
+	Model   string `json:"model,omitempty"`
+	From    int64  `json:"from,omitempty"`
+	To      int64  `json:"to,omitempty"`
+}
+
+func (q FeedbackQuery) withDefaults() FeedbackQuery {
+	if q.GroupBy == "" {
+		q.GroupBy = FeedbackByModel
+	}
+	return q
+}
+
+func (q FeedbackQuery) validate() error {
+	if q.GroupBy != FeedbackByModel && q.GroupBy != FeedbackByUpstream {
+		return ErrUnknownFeedbackGroup
+	}
+	return nil
+}
+
+func (q FeedbackQuery) matches(msg *Message) bool {
+	if msg.Feedback == nil {
+		return false
+	}
+	if q.Model != "" && msg.Model != q.Model {
+		return false
+	}
+	if q.From > 0 && msg.StartTime < q.From {
+		return false
+	}
+	if q.To > 0 && msg.StartTime >= q.To {
+		return false
+	}
+	return true
+}
+
+func (q FeedbackQuery) key(msg *Message) string {
+	if q.GroupBy == FeedbackByUpstream {
+		return msg.Upstream
+	}
+	return msg.Model
+}
+
+// FeedbackStats aggregates the feedback of one model or worker. UpRate is the
+// share of thumbs up among the thumbed turns.
+type FeedbackStats struct {
+	Key       string         `json:"key"`
+	Count     int            `json:"count"`
+	Up        int            `json:"up"`
+	Down      int            `json:"down"`
+	UpRate    float64        `json:"upRate"`
+	Rated     int            `json:"rated"`
+	RatingSum int            `json:"-"`
+	AvgRating float64        `json:"avgRating"`
+	Ratings   [5]int         `json:"ratings"` //turns rated 1 to 5
+	Commented int            `json:"commented"`
+	Tags      map[string]int `json:"tags"`
+}
+
+func (st *FeedbackStats) add(fb *Feedback) {
+	st.Count++
+	switch fb.Thumb {
+	case ThumbUp:
+		st.Up++
+	case ThumbDown:
+		st.Down++
+	}
+	if fb.Rating >= 1 && fb.Rating <= 5 {
+		st.Rated++
+		st.RatingSum += fb.Rating
+		st.Ratings[fb.Rating-1]++
+	}
+	if fb.Comment != "" {
+		st.Commented++
+	}
+	for _, tag := range fb.Tags {
+		st.Tags[tag]++
+	}
+}
+
+func (st *FeedbackStats) finish() {
+	if st.Up+st.Down > 0 {
+		st.UpRate = float64(st.Up) / float64(st.Up+st.Down)
+	}
+	if st.Rated > 0 {
+		st.AvgRating = float64(st.RatingSum) / float64(st.Rated)
+	}
+}
+
+// feedbackAggregator folds turns into stats for the stores without a query
+// engine.
+type feedbackAggregator struct {
+	q     FeedbackQuery
+	stats map[string]*FeedbackStats
+}
+
+func newFeedbackAggregator(q FeedbackQuery) *feedbackAggregator {
+	return &feedbackAggregator{q: q, stats: make(map[string]*FeedbackStats)}
+}
+
+func (a *feedbackAggregator) add(msg *Message) {
+	if !a.q.matches(msg) {
+		return
+	}
+	key := a.q.key(msg)
+	st, ok := a.stats[key]
+	if !ok {
+		st = &FeedbackStats{Key: key, Tags: make(map[string]int)}
+		a.stats[key] = st
+	}
+	st.add(msg.Feedback)
+}
+
+func (a *feedbackAggregator) result() []FeedbackStats {
+	return sortFeedbackStats(a.stats)
+}
+
+func sortFeedbackStats(stats map[string]*FeedbackStats) []FeedbackStats {
+	result := make([]FeedbackStats, 0, len(stats))
+	for _, st := range stats {
+		st.finish()
+		result = append(result, *st)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// SetFeedback stores the feedback on a turn. Turns still queued in the writer
+// are not found until they are flushed.
+func SetFeedback(ctx context.Context, messageId string, fb Feedback) error {
+	if err := fb.Validate(); err != nil {
+		return err
+	}
+	store, err := capability[FeedbackStore](Store, ErrFeedbackUnsupported)
+	if err != nil {
+		return err
+	}
+	return store.SetFeedback(ctx, messageId, fb)
+}
+
+func GetFeedbackStats(ctx context.Context, q FeedbackQuery) ([]FeedbackStats, error) {
+	q = q.withDefaults()
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	store, err := capability[FeedbackStore](Store, ErrFeedbackUnsupported)
+	if err != nil {
+		return nil, err
+	}
+	return store.FeedbackStats(ctx, q)
+}
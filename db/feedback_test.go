@@ -0,0 +1,73 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFeedback(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	msgs := []Message{
+		{ConversationId: "f1", MessageId: "fb1", Prompt: "q1", Text: "a1", Model: "self-driving-v1", StartTime: now - 100, Telemetry: Telemetry{Upstream: "http://w1"}},
+		{ConversationId: "f1", MessageId: "fb2", Prompt: "q2", Text: "a2", Model: "self-driving-v1", StartTime: now - 50, Telemetry: Telemetry{Upstream: "http://w2"}},
+		{ConversationId: "f2", MessageId: "fb3", Prompt: "q3", Text: "a3", Model: "self-driving-v3", StartTime: now, Telemetry: Telemetry{Upstream: "http://w3"}},
+		{ConversationId: "f2", MessageId: "fb4", Prompt: "q4", Text: "a4", Model: "self-driving-v3", StartTime: now},
+	}
+	feedback := map[string]Feedback{
+		"fb1": {Thumb: ThumbDown, Rating: 2, Tags: []string{"wrong"}},
+		"fb2": {Thumb: ThumbUp, Rating: 4, Comment: "clear", Tags: []string{"helpful"}},
+		"fb3": {Thumb: ThumbUp, Rating: 5, Tags: []string{"helpful"}},
+	}
+	for name, store := range testStores(t) {
+		if err := store.InsertConversations(ctx, msgs); err != nil {
+			t.Fatal(name, err)
+		}
+		Store = store
+		for messageId, fb := range feedback {
+			if err := SetFeedback(ctx, messageId, fb); err != nil {
+				t.Fatal(name, err)
+			}
+		}
+		//a second judgement replaces the first
+		if err := SetFeedback(ctx, "fb1", Feedback{Thumb: ThumbDown, Rating: 1, Tags: []string{"wrong"}}); err != nil {
+			t.Fatal(name, err)
+		}
+		if err := SetFeedback(ctx, "missing", Feedback{Thumb: ThumbUp}); !errors.Is(err, ErrNotFound) {
+			t.Fatal(name, "feedback on missing turn", err)
+		}
+		if err := SetFeedback(ctx, "fb4", Feedback{Rating: 6}); !errors.Is(err, ErrInvalidFeedback) {
+			t.Fatal(name, "invalid rating accepted", err)
+		}
+		msg, err := store.GetMessage(ctx, "fb1")
+		if err != nil || msg.Feedback == nil || msg.Feedback.Rating != 1 || msg.Text != "a1" {
+			t.Fatal(name, "feedback not stored", msg, err)
+		}
+
+		stats, err := GetFeedbackStats(ctx, FeedbackQuery{})
+		if err != nil || len(stats) != 2 {
+			t.Fatal(name, "unexpected stats", stats, err)
+		}
+		v1, v3 := stats[0], stats[1]
+		if v1.Key != "self-driving-v1" || v1.Count != 2 || v1.Up != 1 || v1.Down != 1 || v1.UpRate != 0.5 ||
+			v1.AvgRating != 2.5 || v1.Ratings != [5]int{1, 0, 0, 1, 0} || v1.Commented != 1 || v1.Tags["wrong"] != 1 {
+			t.Fatal(name, "unexpected v1 stats", v1)
+		}
+		if v3.Key != "self-driving-v3" || v3.Count != 1 || v3.UpRate != 1 || v3.AvgRating != 5 || v3.Tags["helpful"] != 1 {
+			t.Fatal(name, "unexpected v3 stats", v3)
+		}
+
+		stats, err = GetFeedbackStats(ctx, FeedbackQuery{GroupBy: FeedbackByUpstream, Model: "self-driving-v1", From: now - 60})
+		if err != nil || len(stats) != 1 || stats[0].Key != "http://w2" || stats[0].Up != 1 {
+			t.Fatal(name, "filters not applied", stats, err)
+		}
+		if _, err := GetFeedbackStats(ctx, FeedbackQuery{GroupBy: "tenant"}); !errors.Is(err, ErrUnknownFeedbackGroup) {
+			t.Fatal(name, "unknown group accepted", err)
+		}
+
+		store.DeleteConversation(ctx, "f1")
+		store.DeleteConversation(ctx, "f2")
+	}
+}
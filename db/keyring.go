@@ -0,0 +1,262 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	DefaultKeyEnv = "GATEWAY_ENCRYPTION_KEYS"
+	dataKeySize   = 32
+	//prefix of encrypted field values, unencrypted turns are read as they are
+	encryptedPrefix = "enc:v1:"
+)
+
+var (
+	ErrNoKeys        = errors.New("no encryption keys configured")
+	ErrUnknownKey    = errors.New("unknown encryption key id")
+	ErrInvalidKey    = errors.New("encryption key must be 32 bytes, base64 encoded")
+	ErrDecryptFailed = errors.New("decrypt failed")
+)
+
+// EncryptionConfig turns on envelope encryption of the stored prompts and
+// answers. Keys are read from KeyFile, or from the KeyEnv environment variable
+// when no file is set, as id=base64 entries separated by newlines or commas.
+// New turns are encrypted with ActiveKey, or the last key listed.
+type EncryptionConfig struct {
+	Enable    bool   `yaml:"enable"`
+	KeyFile   string `yaml:"key_file"`
+	KeyEnv    string `yaml:"key_env"`
+	ActiveKey string `yaml:"active_key"`
+}
+
+// Envelope is the data key of one turn, sealed with a master key.
+type Envelope struct {
+	KeyId   string `json:"keyId" bson:"keyId"`
+	DataKey []byte `json:"dataKey" bson:"dataKey"` //nonce then sealed key
+}
+
+// keyring holds the master keys that seal the per turn data keys.
+type keyring struct {
+	keys   map[string]cipher.AEAD
+	active string
+}
+
+func loadKeyring(conf EncryptionConfig) (*keyring, error) {
+	var raw string
+	if conf.KeyFile != "" {
+		data, err := ioutil.ReadFile(conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		raw = string(data)
+	} else {
+		env := conf.KeyEnv
+		if env == "" {
+			env = DefaultKeyEnv
+		}
+		raw = os.Getenv(env)
+	}
+	return parseKeyring(raw, conf.ActiveKey)
+}
+
+func parseKeyring(raw, active string) (*keyring, error) {
+	ring := &keyring{keys: make(map[string]cipher.AEAD)}
+	entries := strings.FieldsFunc(raw, func(r rune) bool { return r == '\n' || r == ',' })
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		sep := strings.IndexByte(entry, '=')
+		if sep <= 0 {
+			return nil, fmt.Errorf("invalid key entry %q, want id=base64", entry)
+		}
+		id := strings.TrimSpace(entry[:sep])
+		//base64 of a 32 byte key ends with one padding '='
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(entry[sep+1:]))
+		if err != nil || len(key) != dataKeySize {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidKey, id)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		ring.keys[id] = aead
+		ring.active = id
+	}
+	if len(ring.keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	if active != "" {
+		if _, ok := ring.keys[active]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownKey, active)
+		}
+		ring.active = active
+	}
+	return ring, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plain, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, additional), nil
+}
+
+func unseal(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrDecryptFailed
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return plain, nil
+}
+
+// newDataKey creates a data key and its envelope under the active key.
+func (r *keyring) newDataKey(messageId string) (cipher.AEAD, *Envelope, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, err
+	}
+	env, err := r.wrap(key, messageId)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(key)
+	return aead, env, err
+}
+
+func (r *keyring) wrap(key []byte, messageId string) (*Envelope, error) {
+	sealed, err := seal(r.keys[r.active], key, []byte(messageId))
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{KeyId: r.active, DataKey: sealed}, nil
+}
+
+func (r *keyring) unwrap(env *Envelope, messageId string) ([]byte, error) {
+	master, ok := r.keys[env.KeyId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, env.KeyId)
+	}
+	return unseal(master, env.DataKey, []byte(messageId))
+}
+
+// rewrap seals the data key of a turn under the active key, the fields stay
+// as they are.
+func (r *keyring) rewrap(env *Envelope, messageId string) (*Envelope, error) {
+	key, err := r.unwrap(env, messageId)
+	if err != nil {
+		return nil, err
+	}
+	return r.wrap(key, messageId)
+}
+
+func fieldAD(messageId, field string) []byte {
+	return []byte(messageId + "\x00" + field)
+}
+
+func encryptField(aead cipher.AEAD, messageId, field, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	sealed, err := seal(aead, []byte(value), fieldAD(messageId, field))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptField(aead cipher.AEAD, messageId, field, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value[len(encryptedPrefix):])
+	if err != nil {
+		return "", ErrDecryptFailed
+	}
+	plain, err := unseal(aead, sealed, fieldAD(messageId, field))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// encrypt seals the prompt, answer and sent prompt of a turn. Turns that are
+// already encrypted are left alone.
+func (r *keyring) encrypt(msg *Message) error {
+	if msg.Encryption != nil {
+		return nil
+	}
+	aead, env, err := r.newDataKey(msg.MessageId)
+	if err != nil {
+		return err
+	}
+	return msg.transformFields(func(field, value string) (string, error) {
+		return encryptField(aead, msg.MessageId, field, value)
+	}, func() { msg.Encryption = env })
+}
+
+func (r *keyring) decrypt(msg *Message) error {
+	if msg.Encryption == nil {
+		return nil
+	}
+	key, err := r.unwrap(msg.Encryption, msg.MessageId)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	return msg.transformFields(func(field, value string) (string, error) {
+		return decryptField(aead, msg.MessageId, field, value)
+	}, func() { msg.Encryption = nil })
+}
+
+// transformFields rewrites the sensitive fields of a copy and applies it to
+// msg only if all of them succeed.
+func (msg *Message) transformFields(fn func(field, value string) (string, error), done func()) error {
+	prompt, err := fn("prompt", msg.Prompt)
+	if err != nil {
+		return err
+	}
+	text, err := fn("text", msg.Text)
+	if err != nil {
+		return err
+	}
+	var sent []PromptMessage
+	if msg.PromptSent != nil {
+		sent = make([]PromptMessage, len(msg.PromptSent))
+		for i, m := range msg.PromptSent {
+			content, err := fn(fmt.Sprintf("promptSent.%d", i), m.Content)
+			if err != nil {
+				return err
+			}
+			sent[i] = PromptMessage{Role: m.Role, Content: content}
+		}
+	}
+	msg.Prompt, msg.Text, msg.PromptSent = prompt, text, sent
+	done()
+	return nil
+}
@@ -0,0 +1,446 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps conversations in process, for tests and single node
+// deployments that do not need history across restarts.
+type memoryStore struct {
+	lock          sync.RWMutex
+	conversations map[string][]Message      //conversation id -> turns, oldest first
+	messages      map[string]string         //message id -> conversation id
+	seqs          map[string]int64          //conversation id -> last sequence
+	index         map[string]map[string]int //term -> message id -> count
+	shares        map[string]Share
+	apiKeys       map[string]APIKey
+	sessions      map[string]Session
+	usage         map[UsageKey]UsageCounts
+	alerts        map[string]Alert
+	audit         []AuditEntry
+}
+
+func NewMemoryStore() *memoryStore {
+	return &memoryStore{
+		conversations: make(map[string][]Message),
+		messages:      make(map[string]string),
+		seqs:          make(map[string]int64),
+		index:         make(map[string]map[string]int),
+		shares:        make(map[string]Share),
+		apiKeys:       make(map[string]APIKey),
+		sessions:      make(map[string]Session),
+		usage:         make(map[UsageKey]UsageCounts),
+		alerts:        make(map[string]Alert),
+	}
+}
+
+func (s *memoryStore) InsertConversation(ctx context.Context, msg Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.insert(msg)
+	return nil
+}
+
+func (s *memoryStore) InsertConversations(ctx context.Context, msgs []Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, msg := range msgs {
+		s.insert(msg)
+	}
+	return nil
+}
+
+func (s *memoryStore) insert(msg Message) {
+	if msg.Seq == 0 {
+		msg.Seq = s.seqs[msg.ConversationId] + 1
+	}
+	if msg.Seq > s.seqs[msg.ConversationId] {
+		s.seqs[msg.ConversationId] = msg.Seq
+	}
+	turns := append(s.conversations[msg.ConversationId], msg)
+	sort.SliceStable(turns, func(i, j int) bool {
+		return turns[i].Seq < turns[j].Seq
+	})
+	s.conversations[msg.ConversationId] = turns
+	s.messages[msg.MessageId] = msg.ConversationId
+	for term, n := range termCounts(&msg) {
+		postings, ok := s.index[term]
+		if !ok {
+			postings = make(map[string]int)
+			s.index[term] = postings
+		}
+		postings[msg.MessageId] += n
+	}
+}
+
+func (s *memoryStore) unindex(msg *Message) {
+	for term := range termCounts(msg) {
+		delete(s.index[term], msg.MessageId)
+		if len(s.index[term]) == 0 {
+			delete(s.index, term)
+		}
+	}
+}
+
+func (s *memoryStore) GetRecentConversation(ctx context.Context, conversationId string, startTime int64, limit int) ([]Message, error) {
+	if conversationId == "" {
+		return nil, ErrConversationIdEmpty
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	turns := s.conversations[conversationId]
+	msgLog := make([]Message, 0)
+	for i := len(turns) - 1; i >= 0 && len(msgLog) < limit; i-- {
+		if turns[i].StartTime > startTime {
+			msgLog = append(msgLog, turns[i])
+		}
+	}
+	return msgLog, nil
+}
+
+func (s *memoryStore) GetConversation(ctx context.Context, conversationId string) ([]Message, error) {
+	if conversationId == "" {
+		return nil, ErrConversationIdEmpty
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]Message{}, s.conversations[conversationId]...), nil
+}
+
+func (s *memoryStore) GetMessage(ctx context.Context, messageId string) (*Message, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	conversationId, ok := s.messages[messageId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	for _, msg := range s.conversations[conversationId] {
+		if msg.MessageId == messageId {
+			return &msg, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) DeleteConversation(ctx context.Context, conversationId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, msg := range s.conversations[conversationId] {
+		delete(s.messages, msg.MessageId)
+		s.unindex(&msg)
+	}
+	delete(s.conversations, conversationId)
+	return nil
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Close(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) ScanBefore(ctx context.Context, before int64, batchSize int, fn func([]Message) error) error {
+	s.lock.RLock()
+	old := make([]Message, 0)
+	for _, turns := range s.conversations {
+		for _, msg := range turns {
+			if msg.StartTime < before {
+				old = append(old, msg)
+			}
+		}
+	}
+	s.lock.RUnlock()
+	return scanInBatches(old, batchSize, fn)
+}
+
+func (s *memoryStore) ReplaceMessages(ctx context.Context, msgs []Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, msg := range msgs {
+		conversationId, ok := s.messages[msg.MessageId]
+		if !ok {
+			continue
+		}
+		turns := s.conversations[conversationId]
+		for i := range turns {
+			if turns[i].MessageId == msg.MessageId {
+				s.unindex(&turns[i])
+				turns[i] = msg
+				break
+			}
+		}
+		for term, n := range termCounts(&msg) {
+			postings, ok := s.index[term]
+			if !ok {
+				postings = make(map[string]int)
+				s.index[term] = postings
+			}
+			postings[msg.MessageId] += n
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteMessages(ctx context.Context, messageIds []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, messageId := range messageIds {
+		conversationId, ok := s.messages[messageId]
+		if !ok {
+			continue
+		}
+		delete(s.messages, messageId)
+		turns := s.conversations[conversationId]
+		for i := range turns {
+			if turns[i].MessageId == messageId {
+				s.unindex(&turns[i])
+				turns = append(turns[:i], turns[i+1:]...)
+				break
+			}
+		}
+		if len(turns) == 0 {
+			delete(s.conversations, conversationId)
+		} else {
+			s.conversations[conversationId] = turns
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Search(ctx context.Context, q SearchQuery) (*SearchResult, error) {
+	q = q.withDefaults()
+	terms := searchTerms(q.Text)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	hits := make([]SearchHit, 0)
+	if len(terms) == 0 {
+		for _, turns := range s.conversations {
+			for i := range turns {
+				if q.matches(&turns[i]) {
+					hits = append(hits, SearchHit{Message: turns[i]})
+				}
+			}
+		}
+		return rankHits(hits, q, terms), nil
+	}
+	for messageId, score := range intersectPostings(terms, func(term string) map[string]int {
+		return s.index[term]
+	}) {
+		for _, msg := range s.conversations[s.messages[messageId]] {
+			if msg.MessageId == messageId && q.matches(&msg) {
+				hits = append(hits, SearchHit{Message: msg, Score: score})
+				break
+			}
+		}
+	}
+	return rankHits(hits, q, terms), nil
+}
+
+func scanInBatches(msgs []Message, batchSize int, fn func([]Message) error) error {
+	for len(msgs) > 0 {
+		n := batchSize
+		if n > len(msgs) {
+			n = len(msgs)
+		}
+		if err := fn(msgs[:n]); err != nil {
+			return err
+		}
+		msgs = msgs[n:]
+	}
+	return nil
+}
+
+func (s *memoryStore) SetFeedback(ctx context.Context, messageId string, fb Feedback) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	turns := s.conversations[s.messages[messageId]]
+	for i := range turns {
+		if turns[i].MessageId == messageId {
+			turns[i].Feedback = &fb
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memoryStore) FeedbackStats(ctx context.Context, q FeedbackQuery) ([]FeedbackStats, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	agg := newFeedbackAggregator(q)
+	for _, turns := range s.conversations {
+		for i := range turns {
+			agg.add(&turns[i])
+		}
+	}
+	return agg.result(), nil
+}
+
+func (s *memoryStore) InsertShare(ctx context.Context, share Share) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.shares[share.Id] = share
+	return nil
+}
+
+func (s *memoryStore) GetShare(ctx context.Context, id string) (*Share, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	share, ok := s.shares[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	share.Turns = append([]Message{}, share.Turns...)
+	return &share, nil
+}
+
+func (s *memoryStore) RevokeShare(ctx context.Context, id string, revokedAt int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	share, ok := s.shares[id]
+	if !ok {
+		return ErrNotFound
+	}
+	share.RevokedAt = revokedAt
+	s.shares[id] = share
+	return nil
+}
+
+func (s *memoryStore) InsertAPIKey(ctx context.Context, key APIKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.apiKeys[key.Id] = copyAPIKey(key)
+	return nil
+}
+
+func (s *memoryStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	key, ok := s.apiKeys[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	key = copyAPIKey(key)
+	return &key, nil
+}
+
+func (s *memoryStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	keys := make([]APIKey, 0, len(s.apiKeys))
+	for _, key := range s.apiKeys {
+		keys = append(keys, copyAPIKey(key))
+	}
+	sortAPIKeys(keys)
+	return keys, nil
+}
+
+func (s *memoryStore) UpdateAPIKey(ctx context.Context, key APIKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.apiKeys[key.Id]; !ok {
+		return ErrNotFound
+	}
+	s.apiKeys[key.Id] = copyAPIKey(key)
+	return nil
+}
+
+func copyAPIKey(key APIKey) APIKey {
+	key.Models = append([]string(nil), key.Models...)
+	key.Scopes = append([]string(nil), key.Scopes...)
+	return key
+}
+
+func (s *memoryStore) PutSession(ctx context.Context, session Session) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions[session.Id] = session
+	return nil
+}
+
+func (s *memoryStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &session, nil
+}
+
+func (s *memoryStore) DeleteSession(ctx context.Context, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memoryStore) DeleteExpiredSessions(ctx context.Context, now time.Time) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	deleted := 0
+	for id, session := range s.sessions {
+		if !session.ExpiresAt.After(now) {
+			delete(s.sessions, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *memoryStore) AddUsage(ctx context.Context, buckets []UsageBucket) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, b := range buckets {
+		counts := s.usage[b.UsageKey]
+		counts.add(b.UsageCounts)
+		s.usage[b.UsageKey] = counts
+	}
+	return nil
+}
+
+func (s *memoryStore) UsageBuckets(ctx context.Context, q UsageQuery) ([]UsageBucket, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	buckets := make([]UsageBucket, 0)
+	for key, counts := range s.usage {
+		if q.matches(key) {
+			buckets = append(buckets, UsageBucket{UsageKey: key, UsageCounts: counts})
+		}
+	}
+	return buckets, nil
+}
+
+func (s *memoryStore) ClaimAlert(ctx context.Context, alert Alert) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.alerts[alert.Id]; ok {
+		return false, nil
+	}
+	s.alerts[alert.Id] = alert
+	return true, nil
+}
+
+func (s *memoryStore) InsertAudit(ctx context.Context, entry AuditEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.audit = append(s.audit, entry)
+	return nil
+}
+
+func (s *memoryStore) AuditEntries(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	entries := make([]AuditEntry, 0)
+	//newest first when entries share a time
+	for i := len(s.audit) - 1; i >= 0; i-- {
+		if q.matches(&s.audit[i]) {
+			entries = append(entries, s.audit[i])
+		}
+	}
+	return sortAuditEntries(entries, q.Limit), nil
+}
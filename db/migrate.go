@@ -0,0 +1,338 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MigrationCollection records the applied schema migrations, the document id
+// is the migration version.
+const MigrationCollection = "migrations"
+
+var (
+	ErrUnknownMigration      = errors.New("unknown migration version")
+	ErrMigrationsUnsupported = errors.New("store backend has no versioned migrations")
+)
+
+// mongo error codes of index management
+const (
+	codeIndexNotFound         = 27
+	codeDuplicateKey          = 11000
+	codeIndexOptionsConflict  = 85
+	codeIndexKeySpecsConflict = 86
+)
+
+// Migrator is implemented by stores with a versioned schema.
+type Migrator interface {
+	// Migrations lists all known migrations and whether they are applied.
+	Migrations(ctx context.Context) ([]MigrationState, error)
+	// MigrateTo applies or reverts migrations until version is the latest
+	// applied one and returns the steps it ran in order. Version 0 reverts
+	// everything, a negative version applies everything.
+	MigrateTo(ctx context.Context, version int) ([]MigrationState, error)
+}
+
+type MigrationState struct {
+	Version     int       `json:"version"`
+	Description string    `json:"description"`
+	Applied     bool      `json:"applied"`
+	AppliedAt   time.Time `json:"appliedAt,omitempty"`
+}
+
+type migrationRecord struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// migration steps must be idempotent, a step interrupted before its record
+// was written runs again.
+type migration struct {
+	version     int
+	description string
+	up          func(ctx context.Context, s *mongoStore) error
+	down        func(ctx context.Context, s *mongoStore) error
+}
+
+// mongoMigrations are ordered by version. Append new steps, never renumber.
+var mongoMigrations = []migration{
+	{
+		version:     1,
+		description: "number conversation turns, unique index on conversationId and seq",
+		up:          backfillSequence,
+		//numbering stays, new turns continue from the counters
+		down: func(ctx context.Context, s *mongoStore) error {
+			return dropIndex(ctx, s.collection, seqIndexName)
+		},
+	},
+	{
+		version:     2,
+		description: "index conversation turns on messageId",
+		up: func(ctx context.Context, s *mongoStore) error {
+			return ensureIndex(ctx, s.collection, mongo.IndexModel{
+				Keys:    bson.D{{Key: "messageId", Value: 1}},
+				Options: options.Index().SetName(messageIdIndexName),
+			})
+		},
+		down: func(ctx context.Context, s *mongoStore) error {
+			return dropIndex(ctx, s.collection, messageIdIndexName)
+		},
+	},
+	{
+		version:     3,
+		description: "index conversation turns on startTime for retention scans",
+		up: func(ctx context.Context, s *mongoStore) error {
+			return ensureIndex(ctx, s.collection, mongo.IndexModel{
+				Keys:    bson.D{{Key: "startTime", Value: 1}},
+				Options: options.Index().SetName(startTimeIndexName),
+			})
+		},
+		down: func(ctx context.Context, s *mongoStore) error {
+			return dropIndex(ctx, s.collection, startTimeIndexName)
+		},
+	},
+	{
+		version:     4,
+		description: "text index on prompt and text for search",
+		up: func(ctx context.Context, s *mongoStore) error {
+			return ensureIndex(ctx, s.collection, mongo.IndexModel{
+				Keys:    bson.D{{Key: "prompt", Value: "text"}, {Key: "text", Value: "text"}},
+				Options: options.Index().SetName(textIndexName).SetDefaultLanguage("none"),
+			})
+		},
+		down: func(ctx context.Context, s *mongoStore) error {
+			return dropIndex(ctx, s.collection, textIndexName)
+		},
+	},
+	{
+		version:     5,
+		description: "expire sessions on expiresAt",
+		up: func(ctx context.Context, s *mongoStore) error {
+			return ensureIndex(ctx, s.sessions, mongo.IndexModel{
+				Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+				Options: options.Index().SetName(sessionExpiryIndexName).SetExpireAfterSeconds(0),
+			})
+		},
+		down: func(ctx context.Context, s *mongoStore) error {
+			return dropIndex(ctx, s.sessions, sessionExpiryIndexName)
+		},
+	},
+	{
+		version:     6,
+		description: "index usage buckets by period, tenant and start",
+		up: func(ctx context.Context, s *mongoStore) error {
+			return ensureIndex(ctx, s.usage, mongo.IndexModel{
+				Keys:    bson.D{{Key: "period", Value: 1}, {Key: "tenant", Value: 1}, {Key: "start", Value: 1}},
+				Options: options.Index().SetName(usageIndexName),
+			})
+		},
+		down: func(ctx context.Context, s *mongoStore) error {
+			return dropIndex(ctx, s.usage, usageIndexName)
+		},
+	},
+	{
+		version:     7,
+		description: "index the audit log on at",
+		up: func(ctx context.Context, s *mongoStore) error {
+			return ensureIndex(ctx, s.audit, mongo.IndexModel{
+				Keys:    bson.D{{Key: "at", Value: -1}},
+				Options: options.Index().SetName(auditIndexName),
+			})
+		},
+		down: func(ctx context.Context, s *mongoStore) error {
+			return dropIndex(ctx, s.audit, auditIndexName)
+		},
+	},
+	{
+		version:     8,
+		description: "unique index on messageId, a retried insert does not store a turn twice",
+		up:          uniqueMessageIds,
+		down: func(ctx context.Context, s *mongoStore) error {
+			if err := dropIndex(ctx, s.collection, messageIdUniqueIndexName); err != nil {
+				return err
+			}
+			return ensureIndex(ctx, s.collection, mongo.IndexModel{
+				Keys:    bson.D{{Key: "messageId", Value: 1}},
+				Options: options.Index().SetName(messageIdIndexName),
+			})
+		},
+	},
+}
+
+const (
+	messageIdIndexName = "messageId"
+	//turns without a messageId are left out
+	messageIdUniqueIndexName = "messageId_unique"
+	startTimeIndexName       = "startTime"
+	textIndexName            = "prompt_text"
+	//sessions
+	sessionExpiryIndexName = "expiresAt"
+	//usage
+	usageIndexName = "period_tenant_start"
+	//audit log
+	auditIndexName = "at"
+)
+
+// StoreMigrator returns the migrations of Store, ErrMigrationsUnsupported if
+// its backend has none.
+func StoreMigrator() (Migrator, error) {
+	return capability[Migrator](Store, ErrMigrationsUnsupported)
+}
+
+// LatestMigration is the schema version the running code expects.
+func LatestMigration() int {
+	return mongoMigrations[len(mongoMigrations)-1].version
+}
+
+func (s *mongoStore) migrationRecords(ctx context.Context) (map[int]migrationRecord, error) {
+	cursor, err := s.migrations.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	records := make(map[int]migrationRecord)
+	for cursor.Next(ctx) {
+		var record migrationRecord
+		if err := cursor.Decode(&record); err != nil {
+			return nil, err
+		}
+		records[record.Version] = record
+	}
+	return records, cursor.Err()
+}
+
+func (s *mongoStore) Migrations(ctx context.Context) ([]MigrationState, error) {
+	records, err := s.migrationRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+	states := make([]MigrationState, 0, len(mongoMigrations))
+	for _, m := range mongoMigrations {
+		state := MigrationState{Version: m.version, Description: m.description}
+		if record, ok := records[m.version]; ok {
+			state.Applied = true
+			state.AppliedAt = record.AppliedAt
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func (s *mongoStore) MigrateTo(ctx context.Context, version int) ([]MigrationState, error) {
+	if version < 0 {
+		version = LatestMigration()
+	}
+	if version > LatestMigration() {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownMigration, version)
+	}
+	records, err := s.migrationRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+	steps := make([]MigrationState, 0)
+	for _, m := range mongoMigrations {
+		if _, ok := records[m.version]; ok || m.version > version {
+			continue
+		}
+		if err := m.up(ctx, s); err != nil {
+			return steps, fmt.Errorf("migration %d up: %w", m.version, err)
+		}
+		record := migrationRecord{Version: m.version, Description: m.description, AppliedAt: time.Now()}
+		_, err := s.migrations.ReplaceOne(ctx, bson.D{{Key: "_id", Value: m.version}}, record, options.Replace().SetUpsert(true))
+		if err != nil {
+			return steps, err
+		}
+		steps = append(steps, MigrationState{Version: m.version, Description: m.description, Applied: true, AppliedAt: record.AppliedAt})
+	}
+	for i := len(mongoMigrations) - 1; i >= 0; i-- {
+		m := mongoMigrations[i]
+		if _, ok := records[m.version]; !ok || m.version <= version {
+			continue
+		}
+		if err := m.down(ctx, s); err != nil {
+			return steps, fmt.Errorf("migration %d down: %w", m.version, err)
+		}
+		if _, err := s.migrations.DeleteOne(ctx, bson.D{{Key: "_id", Value: m.version}}); err != nil {
+			return steps, err
+		}
+		steps = append(steps, MigrationState{Version: m.version, Description: m.description})
+	}
+	return steps, nil
+}
+
+// ensureIndex creates an index, or recreates it if one with the same name or
+// keys exists with other options.
+// uniqueMessageIds removes the copies retried inserts stored of a turn,
+// keeping the first one, and swaps the messageId index for a unique one.
+func uniqueMessageIds(ctx context.Context, s *mongoStore) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "messageId", Value: bson.D{{Key: "$gt", Value: ""}}}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$messageId"},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$gt", Value: 1}}}}}},
+	}
+	cursor, err := s.collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var dup struct {
+			Ids []primitive.ObjectID `bson:"ids"`
+		}
+		if err := cursor.Decode(&dup); err != nil {
+			return err
+		}
+		//object ids grow with insertion time
+		sort.Slice(dup.Ids, func(i, j int) bool { return dup.Ids[i].Hex() < dup.Ids[j].Hex() })
+		filter := bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: dup.Ids[1:]}}}}
+		if _, err := s.collection.DeleteMany(ctx, filter); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	//the same keys can not be indexed twice
+	if err := dropIndex(ctx, s.collection, messageIdIndexName); err != nil {
+		return err
+	}
+	return ensureIndex(ctx, s.collection, mongo.IndexModel{
+		Keys: bson.D{{Key: "messageId", Value: 1}},
+		Options: options.Index().SetName(messageIdUniqueIndexName).SetUnique(true).
+			SetPartialFilterExpression(bson.D{{Key: "messageId", Value: bson.D{{Key: "$gt", Value: ""}}}}),
+	})
+}
+
+func ensureIndex(ctx context.Context, coll *mongo.Collection, model mongo.IndexModel) error {
+	_, err := coll.Indexes().CreateOne(ctx, model)
+	var cmdErr mongo.CommandError
+	if !errors.As(err, &cmdErr) || (cmdErr.Code != codeIndexOptionsConflict && cmdErr.Code != codeIndexKeySpecsConflict) {
+		return err
+	}
+	if err := dropIndex(ctx, coll, *model.Options.Name); err != nil {
+		return err
+	}
+	_, err = coll.Indexes().CreateOne(ctx, model)
+	return err
+}
+
+func dropIndex(ctx context.Context, coll *mongo.Collection, name string) error {
+	_, err := coll.Indexes().DropOne(ctx, name)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == codeIndexNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestMongoMigrations(t *testing.T) {
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		t.Skip("MONGO_URI not set")
+	}
+	store, err := NewMongoStore(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+	ctx := context.Background()
+
+	if _, err := store.MigrateTo(ctx, -1); err != nil {
+		t.Fatal(err)
+	}
+	//applying twice is a no-op
+	steps, err := store.MigrateTo(ctx, -1)
+	if err != nil || len(steps) != 0 {
+		t.Fatal("migrations ran again", steps, err)
+	}
+	steps, err = store.MigrateTo(ctx, LatestMigration()-1)
+	if err != nil || len(steps) != 1 || steps[0].Applied {
+		t.Fatal("last migration not reverted", steps, err)
+	}
+	states, err := store.Migrations(ctx)
+	if err != nil || states[len(states)-1].Applied {
+		t.Fatal("reverted migration still recorded", states, err)
+	}
+	if _, err := store.MigrateTo(ctx, LatestMigration()+1); err == nil {
+		t.Fatal("unknown version accepted")
+	}
+	if _, err := store.MigrateTo(ctx, -1); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"container/list"
+	"sync"
+)
+
+type recentTurns struct {
+	conversationId string
+	turns          []Message //oldest first
+}
+
+// recentCache keeps the last turns of the most recently active
+// conversations, so history survives a database outage.
+type recentCache struct {
+	lock             sync.Mutex
+	maxTurns         int
+	maxConversations int
+	ll               *list.List
+	items            map[string]*list.Element
+}
+
+func newRecentCache(maxTurns, maxConversations int) *recentCache {
+	return &recentCache{
+		maxTurns:         maxTurns,
+		maxConversations: maxConversations,
+		ll:               list.New(),
+		items:            make(map[string]*list.Element),
+	}
+}
+
+func (c *recentCache) Add(msg Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.items[msg.ConversationId]
+	if !ok {
+		elem = c.ll.PushFront(&recentTurns{conversationId: msg.ConversationId})
+		c.items[msg.ConversationId] = elem
+	} else {
+		c.ll.MoveToFront(elem)
+	}
+	conv := elem.Value.(*recentTurns)
+	conv.turns = append(conv.turns, msg)
+	if len(conv.turns) > c.maxTurns {
+		conv.turns = append(conv.turns[:0:0], conv.turns[len(conv.turns)-c.maxTurns:]...)
+	}
+	for c.ll.Len() > c.maxConversations {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*recentTurns).conversationId)
+	}
+}
+
+// Get returns at most limit turns started after startTime, newest first.
+func (c *recentCache) Get(conversationId string, startTime int64, limit int) []Message {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	msgLog := make([]Message, 0)
+	elem, ok := c.items[conversationId]
+	if !ok {
+		return msgLog
+	}
+	turns := elem.Value.(*recentTurns).turns
+	for i := len(turns) - 1; i >= 0 && len(msgLog) < limit; i-- {
+		if turns[i].StartTime > startTime {
+			msgLog = append(msgLog, turns[i])
+		}
+	}
+	return msgLog
+}
+
+func (c *recentCache) Delete(conversationId string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.items[conversationId]; ok {
+		c.ll.Remove(elem)
+		delete(c.items, conversationId)
+	}
+}
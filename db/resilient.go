@@ -0,0 +1,437 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"gateway/log"
+	"gateway/metrics"
+	"net"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+const (
+	DefaultWALPath             = "./data/conversation.wal"
+	DefaultWALMaxBytes         = 64 * 1024 * 1024
+	DefaultReconnectInterval   = 5
+	DefaultRecentTurns         = LimitConversactionMsg
+	DefaultRecentConversations = 10000
+	walReplayChunk             = 500
+)
+
+var ErrStoreUnavailable = errors.New("conversation store unavailable")
+
+// MessageFinder is implemented by stores that can tell which of many turns
+// they hold in one query.
+type MessageFinder interface {
+	StoredMessageIds(ctx context.Context, messageIds []string) (map[string]bool, error)
+}
+
+var (
+	dbHealthy     = metrics.NewGauge("gateway_db_healthy", "1 when the conversation store is reachable")
+	walPending    = metrics.NewGauge("gateway_db_wal_pending", "conversation turns buffered in the write-ahead log")
+	walDropped    = metrics.NewCounter("gateway_db_wal_dropped_total", "conversation turns dropped because the write-ahead log was full")
+	walReplayed   = metrics.NewCounter("gateway_db_wal_replayed_total", "conversation turns replayed from the write-ahead log")
+	historyCached = metrics.NewCounter("gateway_db_history_fallback_total", "history lookups served from the recent turns cache")
+)
+
+// DegradedConfig controls how the gateway keeps serving while the database
+// is down. Intervals are in seconds.
+type DegradedConfig struct {
+	Enable              bool   `yaml:"enable"`
+	WALPath             string `yaml:"wal_path"`
+	WALMaxBytes         int64  `yaml:"wal_max_bytes"`
+	ReconnectInterval   int    `yaml:"reconnect_interval"`
+	RecentTurns         int    `yaml:"recent_turns"`
+	RecentConversations int    `yaml:"recent_conversations"`
+}
+
+func (conf DegradedConfig) withDefaults() DegradedConfig {
+	if conf.WALPath == "" {
+		conf.WALPath = DefaultWALPath
+	}
+	if conf.WALMaxBytes <= 0 {
+		conf.WALMaxBytes = DefaultWALMaxBytes
+	}
+	if conf.ReconnectInterval <= 0 {
+		conf.ReconnectInterval = DefaultReconnectInterval
+	}
+	if conf.RecentTurns <= 0 {
+		conf.RecentTurns = DefaultRecentTurns
+	}
+	if conf.RecentConversations <= 0 {
+		conf.RecentConversations = DefaultRecentConversations
+	}
+	return conf
+}
+
+// Health is the state of the conversation store reported by readiness.
+type Health struct {
+	Backend       string `json:"backend"`
+	Healthy       bool   `json:"healthy"`
+	Degraded      bool   `json:"degraded"`
+	DownSince     int64  `json:"downSince,omitempty"`
+	LastError     string `json:"lastError,omitempty"`
+	PendingWrites int64  `json:"pendingWrites"`
+	WALBytes      int64  `json:"walBytes"`
+}
+
+// resilientStore keeps serving while the wrapped store is unreachable.
+// Writes go to a write-ahead log and are replayed on reconnect, history is
+// read from a cache of recent turns.
+type resilientStore struct {
+	backend   string
+	connect   func() (ConversationStore, error)
+	conf      DegradedConfig
+	wal       *writeAheadLog
+	recent    *recentCache
+	lock      sync.RWMutex
+	store     ConversationStore
+	healthy   bool
+	downSince time.Time
+	lastErr   error
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func newResilientStore(backend string, conf DegradedConfig, connect func() (ConversationStore, error)) (*resilientStore, error) {
+	conf = conf.withDefaults()
+	wal, err := openWriteAheadLog(conf.WALPath, conf.WALMaxBytes)
+	if err != nil {
+		return nil, err
+	}
+	s := &resilientStore{
+		backend: backend,
+		connect: connect,
+		conf:    conf,
+		wal:     wal,
+		recent:  newRecentCache(conf.RecentTurns, conf.RecentConversations),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	store, err := connect()
+	if err != nil {
+		log.Error("conversation store down, start in degraded mode", err)
+		s.markDown(err)
+	} else {
+		s.store = store
+		s.healthy = true
+		dbHealthy.Set(1)
+		s.replay()
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *resilientStore) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(time.Second * time.Duration(s.conf.ReconnectInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.check()
+		}
+	}
+}
+
+// check reconnects or pings the store and replays buffered writes once it
+// is back.
+func (s *resilientStore) check() {
+	s.lock.RLock()
+	store := s.store
+	s.lock.RUnlock()
+	if store == nil {
+		newStore, err := s.connect()
+		if err != nil {
+			s.markDown(err)
+			return
+		}
+		s.lock.Lock()
+		s.store = newStore
+		s.lock.Unlock()
+		store = newStore
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(s.conf.ReconnectInterval))
+	defer cancel()
+	if err := store.Ping(ctx); err != nil {
+		s.markDown(err)
+		return
+	}
+	s.markUp()
+	s.replay()
+}
+
+func (s *resilientStore) replay() {
+	store := s.current()
+	if store == nil {
+		return
+	}
+	n, err := s.wal.Replay(walReplayChunk, func(msgs []Message) error {
+		//every chunk gets its own timeout, a long backlog must not run out of
+		//time and look like the store went away
+		ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+		defer cancel()
+		msgs, err := replayable(ctx, store, msgs)
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			return nil
+		}
+		if err := store.InsertConversations(ctx, msgs); err != nil {
+			if unreachable(err) {
+				return err
+			}
+			//one bad turn must not hold back the others
+			log.Warn("replay write-ahead log batch error, insert one by one", err)
+			if msgs, err = insertEach(ctx, store, msgs); err != nil {
+				return err
+			}
+		}
+		//turns that went to the log were not metered when written
+		if err := recordUsage(ctx, store, msgs); err != nil {
+			log.Warn("meter replayed turns error", err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("replay write-ahead log error", err)
+		if unreachable(err) {
+			s.markDown(err)
+		}
+	}
+	if n > 0 {
+		log.Info("replayed conversation turns from write-ahead log", n)
+		walReplayed.Add(float64(n))
+	}
+	count, _ := s.wal.Stat()
+	walPending.Set(float64(count))
+}
+
+// replayable drops the logged turns that are already stored, a write that
+// failed midway may have landed part of its batch.
+func replayable(ctx context.Context, store ConversationStore, msgs []Message) ([]Message, error) {
+	ids := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.MessageId != "" {
+			ids = append(ids, msg.MessageId)
+		}
+	}
+	stored, err := storedMessageIds(ctx, store, ids)
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if !stored[msg.MessageId] {
+			pending = append(pending, msg)
+		}
+	}
+	return pending, nil
+}
+
+// storedMessageIds returns which of messageIds are stored, in one query
+// where the store can look up many turns at once.
+func storedMessageIds(ctx context.Context, store ConversationStore, messageIds []string) (map[string]bool, error) {
+	finder, err := capability[MessageFinder](store, nil)
+	if err != nil {
+		return nil, err
+	}
+	if finder != nil {
+		return finder.StoredMessageIds(ctx, messageIds)
+	}
+	stored := make(map[string]bool, len(messageIds))
+	for _, id := range messageIds {
+		_, err := store.GetMessage(ctx, id)
+		if err == nil {
+			stored[id] = true
+		} else if !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+	}
+	return stored, nil
+}
+
+// insertEach inserts msgs one at a time and returns the ones stored. Turns
+// the store refuses are logged and dropped.
+func insertEach(ctx context.Context, store ConversationStore, msgs []Message) ([]Message, error) {
+	inserted := make([]Message, 0, len(msgs))
+	for _, msg := range msgs {
+		err := store.InsertConversation(ctx, msg)
+		if err == nil {
+			inserted = append(inserted, msg)
+			continue
+		}
+		if unreachable(err) {
+			return nil, err
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			log.Error("drop write-ahead log turn", msg.ConversationId, msg.MessageId, err)
+		}
+	}
+	return inserted, nil
+}
+
+// unreachable tells whether err means the store could not be reached, as
+// opposed to the store refusing the call. Only the former degrades it.
+func unreachable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrStoreUnavailable) || mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	var serverErr topology.ServerSelectionError
+	if errors.As(err, &serverErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func (s *resilientStore) markDown(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.healthy || s.downSince.IsZero() {
+		log.Warn("conversation store down", err)
+		s.downSince = time.Now()
+	}
+	s.healthy = false
+	s.lastErr = err
+	dbHealthy.Set(0)
+}
+
+func (s *resilientStore) markUp() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.healthy {
+		log.Info("conversation store back after", time.Since(s.downSince))
+	}
+	s.healthy = true
+	s.downSince = time.Time{}
+	s.lastErr = nil
+	dbHealthy.Set(1)
+}
+
+// current returns the wrapped store if it is healthy, nil otherwise.
+func (s *resilientStore) current() ConversationStore {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if !s.healthy {
+		return nil
+	}
+	return s.store
+}
+
+func (s *resilientStore) Unwrap() ConversationStore {
+	return s.current()
+}
+
+func (s *resilientStore) InsertConversation(ctx context.Context, msg Message) error {
+	return s.InsertConversations(ctx, []Message{msg})
+}
+
+func (s *resilientStore) InsertConversations(ctx context.Context, msgs []Message) error {
+	for _, msg := range msgs {
+		s.recent.Add(msg)
+	}
+	if store := s.current(); store != nil {
+		err := store.InsertConversations(ctx, msgs)
+		if !unreachable(err) {
+			return err
+		}
+		s.markDown(err)
+	}
+	err := s.wal.Append(msgs...)
+	if err == ErrWALFull {
+		walDropped.Add(float64(len(msgs)))
+	}
+	count, _ := s.wal.Stat()
+	walPending.Set(float64(count))
+	return err
+}
+
+func (s *resilientStore) GetRecentConversation(ctx context.Context, conversationId string, startTime int64, limit int) ([]Message, error) {
+	if conversationId == "" {
+		return nil, ErrConversationIdEmpty
+	}
+	if store := s.current(); store != nil {
+		msgLog, err := store.GetRecentConversation(ctx, conversationId, startTime, limit)
+		if !unreachable(err) {
+			return msgLog, err
+		}
+		s.markDown(err)
+	}
+	historyCached.Inc()
+	return s.recent.Get(conversationId, startTime, limit), nil
+}
+
+func (s *resilientStore) GetConversation(ctx context.Context, conversationId string) ([]Message, error) {
+	store := s.current()
+	if store == nil {
+		return nil, ErrStoreUnavailable
+	}
+	return store.GetConversation(ctx, conversationId)
+}
+
+func (s *resilientStore) GetMessage(ctx context.Context, messageId string) (*Message, error) {
+	store := s.current()
+	if store == nil {
+		return nil, ErrStoreUnavailable
+	}
+	return store.GetMessage(ctx, messageId)
+}
+
+func (s *resilientStore) DeleteConversation(ctx context.Context, conversationId string) error {
+	s.recent.Delete(conversationId)
+	store := s.current()
+	if store == nil {
+		return ErrStoreUnavailable
+	}
+	return store.DeleteConversation(ctx, conversationId)
+}
+
+func (s *resilientStore) Ping(ctx context.Context) error {
+	store := s.current()
+	if store == nil {
+		return ErrStoreUnavailable
+	}
+	return store.Ping(ctx)
+}
+
+func (s *resilientStore) Close(ctx context.Context) error {
+	close(s.stop)
+	<-s.done
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.store == nil {
+		return nil
+	}
+	return s.store.Close(ctx)
+}
+
+func (s *resilientStore) Health() Health {
+	count, size := s.wal.Stat()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	h := Health{
+		Backend:       s.backend,
+		Healthy:       s.healthy,
+		Degraded:      !s.healthy || count > 0,
+		PendingWrites: count,
+		WALBytes:      size,
+	}
+	if !s.downSince.IsZero() {
+		h.DownSince = s.downSince.Unix()
+	}
+	if s.lastErr != nil {
+		h.LastError = s.lastErr.Error()
+	}
+	return h
+}
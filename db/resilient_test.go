@@ -0,0 +1,217 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errFlakyDown = fmt.Errorf("flaky store down: %w", ErrStoreUnavailable)
+
+// flakyStore is a memory store that can be switched off.
+type flakyStore struct {
+	*memoryStore
+	lock   sync.Mutex
+	down   bool
+	refuse error //returned by inserts while up
+}
+
+func (s *flakyStore) setDown(down bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.down = down
+}
+
+func (s *flakyStore) isDown() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.down
+}
+
+func (s *flakyStore) InsertConversations(ctx context.Context, msgs []Message) error {
+	if s.isDown() {
+		return errFlakyDown
+	}
+	s.lock.Lock()
+	refuse := s.refuse
+	s.lock.Unlock()
+	if refuse != nil {
+		return refuse
+	}
+	return s.memoryStore.InsertConversations(ctx, msgs)
+}
+
+func (s *flakyStore) Ping(ctx context.Context) error {
+	if s.isDown() {
+		return errFlakyDown
+	}
+	return nil
+}
+
+func TestResilientStore(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyStore{memoryStore: NewMemoryStore(), down: true}
+	conf := DegradedConfig{
+		WALPath:           filepath.Join(t.TempDir(), "conversation.wal"),
+		ReconnectInterval: 3600,
+	}
+	store, err := newResilientStore(BackendMongo, conf, func() (ConversationStore, error) {
+		if flaky.isDown() {
+			return nil, errFlakyDown
+		}
+		return flaky, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(ctx)
+	if store.Health().Healthy {
+		t.Fatal("store should start degraded")
+	}
+
+	now := time.Now().Unix()
+	for i, id := range []string{"m1", "m2"} {
+		msg := Message{ConversationId: "c", MessageId: id, StartTime: now + int64(i)}
+		if err := store.InsertConversation(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h := store.Health(); h.PendingWrites != 2 {
+		t.Fatalf("expected 2 buffered writes, got %+v", h)
+	}
+	msgLog, err := store.GetRecentConversation(ctx, "c", now-1, LimitConversactionMsg)
+	if err != nil || len(msgLog) != 2 || msgLog[0].MessageId != "m2" {
+		t.Fatalf("history not served from recent turns: %v %v", msgLog, err)
+	}
+
+	//the first turn landed before the write failed
+	flaky.memoryStore.InsertConversation(ctx, Message{ConversationId: "c", MessageId: "m1", StartTime: now})
+	flaky.setDown(false)
+	store.check()
+	if h := store.Health(); !h.Healthy || h.PendingWrites != 0 {
+		t.Fatalf("store not recovered: %+v", h)
+	}
+	all, err := flaky.GetConversation(ctx, "c")
+	if err != nil || len(all) != 2 {
+		t.Fatalf("buffered writes not replayed: %v %v", all, err)
+	}
+
+	//a refused write is returned, it does not degrade the store
+	flaky.lock.Lock()
+	flaky.refuse = errors.New("invalid turn")
+	flaky.lock.Unlock()
+	if err := store.InsertConversation(ctx, Message{ConversationId: "c", MessageId: "m3"}); err == nil {
+		t.Fatal("refused write accepted")
+	}
+	if h := store.Health(); !h.Healthy || h.PendingWrites != 0 {
+		t.Fatalf("refused write degraded the store: %+v", h)
+	}
+}
+
+func TestWriteAheadLogBound(t *testing.T) {
+	msg := Message{ConversationId: "c", MessageId: "m1"}
+	line, _ := json.Marshal(&msg)
+	//room for one and a half turns
+	wal, err := openWriteAheadLog(filepath.Join(t.TempDir(), "conversation.wal"), int64(len(line)*3/2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Append(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Append(Message{ConversationId: "c", MessageId: "m2"}); err != ErrWALFull {
+		t.Fatal("write over the bound accepted", err)
+	}
+}
+
+func TestWriteAheadLogChunks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversation.wal")
+	wal, err := openWriteAheadLog(path, DefaultWALMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"m1", "m2", "m3", "m4", "m5"} {
+		if err := wal.Append(Message{ConversationId: "c", MessageId: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chunks := 0
+	n, err := wal.Replay(2, func(msgs []Message) error {
+		//the log stays usable while a chunk is written
+		if count, _ := wal.Stat(); count == 0 {
+			t.Fatal("log emptied before the chunk was written")
+		}
+		if chunks++; chunks == 2 {
+			return errFlakyDown
+		}
+		return nil
+	})
+	if n != 2 || err != errFlakyDown {
+		t.Fatal("first chunk not replayed alone", n, err)
+	}
+	//replayed chunks stay dropped after a restart
+	wal, err = openWriteAheadLog(path, DefaultWALMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := wal.Stat(); count != 3 {
+		t.Fatal("replayed turns left in the log", count)
+	}
+	if err := wal.Append(Message{ConversationId: "c", MessageId: "m6"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0)
+	n, err = wal.Replay(2, func(msgs []Message) error {
+		for _, msg := range msgs {
+			ids = append(ids, msg.MessageId)
+		}
+		return nil
+	})
+	if err != nil || n != 4 || strings.Join(ids, ",") != "m3,m4,m5,m6" {
+		t.Fatal("remaining turns not replayed in order", n, ids, err)
+	}
+	if count, size := wal.Stat(); count != 0 || size != 0 {
+		t.Fatal("drained log not emptied", count, size)
+	}
+}
+
+func TestCapabilityChain(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv(DefaultKeyEnv, testKey(t, "k1"))
+	flaky := &flakyStore{memoryStore: NewMemoryStore()}
+	conf := DegradedConfig{WALPath: filepath.Join(t.TempDir(), "conversation.wal"), ReconnectInterval: 3600}
+	resilient, err := newResilientStore(BackendMongo, conf, func() (ConversationStore, error) { return flaky, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resilient.Close(ctx)
+	enc, err := newEncryptedStore(resilient, EncryptionConfig{Enable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := Store
+	Store = enc
+	defer func() { Store = prev }()
+
+	//capabilities the wrappers leave alone reach the inner store
+	if _, _, err := CreateAPIKey(ctx, APIKey{}); err != nil {
+		t.Fatal("api keys not found through wrappers", err)
+	}
+	//the ones they change stop at the wrapper
+	if share, err := capability[ShareStore](Store, ErrShareUnsupported); err != nil || share != ShareStore(enc) {
+		t.Fatal("shares skip the encryption", err)
+	}
+	if _, err := StoreMigrator(); err != ErrMigrationsUnsupported {
+		t.Fatal("memory store has migrations", err)
+	}
+	resilient.markDown(errFlakyDown)
+	if _, err := ListAPIKeys(ctx); err != ErrStoreUnavailable {
+		t.Fatal("unreachable store not reported", err)
+	}
+}
@@ -0,0 +1,273 @@
+package db
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gateway/log"
+	"gateway/metrics"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DefaultPurgeInterval  = 3600
+	DefaultPurgeBatchSize = 1000
+	secondsPerDay         = 24 * 60 * 60
+)
+
+var purgedMessages = metrics.NewCounter("gateway_db_purged_total", "conversation turns removed by retention", "model")
+
+// Purger is implemented by stores that support retention purges.
+type Purger interface {
+	// ScanBefore hands fn batches of turns started before the unix second.
+	ScanBefore(ctx context.Context, before int64, batchSize int, fn func([]Message) error) error
+	DeleteMessages(ctx context.Context, messageIds []string) error
+}
+
+// TTLIndexer is implemented by stores that can expire turns by themselves.
+// A zero ttl removes the index.
+type TTLIndexer interface {
+	EnsureTTLIndex(ctx context.Context, ttl time.Duration) error
+}
+
+// RetentionRule keeps turns matching model and tenant for Days days, empty
+// fields match anything and zero days keeps turns forever.
+type RetentionRule struct {
+	Model  string `yaml:"model" json:"model,omitempty"`
+	Tenant string `yaml:"tenant" json:"tenant,omitempty"`
+	Days   int    `yaml:"days" json:"days"`
+}
+
+type RetentionConfig struct {
+	Enable      bool            `yaml:"enable"`
+	Interval    int             `yaml:"interval"`     //seconds between purges
+	DefaultDays int             `yaml:"default_days"` //for turns no rule matches
+	Rules       []RetentionRule `yaml:"rules"`
+	ArchiveDir  string          `yaml:"archive_dir"` //archive purged turns when set
+	UseTTLIndex bool            `yaml:"use_ttl_index"`
+	DryRun      bool            `yaml:"dry_run"`
+	BatchSize   int             `yaml:"batch_size"`
+}
+
+// RuleFor returns the most specific rule for msg, model and tenant together
+// beat either alone.
+func (conf RetentionConfig) RuleFor(msg Message) RetentionRule {
+	best := RetentionRule{Days: conf.DefaultDays}
+	bestScore := -1
+	for _, rule := range conf.Rules {
+		if (rule.Model != "" && rule.Model != msg.Model) || (rule.Tenant != "" && rule.Tenant != msg.Tenant) {
+			continue
+		}
+		score := 0
+		if rule.Model != "" {
+			score += 1
+		}
+		if rule.Tenant != "" {
+			score += 2
+		}
+		if score > bestScore {
+			best, bestScore = rule, score
+		}
+	}
+	return best
+}
+
+// ttl is the retention a store side ttl index may enforce, the longest of
+// all rules so no rule loses turns early. Zero when a ttl index can not be
+// used.
+func (conf RetentionConfig) ttl() time.Duration {
+	if !conf.UseTTLIndex || conf.ArchiveDir != "" {
+		return 0
+	}
+	longest := conf.DefaultDays
+	for _, rule := range conf.Rules {
+		if rule.Days <= 0 || longest <= 0 {
+			return 0
+		}
+		if rule.Days > longest {
+			longest = rule.Days
+		}
+	}
+	return time.Duration(longest) * secondsPerDay * time.Second
+}
+
+// shortest is the smallest positive retention in days, 0 if turns are kept
+// forever.
+func (conf RetentionConfig) shortest() int {
+	shortest := conf.DefaultDays
+	for _, rule := range conf.Rules {
+		if rule.Days > 0 && (shortest <= 0 || rule.Days < shortest) {
+			shortest = rule.Days
+		}
+	}
+	return shortest
+}
+
+type PurgedMessage struct {
+	MessageId      string `json:"messageId"`
+	ConversationId string `json:"conversationId"`
+	StartTime      int64  `json:"startTime"`
+}
+
+type RuleReport struct {
+	Rule     RetentionRule   `json:"rule"`
+	Cutoff   int64           `json:"cutoff"`
+	Count    int             `json:"count"`
+	Messages []PurgedMessage `json:"messages,omitempty"` //listed on dry runs
+}
+
+type PurgeReport struct {
+	StartTime int64         `json:"startTime"`
+	DryRun    bool          `json:"dryRun"`
+	Total     int           `json:"total"`
+	Archive   string        `json:"archive,omitempty"`
+	Rules     []*RuleReport `json:"rules"`
+}
+
+func (r *PurgeReport) ruleReport(rule RetentionRule, cutoff int64) *RuleReport {
+	for _, rr := range r.Rules {
+		if rr.Rule == rule {
+			return rr
+		}
+	}
+	rr := &RuleReport{Rule: rule, Cutoff: cutoff}
+	r.Rules = append(r.Rules, rr)
+	return rr
+}
+
+// Purge removes turns older than their retention rule, archiving them first
+// when an archive dir is set. A dry run only reports what would go.
+func Purge(ctx context.Context, store ConversationStore, conf RetentionConfig, dryRun bool) (*PurgeReport, error) {
+	now := time.Now()
+	report := &PurgeReport{StartTime: now.Unix(), DryRun: dryRun, Rules: make([]*RuleReport, 0)}
+	shortest := conf.shortest()
+	if shortest <= 0 {
+		return report, nil
+	}
+	purger, err := capability[Purger](store, fmt.Errorf("store %T does not support purges", store))
+	if err != nil {
+		return nil, err
+	}
+	batchSize := conf.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultPurgeBatchSize
+	}
+	var archive *archiveWriter
+	if conf.ArchiveDir != "" && !dryRun {
+		archive = &archiveWriter{path: filepath.Join(conf.ArchiveDir, fmt.Sprintf("conversation-%s.jsonl.gz", now.Format("20060102-150405")))}
+		defer archive.Close()
+	}
+	before := now.Unix() - int64(shortest)*secondsPerDay
+	err = purger.ScanBefore(ctx, before, batchSize, func(msgs []Message) error {
+		expired := make([]Message, 0)
+		for _, msg := range msgs {
+			rule := conf.RuleFor(msg)
+			if rule.Days <= 0 {
+				continue
+			}
+			cutoff := now.Unix() - int64(rule.Days)*secondsPerDay
+			if msg.StartTime >= cutoff {
+				continue
+			}
+			rr := report.ruleReport(rule, cutoff)
+			rr.Count++
+			if dryRun {
+				rr.Messages = append(rr.Messages, PurgedMessage{msg.MessageId, msg.ConversationId, msg.StartTime})
+			}
+			expired = append(expired, msg)
+		}
+		report.Total += len(expired)
+		if dryRun || len(expired) == 0 {
+			return nil
+		}
+		if archive != nil {
+			if err := archive.Write(expired); err != nil {
+				return err
+			}
+			report.Archive = archive.path
+		}
+		ids := make([]string, 0, len(expired))
+		for _, msg := range expired {
+			ids = append(ids, msg.MessageId)
+			purgedMessages.Inc(msg.Model)
+		}
+		return purger.DeleteMessages(ctx, ids)
+	})
+	return report, err
+}
+
+// archiveWriter appends purged turns to a gzip compressed JSON lines file.
+type archiveWriter struct {
+	path string
+	file *os.File
+	gz   *gzip.Writer
+}
+
+func (a *archiveWriter) Write(msgs []Message) error {
+	if a.file == nil {
+		if err := os.MkdirAll(filepath.Dir(a.path), 0777); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		a.file = f
+		a.gz = gzip.NewWriter(f)
+	}
+	enc := json.NewEncoder(a.gz)
+	for i := range msgs {
+		if err := enc.Encode(&msgs[i]); err != nil {
+			return err
+		}
+	}
+	//the batch must be on disk before it is deleted
+	if err := a.gz.Flush(); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+func (a *archiveWriter) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	a.gz.Close()
+	return a.file.Close()
+}
+
+// StartRetention applies the ttl index and runs purges every interval.
+func StartRetention(conf RetentionConfig) {
+	if !conf.Enable {
+		return
+	}
+	indexer, err := capability[TTLIndexer](Store, nil)
+	if indexer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+		err = indexer.EnsureTTLIndex(ctx, conf.ttl())
+		cancel()
+	}
+	if err != nil {
+		log.Error("ensure retention ttl index error", err)
+	}
+	interval := conf.Interval
+	if interval <= 0 {
+		interval = DefaultPurgeInterval
+	}
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(interval))
+			report, err := Purge(ctx, Store, conf, conf.DryRun)
+			cancel()
+			if err != nil {
+				log.Error("retention purge error", err)
+			} else if report.Total > 0 {
+				log.Info(fmt.Sprintf("retention purge dryRun:%v removed:%d archive:%s", report.DryRun, report.Total, report.Archive))
+			}
+			time.Sleep(time.Second * time.Duration(interval))
+		}
+	}()
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetentionRuleFor(t *testing.T) {
+	conf := RetentionConfig{
+		DefaultDays: 30,
+		Rules: []RetentionRule{
+			{Model: "self-driving-v1", Days: 90},
+			{Tenant: "team-a", Days: 180},
+			{Model: "self-driving-v1", Tenant: "team-a", Days: 365},
+		},
+	}
+	cases := []struct {
+		msg  Message
+		days int
+	}{
+		{Message{Model: "gpt"}, 30},
+		{Message{Model: "self-driving-v1"}, 90},
+		{Message{Model: "gpt", Tenant: "team-a"}, 180},
+		{Message{Model: "self-driving-v1", Tenant: "team-a"}, 365},
+	}
+	for _, c := range cases {
+		if rule := conf.RuleFor(c.msg); rule.Days != c.days {
+			t.Fatalf("%+v: got %d days, want %d", c.msg, rule.Days, c.days)
+		}
+	}
+	if conf.ttl() != 0 {
+		t.Fatal("ttl index used without use_ttl_index")
+	}
+	conf.UseTTLIndex = true
+	if conf.ttl() != 365*24*time.Hour {
+		t.Fatal("ttl index should cover the longest rule", conf.ttl())
+	}
+}
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	day := int64(secondsPerDay)
+	now := time.Now().Unix()
+	store.InsertConversations(ctx, []Message{
+		{ConversationId: "c1", MessageId: "old-gpt", Model: "gpt", StartTime: now - 40*day},
+		{ConversationId: "c1", MessageId: "new-gpt", Model: "gpt", StartTime: now - day},
+		{ConversationId: "c2", MessageId: "old-sd", Model: "self-driving-v1", StartTime: now - 40*day},
+		{ConversationId: "c3", MessageId: "ancient-sd", Model: "self-driving-v1", StartTime: now - 100*day},
+	})
+	conf := RetentionConfig{
+		DefaultDays: 30,
+		Rules:       []RetentionRule{{Model: "self-driving-v1", Days: 90}},
+		ArchiveDir:  t.TempDir(),
+	}
+
+	report, err := Purge(ctx, store, conf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 2 || len(report.Rules) != 2 {
+		t.Fatalf("unexpected dry run report %+v", report)
+	}
+	if _, err := store.GetMessage(ctx, "old-gpt"); err != nil {
+		t.Fatal("dry run deleted a turn")
+	}
+
+	report, err = Purge(ctx, store, conf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"old-gpt", "ancient-sd"} {
+		if _, err := store.GetMessage(ctx, id); err != ErrNotFound {
+			t.Fatal("expired turn kept", id)
+		}
+	}
+	for _, id := range []string{"new-gpt", "old-sd"} {
+		if _, err := store.GetMessage(ctx, id); err != nil {
+			t.Fatal("turn within retention purged", id)
+		}
+	}
+
+	f, err := os.Open(report.Archive)
+	if err != nil {
+		t.Fatal("archive missing", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	for scanner := bufio.NewScanner(gz); scanner.Scan(); {
+		lines++
+	}
+	if lines != 2 {
+		t.Fatalf("expected 2 archived turns, got %d", lines)
+	}
+}
@@ -0,0 +1,313 @@
+package db
+
+import (
+	"context"
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	DefaultSearchPageSize = 20
+	MaxSearchPageSize     = 100
+	maxSnippets           = 3
+	snippetContext        = 40 //runes around a match
+)
+
+// Searcher is implemented by stores that can search the stored prompts and
+// answers.
+type Searcher interface {
+	Search(ctx context.Context, q SearchQuery) (*SearchResult, error)
+}
+
+// SearchQuery selects turns whose prompt or answer contains every word of
+// Text. Filters left empty match everything, From and To are unix seconds
+// and To is exclusive. Without Text the newest turns come first.
+type SearchQuery struct {
+	Text      string `json:"q"`
+	Model     string `json:"model"`
+	From      int64  `json:"from"`
+	To        int64  `json:"to"`
+	UserId    string `json:"user"`
+	SessionId string `json:"session"`
+	Url       string `json:"url"`
+	Page      int    `json:"page"` //from 1
+	PageSize  int    `json:"pageSize"`
+}
+
+type SearchResult struct {
+	Total    int         `json:"total"`
+	Page     int         `json:"page"`
+	PageSize int         `json:"pageSize"`
+	Hits     []SearchHit `json:"hits"`
+}
+
+type SearchHit struct {
+	Message  Message   `json:"message"`
+	Score    float64   `json:"score"`
+	Snippets []Snippet `json:"snippets,omitempty"`
+}
+
+// Snippet is an html escaped excerpt of a field with matches in <em>.
+type Snippet struct {
+	Field string `json:"field"` //prompt or text
+	Text  string `json:"text"`
+}
+
+func (q SearchQuery) withDefaults() SearchQuery {
+	if q.Page <= 0 {
+		q.Page = 1
+	}
+	if q.PageSize <= 0 {
+		q.PageSize = DefaultSearchPageSize
+	}
+	if q.PageSize > MaxSearchPageSize {
+		q.PageSize = MaxSearchPageSize
+	}
+	return q
+}
+
+func (q SearchQuery) skip() int {
+	return (q.Page - 1) * q.PageSize
+}
+
+// matches applies the filters, not the text.
+func (q SearchQuery) matches(msg *Message) bool {
+	switch {
+	case q.Model != "" && msg.Model != q.Model:
+		return false
+	case q.Url != "" && msg.Url != q.Url:
+		return false
+	case q.UserId != "" && msg.UserId != q.UserId:
+		return false
+	case q.SessionId != "" && msg.SessionId != q.SessionId:
+		return false
+	case q.From > 0 && msg.StartTime < q.From:
+		return false
+	case q.To > 0 && msg.StartTime >= q.To:
+		return false
+	}
+	return true
+}
+
+func isIdeograph(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+func isWordRune(r rune) bool {
+	return (unicode.IsLetter(r) || unicode.IsDigit(r)) && !isIdeograph(r)
+}
+
+// tokenize lowercases text into words. Ideographic scripts have no word
+// separators, every character is a token of its own.
+func tokenize(text string) []string {
+	tokens := make([]string, 0)
+	word := make([]rune, 0)
+	flush := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+	}
+	for _, r := range text {
+		r = unicode.ToLower(r)
+		switch {
+		case isIdeograph(r):
+			flush()
+			tokens = append(tokens, string(r))
+		case isWordRune(r):
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+// searchTerms are the distinct tokens of a query.
+func searchTerms(text string) []string {
+	seen := make(map[string]bool)
+	terms := make([]string, 0)
+	for _, token := range tokenize(text) {
+		if !seen[token] {
+			seen[token] = true
+			terms = append(terms, token)
+		}
+	}
+	return terms
+}
+
+// termCounts counts the tokens of a turn, for the inverted indexes.
+func termCounts(msg *Message) map[string]int {
+	counts := make(map[string]int)
+	for _, token := range tokenize(msg.Prompt) {
+		counts[token]++
+	}
+	for _, token := range tokenize(msg.Text) {
+		counts[token]++
+	}
+	return counts
+}
+
+// intersectPostings returns the messages containing every term, scored by
+// the total count of the terms.
+func intersectPostings(terms []string, postings func(term string) map[string]int) map[string]float64 {
+	lists := make([]map[string]int, 0, len(terms))
+	for _, term := range terms {
+		list := postings(term)
+		if len(list) == 0 {
+			return nil
+		}
+		lists = append(lists, list)
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	scores := make(map[string]float64)
+next:
+	for messageId := range lists[0] {
+		score := 0
+		for _, list := range lists {
+			n, ok := list[messageId]
+			if !ok {
+				continue next
+			}
+			score += n
+		}
+		scores[messageId] = float64(score)
+	}
+	return scores
+}
+
+// rankHits orders the matching turns, keeps the requested page and adds the
+// snippets of the kept hits.
+func rankHits(hits []SearchHit, q SearchQuery, terms []string) *SearchResult {
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		if hits[i].Message.StartTime != hits[j].Message.StartTime {
+			return hits[i].Message.StartTime > hits[j].Message.StartTime
+		}
+		return hits[i].Message.Seq > hits[j].Message.Seq
+	})
+	result := &SearchResult{Total: len(hits), Page: q.Page, PageSize: q.PageSize, Hits: []SearchHit{}}
+	if q.skip() >= len(hits) {
+		return result
+	}
+	end := q.skip() + q.PageSize
+	if end > len(hits) {
+		end = len(hits)
+	}
+	result.Hits = hits[q.skip():end]
+	addSnippets(result.Hits, terms)
+	return result
+}
+
+func addSnippets(hits []SearchHit, terms []string) {
+	if len(terms) == 0 {
+		return
+	}
+	for i := range hits {
+		hits[i].Snippets = append(snippets("prompt", hits[i].Message.Prompt, terms), snippets("text", hits[i].Message.Text, terms)...)
+		if len(hits[i].Snippets) > maxSnippets {
+			hits[i].Snippets = hits[i].Snippets[:maxSnippets]
+		}
+	}
+}
+
+type span struct {
+	start, end int
+}
+
+// matchSpans finds the whole-token occurrences of terms in text, in rune
+// offsets.
+func matchSpans(text []rune, terms []string) []span {
+	lower := make([]rune, len(text))
+	for i, r := range text {
+		lower[i] = unicode.ToLower(r)
+	}
+	spans := make([]span, 0)
+	for _, term := range terms {
+		pattern := []rune(term)
+		for i := 0; i+len(pattern) <= len(lower); i++ {
+			if string(lower[i:i+len(pattern)]) != term {
+				continue
+			}
+			if isWordRune(pattern[0]) {
+				if i > 0 && isWordRune(lower[i-1]) {
+					continue
+				}
+				if end := i + len(pattern); end < len(lower) && isWordRune(lower[end]) {
+					continue
+				}
+			}
+			spans = append(spans, span{i, i + len(pattern)})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	//merge adjacent matches, e.g. consecutive ideographs of one word
+	merged := make([]span, 0, len(spans))
+	for _, sp := range spans {
+		if n := len(merged); n > 0 && sp.start <= merged[n-1].end {
+			if sp.end > merged[n-1].end {
+				merged[n-1].end = sp.end
+			}
+			continue
+		}
+		merged = append(merged, sp)
+	}
+	return merged
+}
+
+func snippets(field, text string, terms []string) []Snippet {
+	runes := []rune(text)
+	spans := matchSpans(runes, terms)
+	result := make([]Snippet, 0)
+	for i := 0; i < len(spans) && len(result) < maxSnippets; {
+		start := spans[i].start - snippetContext
+		if start < 0 {
+			start = 0
+		}
+		end := spans[i].end + snippetContext
+		//take the following matches that fall into the window
+		j := i
+		for j+1 < len(spans) && spans[j+1].start < end {
+			j++
+			if spans[j].end+snippetContext > end {
+				end = spans[j].end + snippetContext
+			}
+		}
+		if end > len(runes) {
+			end = len(runes)
+		}
+		var b strings.Builder
+		if start > 0 {
+			b.WriteString("…")
+		}
+		pos := start
+		for _, sp := range spans[i : j+1] {
+			b.WriteString(html.EscapeString(string(runes[pos:sp.start])))
+			b.WriteString("<em>")
+			b.WriteString(html.EscapeString(string(runes[sp.start:sp.end])))
+			b.WriteString("</em>")
+			pos = sp.end
+		}
+		b.WriteString(html.EscapeString(string(runes[pos:end])))
+		if end < len(runes) {
+			b.WriteString("…")
+		}
+		result = append(result, Snippet{Field: field, Text: b.String()})
+		i = j + 1
+	}
+	return result
+}
+
+// Search runs q on the conversation store.
+func Search(ctx context.Context, q SearchQuery) (*SearchResult, error) {
+	searcher, err := capability[Searcher](Store, ErrSearchUnsupported)
+	if err != nil {
+		return nil, err
+	}
+	return searcher.Search(ctx, q.withDefaults())
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	msgs := []Message{
+		{ConversationId: "c1", MessageId: "s1", Prompt: "How does lane keeping work?", Text: "Lane keeping steers back when the car drifts.", Model: "m1", SessionId: "sess1", StartTime: now - 100},
+		{ConversationId: "c1", MessageId: "s2", Prompt: "And adaptive cruise?", Text: "It keeps distance, not the lane.", Model: "m1", SessionId: "sess1", StartTime: now - 50},
+		{ConversationId: "c2", MessageId: "s3", Prompt: "车道保持是什么", Text: "车道保持辅助系统<LKA>", Model: "m2", SessionId: "sess2", StartTime: now},
+	}
+	for name, store := range testStores(t) {
+		if err := store.InsertConversations(ctx, msgs); err != nil {
+			t.Fatal(name, err)
+		}
+		Store = store
+
+		res, err := Search(ctx, SearchQuery{Text: "lane KEEPING"})
+		if err != nil || res.Total != 1 || res.Hits[0].Message.MessageId != "s1" {
+			t.Fatal(name, "unexpected hits", res, err)
+		}
+		if len(res.Hits[0].Snippets) == 0 || !strings.Contains(res.Hits[0].Snippets[0].Text, "<em>lane</em> <em>keeping</em>") {
+			t.Fatal(name, "unexpected snippets", res.Hits[0].Snippets)
+		}
+
+		res, err = Search(ctx, SearchQuery{Text: "lane", SessionId: "sess1", From: now - 60})
+		if err != nil || res.Total != 1 || res.Hits[0].Message.MessageId != "s2" {
+			t.Fatal(name, "filters not applied", res, err)
+		}
+
+		//the mongo text index does not split ideographs
+		if name != BackendMongo {
+			res, err = Search(ctx, SearchQuery{Text: "车道保持"})
+			if err != nil || res.Total != 1 {
+				t.Fatal(name, "ideographic search failed", res, err)
+			}
+			if got := res.Hits[0].Snippets[1].Text; got != "<em>车道保持</em>辅助系统&lt;LKA&gt;" {
+				t.Fatal(name, "unexpected snippet", got)
+			}
+		}
+
+		//filters only, newest first, second page
+		res, err = Search(ctx, SearchQuery{PageSize: 2, Page: 2})
+		if err != nil || res.Total != 3 || len(res.Hits) != 1 || res.Hits[0].Message.MessageId != "s1" {
+			t.Fatal(name, "unexpected page", res, err)
+		}
+
+		store.DeleteConversation(ctx, "c1")
+		if res, _ := Search(ctx, SearchQuery{Text: "lane"}); res.Total != 0 {
+			t.Fatal(name, "deleted turns still indexed", res)
+		}
+		store.DeleteConversation(ctx, "c2")
+	}
+}
+
+func TestBoltSearchIndexSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.InsertConversation(context.Background(), Message{ConversationId: "c", MessageId: "m", Prompt: "lane keeping", StartTime: 1})
+	store.Close(context.Background())
+
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+	res, err := store.Search(context.Background(), SearchQuery{Text: "keeping"}.withDefaults())
+	if err != nil || res.Total != 1 {
+		t.Fatal("index lost on reopen", res, err)
+	}
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SequenceCollection keeps the last sequence number handed out per
+// conversation, the document id is the conversation id.
+const SequenceCollection = "conversation_seq"
+
+const seqIndexName = "conversationId_seq"
+
+const migrateBatchSize = 1000
+
+// reserveSeq atomically reserves n sequence numbers of a conversation and
+// returns the first one.
+func (s *mongoStore) reserveSeq(ctx context.Context, conversationId string, n int) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := s.sequences.FindOneAndUpdate(ctx,
+		bson.D{{Key: "_id", Value: conversationId}},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "seq", Value: int64(n)}}}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter.Seq - int64(n) + 1, nil
+}
+
+// assignSeq numbers the turns without a sequence in slice order, one counter
+// update per conversation.
+func (s *mongoStore) assignSeq(ctx context.Context, msgs []Message) error {
+	counts := make(map[string]int)
+	for _, msg := range msgs {
+		if msg.Seq == 0 {
+			counts[msg.ConversationId]++
+		}
+	}
+	next := make(map[string]int64, len(counts))
+	for conversationId, n := range counts {
+		first, err := s.reserveSeq(ctx, conversationId, n)
+		if err != nil {
+			return err
+		}
+		next[conversationId] = first
+	}
+	for i := range msgs {
+		if msgs[i].Seq == 0 {
+			msgs[i].Seq = next[msgs[i].ConversationId]
+			next[msgs[i].ConversationId]++
+		}
+	}
+	return nil
+}
+
+type legacyTurn struct {
+	Id             primitive.ObjectID `bson:"_id"`
+	ConversationId string             `bson:"conversationId"`
+	StartTime      int64              `bson:"startTime"`
+	StartTimeMs    int64              `bson:"startTimeMs"`
+}
+
+// backfillSequence numbers the turns written before sequences existed, in
+// start time then insertion order, and creates the unique
+// (conversationId, seq) index history is read through.
+func backfillSequence(ctx context.Context, s *mongoStore) error {
+	filter := bson.D{{Key: "seq", Value: bson.D{{Key: "$exists", Value: false}}}}
+	opt := options.Find().
+		SetSort(bson.D{{Key: "conversationId", Value: 1}, {Key: "startTime", Value: 1}, {Key: "_id", Value: 1}}).
+		SetProjection(bson.D{{Key: "conversationId", Value: 1}, {Key: "startTime", Value: 1}, {Key: "startTimeMs", Value: 1}}).
+		SetAllowDiskUse(true)
+	cursor, err := s.collection.Find(ctx, filter, opt)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	pending := make([]legacyTurn, 0, migrateBatchSize)
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		first, err := s.reserveSeq(ctx, pending[0].ConversationId, len(pending))
+		if err != nil {
+			return err
+		}
+		models := make([]mongo.WriteModel, 0, len(pending))
+		for i, turn := range pending {
+			set := bson.D{{Key: "seq", Value: first + int64(i)}}
+			if turn.StartTimeMs == 0 {
+				set = append(set, bson.E{Key: "startTimeMs", Value: turn.StartTime * 1000})
+			}
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.D{{Key: "_id", Value: turn.Id}}).
+				SetUpdate(bson.D{{Key: "$set", Value: set}}))
+		}
+		pending = pending[:0]
+		_, err = s.collection.BulkWrite(ctx, models)
+		return err
+	}
+	for cursor.Next(ctx) {
+		var turn legacyTurn
+		if err := cursor.Decode(&turn); err != nil {
+			return err
+		}
+		if len(pending) >= migrateBatchSize || (len(pending) > 0 && pending[0].ConversationId != turn.ConversationId) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		pending = append(pending, turn)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	return ensureIndex(ctx, s.collection, mongo.IndexModel{
+		Keys:    bson.D{{Key: "conversationId", Value: 1}, {Key: "seq", Value: 1}},
+		Options: options.Index().SetName(seqIndexName).SetUnique(true),
+	})
+}
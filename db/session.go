@@ -0,0 +1,76 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const SessionCollection = "sessions"
+
+var ErrSessionUnsupported = errors.New("store backend does not support sessions")
+
+// Session is the server side state of a cookie session: where its last
+// question went, so the next one continues there.
+type Session struct {
+	Id             string    `json:"id" bson:"_id"`
+	ConversationId string    `json:"conversationId,omitempty" bson:"conversationId,omitempty"`
+	MessageId      string    `json:"messageId,omitempty" bson:"messageId,omitempty"`
+	Model          string    `json:"model,omitempty" bson:"model,omitempty"`
+	Url            string    `json:"url,omitempty" bson:"url,omitempty"`             //worker that answered
+	RelayHash      string    `json:"relayHash,omitempty" bson:"relayHash,omitempty"` //hash of the openai key that answered
+	UpdatedAt      int64     `json:"updatedAt" bson:"updatedAt"`
+	ExpiresAt      time.Time `json:"expiresAt" bson:"expiresAt"` //date field for the ttl index
+}
+
+// SessionStore is implemented by stores that keep session state.
+type SessionStore interface {
+	PutSession(ctx context.Context, session Session) error
+	// GetSession returns ErrNotFound if there is no session with id.
+	GetSession(ctx context.Context, id string) (*Session, error)
+	DeleteSession(ctx context.Context, id string) error
+	// DeleteExpiredSessions drops sessions that expired before now.
+	DeleteExpiredSessions(ctx context.Context, now time.Time) (int, error)
+}
+
+func PutSession(ctx context.Context, session Session) error {
+	store, err := capability[SessionStore](Store, ErrSessionUnsupported)
+	if err != nil {
+		return err
+	}
+	return store.PutSession(ctx, session)
+}
+
+// GetSession returns the state of a live session, ErrNotFound if it has
+// none or it expired.
+func GetSession(ctx context.Context, id string) (*Session, error) {
+	store, err := capability[SessionStore](Store, ErrSessionUnsupported)
+	if err != nil {
+		return nil, err
+	}
+	session, err := store.GetSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	//ttl indexes and purges run late
+	if !session.ExpiresAt.After(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return session, nil
+}
+
+func DeleteSession(ctx context.Context, id string) error {
+	store, err := capability[SessionStore](Store, ErrSessionUnsupported)
+	if err != nil {
+		return err
+	}
+	return store.DeleteSession(ctx, id)
+}
+
+func DeleteExpiredSessions(ctx context.Context) (int, error) {
+	store, err := capability[SessionStore](Store, ErrSessionUnsupported)
+	if err != nil {
+		return 0, err
+	}
+	return store.DeleteExpiredSessions(ctx, time.Now())
+}
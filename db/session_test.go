@@ -0,0 +1,53 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		Store = store
+		now := time.Now()
+
+		if _, err := GetSession(ctx, "s1"); !errors.Is(err, ErrNotFound) {
+			t.Fatal(name, "found a missing session", err)
+		}
+		live := Session{Id: "s1", ConversationId: "c1", MessageId: "m1", Model: "gpt", RelayHash: "sha256:00", UpdatedAt: now.Unix(), ExpiresAt: now.Add(time.Hour)}
+		if err := PutSession(ctx, live); err != nil {
+			t.Fatal(name, err)
+		}
+		live.MessageId = "m2"
+		if err := PutSession(ctx, live); err != nil {
+			t.Fatal(name, err)
+		}
+		got, err := GetSession(ctx, "s1")
+		if err != nil || got.ConversationId != "c1" || got.MessageId != "m2" || got.RelayHash != "sha256:00" {
+			t.Fatal(name, "unexpected session", got, err)
+		}
+
+		expired := Session{Id: "s2", ConversationId: "c2", ExpiresAt: now.Add(-time.Minute)}
+		if err := PutSession(ctx, expired); err != nil {
+			t.Fatal(name, err)
+		}
+		if _, err := GetSession(ctx, "s2"); !errors.Is(err, ErrNotFound) {
+			t.Fatal(name, "read an expired session", err)
+		}
+		if n, err := DeleteExpiredSessions(ctx); err != nil || n != 1 {
+			t.Fatal(name, "unexpected purge", n, err)
+		}
+		if _, err := GetSession(ctx, "s1"); err != nil {
+			t.Fatal(name, "purged a live session", err)
+		}
+
+		if err := DeleteSession(ctx, "s1"); err != nil {
+			t.Fatal(name, err)
+		}
+		if _, err := GetSession(ctx, "s1"); !errors.Is(err, ErrNotFound) {
+			t.Fatal(name, "found a deleted session", err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const ShareCollection = "shares"
+
+const shareTokenBytes = 32
+
+var (
+	ErrShareUnsupported = errors.New("store backend does not support shared conversations")
+	ErrNotOwner         = errors.New("not the owner")
+	ErrNothingToShare   = errors.New("no turns to share")
+)
+
+// Share is an immutable snapshot of a conversation behind a link. Only the
+// hash of the link token is stored, so the store contents do not give the
+// links away.
+type Share struct {
+	Id             string    `json:"id" bson:"_id"` //sha256 of the token
+	ConversationId string    `json:"conversationId" bson:"conversationId"`
+	Owner          string    `json:"owner" bson:"owner"`
+	Title          string    `json:"title,omitempty" bson:"title,omitempty"`
+	Turns          []Message `json:"turns" bson:"turns"`
+	CreatedAt      int64     `json:"createdAt" bson:"createdAt"`
+	ExpiresAt      int64     `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"` //0 never
+	RevokedAt      int64     `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+	Hidden         int       `json:"hidden,omitempty" bson:"hidden,omitempty"` //turns withheld as sensitive
+}
+
+// ShareStore is implemented by stores that keep shared snapshots.
+type ShareStore interface {
+	InsertShare(ctx context.Context, share Share) error
+	// GetShare returns ErrNotFound if there is no share with id.
+	GetShare(ctx context.Context, id string) (*Share, error)
+	RevokeShare(ctx context.Context, id string, revokedAt int64) error
+}
+
+func shareId(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newShareToken() (string, error) {
+	b := make([]byte, shareTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (s *Share) live(now time.Time) bool {
+	return s.RevokedAt == 0 && (s.ExpiresAt == 0 || now.Unix() < s.ExpiresAt)
+}
+
+// withhold drops the turns isSensitive flags, counting them in Hidden.
+func (s *Share) withhold(isSensitive func(string) bool) {
+	if isSensitive == nil {
+		return
+	}
+	kept := make([]Message, 0, len(s.Turns))
+	for _, turn := range s.Turns {
+		if isSensitive(turn.Prompt) || isSensitive(turn.Text) {
+			s.Hidden++
+			continue
+		}
+		kept = append(kept, turn)
+	}
+	s.Turns = kept
+}
+
+// snapshotTurn keeps what a reader of the link sees, the message id stays as
+// the key of the turn's encryption.
+func snapshotTurn(msg Message) Message {
+	return Message{
+		ConversationId: msg.ConversationId,
+		MessageId:      msg.MessageId,
+		Prompt:         msg.Prompt,
+		Text:           msg.Text,
+		StartTime:      msg.StartTime,
+		StartTimeMs:    msg.StartTimeMs,
+		Seq:            msg.Seq,
+		Model:          msg.Model,
+	}
+}
+
+// CreateShare snapshots a conversation of owner and returns the token of its
+// link. Turns isSensitive flags are left out of the snapshot. ttl 0 never
+// expires.
+func CreateShare(ctx context.Context, conversationId, owner, title string, ttl time.Duration, isSensitive func(string) bool) (string, *Share, error) {
+	store, err := capability[ShareStore](Store, ErrShareUnsupported)
+	if err != nil {
+		return "", nil, err
+	}
+	msgs, err := GetConversation(ctx, conversationId)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(msgs) == 0 {
+		return "", nil, ErrNotFound
+	}
+	owned := false
+	turns := make([]Message, 0, len(msgs))
+	for _, msg := range msgs {
+		owned = owned || (owner != "" && msg.SessionId == owner)
+		if msg.Error == "" {
+			turns = append(turns, snapshotTurn(msg))
+		}
+	}
+	if !owned {
+		return "", nil, ErrNotOwner
+	}
+	token, err := newShareToken()
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	share := &Share{
+		Id:             shareId(token),
+		ConversationId: conversationId,
+		Owner:          owner,
+		Title:          title,
+		Turns:          turns,
+		CreatedAt:      now.Unix(),
+	}
+	if ttl > 0 {
+		share.ExpiresAt = now.Add(ttl).Unix()
+	}
+	share.withhold(isSensitive)
+	if len(share.Turns) == 0 {
+		return "", nil, ErrNothingToShare
+	}
+	if err := store.InsertShare(ctx, *share); err != nil {
+		return "", nil, err
+	}
+	return token, share, nil
+}
+
+// GetShare returns the snapshot behind a live link. The sensitive word list
+// may have grown since the snapshot, so turns are checked again.
+func GetShare(ctx context.Context, token string, isSensitive func(string) bool) (*Share, error) {
+	store, err := capability[ShareStore](Store, ErrShareUnsupported)
+	if err != nil {
+		return nil, err
+	}
+	share, err := store.GetShare(ctx, shareId(token))
+	if err != nil {
+		return nil, err
+	}
+	if !share.live(time.Now()) {
+		return nil, ErrNotFound
+	}
+	share.withhold(isSensitive)
+	return share, nil
+}
+
+// RevokeShare disables a link of owner for good.
+func RevokeShare(ctx context.Context, token, owner string) error {
+	store, err := capability[ShareStore](Store, ErrShareUnsupported)
+	if err != nil {
+		return err
+	}
+	id := shareId(token)
+	share, err := store.GetShare(ctx, id)
+	if err != nil {
+		return err
+	}
+	if owner == "" || share.Owner != owner {
+		return ErrNotOwner
+	}
+	if share.RevokedAt != 0 {
+		return nil
+	}
+	return store.RevokeShare(ctx, id, time.Now().Unix())
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShare(t *testing.T) {
+	ctx := context.Background()
+	msgs := []Message{
+		{ConversationId: "sh1", MessageId: "sh-m1", Prompt: "What is AEB?", Text: "Automatic emergency braking.", Model: "m1", SessionId: "owner"},
+		{ConversationId: "sh1", MessageId: "sh-m2", Prompt: "secret plan", Text: "No.", Model: "m1", SessionId: "owner"},
+		{ConversationId: "sh1", MessageId: "sh-m3", Prompt: "Again?", Model: "m1", SessionId: "owner", Telemetry: Telemetry{Error: "timeout"}},
+	}
+	sensitive := func(text string) bool { return strings.Contains(text, "secret") }
+	for name, store := range testStores(t) {
+		if err := store.InsertConversations(ctx, msgs); err != nil {
+			t.Fatal(name, err)
+		}
+		Store = store
+
+		if _, _, err := CreateShare(ctx, "sh1", "stranger", "", 0, sensitive); !errors.Is(err, ErrNotOwner) {
+			t.Fatal(name, "shared by a stranger", err)
+		}
+		token, share, err := CreateShare(ctx, "sh1", "owner", "AEB", 0, sensitive)
+		if err != nil || len(token) < 40 || len(share.Turns) != 1 || share.Hidden != 1 {
+			t.Fatal(name, "unexpected share", token, share, err)
+		}
+		got, err := GetShare(ctx, token, sensitive)
+		if err != nil || got.Title != "AEB" || len(got.Turns) != 1 || got.Turns[0].Text != "Automatic emergency braking." {
+			t.Fatal(name, "unexpected shared snapshot", got, err)
+		}
+		//words added to the list later are withheld too
+		got, err = GetShare(ctx, token, func(text string) bool { return strings.Contains(text, "AEB") })
+		if err != nil || len(got.Turns) != 0 || got.Hidden != 2 {
+			t.Fatal(name, "newly sensitive turn exposed", got, err)
+		}
+		if _, err := GetShare(ctx, token+"x", sensitive); !errors.Is(err, ErrNotFound) {
+			t.Fatal(name, "unknown token served", err)
+		}
+
+		if err := RevokeShare(ctx, token, "stranger"); !errors.Is(err, ErrNotOwner) {
+			t.Fatal(name, "revoked by a stranger", err)
+		}
+		if err := RevokeShare(ctx, token, "owner"); err != nil {
+			t.Fatal(name, err)
+		}
+		if _, err := GetShare(ctx, token, sensitive); !errors.Is(err, ErrNotFound) {
+			t.Fatal(name, "revoked share served", err)
+		}
+
+		expiring, _, err := CreateShare(ctx, "sh1", "owner", "", time.Nanosecond, nil)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if _, err := GetShare(ctx, expiring, nil); !errors.Is(err, ErrNotFound) {
+			t.Fatal(name, "expired share served", err)
+		}
+		store.DeleteConversation(ctx, "sh1")
+	}
+}
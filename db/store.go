@@ -0,0 +1,270 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"gateway/log"
+	"math"
+	"time"
+)
+
+const (
+	BackendMongo  = "mongo"
+	BackendMemory = "memory"
+	BackendBolt   = "bolt"
+)
+
+const DefaultBoltPath = "./data/gateway.db"
+
+const opTimeout = time.Minute
+
+var (
+	ErrConversationIdEmpty = errors.New("conversation id empty")
+	ErrNotFound            = errors.New("not found")
+	ErrUnknownBackend      = errors.New("unknown store backend")
+	ErrSearchUnsupported   = errors.New("store backend does not support search")
+)
+
+// InsertError is returned by batch inserts that wrote part of a batch.
+// Failed holds the indexes of the turns not known to be written and Seq the
+// sequence numbers they were given, a retry reuses them.
+type InsertError struct {
+	Failed []int
+	Seq    []int64
+	Err    error
+}
+
+func (e *InsertError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InsertError) Unwrap() error {
+	return e.Err
+}
+
+func (e *InsertError) add(i int, seq int64) {
+	e.Failed = append(e.Failed, i)
+	e.Seq = append(e.Seq, seq)
+}
+
+type Config struct {
+	Backend        string           `yaml:"backend"` //mongo, memory or bolt
+	Path           string           `yaml:"path"`    //bolt file path
+	Degraded       DegradedConfig   `yaml:"degraded"`
+	Writer         WriterConfig     `yaml:"writer"`
+	SkipMigrations bool             `yaml:"skip_migrations"` //leave schema migrations to the migrate command
+	Encryption     EncryptionConfig `yaml:"encryption"`
+}
+
+// ConversationStore persists conversation turns.
+type ConversationStore interface {
+	InsertConversation(ctx context.Context, msg Message) error
+	InsertConversations(ctx context.Context, msgs []Message) error
+	// GetRecentConversation returns at most limit turns of a conversation
+	// started after startTime, newest first.
+	GetRecentConversation(ctx context.Context, conversationId string, startTime int64, limit int) ([]Message, error)
+	// GetConversation returns all turns of a conversation, oldest first.
+	GetConversation(ctx context.Context, conversationId string) ([]Message, error)
+	GetMessage(ctx context.Context, messageId string) (*Message, error)
+	DeleteConversation(ctx context.Context, conversationId string) error
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// Unwrapper is a store wrapping another one, like the encrypted and the
+// degraded mode stores. Optional capabilities such as FeedbackStore are
+// looked up along the chain, so a wrapper only implements the ones whose
+// data it changes.
+type Unwrapper interface {
+	// Unwrap returns the wrapped store, nil while it is unreachable.
+	Unwrap() ConversationStore
+}
+
+// capability returns the first store from store down its wrapper chain that
+// implements T. It fails with ErrStoreUnavailable if a wrapped store is
+// unreachable and with unsupported if none implements T.
+func capability[T any](store ConversationStore, unsupported error) (T, error) {
+	var none T
+	for store != nil {
+		if c, ok := store.(T); ok {
+			return c, nil
+		}
+		w, ok := store.(Unwrapper)
+		if !ok {
+			break
+		}
+		if store = w.Unwrap(); store == nil {
+			return none, ErrStoreUnavailable
+		}
+	}
+	return none, unsupported
+}
+
+var Store ConversationStore
+
+var storeBackend string
+
+func NewStore(conf Config) (ConversationStore, error) {
+	switch conf.Backend {
+	case "", BackendMongo:
+		if conf.Degraded.Enable {
+			return newResilientStore(BackendMongo, conf.Degraded, func() (ConversationStore, error) {
+				return openMongoStore(MongoURI, !conf.SkipMigrations)
+			})
+		}
+		return openMongoStore(MongoURI, !conf.SkipMigrations)
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	case BackendBolt:
+		path := conf.Path
+		if path == "" {
+			path = DefaultBoltPath
+		}
+		return NewBoltStore(path)
+	}
+	return nil, ErrUnknownBackend
+}
+
+// openMongoStore connects and applies the pending migrations before the
+// store takes writes.
+func openMongoStore(uri string, migrate bool) (*mongoStore, error) {
+	store, err := NewMongoStore(uri)
+	if err != nil || !migrate {
+		return store, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	steps, err := store.MigrateTo(ctx, -1)
+	for _, step := range steps {
+		log.Infof("applied migration %d: %s", step.Version, step.Description)
+	}
+	if err != nil {
+		store.Close(context.Background())
+		return nil, err
+	}
+	return store, nil
+}
+
+func Init(conf Config) error {
+	store, err := NewStore(conf)
+	if err != nil {
+		return err
+	}
+	if conf.Encryption.Enable {
+		encrypted, err := newEncryptedStore(store, conf.Encryption)
+		if err != nil {
+			store.Close(context.Background())
+			return err
+		}
+		store = encrypted
+	}
+	Store = store
+	storeBackend = conf.Backend
+	if storeBackend == "" {
+		storeBackend = BackendMongo
+	}
+	return nil
+}
+
+// GetHealth reports whether the conversation store is reachable and how many
+// writes wait to be replayed.
+func GetHealth() Health {
+	if r, err := capability[*resilientStore](Store, ErrStoreUnavailable); err == nil {
+		return r.Health()
+	}
+	h := Health{Backend: storeBackend, Healthy: true}
+	if Store == nil {
+		h.Healthy = false
+		h.LastError = ErrStoreUnavailable.Error()
+		return h
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Store.Ping(ctx); err != nil {
+		h.Healthy = false
+		h.LastError = err.Error()
+	}
+	h.Degraded = !h.Healthy
+	return h
+}
+
+func Close() error {
+	if Store == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return Store.Close(ctx)
+}
+
+func InsertSingleConversation(msg Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	if err := Store.InsertConversation(ctx, msg); err != nil {
+		return err
+	}
+	meterUsage(Store, []Message{msg})
+	return nil
+}
+
+func GetResentConversation(conversationId string, startTime int64) ([]Message, error) {
+	if conversationId == "" {
+		return nil, ErrConversationIdEmpty
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	pending := make([]Message, 0)
+	for _, msg := range pendingTurns(conversationId) {
+		if msg.StartTime > startTime {
+			pending = append(pending, msg)
+		}
+	}
+	msgLog, err := Store.GetRecentConversation(ctx, conversationId, startTime, LimitConversactionMsg)
+	if err != nil {
+		return nil, err
+	}
+	return withPending(msgLog, pending, true, LimitConversactionMsg), nil
+}
+
+func GetMessage(ctx context.Context, messageId string) (*Message, error) {
+	return Store.GetMessage(ctx, messageId)
+}
+
+// ScanTurns hands out every stored turn in batches, decrypted, in no
+// particular order.
+func ScanTurns(ctx context.Context, batchSize int, fn func([]Message) error) error {
+	purger, err := capability[Purger](Store, ErrStoreUnavailable)
+	if err != nil {
+		return err
+	}
+	if enc, ok := Store.(*encryptedStore); ok {
+		next := fn
+		fn = func(batch []Message) error {
+			plain, err := enc.decryptAll(batch)
+			if err != nil {
+				return err
+			}
+			return next(plain)
+		}
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultPurgeBatchSize
+	}
+	return purger.ScanBefore(ctx, math.MaxInt64, batchSize, fn)
+}
+
+func InsertConversations(ctx context.Context, msgs []Message) error {
+	return Store.InsertConversations(ctx, msgs)
+}
+
+func GetConversation(ctx context.Context, conversationId string) ([]Message, error) {
+	if conversationId == "" {
+		return nil, ErrConversationIdEmpty
+	}
+	pending := pendingTurns(conversationId)
+	msgs, err := Store.GetConversation(ctx, conversationId)
+	if err != nil {
+		return nil, err
+	}
+	return withPending(msgs, pending, false, 0), nil
+}
@@ -1,11 +1,52 @@
 package db
 
+import "time"
+
 type Message struct {
-	ConversationId string `json:"conversationId" bson:"conversationId"`
-	MessageId      string `json:"messageId" bson:"messageId"`
-	Prompt         string `json:"prompt" bson:"prompt"`
-	Text           string `json:"text" bson:"text"`
-	StartTime      int64  `json:"startTime" bson:"startTime"`
-	Model          string `json:"model" bson:"model"`
-	Url            string `json:"url" bson:"url"`
+	ConversationId string    `json:"conversationId" bson:"conversationId"`
+	MessageId      string    `json:"messageId" bson:"messageId"`
+	Prompt         string    `json:"prompt" bson:"prompt"`
+	Text           string    `json:"text" bson:"text"`
+	StartTime      int64     `json:"startTime" bson:"startTime"`
+	StartTimeMs    int64     `json:"startTimeMs" bson:"startTimeMs"` //unix milliseconds
+	Seq            int64     `json:"seq" bson:"seq"`                 //position in the conversation, assigned by the store on insert
+	Model          string    `json:"model" bson:"model"`
+	Url            string    `json:"url" bson:"url"`
+	Tenant         string    `json:"tenant,omitempty" bson:"tenant,omitempty"`
+	UserId         string    `json:"userId,omitempty" bson:"userId,omitempty"`
+	SessionId      string    `json:"sessionId,omitempty" bson:"sessionId,omitempty"`
+	CreatedAt      time.Time `json:"createdAt" bson:"createdAt,omitempty"` //date field for ttl indexes
+	//response cache the answer came from, empty for model answers
+	Cache       string  `json:"cache,omitempty" bson:"cache,omitempty"`
+	CacheSource string  `json:"cacheSource,omitempty" bson:"cacheSource,omitempty"`
+	Similarity  float32 `json:"similarity,omitempty" bson:"similarity,omitempty"`
+	Coalesced   bool    `json:"coalesced,omitempty" bson:"coalesced,omitempty"` //answered by an identical question in flight, which has the tokens
+	Telemetry   `bson:",inline"`
+	Feedback    *Feedback `json:"feedback,omitempty" bson:"feedback,omitempty"`
+	//set while prompt, text and promptSent are encrypted at rest
+	Encryption *Envelope `json:"encryption,omitempty" bson:"encryption,omitempty"`
+}
+
+type PromptMessage struct {
+	Role    string `json:"role" bson:"role"`
+	Content string `json:"content" bson:"content"`
+}
+
+// Telemetry describes how a turn was served. A turn with Error set failed and
+// has no answer, it is kept for debugging but left out of history.
+type Telemetry struct {
+	PromptSent       []PromptMessage `json:"promptSent,omitempty" bson:"promptSent,omitempty"`
+	Temperature      float32         `json:"temperature" bson:"temperature"`
+	TopP             float32         `json:"topP" bson:"topP"`
+	FinishReason     string          `json:"finishReason,omitempty" bson:"finishReason,omitempty"`
+	PromptTokens     int             `json:"promptTokens" bson:"promptTokens"`
+	CompletionTokens int             `json:"completionTokens" bson:"completionTokens"`
+	QueueWaitMs      int64           `json:"queueWaitMs" bson:"queueWaitMs"`
+	TTFTMs           int64           `json:"ttftMs" bson:"ttftMs"`
+	LatencyMs        int64           `json:"latencyMs" bson:"latencyMs"`
+	Upstream         string          `json:"upstream,omitempty" bson:"upstream,omitempty"` //worker url or api key hash
+	Retries          int             `json:"retries" bson:"retries"`
+	Cost             float64         `json:"cost,omitempty" bson:"cost,omitempty"` //in the pricing currency, 0 if cached or not priced
+	Error            string          `json:"error,omitempty" bson:"error,omitempty"`
+	Redacted         map[string]int  `json:"redacted,omitempty" bson:"redacted,omitempty"` //values replaced per detector
 }
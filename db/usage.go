@@ -0,0 +1,285 @@
+package db
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const UsageCollection = "usage"
+
+const (
+	UsageHour  = "hour"
+	UsageDay   = "day"
+	UsageMonth = "month"
+)
+
+var (
+	ErrUsageUnsupported = errors.New("store backend does not support usage metering")
+	ErrUnknownPeriod    = errors.New("unknown usage period, want hour, day or month")
+)
+
+// UsageKey names a usage bucket. Buckets start at UTC hour, day or month
+// boundaries.
+type UsageKey struct {
+	Period   string `json:"period" bson:"period"`
+	Start    int64  `json:"start" bson:"start"` //unix seconds
+	Tenant   string `json:"tenant" bson:"tenant"`
+	Model    string `json:"model" bson:"model"`
+	Upstream string `json:"upstream" bson:"upstream"` //worker url or api key hash
+}
+
+func (k UsageKey) id() string {
+	return k.Period + "|" + strconv.FormatInt(k.Start, 10) + "|" + k.Tenant + "|" + k.Model + "|" + k.Upstream
+}
+
+// UsageCounts add up the turns of a bucket. Cached turns were answered
+// without asking a model and used no tokens.
+type UsageCounts struct {
+	Requests         int64   `json:"requests" bson:"requests"`
+	Errors           int64   `json:"errors" bson:"errors"`
+	Cached           int64   `json:"cached" bson:"cached"`
+	PromptTokens     int64   `json:"promptTokens" bson:"promptTokens"`
+	CompletionTokens int64   `json:"completionTokens" bson:"completionTokens"`
+	LatencyMs        int64   `json:"latencyMs" bson:"latencyMs"` //sum, divide by requests for the mean
+	Cost             float64 `json:"cost" bson:"cost"`
+}
+
+func (c *UsageCounts) add(o UsageCounts) {
+	c.Requests += o.Requests
+	c.Errors += o.Errors
+	c.Cached += o.Cached
+	c.PromptTokens += o.PromptTokens
+	c.CompletionTokens += o.CompletionTokens
+	c.LatencyMs += o.LatencyMs
+	c.Cost += o.Cost
+}
+
+func (c UsageCounts) Tokens() int64 {
+	return c.PromptTokens + c.CompletionTokens
+}
+
+type UsageBucket struct {
+	UsageKey    `bson:",inline"`
+	UsageCounts `bson:",inline"`
+}
+
+// UsageQuery selects buckets of a period starting in [From, To), unix
+// seconds, 0 leaves a bound open.
+type UsageQuery struct {
+	Period string
+	From   int64
+	To     int64
+	Tenant string
+	Model  string
+}
+
+func (q UsageQuery) matches(k UsageKey) bool {
+	return k.Period == q.Period &&
+		(q.From == 0 || k.Start >= q.From) &&
+		(q.To == 0 || k.Start < q.To) &&
+		(q.Tenant == "" || k.Tenant == q.Tenant) &&
+		(q.Model == "" || k.Model == q.Model)
+}
+
+// UsageStore is implemented by stores that meter usage.
+type UsageStore interface {
+	// AddUsage adds the counts of buckets to the stored ones.
+	AddUsage(ctx context.Context, buckets []UsageBucket) error
+	UsageBuckets(ctx context.Context, q UsageQuery) ([]UsageBucket, error)
+}
+
+// PeriodStart returns the start of the UTC period t falls in.
+func PeriodStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	switch period {
+	case UsageHour:
+		return t.Truncate(time.Hour)
+	case UsageDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func ValidatePeriod(period string) error {
+	switch period {
+	case UsageHour, UsageDay, UsageMonth:
+		return nil
+	}
+	return ErrUnknownPeriod
+}
+
+func messageUsage(msg *Message) UsageCounts {
+	c := UsageCounts{
+		Requests:         1,
+		PromptTokens:     int64(msg.PromptTokens),
+		CompletionTokens: int64(msg.CompletionTokens),
+		LatencyMs:        msg.LatencyMs,
+		Cost:             msg.Cost,
+	}
+	if msg.Error != "" {
+		c.Errors = 1
+	}
+	if msg.Cache != "" || msg.Coalesced {
+		c.Cached = 1
+	}
+	return c
+}
+
+// usageBuckets adds the turns of msgs up into their hour, day and month
+// buckets.
+func usageBuckets(msgs []Message) []UsageBucket {
+	sums := make(map[UsageKey]*UsageCounts)
+	keys := make([]UsageKey, 0)
+	for i := range msgs {
+		msg := &msgs[i]
+		at := time.Unix(msg.StartTime, 0)
+		counts := messageUsage(msg)
+		for _, period := range []string{UsageHour, UsageDay, UsageMonth} {
+			key := UsageKey{Period: period, Start: PeriodStart(period, at).Unix(), Tenant: msg.Tenant, Model: msg.Model, Upstream: msg.Url}
+			sum, ok := sums[key]
+			if !ok {
+				sum = new(UsageCounts)
+				sums[key] = sum
+				keys = append(keys, key)
+			}
+			sum.add(counts)
+		}
+	}
+	buckets := make([]UsageBucket, 0, len(keys))
+	for _, key := range keys {
+		buckets = append(buckets, UsageBucket{UsageKey: key, UsageCounts: *sums[key]})
+	}
+	return buckets
+}
+
+// recordUsage meters written turns, stores without metering are skipped.
+func recordUsage(ctx context.Context, store ConversationStore, msgs []Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	usage, err := capability[UsageStore](store, nil)
+	if usage == nil {
+		return err
+	}
+	return usage.AddUsage(ctx, usageBuckets(msgs))
+}
+
+func sortUsageBuckets(buckets []UsageBucket) {
+	sort.Slice(buckets, func(i, j int) bool {
+		a, b := buckets[i], buckets[j]
+		if a.Start != b.Start {
+			return a.Start < b.Start
+		}
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		return a.Upstream < b.Upstream
+	})
+}
+
+// GetUsage returns the buckets of q, oldest first.
+func GetUsage(ctx context.Context, q UsageQuery) ([]UsageBucket, error) {
+	if err := ValidatePeriod(q.Period); err != nil {
+		return nil, err
+	}
+	store, err := capability[UsageStore](Store, ErrUsageUnsupported)
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := store.UsageBuckets(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	sortUsageBuckets(buckets)
+	return buckets, nil
+}
+
+// MonthUsage adds up the usage of tenant in the month of now.
+func MonthUsage(ctx context.Context, tenant string, now time.Time) (UsageCounts, error) {
+	start := PeriodStart(UsageMonth, now).Unix()
+	buckets, err := GetUsage(ctx, UsageQuery{Period: UsageMonth, From: start, To: start + 1, Tenant: tenant})
+	var total UsageCounts
+	for _, b := range buckets {
+		total.add(b.UsageCounts)
+	}
+	return total, err
+}
+
+// UsageTotal adds up the buckets of a tenant and model.
+type UsageTotal struct {
+	Tenant string `json:"tenant"`
+	Model  string `json:"model"`
+	UsageCounts
+}
+
+// TotalUsage adds buckets up per tenant and model, ordered by both.
+func TotalUsage(buckets []UsageBucket) []UsageTotal {
+	type key struct{ tenant, model string }
+	sums := make(map[key]*UsageTotal)
+	totals := make([]*UsageTotal, 0)
+	for _, b := range buckets {
+		k := key{b.Tenant, b.Model}
+		sum, ok := sums[k]
+		if !ok {
+			sum = &UsageTotal{Tenant: b.Tenant, Model: b.Model}
+			sums[k] = sum
+			totals = append(totals, sum)
+		}
+		sum.add(b.UsageCounts)
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].Tenant != totals[j].Tenant {
+			return totals[i].Tenant < totals[j].Tenant
+		}
+		return totals[i].Model < totals[j].Model
+	})
+	result := make([]UsageTotal, 0, len(totals))
+	for _, t := range totals {
+		result = append(result, *t)
+	}
+	return result
+}
+
+var usageCSVHeader = []string{"period", "start", "tenant", "model", "upstream", "requests", "errors", "cached", "prompt_tokens", "completion_tokens", "total_tokens", "avg_latency_ms", "cost"}
+
+// WriteUsageCSV writes buckets as csv with a header row, starts in RFC 3339.
+func WriteUsageCSV(w io.Writer, buckets []UsageBucket) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(usageCSVHeader); err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		var avg int64
+		if b.Requests > 0 {
+			avg = b.LatencyMs / b.Requests
+		}
+		row := []string{
+			b.Period,
+			time.Unix(b.Start, 0).UTC().Format(time.RFC3339),
+			b.Tenant,
+			b.Model,
+			b.Upstream,
+			strconv.FormatInt(b.Requests, 10),
+			strconv.FormatInt(b.Errors, 10),
+			strconv.FormatInt(b.Cached, 10),
+			strconv.FormatInt(b.PromptTokens, 10),
+			strconv.FormatInt(b.CompletionTokens, 10),
+			strconv.FormatInt(b.Tokens(), 10),
+			strconv.FormatInt(avg, 10),
+			strconv.FormatFloat(b.Cost, 'f', -1, 64),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsage(t *testing.T) {
+	ctx := context.Background()
+	at := time.Date(2024, 5, 31, 23, 30, 0, 0, time.UTC)
+	turn := func(id, tenant, model string, prompt, completion int, offset time.Duration) Message {
+		start := at.Add(offset)
+		return Message{
+			ConversationId: "c-" + id,
+			MessageId:      id,
+			StartTime:      start.Unix(),
+			Model:          model,
+			Url:            "http://worker",
+			Tenant:         tenant,
+			Telemetry:      Telemetry{PromptTokens: prompt, CompletionTokens: completion, LatencyMs: 100, Cost: float64(prompt+completion) / 1000},
+		}
+	}
+	for name, store := range testStores(t) {
+		Store = store
+
+		//written directly and through the write-behind pipeline
+		if err := WriteConversation(turn("m1", "acme", "gpt", 10, 5, 0)); err != nil {
+			t.Fatal(name, err)
+		}
+		w := NewWriter(store, WriterConfig{})
+		failed := turn("m2", "acme", "gpt", 0, 0, 10*time.Minute)
+		failed.Error = "timeout"
+		cached := turn("m3", "acme", "gpt", 0, 0, 20*time.Minute)
+		cached.Coalesced = true
+		for _, msg := range []Message{failed, cached, turn("m4", "acme", "gpt", 20, 10, time.Hour), turn("m5", "other", "m1", 1, 1, 0)} {
+			if err := w.Write(msg); err != nil {
+				t.Fatal(name, err)
+			}
+		}
+		if err := w.Close(ctx); err != nil {
+			t.Fatal(name, err)
+		}
+
+		days, err := GetUsage(ctx, UsageQuery{Period: UsageDay, Tenant: "acme"})
+		if err != nil || len(days) != 2 {
+			t.Fatal(name, "unexpected days", days, err)
+		}
+		may := days[0]
+		if may.Start != time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC).Unix() || may.Requests != 3 || may.Errors != 1 || may.Cached != 1 || may.Tokens() != 15 || may.LatencyMs != 300 || may.Cost != 0.015 {
+			t.Fatal(name, "unexpected may 31", may)
+		}
+		if june := days[1]; june.Requests != 1 || june.PromptTokens != 20 || june.CompletionTokens != 10 {
+			t.Fatal(name, "unexpected june 1", june)
+		}
+		hours, err := GetUsage(ctx, UsageQuery{Period: UsageHour, From: PeriodStart(UsageHour, at).Unix(), To: at.Unix()})
+		if err != nil || len(hours) != 2 || hours[0].Tenant != "acme" || hours[0].Requests != 3 || hours[1].Model != "m1" {
+			t.Fatal(name, "unexpected hours", hours, err)
+		}
+
+		month, err := MonthUsage(ctx, "acme", at)
+		if err != nil || month.Requests != 3 || month.Tokens() != 15 {
+			t.Fatal(name, "unexpected month usage", month, err)
+		}
+		if month, _ := MonthUsage(ctx, "acme", at.Add(time.Hour)); month.Requests != 1 {
+			t.Fatal(name, "june counted in may", month)
+		}
+
+		var csv bytes.Buffer
+		if err := WriteUsageCSV(&csv, days); err != nil {
+			t.Fatal(name, err)
+		}
+		lines := strings.Split(strings.TrimSpace(csv.String()), "\n")
+		if len(lines) != 3 || lines[1] != "day,2024-05-31T00:00:00Z,acme,gpt,http://worker,3,1,1,10,5,15,100,0.015" {
+			t.Fatal(name, "unexpected csv", csv.String())
+		}
+		all, _ := GetUsage(ctx, UsageQuery{Period: UsageMonth})
+		totals := TotalUsage(all)
+		if len(totals) != 2 || totals[0].Tenant != "acme" || totals[0].Requests != 4 || totals[0].Cost != 0.045 || totals[1].Model != "m1" {
+			t.Fatal(name, "unexpected totals", totals)
+		}
+
+		if _, err := GetUsage(ctx, UsageQuery{Period: "week"}); !errors.Is(err, ErrUnknownPeriod) {
+			t.Fatal(name, "unknown period accepted", err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+var ErrWALFull = errors.New("write-ahead log full")
+
+// writeAheadLog buffers conversation turns in a local JSON lines file while
+// the database is unreachable. It is bounded by file size. Replayed turns
+// are skipped by an offset kept next to the log, the file is emptied once all
+// of it is replayed.
+type writeAheadLog struct {
+	lock      sync.Mutex
+	replaying sync.Mutex
+	path      string
+	maxBytes  int64
+	size      int64
+	count     int64
+	offset    int64 //bytes already replayed
+}
+
+func openWriteAheadLog(path string, maxBytes int64) (*writeAheadLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, err
+	}
+	w := &writeAheadLog{path: path, maxBytes: maxBytes}
+	if fi, err := os.Stat(path); err == nil {
+		w.size = fi.Size()
+	}
+	//a missing or torn offset replays from the start, replay skips stored turns
+	if data, err := os.ReadFile(w.offsetPath()); err == nil {
+		if offset, err := strconv.ParseInt(string(data), 10, 64); err == nil && offset <= w.size {
+			w.offset = offset
+		}
+	}
+	//pick up turns left over from a previous run
+	msgs, _, err := w.read(w.offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	w.count = int64(len(msgs))
+	return w, nil
+}
+
+func (w *writeAheadLog) offsetPath() string {
+	return w.path + ".offset"
+}
+
+func (w *writeAheadLog) Append(msgs ...Message) error {
+	buf := make([]byte, 0)
+	for _, msg := range msgs {
+		line, err := json.Marshal(&msg)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.size+int64(len(buf)) > w.maxBytes {
+		return ErrWALFull
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	w.size += int64(len(buf))
+	w.count += int64(len(msgs))
+	return nil
+}
+
+// Replay hands the buffered turns to insert, oldest first and at most
+// chunkSize at a time, and drops each chunk from the log once insert
+// succeeds. The log is not locked while insert runs, appends and Stat go on.
+func (w *writeAheadLog) Replay(chunkSize int, insert func([]Message) error) (int, error) {
+	w.replaying.Lock()
+	defer w.replaying.Unlock()
+	replayed := 0
+	for {
+		w.lock.Lock()
+		msgs, next, err := w.read(w.offset, chunkSize)
+		w.lock.Unlock()
+		if err != nil {
+			return replayed, err
+		}
+		if len(msgs) != 0 {
+			if err := insert(msgs); err != nil {
+				return replayed, err
+			}
+			replayed += len(msgs)
+		}
+		done, err := w.commit(next, len(msgs))
+		if err != nil || done {
+			return replayed, err
+		}
+	}
+}
+
+// commit drops the turns before offset from the log and reports whether
+// nothing is left to replay.
+func (w *writeAheadLog) commit(offset int64, n int) (bool, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.offset = offset
+	w.count -= int64(n)
+	if w.offset < w.size {
+		return false, os.WriteFile(w.offsetPath(), []byte(strconv.FormatInt(w.offset, 10)), 0666)
+	}
+	if err := os.Truncate(w.path, 0); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	w.size, w.count, w.offset = 0, 0, 0
+	if err := os.Remove(w.offsetPath()); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	return true, nil
+}
+
+func (w *writeAheadLog) Stat() (count int64, size int64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.count, w.size
+}
+
+// read returns up to limit turns from offset on, all of them for a zero
+// limit, and the offset after the last line read.
+func (w *writeAheadLog) read(offset int64, limit int) ([]Message, int64, error) {
+	f, err := os.Open(w.path)
+	if os.IsNotExist(err) {
+		return nil, offset, nil
+	}
+	if err != nil {
+		return nil, offset, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+	msgs := make([]Message, 0)
+	reader := bufio.NewReader(f)
+	for limit <= 0 || len(msgs) < limit {
+		line, err := reader.ReadBytes('\n')
+		offset += int64(len(line))
+		var msg Message
+		//a torn last line from a crash is skipped
+		if len(line) != 0 && json.Unmarshal(line, &msg) == nil {
+			msgs = append(msgs, msg)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, offset, err
+		}
+	}
+	return msgs, offset, nil
+}
@@ -0,0 +1,326 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"gateway/log"
+	"gateway/metrics"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWriteQueueSize    = 10000
+	DefaultWriteBatchSize    = 100
+	DefaultFlushInterval     = 500 //ms
+	DefaultWriteRetry        = 5
+	DefaultWriteRetryBackoff = 200   //ms
+	maxWriteRetryBackoff     = 10000 //ms
+)
+
+var (
+	ErrWriteQueueFull = errors.New("conversation write queue full")
+	ErrWriterClosed   = errors.New("conversation writer closed")
+)
+
+var (
+	writeQueueDepth   = metrics.NewGauge("gateway_db_write_queue_depth", "conversation turns waiting to be written")
+	writeBatchLatency = metrics.NewHistogram("gateway_db_write_batch_seconds", "latency of conversation batch inserts", metrics.LatencyBuckets, "result")
+	writeDropped      = metrics.NewCounter("gateway_db_write_dropped_total", "conversation turns dropped by the write pipeline", "reason")
+)
+
+// WriterConfig tunes the write-behind pipeline, times are in milliseconds.
+type WriterConfig struct {
+	QueueSize     int `yaml:"queue_size"`
+	BatchSize     int `yaml:"batch_size"`
+	FlushInterval int `yaml:"flush_interval"`
+	MaxRetry      int `yaml:"max_retry"`
+	RetryBackoff  int `yaml:"retry_backoff"`
+}
+
+func (conf WriterConfig) withDefaults() WriterConfig {
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = DefaultWriteQueueSize
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = DefaultWriteBatchSize
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = DefaultFlushInterval
+	}
+	if conf.MaxRetry < 0 {
+		conf.MaxRetry = 0
+	} else if conf.MaxRetry == 0 {
+		conf.MaxRetry = DefaultWriteRetry
+	}
+	if conf.RetryBackoff <= 0 {
+		conf.RetryBackoff = DefaultWriteRetryBackoff
+	}
+	return conf
+}
+
+// Writer batches conversation inserts behind a bounded queue. Batches are
+// written when full or every flush interval and retried with backoff. Turns
+// not written yet are kept by conversation so reads can see them.
+type Writer struct {
+	store       ConversationStore
+	conf        WriterConfig
+	queue       chan Message
+	lock        sync.RWMutex
+	closed      bool
+	done        chan struct{}
+	pendingLock sync.Mutex
+	pending     map[string][]Message
+}
+
+func NewWriter(store ConversationStore, conf WriterConfig) *Writer {
+	conf = conf.withDefaults()
+	w := &Writer{
+		store:   store,
+		conf:    conf,
+		queue:   make(chan Message, conf.QueueSize),
+		done:    make(chan struct{}),
+		pending: make(map[string][]Message),
+	}
+	go w.run()
+	return w
+}
+
+// Write queues msg without blocking, the turn is dropped if the queue is full.
+func (w *Writer) Write(msg Message) error {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if w.closed {
+		writeDropped.Inc("closed")
+		return ErrWriterClosed
+	}
+	//pending before queued, the flush may run before this returns
+	w.addPending(msg)
+	select {
+	case w.queue <- msg:
+		writeQueueDepth.Set(float64(len(w.queue)))
+		return nil
+	default:
+		w.removePending([]Message{msg})
+		writeDropped.Inc("queue_full")
+		return ErrWriteQueueFull
+	}
+}
+
+func (w *Writer) addPending(msg Message) {
+	w.pendingLock.Lock()
+	defer w.pendingLock.Unlock()
+	w.pending[msg.ConversationId] = append(w.pending[msg.ConversationId], msg)
+}
+
+// removePending forgets written or dropped turns.
+func (w *Writer) removePending(msgs []Message) {
+	w.pendingLock.Lock()
+	defer w.pendingLock.Unlock()
+	for _, msg := range msgs {
+		turns := w.pending[msg.ConversationId]
+		for i := range turns {
+			if turns[i].MessageId == msg.MessageId && turns[i].StartTimeMs == msg.StartTimeMs {
+				turns = append(turns[:i:i], turns[i+1:]...)
+				break
+			}
+		}
+		if len(turns) == 0 {
+			delete(w.pending, msg.ConversationId)
+		} else {
+			w.pending[msg.ConversationId] = turns
+		}
+	}
+}
+
+// Pending returns the turns of a conversation that are not written yet, in
+// the order they were queued.
+func (w *Writer) Pending(conversationId string) []Message {
+	w.pendingLock.Lock()
+	defer w.pendingLock.Unlock()
+	return append([]Message(nil), w.pending[conversationId]...)
+}
+
+// Close stops accepting writes and waits until queued turns are flushed or
+// ctx is done.
+func (w *Writer) Close(ctx context.Context) error {
+	w.lock.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.lock.Unlock()
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(time.Millisecond * time.Duration(w.conf.FlushInterval))
+	defer ticker.Stop()
+	batch := make([]Message, 0, w.conf.BatchSize)
+	for {
+		select {
+		case msg, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, msg)
+			writeQueueDepth.Set(float64(len(w.queue)))
+			if len(batch) >= w.conf.BatchSize {
+				w.flush(batch)
+				batch = make([]Message, 0, w.conf.BatchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				w.flush(batch)
+				batch = make([]Message, 0, w.conf.BatchSize)
+			}
+		}
+	}
+}
+
+// flush writes batch, retrying the turns not written while the store is
+// unreachable. Turns the store refuses are dropped right away.
+func (w *Writer) flush(batch []Message) {
+	if len(batch) == 0 {
+		return
+	}
+	defer w.removePending(batch)
+	pending := batch
+	backoff := time.Millisecond * time.Duration(w.conf.RetryBackoff)
+	for try := 0; ; try++ {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+		err := w.store.InsertConversations(ctx, pending)
+		cancel()
+		if err == nil {
+			writeBatchLatency.Observe(time.Since(start).Seconds(), "ok")
+			meterUsage(w.store, pending)
+			return
+		}
+		writeBatchLatency.Observe(time.Since(start).Seconds(), "error")
+		written, failed := splitInsert(pending, err)
+		meterUsage(w.store, written)
+		if !unreachable(err) {
+			log.Error("write conversation batch refused, dropped", len(failed), err)
+			writeDropped.Add(float64(len(failed)), "insert_failed")
+			return
+		}
+		if try >= w.conf.MaxRetry {
+			log.Error("write conversation batch failed, dropped", len(failed), err)
+			writeDropped.Add(float64(len(failed)), "insert_failed")
+			return
+		}
+		pending = failed
+		log.Warn("write conversation batch error, retry in", backoff, len(pending), err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > time.Millisecond*maxWriteRetryBackoff {
+			backoff = time.Millisecond * maxWriteRetryBackoff
+		}
+	}
+}
+
+// splitInsert returns the turns of msgs a failed insert wrote and the ones
+// it did not, with the sequence numbers they were given. Without an
+// *InsertError none count as written.
+func splitInsert(msgs []Message, err error) (written, failed []Message) {
+	var insertErr *InsertError
+	if !errors.As(err, &insertErr) {
+		return nil, msgs
+	}
+	isFailed := make(map[int]bool, len(insertErr.Failed))
+	failed = make([]Message, 0, len(insertErr.Failed))
+	for i, idx := range insertErr.Failed {
+		isFailed[idx] = true
+		msg := msgs[idx]
+		msg.Seq = insertErr.Seq[i]
+		failed = append(failed, msg)
+	}
+	written = make([]Message, 0, len(msgs)-len(failed))
+	for i, msg := range msgs {
+		if !isFailed[i] {
+			written = append(written, msg)
+		}
+	}
+	return written, failed
+}
+
+// meterUsage adds written turns to the usage buckets. Turns kept in the
+// write-ahead log of a degraded store are metered when replayed.
+func meterUsage(store ConversationStore, msgs []Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	if err := recordUsage(ctx, store, msgs); err != nil && !errors.Is(err, ErrStoreUnavailable) {
+		log.Error("meter usage error", err)
+	}
+}
+
+var writer *Writer
+
+// StartWriter starts the write-behind pipeline in front of Store.
+func StartWriter(conf WriterConfig) {
+	writer = NewWriter(Store, conf)
+}
+
+// WriteConversation queues msg for the write-behind pipeline, or inserts it
+// directly when the pipeline is not started.
+func WriteConversation(msg Message) error {
+	if writer == nil {
+		return InsertSingleConversation(msg)
+	}
+	return writer.Write(msg)
+}
+
+// withPending adds the queued turns of a conversation missing from the
+// stored ones, pending must be read before stored so no turn is missed while
+// it is flushed. newestFirst is the order of stored, limit caps the result
+// if positive.
+func withPending(stored, pending []Message, newestFirst bool, limit int) []Message {
+	if len(pending) == 0 {
+		return stored
+	}
+	seen := make(map[string]bool, len(stored))
+	for _, msg := range stored {
+		seen[msg.MessageId] = true
+	}
+	missing := make([]Message, 0, len(pending))
+	for _, msg := range pending {
+		if msg.MessageId == "" || !seen[msg.MessageId] {
+			missing = append(missing, msg)
+		}
+	}
+	if !newestFirst {
+		return append(stored, missing...)
+	}
+	merged := make([]Message, 0, len(missing)+len(stored))
+	for i := len(missing) - 1; i >= 0; i-- {
+		merged = append(merged, missing[i])
+	}
+	merged = append(merged, stored...)
+	if limit > 0 && len(merged) > limit {
+		merged = merged[:limit]
+	}
+	return merged
+}
+
+func pendingTurns(conversationId string) []Message {
+	if writer == nil {
+		return nil
+	}
+	return writer.Pending(conversationId)
+}
+
+// StopWriter flushes the queued turns, called on graceful shutdown.
+func StopWriter(ctx context.Context) error {
+	if writer == nil {
+		return nil
+	}
+	return writer.Close(ctx)
+}
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriterFlushOnClose(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	w := NewWriter(store, WriterConfig{BatchSize: 10, FlushInterval: 60000})
+	for i := 0; i < 25; i++ {
+		if err := w.Write(Message{ConversationId: "c", MessageId: fmt.Sprint(i), StartTime: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	all, _ := store.GetConversation(ctx, "c")
+	if len(all) != 25 {
+		t.Fatalf("expected 25 turns flushed, got %d", len(all))
+	}
+	if err := w.Write(Message{ConversationId: "c"}); err != ErrWriterClosed {
+		t.Fatal("write after close accepted", err)
+	}
+}
+
+func TestWriterRetry(t *testing.T) {
+	ctx := context.Background()
+	store := &flakyStore{memoryStore: NewMemoryStore(), down: true}
+	w := NewWriter(store, WriterConfig{BatchSize: 1, RetryBackoff: 10, MaxRetry: 10})
+	w.Write(Message{ConversationId: "c", MessageId: "m1"})
+	time.Sleep(time.Millisecond * 30)
+	store.setDown(false)
+	if err := w.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetMessage(ctx, "m1"); err != nil {
+		t.Fatal("turn not written after retry", err)
+	}
+}
+
+// blockedStore holds every insert until release is closed.
+type blockedStore struct {
+	*memoryStore
+	release chan struct{}
+}
+
+func (s *blockedStore) InsertConversations(ctx context.Context, msgs []Message) error {
+	<-s.release
+	return s.memoryStore.InsertConversations(ctx, msgs)
+}
+
+func TestWriterQueueFull(t *testing.T) {
+	store := &blockedStore{memoryStore: NewMemoryStore(), release: make(chan struct{})}
+	w := NewWriter(store, WriterConfig{QueueSize: 1, BatchSize: 1})
+	defer w.Close(context.Background())
+	defer close(store.release)
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		err = w.Write(Message{ConversationId: "c", MessageId: fmt.Sprint(i)})
+	}
+	if err != ErrWriteQueueFull {
+		t.Fatal("bounded queue never reported full", err)
+	}
+}
+
+func TestWriterPendingReads(t *testing.T) {
+	ctx := context.Background()
+	store := &blockedStore{memoryStore: NewMemoryStore(), release: make(chan struct{})}
+	now := time.Now().Unix()
+	store.memoryStore.InsertConversation(ctx, Message{ConversationId: "c", MessageId: "m1", StartTime: now})
+	prevStore, prevWriter := Store, writer
+	Store = store
+	writer = NewWriter(store, WriterConfig{BatchSize: 1})
+	defer func() { Store, writer = prevStore, prevWriter }()
+	if err := WriteConversation(Message{ConversationId: "c", MessageId: "m2", StartTime: now + 1}); err != nil {
+		t.Fatal(err)
+	}
+	//the insert of m2 is held, reads still see it
+	msgLog, err := GetResentConversation("c", now-10)
+	if err != nil || len(msgLog) != 2 || msgLog[0].MessageId != "m2" || msgLog[1].MessageId != "m1" {
+		t.Fatalf("pending turn missing from history: %v %v", msgLog, err)
+	}
+	all, err := GetConversation(ctx, "c")
+	if err != nil || len(all) != 2 || all[1].MessageId != "m2" {
+		t.Fatalf("pending turn missing from conversation: %v %v", all, err)
+	}
+	close(store.release)
+	if err := writer.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(writer.Pending("c")) != 0 {
+		t.Fatal("written turn still pending")
+	}
+	if all, _ := GetConversation(ctx, "c"); len(all) != 2 {
+		t.Fatalf("written turn read twice: %v", all)
+	}
+}
+
+// partialStore writes the first turn of every batch and fails the rest
+// with err, numbering them the way a batch insert does.
+type partialStore struct {
+	*memoryStore
+	lock    sync.Mutex
+	err     error
+	batches [][]Message
+}
+
+func (s *partialStore) InsertConversations(ctx context.Context, msgs []Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.batches = append(s.batches, msgs)
+	if s.err == nil {
+		return s.memoryStore.InsertConversations(ctx, msgs)
+	}
+	s.memoryStore.InsertConversation(ctx, msgs[0])
+	failed := &InsertError{Err: s.err}
+	for i := range msgs[1:] {
+		failed.add(i+1, int64(100+i))
+	}
+	s.err = nil
+	return failed
+}
+
+func TestWriterRetryFailedTurns(t *testing.T) {
+	ctx := context.Background()
+	batch := []Message{{ConversationId: "c", MessageId: "m1"}, {ConversationId: "c", MessageId: "m2"}, {ConversationId: "c", MessageId: "m3"}}
+
+	store := &partialStore{memoryStore: NewMemoryStore(), err: errFlakyDown}
+	w := NewWriter(store, WriterConfig{BatchSize: 3, RetryBackoff: 1, MaxRetry: 3})
+	for _, msg := range batch {
+		w.Write(msg)
+	}
+	if err := w.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.batches) != 2 || len(store.batches[1]) != 2 || store.batches[1][0].MessageId != "m2" || store.batches[1][0].Seq != 100 {
+		t.Fatalf("retry should resend only the failed turns with their numbers: %v", store.batches)
+	}
+	if all, _ := store.GetConversation(ctx, "c"); len(all) != 3 {
+		t.Fatalf("turns written twice or lost: %v", all)
+	}
+
+	//a refused batch is not retried
+	store = &partialStore{memoryStore: NewMemoryStore(), err: errors.New("document invalid")}
+	w = NewWriter(store, WriterConfig{BatchSize: 3, RetryBackoff: 1, MaxRetry: 3})
+	for _, msg := range batch {
+		w.Write(msg)
+	}
+	if err := w.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.batches) != 1 {
+		t.Fatalf("refused batch retried: %v", store.batches)
+	}
+	if _, err := store.GetMessage(ctx, "m1"); err != nil {
+		t.Fatal("written turn of a refused batch lost", err)
+	}
+}
@@ -0,0 +1,343 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMalformed      = errors.New("malformed token")
+	ErrUnsupportedAlg = errors.New("unsupported jwt algorithm")
+	ErrUnknownKey     = errors.New("no key to verify the token")
+	ErrSignature      = errors.New("invalid token signature")
+	ErrExpired        = errors.New("token expired")
+	ErrNotYetValid    = errors.New("token not valid yet")
+	ErrIssuer         = errors.New("unexpected token issuer")
+	ErrAudience       = errors.New("unexpected token audience")
+	ErrMissingClaim   = errors.New("missing token claim")
+)
+
+const defaultLeeway = 60
+
+// ClaimsConfig names the claims an identity is read from. Nested claims are
+// named by path, e.g. realm_access.roles.
+type ClaimsConfig struct {
+	User   string `yaml:"user"`   //default sub
+	Tenant string `yaml:"tenant"` //default tenant
+	Models string `yaml:"models"` //default models, a list or space separated
+	Scopes string `yaml:"scopes"` //default scope, a list or space separated
+	Roles  string `yaml:"roles"`  //default roles, a list or space separated
+}
+
+type Config struct {
+	Enable   bool   `yaml:"enable"`
+	Issuer   string `yaml:"issuer"`   //checked when set
+	Audience string `yaml:"audience"` //checked when set
+	// JWKSFile is a key set file, read again when a token names a key it
+	// does not know and the file has changed.
+	JWKSFile string       `yaml:"jwks_file"`
+	Keys     []Key        `yaml:"keys"`
+	Leeway   int          `yaml:"leeway"` //seconds of clock skew allowed, default 60
+	Claims   ClaimsConfig `yaml:"claims"`
+}
+
+// Identity is who a verified token speaks for.
+type Identity struct {
+	Issuer    string
+	Subject   string
+	UserId    string
+	Tenant    string
+	Models    []string //empty if the token does not limit models
+	Scopes    []string
+	Roles     []string
+	ExpiresAt int64
+}
+
+// Verifier checks tokens against the configured keys.
+type Verifier struct {
+	conf   Config
+	static []*verifyKey
+	leeway time.Duration
+	now    func() time.Time
+
+	lock     sync.RWMutex
+	jwks     []*verifyKey
+	jwksTime time.Time //modification time of the loaded jwks file
+}
+
+func New(conf Config) (*Verifier, error) {
+	v := &Verifier{conf: conf, now: time.Now}
+	if conf.Leeway == 0 {
+		conf.Leeway = defaultLeeway
+	}
+	v.leeway = time.Duration(conf.Leeway) * time.Second
+	defaults := map[*string]string{&v.conf.Claims.User: "sub", &v.conf.Claims.Tenant: "tenant", &v.conf.Claims.Models: "models", &v.conf.Claims.Scopes: "scope", &v.conf.Claims.Roles: "roles"}
+	for field, value := range defaults {
+		if *field == "" {
+			*field = value
+		}
+	}
+	for _, k := range conf.Keys {
+		key, err := parseKey(k)
+		if err != nil {
+			return nil, err
+		}
+		v.static = append(v.static, key)
+	}
+	if conf.JWKSFile != "" {
+		if _, err := v.reloadJWKS(); err != nil {
+			return nil, err
+		}
+	}
+	if len(v.static) == 0 && len(v.jwks) == 0 {
+		return nil, errors.New("jwt needs keys or a jwks file")
+	}
+	return v, nil
+}
+
+// reloadJWKS reads the key set file if it changed since the last read.
+func (v *Verifier) reloadJWKS() (bool, error) {
+	info, err := os.Stat(v.conf.JWKSFile)
+	if err != nil {
+		return false, err
+	}
+	v.lock.RLock()
+	unchanged := info.ModTime().Equal(v.jwksTime)
+	v.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(v.conf.JWKSFile)
+	if err != nil {
+		return false, err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return false, err
+	}
+	v.lock.Lock()
+	v.jwks = keys
+	v.jwksTime = info.ModTime()
+	v.lock.Unlock()
+	return true, nil
+}
+
+// candidates are the keys that may have signed a token with kid and alg.
+func (v *Verifier) candidates(kid, alg string) []*verifyKey {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	keys := make([]*verifyKey, 0, 1)
+	for _, set := range [][]*verifyKey{v.static, v.jwks} {
+		for _, key := range set {
+			if key.alg == alg && (kid == "" || key.kid == "" || key.kid == kid) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func decodeSegment(s string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ErrMalformed
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
+
+// LooksLikeToken reports whether s has the three segments of a jwt.
+func LooksLikeToken(s string) bool {
+	return strings.Count(s, ".") == 2
+}
+
+// Verify checks the signature, expiry, issuer and audience of token and
+// returns its identity.
+func (v *Verifier) Verify(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, err
+	}
+	switch h.Alg {
+	case RS256, ES256, HS256:
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedAlg, h.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	keys := v.candidates(h.Kid, h.Alg)
+	if len(keys) == 0 && v.conf.JWKSFile != "" {
+		//the issuer may have rotated its keys
+		if reloaded, err := v.reloadJWKS(); err == nil && reloaded {
+			keys = v.candidates(h.Kid, h.Alg)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, ErrUnknownKey
+	}
+	verified := false
+	for _, key := range keys {
+		if verifySignature(key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrSignature
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return v.identity(claims)
+}
+
+func verifySignature(key *verifyKey, signed, sig []byte) bool {
+	sum := sha256.Sum256(signed)
+	switch pub := key.key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	case *ecdsa.PublicKey:
+		//r and s, 32 bytes each
+		if len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, sum[:], r, s)
+	case []byte:
+		mac := hmac.New(sha256.New, pub)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	}
+	return false
+}
+
+func (v *Verifier) identity(claims map[string]interface{}) (*Identity, error) {
+	now := v.now()
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return nil, fmt.Errorf("%w exp", ErrMissingClaim)
+	}
+	if now.Add(-v.leeway).Unix() >= exp {
+		return nil, ErrExpired
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(v.leeway).Unix() < nbf {
+		return nil, ErrNotYetValid
+	}
+	iss, _ := claims["iss"].(string)
+	if v.conf.Issuer != "" && iss != v.conf.Issuer {
+		return nil, ErrIssuer
+	}
+	if v.conf.Audience != "" && !contains(stringsClaim(claims, "aud"), v.conf.Audience) {
+		return nil, ErrAudience
+	}
+	sub, _ := claims["sub"].(string)
+	id := &Identity{
+		Issuer:    iss,
+		Subject:   sub,
+		Tenant:    stringClaim(claims, v.conf.Claims.Tenant),
+		Models:    stringsClaim(claims, v.conf.Claims.Models),
+		Scopes:    stringsClaim(claims, v.conf.Claims.Scopes),
+		Roles:     stringsClaim(claims, v.conf.Claims.Roles),
+		ExpiresAt: exp,
+	}
+	id.UserId = stringClaim(claims, v.conf.Claims.User)
+	if id.UserId == "" {
+		return nil, fmt.Errorf("%w %s", ErrMissingClaim, v.conf.Claims.User)
+	}
+	return id, nil
+}
+
+// lookup follows a dotted claim path.
+func lookup(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[name]
+	}
+	return value
+}
+
+func numericClaim(claims map[string]interface{}, name string) (int64, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	if i, err := n.Int64(); err == nil {
+		return i, true
+	}
+	f, err := n.Float64()
+	return int64(f), err == nil
+}
+
+func stringClaim(claims map[string]interface{}, path string) string {
+	switch value := lookup(claims, path).(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	}
+	return ""
+}
+
+// stringsClaim reads a list claim, given as an array or space separated.
+func stringsClaim(claims map[string]interface{}, path string) []string {
+	switch value := lookup(claims, path).(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok && s != "" {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
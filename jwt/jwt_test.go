@@ -0,0 +1,147 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func sign(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	signed := b64(h) + "." + b64(c)
+	sum := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, sum[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func writeJWKS(t *testing.T, path string, keys ...*rsa.PrivateKey) {
+	set := make([]map[string]string, 0)
+	for i, key := range keys {
+		set = append(set, map[string]string{
+			"kty": "RSA", "use": "sig", "kid": "rsa" + string(rune('0'+i)),
+			"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	data, _ := json.Marshal(map[string]interface{}{"keys": set})
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	ecPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	secret := []byte("portal-secret")
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwks, rsaKey)
+
+	v, err := New(Config{
+		Issuer:   "https://portal",
+		Audience: "gateway",
+		JWKSFile: jwks,
+		Keys: []Key{
+			{Kid: "ec", Alg: ES256, PublicKey: ecPEM},
+			{Kid: "hs", Alg: HS256, Secret: string(secret)},
+		},
+		Claims: ClaimsConfig{Tenant: "org.id"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": "https://portal", "aud": []string{"gateway", "other"}, "sub": "u1", "exp": now + 600,
+			"org": map[string]string{"id": "acme"}, "models": "m1 m2", "scope": "openid chat", "roles": []string{"viewer"}}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	for name, token := range map[string]string{
+		RS256: sign(t, RS256, "rsa0", rsaKey, claims(nil)),
+		ES256: sign(t, ES256, "ec", ecKey, claims(nil)),
+		HS256: sign(t, HS256, "hs", secret, claims(nil)),
+	} {
+		id, err := v.Verify(token)
+		if err != nil || id.UserId != "u1" || id.Tenant != "acme" || len(id.Models) != 2 || id.Scopes[1] != "chat" || id.Roles[0] != "viewer" {
+			t.Fatal(name, "unexpected identity", id, err)
+		}
+	}
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	hsToken := sign(t, HS256, "hs", secret, claims(nil))
+	for name, tc := range map[string]struct {
+		token string
+		want  error
+	}{
+		"expired":      {sign(t, HS256, "hs", secret, claims(map[string]interface{}{"exp": now - 120})), ErrExpired},
+		"no exp":       {sign(t, HS256, "hs", secret, claims(map[string]interface{}{"exp": nil})), ErrMissingClaim},
+		"not yet":      {sign(t, HS256, "hs", secret, claims(map[string]interface{}{"nbf": now + 600})), ErrNotYetValid},
+		"issuer":       {sign(t, HS256, "hs", secret, claims(map[string]interface{}{"iss": "evil"})), ErrIssuer},
+		"audience":     {sign(t, HS256, "hs", secret, claims(map[string]interface{}{"aud": "other"})), ErrAudience},
+		"no user":      {sign(t, HS256, "hs", secret, claims(map[string]interface{}{"sub": ""})), ErrMissingClaim},
+		"wrong secret": {sign(t, HS256, "hs", []byte("guess"), claims(nil)), ErrSignature},
+		"wrong key":    {sign(t, RS256, "rsa0", other, claims(nil)), ErrSignature},
+		"unknown kid":  {sign(t, RS256, "rsa9", rsaKey, claims(nil)), ErrUnknownKey},
+		"none":         {b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"u1"}`)) + ".", ErrUnsupportedAlg},
+		//a secret must not verify a token claiming the rsa key's algorithm
+		"alg swap": {sign(t, HS256, "rsa0", secret, claims(nil)), ErrUnknownKey},
+		"tampered": {hsToken[:len(hsToken)-2] + "AA", ErrSignature},
+		"garbage":  {"a.b", ErrMalformed},
+	} {
+		if _, err := v.Verify(tc.token); !errors.Is(err, tc.want) {
+			t.Fatal(name, "want", tc.want, "got", err)
+		}
+	}
+
+	//a rotated key set is picked up when a token names a new key
+	writeJWKS(t, jwks, rsaKey, other)
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(jwks, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(sign(t, RS256, "rsa1", other, claims(nil))); err != nil {
+		t.Fatal("rotated key not loaded", err)
+	}
+}
@@ -0,0 +1,198 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	HS256 = "HS256"
+)
+
+// Key is a verification key from config.
+type Key struct {
+	Kid string `yaml:"kid"`
+	Alg string `yaml:"alg"` //RS256, ES256 or HS256
+	// Secret is the shared secret of HS256.
+	Secret string `yaml:"secret"`
+	// PublicKey is a PEM public key or certificate of RS256 and ES256, or the
+	// path of a file holding one.
+	PublicKey string `yaml:"public_key"`
+}
+
+// verifyKey is a parsed key, bound to the one algorithm it may verify, so a
+// token can not pick a weaker one.
+type verifyKey struct {
+	kid string
+	alg string
+	key interface{} //*rsa.PublicKey, *ecdsa.PublicKey or []byte
+}
+
+func parseKey(k Key) (*verifyKey, error) {
+	switch k.Alg {
+	case HS256:
+		if k.Secret == "" {
+			return nil, fmt.Errorf("jwt key %q: HS256 needs a secret", k.Kid)
+		}
+		return &verifyKey{kid: k.Kid, alg: k.Alg, key: []byte(k.Secret)}, nil
+	case RS256, ES256:
+	default:
+		return nil, fmt.Errorf("jwt key %q: %w %q", k.Kid, ErrUnsupportedAlg, k.Alg)
+	}
+	data := []byte(k.PublicKey)
+	if !strings.HasPrefix(strings.TrimSpace(k.PublicKey), "-----BEGIN") {
+		var err error
+		if data, err = ioutil.ReadFile(k.PublicKey); err != nil {
+			return nil, fmt.Errorf("jwt key %q: %w", k.Kid, err)
+		}
+	}
+	pub, err := parsePEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("jwt key %q: %w", k.Kid, err)
+	}
+	key := &verifyKey{kid: k.Kid, alg: k.Alg, key: pub}
+	if err := key.check(); err != nil {
+		return nil, fmt.Errorf("jwt key %q: %w", k.Kid, err)
+	}
+	return key, nil
+}
+
+func parsePEM(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// check makes sure the key type fits the algorithm.
+func (k *verifyKey) check() error {
+	switch pub := k.key.(type) {
+	case *rsa.PublicKey:
+		if k.alg != RS256 {
+			return errors.New("rsa key for " + k.alg)
+		}
+	case *ecdsa.PublicKey:
+		if k.alg != ES256 || pub.Curve != elliptic.P256() {
+			return errors.New("ES256 needs a P-256 key")
+		}
+	case []byte:
+		if k.alg != HS256 {
+			return errors.New("secret for " + k.alg)
+		}
+	default:
+		return errors.New("unsupported key type")
+	}
+	return nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// parseJWKS reads the signing keys of a key set. Encryption keys and keys
+// of other algorithms are skipped.
+func parseJWKS(data []byte) ([]*verifyKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("decode jwks: %w", err)
+	}
+	keys := make([]*verifyKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		key, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("jwks key %q: %w", k.Kid, err)
+		}
+		if key == nil || (k.Alg != "" && k.Alg != key.alg) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// parse returns nil for key types this package does not verify with.
+func (k *jwk) parse() (*verifyKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64Int(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &verifyKey{kid: k.Kid, alg: RS256, key: &rsa.PublicKey{N: n, E: int(e.Int64())}}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := b64Int(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64Int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point not on P-256")
+		}
+		return &verifyKey{kid: k.Kid, alg: ES256, key: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}, nil
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("invalid secret")
+		}
+		return &verifyKey{kid: k.Kid, alg: HS256, key: secret}, nil
+	}
+	return nil, nil
+}
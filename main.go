@@ -3,8 +3,13 @@ package main
 import (
 	"context"
 	"fmt"
+	"gateway/cache"
+	"gateway/common"
 	"gateway/db"
 	"gateway/log"
+	"gateway/pricing"
+	"gateway/ratelimit"
+	"gateway/redact"
 	"gateway/rpc"
 	"gateway/trie"
 	"io/ioutil"
@@ -32,6 +37,8 @@ OPTIONS:
 )
 var app *cli.App
 
+const ShutdownTimeout = time.Second * 30
+
 var (
 	configPathFlag = cli.StringFlag{
 		Name:  "config",
@@ -55,6 +62,12 @@ func init() {
 	app.Version = "v1.0.0"
 	app.Commands = []cli.Command{
 		commandStart,
+		commandPurge,
+		commandMigrate,
+		commandReEncrypt,
+		commandExportDataset,
+		commandAPIKey,
+		commandUsage,
 	}
 
 	cli.CommandHelpTemplate = OriginCommandHelpTemplate
@@ -79,19 +92,30 @@ var commandStart = cli.Command{
 }
 
 type ProxyConfig struct {
-	Port             string              `yaml:"port"`
-	OpenAiKey        []string            `yaml:"openai_key"`
-	MaxPendingLength int                 `yaml:"max_pending"`
-	Host             string              `yaml:"host"`
-	ModelConfig      map[string][]string `yaml:"bs_model"`
-	MongoURI         string              `yaml:"mongo_uri"`
-	Sensitive        string              `yaml:"sensitive"`
+	Port             string                `yaml:"port"`
+	OpenAiKey        []string              `yaml:"openai_key"`
+	MaxPendingLength int                   `yaml:"max_pending"`
+	Host             string                `yaml:"host"`
+	ModelConfig      map[string][]string   `yaml:"bs_model"`
+	MongoURI         string                `yaml:"mongo_uri"`
+	Store            db.Config             `yaml:"store"`
+	Sensitive        string                `yaml:"sensitive"`
+	Upstream         common.UpstreamConfig `yaml:"upstream"`
+	Cache            cache.Config          `yaml:"cache"`
+	Coalesce         bool                  `yaml:"coalesce"`
+	SemanticCache    cache.SemanticConfig  `yaml:"semantic_cache"`
+	Retention        db.RetentionConfig    `yaml:"retention"`
+	Redaction        redact.Config         `yaml:"redaction"`
+	Auth             rpc.AuthConfig        `yaml:"auth"`
+	Session          rpc.SessionConfig     `yaml:"session"`
+	RateLimit        ratelimit.Config      `yaml:"rate_limit"`
+	Quota            rpc.QuotaConfig       `yaml:"quota"`
+	Pricing          pricing.Config        `yaml:"pricing"`
+	Admin            rpc.AdminConfig       `yaml:"admin"`
 }
 
 func Start(ctx *cli.Context) {
-	defer func() {
-		db.MgoCli.Disconnect(context.Background())
-	}()
+	defer db.Close()
 	logLevel := ctx.Int(logLevelFlag.Name)
 	fmt.Println("log level", logLevel)
 	logPath := ctx.String(logFilePath.Name)
@@ -121,10 +145,29 @@ func Start(ctx *cli.Context) {
 		panic(err)
 	}
 
-	//init db
-	db.MongoURI = conf.MongoURI
-	db.Init()
+	common.Upstream = conf.Upstream
 
+	//init db
+	if conf.MongoURI != "" {
+		db.MongoURI = conf.MongoURI
+	}
+	err = db.Init(conf.Store)
+	if err != nil {
+		panic(err)
+	}
+	db.StartWriter(conf.Store.Writer)
+	db.StartRetention(conf.Retention)
+
+	rpc.CacheConf = conf.Cache
+	rpc.CoalesceRequests = conf.Coalesce
+	rpc.SemanticCacheConf = conf.SemanticCache
+	rpc.RedactionConf = conf.Redaction
+	rpc.AuthConf = conf.Auth
+	rpc.SessionConf = conf.Session
+	rpc.RateLimitConf = conf.RateLimit
+	rpc.QuotaConf = conf.Quota
+	rpc.PricingConf = conf.Pricing
+	rpc.AdminConf = conf.Admin
 	rpc.InitRpcService(conf.Port, conf.OpenAiKey, conf.MaxPendingLength, conf.ModelConfig)
 
 	contx := context.Background()
@@ -133,6 +176,16 @@ func Start(ctx *cli.Context) {
 		log.Fatal(err)
 	}
 	waitToExit()
+
+	//stop taking requests, then flush pending conversation writes
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := rpc.RpcServer.Stop(shutdownCtx); err != nil {
+		log.Error("stop rpc server error", err)
+	}
+	if err := db.StopWriter(shutdownCtx); err != nil {
+		log.Error("flush conversation writes error", err)
+	}
 }
 
 func loadConfig(ctx *cli.Context) ProxyConfig {
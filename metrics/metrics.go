@@ -0,0 +1,251 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	registryLock sync.Mutex
+	registry     []collector
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+func register(c collector) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = append(registry, c)
+}
+
+// vec keeps one value per label combination.
+type vec struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	lock       sync.Mutex
+	values     map[string]float64
+}
+
+func newVec(kind, name, help string, labelNames []string) *vec {
+	return &vec{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		values:     make(map[string]float64),
+	}
+}
+
+func (v *vec) labelKey(labelValues []string) string {
+	return labelKey(v.name, v.labelNames, labelValues)
+}
+
+func labelKey(metric string, labelNames, labelValues []string) string {
+	if len(labelValues) != len(labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", metric, len(labelNames), len(labelValues)))
+	}
+	pairs := make([]string, 0, len(labelValues))
+	for i, name := range labelNames {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, labelValues[i]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (v *vec) add(delta float64, labelValues []string) {
+	key := v.labelKey(labelValues)
+	v.lock.Lock()
+	v.values[key] += delta
+	v.lock.Unlock()
+}
+
+func (v *vec) set(value float64, labelValues []string) {
+	key := v.labelKey(labelValues)
+	v.lock.Lock()
+	v.values[key] = value
+	v.lock.Unlock()
+}
+
+func (v *vec) get(labelValues []string) float64 {
+	key := v.labelKey(labelValues)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.values[key]
+}
+
+func (v *vec) write(w io.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "" {
+			fmt.Fprintf(w, "%s %v\n", v.name, v.values[k])
+			continue
+		}
+		fmt.Fprintf(w, "%s{%s} %v\n", v.name, k, v.values[k])
+	}
+}
+
+type Counter struct {
+	*vec
+}
+
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{newVec("counter", name, help, labelNames)}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	c.add(delta, labelValues)
+}
+
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.get(labelValues)
+}
+
+type Gauge struct {
+	*vec
+}
+
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	g := &Gauge{newVec("gauge", name, help, labelNames)}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.set(value, labelValues)
+}
+
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.add(delta, labelValues)
+}
+
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.get(labelValues)
+}
+
+// LatencyBuckets are upper bounds in seconds for request and batch latencies.
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+	lock       sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	h := &Histogram{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    append([]float64{}, buckets...),
+		series:     make(map[string]*histogramSeries),
+	}
+	sort.Float64s(h.buckets)
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := labelKey(h.name, h.labelNames, labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+// Count returns the number of observations for the label values.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	key := labelKey(h.name, h.labelNames, labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if series, ok := h.series[key]; ok {
+		return series.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		series := h.series[k]
+		prefix := k
+		if prefix != "" {
+			prefix += ","
+		}
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%v\"} %d\n", h.name, prefix, bound, series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, series.count)
+		labels := ""
+		if k != "" {
+			labels = "{" + k + "}"
+		}
+		fmt.Fprintf(w, "%s_sum%s %v\n%s_count%s %d\n", h.name, labels, series.sum, h.name, labels, series.count)
+	}
+}
+
+// Handler serves all registered metrics in the prometheus text format.
+func Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		c.Header("Content-Type", "text/plain; version=0.0.4")
+		WriteText(c.Writer)
+	}
+}
+
+func WriteText(w io.Writer) {
+	registryLock.Lock()
+	collectors := append([]collector{}, registry...)
+	registryLock.Unlock()
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
@@ -0,0 +1,158 @@
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const DefaultCurrency = "USD"
+
+var DefaultAlertPercents = []int{50, 80, 100}
+
+// Price is what 1k tokens of a model cost from its effective date on. List
+// prices of openai and the internal cost of self hosted workers are given
+// the same way.
+type Price struct {
+	Model string `yaml:"model"`
+	// Upstream limits the price to a worker url or openai key hash, as stored
+	// on the turns. Prices of the upstream win over those without one.
+	Upstream        string  `yaml:"upstream"`
+	From            string  `yaml:"from"` //2006-01-02 or RFC 3339, UTC, always if not set
+	PromptPer1K     float64 `yaml:"prompt_per_1k"`
+	CompletionPer1K float64 `yaml:"completion_per_1k"`
+}
+
+// Budget is what a tenant may spend in a calendar month (UTC). An alert is
+// sent when the cost passes each of the percents.
+type Budget struct {
+	Monthly       float64 `yaml:"monthly"`
+	AlertPercents []int   `yaml:"alert_percents"` //default 50, 80 and 100
+}
+
+type Config struct {
+	Enable   bool              `yaml:"enable"`
+	Currency string            `yaml:"currency"` //default USD
+	Prices   []Price           `yaml:"prices"`
+	Budgets  map[string]Budget `yaml:"budgets"`
+	// AlertWebhook is posted the json of every budget alert, they are logged
+	// in any case.
+	AlertWebhook string `yaml:"alert_webhook"`
+}
+
+type price struct {
+	Price
+	from time.Time
+}
+
+// Table finds the price of a turn.
+type Table struct {
+	conf   Config
+	prices map[string][]price //model -> prices, newest first
+}
+
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func New(conf Config) (*Table, error) {
+	if conf.Currency == "" {
+		conf.Currency = DefaultCurrency
+	}
+	t := &Table{conf: conf, prices: make(map[string][]price)}
+	for _, p := range conf.Prices {
+		if p.Model == "" {
+			return nil, errors.New("price without model")
+		}
+		if p.PromptPer1K < 0 || p.CompletionPer1K < 0 {
+			return nil, fmt.Errorf("negative price of %s", p.Model)
+		}
+		from, err := parseDate(p.From)
+		if err != nil {
+			return nil, fmt.Errorf("price of %s: invalid from %q", p.Model, p.From)
+		}
+		t.prices[p.Model] = append(t.prices[p.Model], price{Price: p, from: from})
+	}
+	for model, prices := range t.prices {
+		sort.SliceStable(prices, func(i, j int) bool { return prices[i].from.After(prices[j].from) })
+		for i := 1; i < len(prices); i++ {
+			if prices[i].from.Equal(prices[i-1].from) && prices[i].Upstream == prices[i-1].Upstream {
+				return nil, fmt.Errorf("two prices of %s %s from %s", model, prices[i].Upstream, prices[i].From)
+			}
+		}
+	}
+	for tenant, budget := range conf.Budgets {
+		if budget.Monthly <= 0 {
+			return nil, fmt.Errorf("budget of %s must be positive", tenant)
+		}
+	}
+	return t, nil
+}
+
+func (t *Table) Currency() string {
+	return t.conf.Currency
+}
+
+// Lookup returns the price of model at upstream in effect at at.
+func (t *Table) Lookup(model, upstream string, at time.Time) (Price, bool) {
+	var fallback *price
+	for i := range t.prices[model] {
+		p := &t.prices[model][i]
+		if p.from.After(at) {
+			continue
+		}
+		if p.Upstream == upstream {
+			return p.Price, true
+		}
+		if p.Upstream == "" && fallback == nil {
+			fallback = p
+		}
+	}
+	if fallback == nil {
+		return Price{}, false
+	}
+	return fallback.Price, true
+}
+
+// Cost returns the cost of a turn, false if the model has no price.
+func (t *Table) Cost(model, upstream string, at time.Time, promptTokens, completionTokens int) (float64, bool) {
+	p, ok := t.Lookup(model, upstream, at)
+	if !ok {
+		return 0, false
+	}
+	return (float64(promptTokens)*p.PromptPer1K + float64(completionTokens)*p.CompletionPer1K) / 1000, true
+}
+
+// Budget returns the monthly budget of tenant.
+func (t *Table) Budget(tenant string) (Budget, bool) {
+	budget, ok := t.conf.Budgets[tenant]
+	if ok && len(budget.AlertPercents) == 0 {
+		budget.AlertPercents = DefaultAlertPercents
+	}
+	return budget, ok
+}
+
+// Reached returns the alert percents of budget that spent reached, lowest
+// first.
+func (b Budget) Reached(spent float64) []int {
+	reached := make([]int, 0)
+	percents := append([]int(nil), b.AlertPercents...)
+	sort.Ints(percents)
+	for _, pct := range percents {
+		if spent >= b.Monthly*float64(pct)/100 {
+			reached = append(reached, pct)
+		}
+	}
+	return reached
+}
+
+func (t *Table) AlertWebhook() string {
+	return t.conf.AlertWebhook
+}
@@ -0,0 +1,64 @@
+package pricing
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTable(t *testing.T) {
+	table, err := New(Config{
+		Prices: []Price{
+			{Model: "gpt", From: "2024-01-01", PromptPer1K: 1.5, CompletionPer1K: 2},
+			{Model: "gpt", From: "2024-06-01", PromptPer1K: 0.5, CompletionPer1K: 1.5},
+			{Model: "gpt", Upstream: "sha256:00", From: "2024-01-01", PromptPer1K: 1, CompletionPer1K: 1},
+			{Model: "m1", PromptPer1K: 0.2, CompletionPer1K: 0.2},
+		},
+		Budgets: map[string]Budget{"acme": {Monthly: 100}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Currency() != DefaultCurrency {
+		t.Fatal("unexpected currency", table.Currency())
+	}
+	may := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	june := time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		model, upstream string
+		at              time.Time
+		cost            float64
+		ok              bool
+	}{
+		{"gpt", "http://worker", may, 3.5, true},
+		{"gpt", "http://worker", june, 2, true},
+		{"gpt", "sha256:00", june, 2, true},
+		{"gpt", "", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), 0, false},
+		{"m1", "http://worker", may, 0.4, true},
+		{"m2", "", may, 0, false},
+	} {
+		cost, ok := table.Cost(c.model, c.upstream, c.at, 1000, 1000)
+		if cost != c.cost || ok != c.ok {
+			t.Fatal("unexpected cost", c, cost, ok)
+		}
+	}
+
+	budget, ok := table.Budget("acme")
+	if !ok || !reflect.DeepEqual(budget.Reached(85), []int{50, 80}) || len(budget.Reached(10)) != 0 {
+		t.Fatal("unexpected budget", budget)
+	}
+	if _, ok := table.Budget("other"); ok {
+		t.Fatal("budget of a tenant without one")
+	}
+
+	for _, conf := range []Config{
+		{Prices: []Price{{PromptPer1K: 1}}},
+		{Prices: []Price{{Model: "gpt", From: "June"}}},
+		{Prices: []Price{{Model: "gpt", From: "2024-01-01"}, {Model: "gpt", From: "2024-01-01"}}},
+		{Budgets: map[string]Budget{"acme": {}}},
+	} {
+		if _, err := New(conf); err == nil {
+			t.Fatal("invalid config accepted", conf)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const maxMemoryBuckets = 100000
+
+type bucket struct {
+	rate    Rate
+	level   float64
+	updated time.Time
+}
+
+// Memory keeps buckets in process, every gateway limits on its own.
+type Memory struct {
+	lock    sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]*bucket)}
+}
+
+func (m *Memory) Take(ctx context.Context, key string, rate Rate, n float64, force bool, now time.Time) (bool, float64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	b, ok := m.buckets[key]
+	if !ok {
+		if len(m.buckets) >= maxMemoryBuckets {
+			m.sweep(now)
+		}
+		b = &bucket{level: rate.Capacity, updated: now}
+		m.buckets[key] = b
+	}
+	b.rate = rate
+	level := refill(rate, b.level, b.updated, now)
+	taken, level := take(level, n, force)
+	b.level = level
+	b.updated = now
+	return taken, level, nil
+}
+
+// sweep drops the buckets that refilled, they are the same as new ones.
+func (m *Memory) sweep(now time.Time) {
+	for key, b := range m.buckets {
+		if refill(b.rate, b.level, b.updated, now) >= b.rate.Capacity {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"gateway/db"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const mongoCollection = "rate_limits"
+
+const mongoTimeout = time.Second * 5
+
+type mongoBucket struct {
+	Key      string    `bson:"_id"`
+	Level    float64   `bson:"level"`
+	Taken    bool      `bson:"taken"`
+	Updated  time.Time `bson:"updated"`
+	ExpireAt time.Time `bson:"expireAt"`
+}
+
+// Mongo shares buckets between gateway replicas. A take is one atomic
+// update, buckets that refilled are removed by a TTL index.
+type Mongo struct {
+	collection *mongo.Collection
+}
+
+func NewMongo() (*Mongo, error) {
+	if db.MgoCli == nil {
+		return nil, errors.New("mongo rate limit backend needs a mongo connection")
+	}
+	m := &Mongo{collection: db.MgoCli.Database(db.DatabaseName).Collection(mongoCollection)}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := m.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expireAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Mongo) Take(ctx context.Context, key string, rate Rate, n float64, force bool, now time.Time) (bool, float64, error) {
+	//refill by the ms since the last take, new buckets start full
+	elapsed := bson.D{{Key: "$max", Value: bson.A{0, bson.D{{Key: "$subtract", Value: bson.A{now, bson.D{{Key: "$ifNull", Value: bson.A{"$updated", now}}}}}}}}}
+	level := bson.D{{Key: "$min", Value: bson.A{rate.Capacity, bson.D{{Key: "$add", Value: bson.A{
+		bson.D{{Key: "$ifNull", Value: bson.A{"$level", rate.Capacity}}},
+		bson.D{{Key: "$multiply", Value: bson.A{elapsed, rate.PerSecond / 1000}}},
+	}}}}}}
+	var taken interface{} = true
+	if !force {
+		taken = bson.D{{Key: "$and", Value: bson.A{
+			bson.D{{Key: "$gte", Value: bson.A{"$level", n}}},
+			bson.D{{Key: "$gt", Value: bson.A{"$level", 0}}},
+		}}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{{Key: "level", Value: level}}}},
+		{{Key: "$set", Value: bson.D{{Key: "taken", Value: taken}}}},
+		{{Key: "$set", Value: bson.D{
+			{Key: "level", Value: bson.D{{Key: "$cond", Value: bson.A{"$taken", bson.D{{Key: "$subtract", Value: bson.A{"$level", n}}}, "$level"}}}},
+			{Key: "updated", Value: now},
+		}}},
+		//a bucket removed once it refilled reads as a new, full one
+		{{Key: "$set", Value: bson.D{{Key: "expireAt", Value: bson.D{{Key: "$add", Value: bson.A{
+			now.Add(time.Minute),
+			bson.D{{Key: "$multiply", Value: bson.A{bson.D{{Key: "$subtract", Value: bson.A{rate.Capacity, "$level"}}}, msPerToken(rate)}}},
+		}}}}}}},
+	}
+	opt := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var b mongoBucket
+	if err := m.collection.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: key}}, pipeline, opt).Decode(&b); err != nil {
+		return false, 0, err
+	}
+	return b.Taken, b.Level, nil
+}
+
+// msPerToken is how long the bucket takes to refill one token.
+func msPerToken(rate Rate) float64 {
+	if rate.PerSecond <= 0 {
+		return 0
+	}
+	return 1000 / rate.PerSecond
+}
@@ -0,0 +1,200 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	BackendMemory = "memory"
+	BackendMongo  = "mongo"
+)
+
+const (
+	kindRequests = "r"
+	kindTokens   = "t"
+	allModels    = "*"
+)
+
+var ErrUnknownBackend = errors.New("unknown rate limit backend")
+
+// Limit is what one identity may use per minute, 0 does not limit.
+type Limit struct {
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+	TokensPerMinute   int `yaml:"tokens_per_minute"`
+}
+
+// Tenant overrides the limits for the identities of a tenant.
+type Tenant struct {
+	Default *Limit           `yaml:"default"`
+	Models  map[string]Limit `yaml:"models"`
+}
+
+type Config struct {
+	Enable  bool              `yaml:"enable"`
+	Backend string            `yaml:"backend"` //memory or mongo
+	Default Limit             `yaml:"default"`
+	Models  map[string]Limit  `yaml:"models"`
+	Tenants map[string]Tenant `yaml:"tenants"`
+}
+
+// Rate is a token bucket: it holds up to Capacity and refills PerSecond.
+type Rate struct {
+	Capacity  float64
+	PerSecond float64
+}
+
+func perMinute(n int) Rate {
+	return Rate{Capacity: float64(n), PerSecond: float64(n) / 60}
+}
+
+// Store keeps token buckets.
+type Store interface {
+	// Take refills the bucket of key and takes n from it if it holds n and
+	// is not empty, or in any case when force is set, which may leave it in
+	// debt. It returns whether n was taken and the level left.
+	Take(ctx context.Context, key string, rate Rate, n float64, force bool, now time.Time) (bool, float64, error)
+}
+
+// Quota is the state of one bucket as reported to clients.
+type Quota struct {
+	Limit     int //0 when not limited
+	Remaining int
+	Reset     time.Duration //until the bucket is full again
+}
+
+// Decision is the outcome of a check.
+type Decision struct {
+	Allowed    bool
+	Requests   Quota
+	Tokens     Quota
+	RetryAfter time.Duration //set when not allowed
+}
+
+// Limiter applies the configured limits to identities.
+type Limiter struct {
+	conf  Config
+	store Store
+	now   func() time.Time
+}
+
+func New(conf Config) (*Limiter, error) {
+	var store Store
+	switch conf.Backend {
+	case "", BackendMemory:
+		store = NewMemory()
+	case BackendMongo:
+		mongo, err := NewMongo()
+		if err != nil {
+			return nil, err
+		}
+		store = mongo
+	default:
+		return nil, ErrUnknownBackend
+	}
+	return NewLimiter(conf, store), nil
+}
+
+func NewLimiter(conf Config, store Store) *Limiter {
+	return &Limiter{conf: conf, store: store, now: time.Now}
+}
+
+// limitFor returns the limit of tenant for model and the model its buckets
+// are kept for, allModels when the limit is not a model's own.
+func (l *Limiter) limitFor(tenant, model string) (Limit, string) {
+	if t, ok := l.conf.Tenants[tenant]; ok && tenant != "" {
+		if limit, ok := t.Models[model]; ok {
+			return limit, model
+		}
+		if t.Default != nil {
+			return *t.Default, allModels
+		}
+	}
+	if limit, ok := l.conf.Models[model]; ok {
+		return limit, model
+	}
+	return l.conf.Default, allModels
+}
+
+func bucketKey(id, model, kind string) string {
+	return id + "|" + model + "|" + kind
+}
+
+// Allow takes a request of id from its buckets. A request is refused while
+// the requests bucket is empty or the tokens bucket is in debt, tokens are
+// only known after the answer and are charged by Charge.
+func (l *Limiter) Allow(ctx context.Context, id, tenant, model string) (Decision, error) {
+	limit, scope := l.limitFor(tenant, model)
+	now := l.now()
+	d := Decision{Allowed: true}
+	if limit.TokensPerMinute > 0 {
+		rate := perMinute(limit.TokensPerMinute)
+		ok, level, err := l.store.Take(ctx, bucketKey(id, scope, kindTokens), rate, 0, false, now)
+		if err != nil {
+			return d, err
+		}
+		d.Tokens = quota(limit.TokensPerMinute, rate, level)
+		if !ok {
+			d.Allowed = false
+			d.RetryAfter = wait(rate, level, 1)
+			return d, nil
+		}
+	}
+	if limit.RequestsPerMinute > 0 {
+		rate := perMinute(limit.RequestsPerMinute)
+		ok, level, err := l.store.Take(ctx, bucketKey(id, scope, kindRequests), rate, 1, false, now)
+		if err != nil {
+			return d, err
+		}
+		d.Requests = quota(limit.RequestsPerMinute, rate, level)
+		if !ok {
+			d.Allowed = false
+			d.RetryAfter = wait(rate, level, 1)
+		}
+	}
+	return d, nil
+}
+
+// Charge takes the tokens an answer used from the tokens bucket of id.
+func (l *Limiter) Charge(ctx context.Context, id, tenant, model string, tokens int) error {
+	limit, scope := l.limitFor(tenant, model)
+	if limit.TokensPerMinute <= 0 || tokens <= 0 {
+		return nil
+	}
+	_, _, err := l.store.Take(ctx, bucketKey(id, scope, kindTokens), perMinute(limit.TokensPerMinute), float64(tokens), true, l.now())
+	return err
+}
+
+func quota(limit int, rate Rate, level float64) Quota {
+	remaining := int(math.Floor(level))
+	if remaining < 0 {
+		remaining = 0
+	}
+	return Quota{Limit: limit, Remaining: remaining, Reset: wait(rate, level, rate.Capacity)}
+}
+
+// wait is how long the bucket takes to refill from level to need.
+func wait(rate Rate, level, need float64) time.Duration {
+	if level >= need || rate.PerSecond <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil((need - level) / rate.PerSecond * float64(time.Second)))
+}
+
+// refill returns the level of a bucket last left at level at then.
+func refill(rate Rate, level float64, then, now time.Time) float64 {
+	if elapsed := now.Sub(then).Seconds(); elapsed > 0 {
+		level += elapsed * rate.PerSecond
+	}
+	return math.Min(level, rate.Capacity)
+}
+
+// take applies a take of n to a refilled level.
+func take(level, n float64, force bool) (bool, float64) {
+	if force || (level >= n && level > 0) {
+		return true, level - n
+	}
+	return false, level
+}
@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := NewLimiter(Config{
+		Default: Limit{RequestsPerMinute: 2, TokensPerMinute: 100},
+		Models:  map[string]Limit{"m1": {RequestsPerMinute: 60}},
+		Tenants: map[string]Tenant{"acme": {Default: &Limit{RequestsPerMinute: 3}}},
+	}, NewMemory())
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		d, err := l.Allow(ctx, "key:a", "", "gpt")
+		if err != nil || !d.Allowed || d.Requests.Limit != 2 || d.Requests.Remaining != 1-i {
+			t.Fatal("unexpected decision", i, d, err)
+		}
+	}
+	d, _ := l.Allow(ctx, "key:a", "", "gpt")
+	if d.Allowed || d.RetryAfter != 30*time.Second {
+		t.Fatal("third request allowed", d)
+	}
+	//other identities and models have their own buckets
+	if d, _ := l.Allow(ctx, "key:b", "", "gpt"); !d.Allowed {
+		t.Fatal("other identity limited", d)
+	}
+	if d, _ := l.Allow(ctx, "key:a", "", "m1"); !d.Allowed || d.Requests.Limit != 60 || d.Tokens.Limit != 0 {
+		t.Fatal("model limit not applied", d)
+	}
+	if d, _ := l.Allow(ctx, "key:c", "acme", "gpt"); !d.Allowed || d.Requests.Limit != 3 {
+		t.Fatal("tenant limit not applied", d)
+	}
+
+	now = now.Add(30 * time.Second)
+	if d, _ := l.Allow(ctx, "key:a", "", "gpt"); !d.Allowed {
+		t.Fatal("bucket did not refill", d)
+	}
+
+	//tokens are charged after the answer and may go into debt
+	if err := l.Charge(ctx, "key:b", "", "gpt", 130); err != nil {
+		t.Fatal(err)
+	}
+	d, _ = l.Allow(ctx, "key:b", "", "gpt")
+	if d.Allowed || d.Tokens.Remaining != 0 || d.RetryAfter != 18600*time.Millisecond {
+		t.Fatal("request allowed in token debt", d)
+	}
+	now = now.Add(20 * time.Second)
+	if d, _ := l.Allow(ctx, "key:b", "", "gpt"); !d.Allowed || d.Tokens.Remaining != 3 {
+		t.Fatal("tokens did not refill", d)
+	}
+}
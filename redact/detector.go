@@ -0,0 +1,133 @@
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Detector finds one kind of sensitive value in text.
+type Detector interface {
+	// Name identifies the detector in policies, upper cased it labels the
+	// placeholders, e.g. [EMAIL_1].
+	Name() string
+	// Find returns the byte spans of the values in text.
+	Find(text string) [][2]int
+}
+
+// Checksum validates a candidate value, e.g. the check digit of an id.
+type Checksum func(value string) bool
+
+// RegexDetector matches a pattern, and the checksum when set.
+type RegexDetector struct {
+	name     string
+	re       *regexp.Regexp
+	checksum Checksum
+}
+
+func NewRegexDetector(name, pattern string, checksum Checksum) (*RegexDetector, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("detector %s: %w", name, err)
+	}
+	return &RegexDetector{name: name, re: re, checksum: checksum}, nil
+}
+
+func (d *RegexDetector) Name() string {
+	return d.name
+}
+
+func (d *RegexDetector) Find(text string) [][2]int {
+	spans := make([][2]int, 0)
+	for _, loc := range d.re.FindAllStringIndex(text, -1) {
+		if d.checksum != nil && !d.checksum(text[loc[0]:loc[1]]) {
+			continue
+		}
+		spans = append(spans, [2]int{loc[0], loc[1]})
+	}
+	return spans
+}
+
+// Checksums are the validators custom detectors can refer to by name.
+var Checksums = map[string]Checksum{
+	"luhn":  Luhn,
+	"cn_id": ValidCNID,
+}
+
+// Luhn validates card numbers, spaces and dashes are ignored.
+func Luhn(value string) bool {
+	sum, n := 0, 0
+	for i := len(value) - 1; i >= 0; i-- {
+		c := value[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		if c < '0' || c > '9' {
+			return false
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 12 && sum%10 == 0
+}
+
+var cnIdWeights = []int{7, 9, 10, 5, 8, 4, 2, 1, 6, 3, 7, 9, 10, 5, 8, 4, 2}
+
+const cnIdCheckCodes = "10X98765432"
+
+// ValidCNID checks the ISO 7064 MOD 11-2 check digit of an 18 digit
+// resident identity card number.
+func ValidCNID(value string) bool {
+	if len(value) != 18 {
+		return false
+	}
+	sum := 0
+	for i := 0; i < 17; i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return false
+		}
+		sum += int(value[i]-'0') * cnIdWeights[i]
+	}
+	return strings.ToUpper(value[17:]) == string(cnIdCheckCodes[sum%11])
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]Detector)
+	builtins     = make([]string, 0) //registration order, the default policy
+)
+
+// Register adds a detector policies can refer to by name. Detectors
+// registered earlier win when two of them match the same span.
+func Register(d Detector) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[d.Name()]; !ok {
+		builtins = append(builtins, d.Name())
+	}
+	registry[d.Name()] = d
+}
+
+func mustRegister(name, pattern string, checksum Checksum) {
+	d, err := NewRegexDetector(name, pattern, checksum)
+	if err != nil {
+		panic(err)
+	}
+	Register(d)
+}
+
+func init() {
+	mustRegister("api_key", `\b(?:sk-[A-Za-z0-9_\-]{20,}|AKIA[0-9A-Z]{16}|gh[pousr]_[A-Za-z0-9]{36,}|xox[abpr]-[A-Za-z0-9\-]{10,}|AIza[0-9A-Za-z_\-]{35})`, nil)
+	mustRegister("email", `[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`, nil)
+	mustRegister("cn_id", `\b\d{17}[\dXx]\b`, ValidCNID)
+	mustRegister("card", `\b(?:\d[ \-]?){12,18}\d\b`, Luhn)
+	mustRegister("phone", `(?:\+86[ \-]?)?\b1[3-9]\d{9}\b|\+[1-9]\d{0,2}[ \-]?\d{2,4}(?:[ \-]?\d{2,4}){2,3}\b`, nil)
+}
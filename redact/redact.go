@@ -0,0 +1,185 @@
+package redact
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Config selects the detectors run on the prompts of each model. Detectors
+// is the default policy, empty means every registered detector. Models
+// overrides it per model name, an empty list sends the model's prompts as
+// they are, e.g. for workers on the local network.
+type Config struct {
+	Enable    bool                `yaml:"enable"`
+	Detectors []string            `yaml:"detectors"`
+	Models    map[string][]string `yaml:"models"`
+	Custom    []CustomDetector    `yaml:"custom"`
+}
+
+// CustomDetector is a regex detector from the config. Checksum names one of
+// Checksums.
+type CustomDetector struct {
+	Name     string `yaml:"name"`
+	Pattern  string `yaml:"pattern"`
+	Checksum string `yaml:"checksum"`
+}
+
+type Redactor struct {
+	defaults []Detector
+	models   map[string][]Detector
+}
+
+func New(conf Config) (*Redactor, error) {
+	available := make(map[string]Detector)
+	registryLock.RLock()
+	names := append([]string{}, builtins...)
+	for name, d := range registry {
+		available[name] = d
+	}
+	registryLock.RUnlock()
+	for _, custom := range conf.Custom {
+		var checksum Checksum
+		if custom.Checksum != "" {
+			var ok bool
+			if checksum, ok = Checksums[custom.Checksum]; !ok {
+				return nil, fmt.Errorf("detector %s: unknown checksum %s", custom.Name, custom.Checksum)
+			}
+		}
+		d, err := NewRegexDetector(custom.Name, custom.Pattern, checksum)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := available[custom.Name]; !ok {
+			names = append(names, custom.Name)
+		}
+		available[custom.Name] = d
+	}
+	resolve := func(names []string) ([]Detector, error) {
+		detectors := make([]Detector, 0, len(names))
+		for _, name := range names {
+			d, ok := available[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown detector %s", name)
+			}
+			detectors = append(detectors, d)
+		}
+		return detectors, nil
+	}
+
+	defaults := conf.Detectors
+	if len(defaults) == 0 {
+		defaults = names
+	}
+	r := &Redactor{models: make(map[string][]Detector)}
+	var err error
+	if r.defaults, err = resolve(defaults); err != nil {
+		return nil, err
+	}
+	for model, names := range conf.Models {
+		if r.models[model], err = resolve(names); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Session starts redacting one question for model, or returns nil if the
+// model's policy has no detectors.
+func (r *Redactor) Session(model string) *Session {
+	detectors, ok := r.models[model]
+	if !ok {
+		detectors = r.defaults
+	}
+	if len(detectors) == 0 {
+		return nil
+	}
+	return &Session{
+		detectors:     detectors,
+		placeholders:  make(map[string]string),
+		originals:     make(map[string]string),
+		labelCounts:   make(map[string]int),
+		DetectorCount: make(map[string]int),
+	}
+}
+
+// Session replaces sensitive values with placeholders across all messages of
+// one question, the same value always gets the same placeholder, and puts
+// them back into the answer.
+type Session struct {
+	detectors     []Detector
+	placeholders  map[string]string //value -> placeholder
+	originals     map[string]string //placeholder -> value
+	labelCounts   map[string]int
+	DetectorCount map[string]int //values replaced per detector
+}
+
+type match struct {
+	start, end int
+	detector   int
+}
+
+func (s *Session) Redact(text string) string {
+	matches := make([]match, 0)
+	for i, d := range s.detectors {
+		for _, span := range d.Find(text) {
+			matches = append(matches, match{span[0], span[1], i})
+		}
+	}
+	if len(matches) == 0 {
+		return text
+	}
+	//earliest first, then the longest, then the first detector
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.start != b.start {
+			return a.start < b.start
+		}
+		if a.end != b.end {
+			return a.end > b.end
+		}
+		return a.detector < b.detector
+	})
+	var b strings.Builder
+	pos := 0
+	for _, m := range matches {
+		if m.start < pos {
+			continue
+		}
+		b.WriteString(text[pos:m.start])
+		b.WriteString(s.placeholder(s.detectors[m.detector].Name(), text[m.start:m.end]))
+		pos = m.end
+	}
+	b.WriteString(text[pos:])
+	return b.String()
+}
+
+func (s *Session) placeholder(name, value string) string {
+	if p, ok := s.placeholders[value]; ok {
+		return p
+	}
+	label := strings.ToUpper(name)
+	s.labelCounts[label]++
+	p := fmt.Sprintf("[%s_%d]", label, s.labelCounts[label])
+	s.placeholders[value] = p
+	s.originals[p] = value
+	s.DetectorCount[name]++
+	return p
+}
+
+// Restore puts the original values back for the placeholders in text.
+func (s *Session) Restore(text string) string {
+	if len(s.originals) == 0 {
+		return text
+	}
+	pairs := make([]string, 0, 2*len(s.originals))
+	for p, value := range s.originals {
+		pairs = append(pairs, p, value)
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// Count is the number of distinct values replaced.
+func (s *Session) Count() int {
+	return len(s.originals)
+}
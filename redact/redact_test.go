@@ -0,0 +1,71 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactRestore(t *testing.T) {
+	r, err := New(Config{Enable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := r.Session("gpt")
+	text := "我的手机13812345678，邮箱 dev@example.com，身份证11010519491231002X，卡号4111 1111 1111 1111，key sk-abcdefghijklmnopqrstuvwx"
+	redacted := s.Redact(text)
+	for _, secret := range []string{"13812345678", "dev@example.com", "11010519491231002X", "4111 1111 1111 1111", "sk-abcdefghijklmnopqrstuvwx"} {
+		if strings.Contains(redacted, secret) {
+			t.Fatal("not redacted", secret, redacted)
+		}
+	}
+	for _, p := range []string{"[PHONE_1]", "[EMAIL_1]", "[CN_ID_1]", "[CARD_1]", "[API_KEY_1]"} {
+		if !strings.Contains(redacted, p) {
+			t.Fatal("missing placeholder", p, redacted)
+		}
+	}
+	//the same value keeps its placeholder across messages
+	if got := s.Redact("call 13812345678"); got != "call [PHONE_1]" {
+		t.Fatal("unexpected placeholder", got)
+	}
+	if got := s.Restore("Sent to [EMAIL_1] and [PHONE_1]."); got != "Sent to dev@example.com and 13812345678." {
+		t.Fatal("unexpected restore", got)
+	}
+	if s.Count() != 5 || s.DetectorCount["phone"] != 1 {
+		t.Fatal("unexpected counts", s.Count(), s.DetectorCount)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	r, _ := New(Config{Enable: true, Detectors: []string{"cn_id", "card"}})
+	s := r.Session("gpt")
+	//wrong check digits stay as they are
+	for _, text := range []string{"110105194912310021", "4111 1111 1111 1112"} {
+		if got := s.Redact(text); got != text {
+			t.Fatal("invalid number redacted", got)
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	r, err := New(Config{
+		Enable:    true,
+		Detectors: []string{"email"},
+		Models:    map[string][]string{"self-driving-v1": {}, "gpt": {"email", "vin"}},
+		Custom:    []CustomDetector{{Name: "vin", Pattern: `\b[A-HJ-NPR-Z0-9]{17}\b`}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Session("self-driving-v1") != nil {
+		t.Fatal("local model not skipped")
+	}
+	if got := r.Session("other").Redact("LSVAU2180N2183294 a@b.io"); got != "LSVAU2180N2183294 [EMAIL_1]" {
+		t.Fatal("default policy not applied", got)
+	}
+	if got := r.Session("gpt").Redact("LSVAU2180N2183294"); got != "[VIN_1]" {
+		t.Fatal("custom detector not applied", got)
+	}
+	if _, err := New(Config{Detectors: []string{"missing"}}); err == nil {
+		t.Fatal("unknown detector accepted")
+	}
+}
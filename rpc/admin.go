@@ -0,0 +1,436 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"gateway/common"
+	"gateway/dataset"
+	"gateway/db"
+	"gateway/log"
+	selfdriving "gateway/self-driving"
+	"gateway/trie"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// AdminConfig places the /admin endpoints.
+type AdminConfig struct {
+	// Listen serves /admin on its own address, e.g. 127.0.0.1:9090, and
+	// not on the gateway port.
+	Listen string `yaml:"listen"`
+}
+
+var AdminConf AdminConfig
+
+const (
+	maxAuditBody = 4096
+	auditTimeout = 5 * time.Second
+)
+
+var (
+	errUnknownModel     = errors.New("unknown model")
+	errModelExists      = errors.New("model already exists")
+	errUnknownWorker    = errors.New("unknown worker")
+	errWorkerExists     = errors.New("worker already registered")
+	errWorkerRequest    = errors.New("model and url required")
+	errSensitiveRequest = errors.New("entries required")
+)
+
+var workerStates = map[int]string{
+	selfdriving.ModelDown:     "down",
+	selfdriving.ModelAvalible: "available",
+	selfdriving.ModelBusy:     "busy",
+}
+
+var relayStates = map[int]string{
+	Down:     "down",
+	Avalible: "available",
+	InUse:    "busy",
+}
+
+// WorkerView is a worker or openai key as admins see it.
+type WorkerView struct {
+	Model    string `json:"model"`
+	Url      string `json:"url"` //the hash for openai keys
+	Status   string `json:"status"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+type ModelView struct {
+	Model     string `json:"model"`
+	Workers   int    `json:"workers"`
+	Available int    `json:"available"`
+}
+
+// WorkerReq names a worker, Disabled is only read by updates.
+type WorkerReq struct {
+	Model    string `json:"model"`
+	Url      string `json:"url"`
+	Disabled bool   `json:"disabled"`
+}
+
+type ModelReq struct {
+	Model string `json:"model"`
+}
+
+type SensitiveReq struct {
+	Entries []string `json:"entries"`
+}
+
+// auditLog records every mutating call of the group after it is handled,
+// refused ones included.
+func auditLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+		var body []byte
+		if c.Request.Body != nil {
+			body, _ = ioutil.ReadAll(c.Request.Body)
+			c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		c.Next()
+		entry := db.AuditEntry{
+			Id:       uuid.NewString(),
+			At:       time.Now(),
+			Method:   c.Request.Method,
+			Path:     c.Request.URL.RequestURI(),
+			Status:   c.Writer.Status(),
+			ClientIP: c.ClientIP(),
+		}
+		if p := principalOf(c); p != nil {
+			entry.Actor = p.Session
+			entry.Role = p.Role
+		}
+		if len(body) > maxAuditBody {
+			body = body[:maxAuditBody]
+		}
+		entry.Body = string(body)
+		ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+		defer cancel()
+		if err := db.InsertAudit(ctx, entry); err != nil {
+			log.Error("write audit log error", entry.Method, entry.Path, err)
+		}
+	}
+}
+
+// adminRoutes adds the /admin endpoints to g by the role they need.
+func (s *Service) adminRoutes(g *gin.RouterGroup) {
+	viewer := g.Group("", RequireRole(db.RoleViewer))
+	viewer.GET("/workers", s.HandleListWorkers)
+	viewer.GET("/models", s.HandleListModelConfig)
+	viewer.GET("/queue", s.HandleQueue)
+	viewer.GET("/usage", s.HandleUsageReport)
+	viewer.GET("/costs", s.HandleCostReport)
+
+	operator := g.Group("", RequireRole(db.RoleOperator))
+	operator.POST("/workers", s.HandleAddWorker)
+	operator.PUT("/workers", s.HandleUpdateWorker)
+	operator.DELETE("/workers", s.HandleRemoveWorker)
+	operator.POST("/models", s.HandleAddModel)
+	operator.DELETE("/models/:model", s.HandleRemoveModel)
+	operator.GET("/sensitive", s.HandleListSensitive)
+	operator.POST("/sensitive", s.HandleAddSensitive)
+	operator.DELETE("/sensitive", s.HandleRemoveSensitive)
+	operator.POST("/sensitive/reload", s.HandleReloadSensitive)
+
+	admin := g.Group("", RequireRole(db.RoleAdmin))
+	admin.GET("/export-dataset", s.HandleExportDataset)
+	admin.POST("/api-keys", s.HandleCreateAPIKey)
+	admin.GET("/api-keys", s.HandleListAPIKeys)
+	admin.PUT("/api-keys/:id", s.HandleUpdateAPIKey)
+	admin.GET("/audit", s.HandleAuditLog)
+}
+
+func adminError(c *gin.Context, status int, err error) {
+	code := ErrorCodeParseReq
+	if status >= http.StatusInternalServerError {
+		code = ErrorCodeUnknow
+	}
+	c.JSON(status, Resp{ResultCode: code, ResultMsg: err.Error(), ResultBody: ""})
+}
+
+func adminOK(c *gin.Context, body interface{}) {
+	c.JSON(http.StatusOK, Resp{ResultCode: Success, ResultMsg: "", ResultBody: body})
+}
+
+// HandleListWorkers lists the workers of every model and the openai keys.
+func (s *Service) HandleListWorkers(c *gin.Context) {
+	workers := make([]WorkerView, 0)
+	s.bsClientMut.RLock()
+	for model, clients := range s.bsApiClient {
+		for _, cli := range clients {
+			workers = append(workers, WorkerView{Model: model, Url: cli.Url, Status: workerStates[cli.Status], Disabled: cli.Disabled})
+		}
+	}
+	s.bsClientMut.RUnlock()
+	s.relaysStateLock.RLock()
+	for key, state := range s.gptApiState {
+		workers = append(workers, WorkerView{Model: "gpt", Url: common.KeyHash(key), Status: relayStates[state]})
+	}
+	s.relaysStateLock.RUnlock()
+	sort.Slice(workers, func(i, j int) bool {
+		if workers[i].Model != workers[j].Model {
+			return workers[i].Model < workers[j].Model
+		}
+		return workers[i].Url < workers[j].Url
+	})
+	adminOK(c, workers)
+}
+
+func bindWorker(c *gin.Context) (WorkerReq, bool) {
+	req := WorkerReq{}
+	if err := c.BindJSON(&req); err != nil || req.Model == "" || req.Url == "" {
+		adminError(c, http.StatusBadRequest, errWorkerRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// findWorker returns the index of the worker of model at url, -1 if there
+// is none. It is called with bsClientMut held.
+func (s *Service) findWorker(model, url string) int {
+	for i, cli := range s.bsApiClient[model] {
+		if cli.Url == url {
+			return i
+		}
+	}
+	return -1
+}
+
+// HandleAddWorker registers a worker of a model on this gateway.
+func (s *Service) HandleAddWorker(c *gin.Context) {
+	req, ok := bindWorker(c)
+	if !ok {
+		return
+	}
+	s.bsClientMut.Lock()
+	defer s.bsClientMut.Unlock()
+	if _, ok := s.bsApiClient[req.Model]; !ok {
+		adminError(c, http.StatusNotFound, errUnknownModel)
+		return
+	}
+	if s.findWorker(req.Model, req.Url) >= 0 {
+		adminError(c, http.StatusConflict, errWorkerExists)
+		return
+	}
+	cli := selfdriving.NewClient(req.Url, req.Model, context.Background())
+	cli.Disabled = req.Disabled
+	s.bsApiClient[req.Model] = append(s.bsApiClient[req.Model], cli)
+	s.urls[req.Url] = 1
+	log.Info("admin added worker", req.Model, req.Url)
+	adminOK(c, WorkerView{Model: req.Model, Url: req.Url, Status: workerStates[cli.Status], Disabled: cli.Disabled})
+}
+
+// HandleUpdateWorker disables a worker, so it gets no new questions, or
+// enables it again.
+func (s *Service) HandleUpdateWorker(c *gin.Context) {
+	req, ok := bindWorker(c)
+	if !ok {
+		return
+	}
+	s.bsClientMut.Lock()
+	defer s.bsClientMut.Unlock()
+	i := s.findWorker(req.Model, req.Url)
+	if i < 0 {
+		adminError(c, http.StatusNotFound, errUnknownWorker)
+		return
+	}
+	cli := s.bsApiClient[req.Model][i]
+	cli.Disabled = req.Disabled
+	adminOK(c, WorkerView{Model: req.Model, Url: req.Url, Status: workerStates[cli.Status], Disabled: cli.Disabled})
+}
+
+// HandleRemoveWorker drops a worker, e.g. /admin/workers?model=m1&url=http://10.0.0.1:8000
+// Questions it is answering finish.
+func (s *Service) HandleRemoveWorker(c *gin.Context) {
+	model, url := c.Query("model"), c.Query("url")
+	if model == "" || url == "" {
+		adminError(c, http.StatusBadRequest, errWorkerRequest)
+		return
+	}
+	s.bsClientMut.Lock()
+	defer s.bsClientMut.Unlock()
+	i := s.findWorker(model, url)
+	if i < 0 {
+		adminError(c, http.StatusNotFound, errUnknownWorker)
+		return
+	}
+	clients := s.bsApiClient[model]
+	clients[i].Close()
+	s.bsApiClient[model] = append(clients[:i:i], clients[i+1:]...)
+	s.forgetUrl(url)
+	log.Info("admin removed worker", model, url)
+	adminOK(c, "")
+}
+
+// forgetUrl drops url from the registered urls unless another model still
+// has a worker there. It is called with bsClientMut held.
+func (s *Service) forgetUrl(url string) {
+	for model := range s.bsApiClient {
+		if s.findWorker(model, url) >= 0 {
+			return
+		}
+	}
+	delete(s.urls, url)
+}
+
+// HandleListModelConfig lists the models questions may ask and how many of
+// their workers are available.
+func (s *Service) HandleListModelConfig(c *gin.Context) {
+	models := make([]ModelView, 0)
+	s.bsClientMut.RLock()
+	for model, clients := range s.bsApiClient {
+		view := ModelView{Model: model, Workers: len(clients)}
+		for _, cli := range clients {
+			if cli.Status != selfdriving.ModelDown && !cli.Disabled {
+				view.Available++
+			}
+		}
+		models = append(models, view)
+	}
+	s.bsClientMut.RUnlock()
+	gpt := ModelView{Model: "gpt"}
+	s.relaysStateLock.RLock()
+	for _, state := range s.gptApiState {
+		gpt.Workers++
+		if state != Down {
+			gpt.Available++
+		}
+	}
+	s.relaysStateLock.RUnlock()
+	models = append(models, gpt)
+	sort.Slice(models, func(i, j int) bool { return models[i].Model < models[j].Model })
+	adminOK(c, models)
+}
+
+// HandleAddModel lets questions ask a model, its workers are added next.
+func (s *Service) HandleAddModel(c *gin.Context) {
+	req := ModelReq{}
+	if err := c.BindJSON(&req); err != nil || req.Model == "" {
+		adminError(c, http.StatusBadRequest, errUnknownModel)
+		return
+	}
+	s.bsClientMut.Lock()
+	defer s.bsClientMut.Unlock()
+	if _, ok := s.bsApiClient[req.Model]; ok || req.Model == "gpt" {
+		adminError(c, http.StatusConflict, errModelExists)
+		return
+	}
+	s.bsApiClient[req.Model] = make([]*selfdriving.Client, 0)
+	log.Info("admin added model", req.Model)
+	adminOK(c, ModelView{Model: req.Model})
+}
+
+// HandleRemoveModel stops questions to a model and drops its workers.
+func (s *Service) HandleRemoveModel(c *gin.Context) {
+	model := c.Param("model")
+	s.bsClientMut.Lock()
+	defer s.bsClientMut.Unlock()
+	clients, ok := s.bsApiClient[model]
+	if !ok {
+		adminError(c, http.StatusNotFound, errUnknownModel)
+		return
+	}
+	delete(s.bsApiClient, model)
+	for _, cli := range clients {
+		cli.Close()
+		s.forgetUrl(cli.Url)
+	}
+	log.Info("admin removed model", model)
+	adminOK(c, "")
+}
+
+// HandleQueue shows the questions waiting for and holding worker slots.
+func (s *Service) HandleQueue(c *gin.Context) {
+	adminOK(c, s.queue.status(s.maxPendingLength))
+}
+
+func (s *Service) HandleListSensitive(c *gin.Context) {
+	adminOK(c, trie.SensitiveEntries())
+}
+
+func sensitiveStatus(err error) int {
+	if errors.Is(err, trie.ErrNoSensitiveFile) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *Service) changeSensitive(c *gin.Context, change func(entries ...string) (int, error)) {
+	req := SensitiveReq{}
+	if err := c.BindJSON(&req); err != nil || len(req.Entries) == 0 {
+		adminError(c, http.StatusBadRequest, errSensitiveRequest)
+		return
+	}
+	changed, err := change(req.Entries...)
+	if err != nil {
+		log.Error("change sensitive list error", err)
+		adminError(c, sensitiveStatus(err), err)
+		return
+	}
+	adminOK(c, gin.H{"changed": changed})
+}
+
+// HandleAddSensitive adds entries to the sensitive list and its file.
+func (s *Service) HandleAddSensitive(c *gin.Context) {
+	s.changeSensitive(c, trie.AddSensitive)
+}
+
+// HandleRemoveSensitive drops entries from the sensitive list and its file.
+func (s *Service) HandleRemoveSensitive(c *gin.Context) {
+	s.changeSensitive(c, trie.RemoveSensitive)
+}
+
+// HandleReloadSensitive reads the sensitive file again, e.g. after it was
+// changed by hand or on another gateway.
+func (s *Service) HandleReloadSensitive(c *gin.Context) {
+	n, err := trie.ReloadSensitive()
+	if err != nil {
+		log.Error("reload sensitive list error", err)
+		adminError(c, sensitiveStatus(err), err)
+		return
+	}
+	adminOK(c, gin.H{"entries": n})
+}
+
+// HandleAuditLog lists mutating admin calls, newest first, e.g.
+// /admin/audit?from=2024-05-01&actor=key:0123456789ab&limit=50
+func (s *Service) HandleAuditLog(c *gin.Context) {
+	q := db.AuditQuery{Actor: c.Query("actor")}
+	var err error
+	for name, field := range map[string]*int64{"from": &q.From, "to": &q.To} {
+		if *field, err = dataset.ParseTime(c.Query(name)); err != nil {
+			adminError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			adminError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), auditTimeout)
+	defer cancel()
+	entries, err := db.GetAuditLog(ctx, q)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, db.ErrAuditUnsupported) {
+			status = http.StatusNotImplemented
+		} else {
+			log.Error("read audit log error", err)
+		}
+		adminError(c, status, err)
+		return
+	}
+	adminOK(c, entries)
+}
@@ -0,0 +1,241 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"gateway/common"
+	"gateway/db"
+	"gateway/jwt"
+	selfdriving "gateway/self-driving"
+	"gateway/trie"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestAdminRoles(t *testing.T) {
+	db.Store = db.NewMemoryStore()
+	loadTestSensitive(t)
+	AuthConf = AuthConfig{Enable: true}
+	defer func() { AuthConf = AuthConfig{} }()
+	ctx := context.Background()
+	keys := make(map[string]string)
+	for _, role := range []string{db.RoleViewer, db.RoleOperator, ""} {
+		secret, _, err := db.CreateAPIKey(ctx, db.APIKey{Scopes: []string{db.ScopeAdmin}, Role: role})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[role] = secret
+	}
+	viewer, operator, admin := keys[db.RoleViewer], keys[db.RoleOperator], keys[""]
+	chat, _, err := db.CreateAPIKey(ctx, db.APIKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.CreateAPIKey(ctx, db.APIKey{Role: "root"}); err != db.ErrUnknownRole {
+		t.Fatal("unknown role accepted", err)
+	}
+	if p := jwtPrincipal(&jwt.Identity{UserId: "u1", Scopes: []string{db.ScopeAdmin}, Roles: []string{"viewer", "operator", "root"}}); p.Role != db.RoleOperator {
+		t.Fatal("unexpected token role", p.Role)
+	}
+	//a mistyped role claim is no admin
+	for _, roles := range [][]string{nil, {"Admin", "root"}} {
+		if p := jwtPrincipal(&jwt.Identity{UserId: "u2", Scopes: []string{db.ScopeAdmin}, Roles: roles}); p.Role != db.RoleViewer || db.RoleAllows(p.Role, db.RoleOperator) {
+			t.Fatal("unknown token role allowed", roles, p.Role)
+		}
+	}
+
+	s := &Service{
+		bsApiClient:      map[string][]*selfdriving.Client{"m1": {}},
+		urls:             make(map[string]int),
+		gptApiState:      map[string]int{"sk-test": Avalible},
+		maxPendingLength: 4,
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Authenticate(nil))
+	s.adminRoutes(r.Group("/admin", auditLog(), RequireScope(db.ScopeAdmin)))
+	do := func(method, url, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	worker := `{"model":"m1","url":"http://127.0.0.1:1"}`
+	for _, tc := range []struct {
+		method, url, key, body string
+		want                   int
+	}{
+		{http.MethodGet, "/admin/workers", chat, "", http.StatusForbidden},
+		{http.MethodGet, "/admin/workers", viewer, "", http.StatusOK},
+		{http.MethodPost, "/admin/workers", viewer, worker, http.StatusForbidden},
+		{http.MethodPost, "/admin/workers", operator, worker, http.StatusOK},
+		{http.MethodPost, "/admin/workers", operator, worker, http.StatusConflict},
+		{http.MethodPost, "/admin/workers", operator, `{"model":"m9","url":"http://127.0.0.1:1"}`, http.StatusNotFound},
+		{http.MethodPut, "/admin/workers", operator, `{"model":"m1","url":"http://127.0.0.1:1","disabled":true}`, http.StatusOK},
+		{http.MethodPost, "/admin/models", operator, `{"model":"m2"}`, http.StatusOK},
+		{http.MethodPost, "/admin/models", operator, `{"model":"gpt"}`, http.StatusConflict},
+		{http.MethodPost, "/admin/sensitive", operator, `{"entries":["secret"]}`, http.StatusOK},
+		{http.MethodGet, "/admin/audit", operator, "", http.StatusForbidden},
+		{http.MethodGet, "/admin/api-keys", operator, "", http.StatusForbidden},
+		{http.MethodGet, "/admin/api-keys", admin, "", http.StatusOK},
+	} {
+		if w := do(tc.method, tc.url, tc.key, tc.body); w.Code != tc.want {
+			t.Fatal("unexpected status", tc.method, tc.url, w.Code, w.Body.String())
+		}
+	}
+	if !trie.IsSensitive("a secret") {
+		t.Fatal("sensitive entry not added")
+	}
+
+	var workers struct {
+		Data []WorkerView `json:"data"`
+	}
+	json.Unmarshal(do(http.MethodGet, "/admin/workers", viewer, "").Body.Bytes(), &workers)
+	if len(workers.Data) != 2 || workers.Data[0].Model != "gpt" || workers.Data[0].Url != common.KeyHash("sk-test") ||
+		workers.Data[1].Url != "http://127.0.0.1:1" || !workers.Data[1].Disabled {
+		t.Fatal("unexpected workers", workers.Data)
+	}
+	var models struct {
+		Data []ModelView `json:"data"`
+	}
+	json.Unmarshal(do(http.MethodGet, "/admin/models", viewer, "").Body.Bytes(), &models)
+	if len(models.Data) != 3 || models.Data[1].Model != "m1" || models.Data[1].Workers != 1 || models.Data[1].Available != 0 {
+		t.Fatal("unexpected models", models.Data)
+	}
+	if w := do(http.MethodDelete, "/admin/workers?model=m1&url=http://127.0.0.1:1", operator, ""); w.Code != http.StatusOK || len(s.bsApiClient["m1"]) != 0 || len(s.urls) != 0 {
+		t.Fatal("worker not removed", w.Code, s.bsApiClient)
+	}
+	if w := do(http.MethodDelete, "/admin/models/m2", operator, ""); w.Code != http.StatusOK {
+		t.Fatal("model not removed", w.Code)
+	}
+	if _, ok := s.bsApiClient["m2"]; ok {
+		t.Fatal("model m2 still asked")
+	}
+
+	s.queue.add(&common.Question{Model: "m1", Tenant: "acme"}, time.Now())
+	started := s.queue.add(&common.Question{Model: "gpt"}, time.Now())
+	s.queue.start(started, time.Now())
+	var queue struct {
+		Data QueueStatus `json:"data"`
+	}
+	json.Unmarshal(do(http.MethodGet, "/admin/queue", viewer, "").Body.Bytes(), &queue)
+	if queue.Data.Waiting != 1 || queue.Data.Running != 1 || queue.Data.MaxPending != 4 || queue.Data.Models["m1"].Waiting != 1 || len(queue.Data.Questions) != 2 {
+		t.Fatal("unexpected queue", queue.Data)
+	}
+
+	//mutating calls are audited, refused ones too
+	var audit struct {
+		Data []db.AuditEntry `json:"data"`
+	}
+	json.Unmarshal(do(http.MethodGet, "/admin/audit?limit=100", admin, "").Body.Bytes(), &audit)
+	if len(audit.Data) != 10 {
+		t.Fatal("unexpected audit log", len(audit.Data), audit.Data)
+	}
+	last, refused := audit.Data[0], audit.Data[len(audit.Data)-1]
+	if last.Method != http.MethodDelete || last.Path != "/admin/models/m2" || last.Role != db.RoleOperator || !strings.HasPrefix(last.Actor, db.KeySessionPrefix) {
+		t.Fatal("unexpected last entry", last)
+	}
+	if refused.Status != http.StatusForbidden || refused.Role != db.RoleViewer || refused.Body != worker {
+		t.Fatal("unexpected refused entry", refused)
+	}
+}
+
+func TestAdminNeedsAuth(t *testing.T) {
+	db.Store = db.NewMemoryStore()
+	admin, _, err := db.CreateAPIKey(context.Background(), db.APIKey{Scopes: []string{db.ScopeAdmin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{port: "0", bsApiClient: map[string][]*selfdriving.Client{}, urls: make(map[string]int), maxPendingLength: 1}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.Background())
+	//auth is off, so there is no /admin
+	for _, url := range []string{"/admin/workers", "/admin/api-keys", "/admin/export-dataset"} {
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatal("admin served without auth", url, w.Code)
+		}
+	}
+
+	//the guards refuse wherever they are mounted
+	r := gin.New()
+	r.Use(Authenticate(nil))
+	s.adminRoutes(r.Group("/admin", auditLog(), RequireScope(db.ScopeAdmin)))
+	for _, key := range []string{"", admin} {
+		req := httptest.NewRequest(http.MethodPost, "/admin/api-keys", strings.NewReader(`{"name":"x","scopes":["admin"]}`))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatal("admin call passed without auth", w.Code)
+		}
+	}
+	if keys, _ := db.ListAPIKeys(context.Background()); len(keys) != 1 {
+		t.Fatal("key minted without auth", len(keys))
+	}
+}
+
+func TestWorkerChangesDuringQuestion(t *testing.T) {
+	asked := make(chan struct{})
+	release := make(chan struct{})
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == selfdriving.HealthPath {
+			return
+		}
+		close(asked)
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer worker.Close()
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	defer unblock()
+	cli := selfdriving.NewClient(worker.URL, "m1", context.Background())
+	defer cli.Close()
+	cli.Status = selfdriving.ModelAvalible
+	s := &Service{bsApiClient: map[string][]*selfdriving.Client{"m1": {cli}}}
+	qu := pendingQuestion{
+		data:   common.Question{Model: "m1", Message: "hi", Prompt: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}},
+		resp:   make(chan RelayResponse, 1),
+		cancel: make(chan struct{}),
+	}
+	go s.checkOneQuestion(qu)
+	select {
+	case <-asked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("question never reached the worker")
+	}
+
+	//an admin change must not wait for the question in flight
+	changed := make(chan struct{})
+	go func() {
+		s.bsClientMut.Lock()
+		s.bsApiClient["m2"] = make([]*selfdriving.Client, 0)
+		s.bsClientMut.Unlock()
+		close(changed)
+	}()
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("worker change blocked by a question in flight")
+	}
+	unblock()
+	select {
+	case <-qu.resp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no answer after the worker replied")
+	}
+}
@@ -0,0 +1,194 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"gateway/db"
+	"gateway/log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type APIKeyReq struct {
+	Name      string   `json:"name"`
+	Tenant    string   `json:"tenant"`
+	Models    []string `json:"models"`
+	Scopes    []string `json:"scopes"`
+	Role      string   `json:"role"`       //of the admin scope, empty is admin
+	ExpiresIn int64    `json:"expires_in"` //seconds, 0 never expires
+}
+
+// APIKeyUpdateReq changes the fields that are set.
+type APIKeyUpdateReq struct {
+	Name      *string   `json:"name"`
+	Tenant    *string   `json:"tenant"`
+	Models    *[]string `json:"models"`
+	Scopes    *[]string `json:"scopes"`
+	Role      *string   `json:"role"`
+	Enabled   *bool     `json:"enabled"`
+	ExpiresAt *int64    `json:"expires_at"` //unix seconds, 0 never expires
+}
+
+// APIKeyView is a key as admins see it, without its hash.
+type APIKeyView struct {
+	Id        string   `json:"id"`
+	Key       string   `json:"key,omitempty"` //the secret, only when created
+	Name      string   `json:"name,omitempty"`
+	Tenant    string   `json:"tenant,omitempty"`
+	Models    []string `json:"models"`
+	Scopes    []string `json:"scopes"`
+	Role      string   `json:"role,omitempty"`
+	Enabled   bool     `json:"enabled"`
+	CreatedAt int64    `json:"createdAt"`
+	ExpiresAt int64    `json:"expiresAt,omitempty"`
+}
+
+func apiKeyView(key *db.APIKey) APIKeyView {
+	models := key.Models
+	if models == nil {
+		models = []string{}
+	}
+	return APIKeyView{
+		Id:        key.Id,
+		Name:      key.Name,
+		Tenant:    key.Tenant,
+		Models:    models,
+		Scopes:    key.Scopes,
+		Role:      key.Role,
+		Enabled:   key.Enabled,
+		CreatedAt: key.CreatedAt,
+		ExpiresAt: key.ExpiresAt,
+	}
+}
+
+func apiKeyStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrUnknownScope), errors.Is(err, db.ErrUnknownRole):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// HandleCreateAPIKey issues a key, the secret is only in this response.
+func (s *Service) HandleCreateAPIKey(c *gin.Context) {
+	rep := Resp{
+		ResultCode: ErrorCodeParseReq,
+		ResultMsg:  "",
+		ResultBody: "",
+	}
+	req := APIKeyReq{}
+	if err := c.BindJSON(&req); err != nil || req.ExpiresIn < 0 {
+		rep.ResultMsg = "invalid api key request"
+		c.JSON(http.StatusBadRequest, rep)
+		return
+	}
+	key := db.APIKey{Name: req.Name, Tenant: req.Tenant, Models: req.Models, Scopes: req.Scopes, Role: req.Role}
+	if req.ExpiresIn > 0 {
+		key.ExpiresAt = time.Now().Unix() + req.ExpiresIn
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), authTimeout)
+	defer cancel()
+	secret, created, err := db.CreateAPIKey(ctx, key)
+	if err != nil {
+		status := apiKeyStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Error("create api key error", err)
+			rep.ResultCode = ErrorCodeUnknow
+		}
+		rep.ResultMsg = err.Error()
+		c.JSON(status, rep)
+		return
+	}
+	view := apiKeyView(created)
+	view.Key = secret
+	rep.ResultCode = Success
+	rep.ResultBody = view
+	c.JSON(http.StatusOK, rep)
+}
+
+func (s *Service) HandleListAPIKeys(c *gin.Context) {
+	rep := Resp{
+		ResultCode: Success,
+		ResultMsg:  "",
+		ResultBody: "",
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), authTimeout)
+	defer cancel()
+	keys, err := db.ListAPIKeys(ctx)
+	if err != nil {
+		log.Error("list api keys error", err)
+		rep.ResultCode = ErrorCodeUnknow
+		rep.ResultMsg = err.Error()
+		c.JSON(http.StatusInternalServerError, rep)
+		return
+	}
+	views := make([]APIKeyView, 0, len(keys))
+	for i := range keys {
+		views = append(views, apiKeyView(&keys[i]))
+	}
+	rep.ResultBody = views
+	c.JSON(http.StatusOK, rep)
+}
+
+// HandleUpdateAPIKey enables, disables or changes a key. This gateway stops
+// trusting the old key at once, others after auth.cache_seconds.
+func (s *Service) HandleUpdateAPIKey(c *gin.Context) {
+	rep := Resp{
+		ResultCode: ErrorCodeParseReq,
+		ResultMsg:  "",
+		ResultBody: "",
+	}
+	req := APIKeyUpdateReq{}
+	if err := c.BindJSON(&req); err != nil {
+		rep.ResultMsg = "invalid api key request"
+		c.JSON(http.StatusBadRequest, rep)
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), authTimeout)
+	defer cancel()
+	key, err := db.GetAPIKey(ctx, c.Param("id"))
+	if err == nil {
+		if req.Name != nil {
+			key.Name = *req.Name
+		}
+		if req.Tenant != nil {
+			key.Tenant = *req.Tenant
+		}
+		if req.Models != nil {
+			key.Models = *req.Models
+		}
+		if req.Scopes != nil {
+			key.Scopes, err = db.ValidateScopes(*req.Scopes)
+		}
+		if req.Role != nil {
+			key.Role = *req.Role
+		}
+		if req.Enabled != nil {
+			key.Enabled = *req.Enabled
+		}
+		if req.ExpiresAt != nil {
+			key.ExpiresAt = *req.ExpiresAt
+		}
+		if err == nil {
+			err = db.UpdateAPIKey(ctx, *key)
+		}
+	}
+	if err != nil {
+		status := apiKeyStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Error("update api key error", err)
+			rep.ResultCode = ErrorCodeUnknow
+		}
+		rep.ResultMsg = err.Error()
+		c.JSON(status, rep)
+		return
+	}
+	forgetAPIKey(key.Id)
+	rep.ResultCode = Success
+	rep.ResultBody = apiKeyView(key)
+	c.JSON(http.StatusOK, rep)
+}
@@ -0,0 +1,334 @@
+package rpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"gateway/db"
+	"gateway/jwt"
+	"gateway/log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuthConfig struct {
+	Enable bool `yaml:"enable"`
+	// Anonymous lets cookie sessions without a key use the chat endpoints.
+	Anonymous bool `yaml:"anonymous"`
+	// CacheSeconds is how long a verified key is trusted before it is read
+	// again, a key disabled on another gateway stops working after it.
+	CacheSeconds int `yaml:"cache_seconds"`
+	// JWT accepts tokens of an identity provider next to api keys.
+	JWT jwt.Config `yaml:"jwt"`
+}
+
+var AuthConf AuthConfig
+
+const (
+	PrincipalContextName = "principal"
+	defaultKeyCacheTime  = 30 * time.Second
+	maxCachedKeys        = 10000
+	authTimeout          = 5 * time.Second
+)
+
+type cachedKey struct {
+	key      *db.APIKey
+	verified time.Time
+}
+
+// keyCache keeps verified keys by the hash of their secret, so a request
+// does not read the store every time.
+var keyCache = struct {
+	sync.Mutex
+	keys map[[sha256.Size]byte]cachedKey
+}{keys: make(map[[sha256.Size]byte]cachedKey)}
+
+func keyCacheTime() time.Duration {
+	if AuthConf.CacheSeconds > 0 {
+		return time.Duration(AuthConf.CacheSeconds) * time.Second
+	}
+	return defaultKeyCacheTime
+}
+
+func verifyAPIKey(ctx context.Context, secret string) (*db.APIKey, error) {
+	sum := sha256.Sum256([]byte(secret))
+	now := time.Now()
+	keyCache.Lock()
+	cached, ok := keyCache.keys[sum]
+	keyCache.Unlock()
+	if ok && now.Sub(cached.verified) < keyCacheTime() {
+		if err := cached.key.Check(now); err != nil {
+			return nil, err
+		}
+		return cached.key, nil
+	}
+	key, err := db.VerifyAPIKey(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	keyCache.Lock()
+	if len(keyCache.keys) >= maxCachedKeys {
+		keyCache.keys = make(map[[sha256.Size]byte]cachedKey)
+	}
+	keyCache.keys[sum] = cachedKey{key: key, verified: now}
+	keyCache.Unlock()
+	return key, nil
+}
+
+// forgetAPIKey drops a changed key from the cache of this gateway.
+func forgetAPIKey(id string) {
+	keyCache.Lock()
+	defer keyCache.Unlock()
+	for sum, cached := range keyCache.keys {
+		if cached.key.Id == id {
+			delete(keyCache.keys, sum)
+		}
+	}
+}
+
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+func abortUnauthorized(c *gin.Context, status int, msg string) {
+	if status == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", `Bearer realm="gateway"`)
+	}
+	c.AbortWithStatusJSON(status, Resp{
+		ResultCode: ErrorCodeUnknow,
+		ResultMsg:  msg,
+		ResultBody: "",
+	})
+}
+
+// Principal is who an authenticated request speaks for, an api key or the
+// user of a jwt.
+type Principal struct {
+	Session string //session id the principal's conversations are stored under
+	KeyId   string //set for api keys
+	UserId  string
+	Tenant  string
+	Models  []string //empty allows every model
+	Scopes  []string
+	Role    string //of the admin scope
+}
+
+func keyPrincipal(key *db.APIKey) *Principal {
+	return &Principal{Session: key.Session(), KeyId: key.Id, Tenant: key.Tenant, Models: key.Models, Scopes: key.Scopes, Role: key.AdminRole()}
+}
+
+// jwtPrincipal keeps the scopes of a token the gateway knows, tokens
+// without any get chat. Of its roles the one that allows most is kept,
+// tokens without a known one are viewers so a wrong role claim never grants
+// more.
+func jwtPrincipal(id *jwt.Identity) *Principal {
+	role := db.RoleViewer
+	for _, r := range id.Roles {
+		if db.RoleAllows(r, role) {
+			role = r
+		}
+	}
+	scopes := make([]string, 0, 1)
+	for _, scope := range id.Scopes {
+		if _, err := db.ValidateScopes([]string{scope}); err == nil {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		scopes = append(scopes, db.ScopeChat)
+	}
+	return &Principal{Session: db.UserSessionPrefix + id.UserId, UserId: id.UserId, Tenant: id.Tenant, Models: id.Models, Scopes: scopes, Role: role}
+}
+
+// AllowsModel reports whether the principal may ask model.
+func (p *Principal) AllowsModel(model string) bool {
+	if len(p.Models) == 0 {
+		return true
+	}
+	for _, allowed := range p.Models {
+		if allowed == model {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// NewJWTVerifier returns the verifier of the jwt config, nil if jwt auth is
+// off.
+func NewJWTVerifier(conf AuthConfig) (*jwt.Verifier, error) {
+	if !conf.Enable || !conf.JWT.Enable {
+		return nil, nil
+	}
+	return jwt.New(conf.JWT)
+}
+
+// Authenticate verifies the bearer api key or jwt of a request, if any. A
+// request with a bad one is refused even where anonymous sessions are
+// allowed. Tokens are only taken when verifier is set.
+func Authenticate(verifier *jwt.Verifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !AuthConf.Enable {
+			return
+		}
+		secret := bearerToken(c)
+		if secret == "" {
+			return
+		}
+		if verifier != nil && jwt.LooksLikeToken(secret) {
+			id, err := verifier.Verify(secret)
+			if err != nil {
+				abortUnauthorized(c, http.StatusUnauthorized, err.Error())
+				return
+			}
+			c.Set(PrincipalContextName, jwtPrincipal(id))
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), authTimeout)
+		defer cancel()
+		key, err := verifyAPIKey(ctx, secret)
+		switch {
+		case errors.Is(err, db.ErrInvalidAPIKey), errors.Is(err, db.ErrAPIKeyDisabled), errors.Is(err, db.ErrAPIKeyExpired):
+			abortUnauthorized(c, http.StatusUnauthorized, err.Error())
+			return
+		case err != nil:
+			log.Error("verify api key error", err)
+			abortUnauthorized(c, http.StatusServiceUnavailable, "can not verify api key")
+			return
+		}
+		c.Set(PrincipalContextName, keyPrincipal(key))
+	}
+}
+
+// RequireScope lets a request through if its principal has scope. Requests
+// without one pass the chat scope when anonymous sessions are allowed. With
+// auth off everything but the admin scope passes.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !AuthConf.Enable {
+			if scope == db.ScopeAdmin {
+				abortUnauthorized(c, http.StatusUnauthorized, "api key or token required")
+			}
+			return
+		}
+		p := principalOf(c)
+		switch {
+		case p == nil && scope == db.ScopeChat && AuthConf.Anonymous:
+		case p == nil:
+			abortUnauthorized(c, http.StatusUnauthorized, "api key or token required")
+		case !p.HasScope(scope):
+			abortUnauthorized(c, http.StatusForbidden, "credentials lack the "+scope+" scope")
+		}
+	}
+}
+
+// RequireRole lets a request through if it is authenticated with the admin
+// scope and a role that allows what role does. With auth off nothing passes.
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		adminAllowed(c, role)
+	}
+}
+
+// adminAllowed aborts the request and returns false unless it is
+// authenticated with the admin scope and a role that allows role. With auth
+// off nobody is.
+func adminAllowed(c *gin.Context, role string) bool {
+	p := principalOf(c)
+	switch {
+	case !AuthConf.Enable || p == nil:
+		abortUnauthorized(c, http.StatusUnauthorized, "api key or token required")
+	case !p.HasScope(db.ScopeAdmin):
+		abortUnauthorized(c, http.StatusForbidden, "credentials lack the "+db.ScopeAdmin+" scope")
+	case !db.RoleAllows(p.Role, role):
+		abortUnauthorized(c, http.StatusForbidden, "credentials lack the "+role+" role")
+	default:
+		return true
+	}
+	return false
+}
+
+// isAdmin reports whether the request is authenticated with the admin scope
+// and a role, without refusing it otherwise.
+func isAdmin(c *gin.Context) bool {
+	p := principalOf(c)
+	return AuthConf.Enable && p != nil && p.HasScope(db.ScopeAdmin) && db.RoleAllows(p.Role, db.RoleViewer)
+}
+
+// principalOf returns who a request was authenticated as, nil for anonymous
+// sessions.
+func principalOf(c *gin.Context) *Principal {
+	if v, ok := c.Get(PrincipalContextName); ok {
+		return v.(*Principal)
+	}
+	return nil
+}
+
+// sessionOwner returns the key or user session turns were asked under,
+// empty if they belong to anonymous sessions.
+func sessionOwner(msgs []db.Message) string {
+	for _, msg := range msgs {
+		if strings.HasPrefix(msg.SessionId, db.KeySessionPrefix) || strings.HasPrefix(msg.SessionId, db.UserSessionPrefix) {
+			return msg.SessionId
+		}
+	}
+	return ""
+}
+
+// canAccess reports whether the caller may see the turns of a conversation.
+// Conversations of a key or user are only visible to them, and they only
+// see their own.
+func canAccess(c *gin.Context, msgs []db.Message) bool {
+	owner := sessionOwner(msgs)
+	if p := principalOf(c); p != nil {
+		return owner == p.Session
+	}
+	return owner == ""
+}
+
+// tenantOf is the tenant turns of the caller are stored under.
+func tenantOf(c *gin.Context) string {
+	if p := principalOf(c); p != nil {
+		return p.Tenant
+	}
+	return ""
+}
+
+// userOf is the user id turns of the caller are stored under.
+func userOf(c *gin.Context) string {
+	if p := principalOf(c); p != nil {
+		return p.UserId
+	}
+	return ""
+}
+
+// canContinue reports whether the caller may ask on in a conversation. Ids
+// nobody has used yet are free.
+func canContinue(c *gin.Context, conversationId string) (bool, error) {
+	if !AuthConf.Enable {
+		return true, nil
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), authTimeout)
+	defer cancel()
+	msgs, err := db.GetConversation(ctx, conversationId)
+	if err != nil {
+		return false, err
+	}
+	return len(msgs) == 0 || canAccess(c, msgs), nil
+}
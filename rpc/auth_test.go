@@ -0,0 +1,310 @@
+package rpc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"gateway/db"
+	"gateway/jwt"
+	"gateway/log"
+	selfdriving "gateway/self-driving"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	log.InitLog(log.InfoLog)
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	db.Store = db.NewMemoryStore()
+	AuthConf = AuthConfig{Enable: true, Anonymous: true}
+	defer func() { AuthConf = AuthConfig{} }()
+	ctx := context.Background()
+	alice, _, err := db.CreateAPIKey(ctx, db.APIKey{Tenant: "acme", Models: []string{"m1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, bobKey, err := db.CreateAPIKey(ctx, db.APIKey{Scopes: []string{db.ScopeChat, db.ScopeWorker}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Service{bsApiClient: map[string][]*selfdriving.Client{"m1": nil, "m2": nil}}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	sessions, err := NewSessionManager(SessionConfig{Secrets: []string{"test-session-secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Use(Authenticate(nil))
+	r.Use(UserSession(sessions))
+	chat := r.Group("", RequireScope(db.ScopeChat))
+	chat.POST("/api/question", s.HandleQuestion)
+	chat.GET("/api/conversations/:id/export", s.HandleExportConversation)
+	chat.POST("/api/conversations/import", s.HandleImportConversations)
+	r.Group("", RequireScope(db.ScopeWorker)).POST("/api/worker_get_status", s.HandleWorkerGetStatus)
+	r.Group("/admin", RequireScope(db.ScopeAdmin)).PUT("/api-keys/:id", s.HandleUpdateAPIKey)
+
+	do := func(method, url, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for _, tc := range []struct {
+		method, url, key string
+		want             int
+	}{
+		{http.MethodPost, "/api/worker_get_status", "", http.StatusUnauthorized},
+		{http.MethodPost, "/api/worker_get_status", alice, http.StatusForbidden},
+		{http.MethodPost, "/api/worker_get_status", bob, http.StatusOK},
+		{http.MethodPost, "/api/worker_get_status", bob + "x", http.StatusUnauthorized},
+		{http.MethodPut, "/admin/api-keys/" + bobKey.Id, bob, http.StatusForbidden},
+	} {
+		if w := do(tc.method, tc.url, tc.key, ""); w.Code != tc.want {
+			t.Fatal("unexpected status", tc.url, w.Code, w.Body.String())
+		}
+	}
+
+	//models outside the key are refused before queueing
+	if w := do(http.MethodPost, "/api/question", alice, `{"message":"hi","model":"m2"}`); w.Code != http.StatusForbidden {
+		t.Fatal("disallowed model asked", w.Code, w.Body.String())
+	}
+
+	//conversations are only visible to their key
+	w := do(http.MethodPost, "/api/conversations/import?format=markdown", alice, "## User\n\nWhat is ACC?\n\n## Assistant (m1)\n\nAdaptive cruise control.\n")
+	if w.Code != http.StatusOK {
+		t.Fatal("import failed", w.Code, w.Body.String())
+	}
+	convId := strings.Split(strings.Split(w.Body.String(), `"conversationId":"`)[1], `"`)[0]
+	msgs, err := db.GetConversation(ctx, convId)
+	if err != nil || len(msgs) != 1 || msgs[0].Tenant != "acme" || !strings.HasPrefix(msgs[0].SessionId, db.KeySessionPrefix) {
+		t.Fatal("unexpected imported turns", msgs, err)
+	}
+	export := "/api/conversations/" + convId + "/export"
+	for key, want := range map[string]int{alice: http.StatusOK, bob: http.StatusNotFound, "": http.StatusNotFound} {
+		if w := do(http.MethodGet, export, key, ""); w.Code != want {
+			t.Fatal("unexpected export status", key, w.Code)
+		}
+	}
+	if w := do(http.MethodPost, "/api/question", bob, `{"message":"go on","model":"m1","conversation_id":"`+convId+`"}`); w.Code != http.StatusNotFound {
+		t.Fatal("continued another key's conversation", w.Code, w.Body.String())
+	}
+
+	//disabled keys stop working once dropped from the cache
+	bobKey.Enabled = false
+	if err := db.UpdateAPIKey(ctx, *bobKey); err != nil {
+		t.Fatal(err)
+	}
+	forgetAPIKey(bobKey.Id)
+	if w := do(http.MethodPost, "/api/worker_get_status", bob, ""); w.Code != http.StatusUnauthorized {
+		t.Fatal("disabled key accepted", w.Code)
+	}
+}
+
+func hs256Token(claims string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	signed := enc([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc([]byte(claims))
+	mac := hmac.New(sha256.New, []byte("portal-secret"))
+	mac.Write([]byte(signed))
+	return signed + "." + enc(mac.Sum(nil))
+}
+
+func TestJWTAuth(t *testing.T) {
+	db.Store = db.NewMemoryStore()
+	AuthConf = AuthConfig{Enable: true, JWT: jwt.Config{
+		Enable:   true,
+		Issuer:   "portal",
+		Audience: "gateway",
+		Keys:     []jwt.Key{{Alg: jwt.HS256, Secret: "portal-secret"}},
+	}}
+	defer func() { AuthConf = AuthConfig{} }()
+	verifier, err := NewJWTVerifier(AuthConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{bsApiClient: map[string][]*selfdriving.Client{"m1": nil, "m2": nil}}
+	r := gin.New()
+	sessions, err := NewSessionManager(SessionConfig{Secrets: []string{"test-session-secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Use(Authenticate(verifier))
+	r.Use(UserSession(sessions))
+	chat := r.Group("", RequireScope(db.ScopeChat))
+	chat.POST("/api/question", s.HandleQuestion)
+	chat.POST("/api/conversations/import", s.HandleImportConversations)
+	chat.GET("/api/conversations/:id/export", s.HandleExportConversation)
+	r.Group("/admin", RequireScope(db.ScopeAdmin)).GET("/api-keys", s.HandleListAPIKeys)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	alice := hs256Token(fmt.Sprintf(`{"iss":"portal","aud":"gateway","sub":"alice","tenant":"acme","models":["m1"],"exp":%d}`, exp))
+	carol := hs256Token(fmt.Sprintf(`{"iss":"portal","aud":"gateway","sub":"carol","scope":"chat admin","exp":%d}`, exp))
+	expired := hs256Token(`{"iss":"portal","aud":"gateway","sub":"alice","exp":1}`)
+	do := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for _, tc := range []struct {
+		method, url, token string
+		want               int
+	}{
+		{http.MethodGet, "/admin/api-keys", "", http.StatusUnauthorized},
+		{http.MethodGet, "/admin/api-keys", expired, http.StatusUnauthorized},
+		{http.MethodGet, "/admin/api-keys", alice, http.StatusForbidden},
+		{http.MethodGet, "/admin/api-keys", carol, http.StatusOK},
+		//anonymous sessions are off
+		{http.MethodPost, "/api/question", "", http.StatusUnauthorized},
+	} {
+		if w := do(tc.method, tc.url, tc.token, ""); w.Code != tc.want {
+			t.Fatal("unexpected status", tc.url, w.Code, w.Body.String())
+		}
+	}
+	if w := do(http.MethodPost, "/api/question", alice, `{"message":"hi","model":"m2"}`); w.Code != http.StatusForbidden {
+		t.Fatal("disallowed model asked", w.Code, w.Body.String())
+	}
+
+	w := do(http.MethodPost, "/api/conversations/import?format=markdown", alice, "## User\n\nWhat is ACC?\n\n## Assistant (m1)\n\nAdaptive cruise control.\n")
+	if w.Code != http.StatusOK {
+		t.Fatal("import failed", w.Code, w.Body.String())
+	}
+	convId := strings.Split(strings.Split(w.Body.String(), `"conversationId":"`)[1], `"`)[0]
+	msgs, err := db.GetConversation(context.Background(), convId)
+	if err != nil || len(msgs) != 1 || msgs[0].UserId != "alice" || msgs[0].Tenant != "acme" || msgs[0].SessionId != db.UserSessionPrefix+"alice" {
+		t.Fatal("unexpected imported turns", msgs, err)
+	}
+	for token, want := range map[string]int{alice: http.StatusOK, carol: http.StatusNotFound} {
+		if w := do(http.MethodGet, "/api/conversations/"+convId+"/export", token, ""); w.Code != want {
+			t.Fatal("unexpected export status", w.Code)
+		}
+	}
+}
+
+func TestExportDatasetNeedsAdmin(t *testing.T) {
+	db.Store = db.NewMemoryStore()
+	ctx := context.Background()
+	chat, _, err := db.CreateAPIKey(ctx, db.APIKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, _, err := db.CreateAPIKey(ctx, db.APIKey{Scopes: []string{db.ScopeAdmin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{}
+	r := gin.New()
+	r.Use(Authenticate(nil))
+	//mounted without guards, the handler checks itself
+	r.GET("/admin/export-dataset", s.HandleExportDataset)
+	do := func(key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/admin/export-dataset", nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := do(admin); code != http.StatusUnauthorized {
+		t.Fatal("export served with auth off", code)
+	}
+	AuthConf = AuthConfig{Enable: true}
+	defer func() { AuthConf = AuthConfig{} }()
+	for key, want := range map[string]int{"": http.StatusUnauthorized, chat: http.StatusForbidden, admin: http.StatusOK} {
+		if code := do(key); code != want {
+			t.Fatal("unexpected status", code, want)
+		}
+	}
+}
+
+func TestSearchOwnSession(t *testing.T) {
+	db.Store = db.NewMemoryStore()
+	ctx := context.Background()
+	chat, chatKey, err := db.CreateAPIKey(ctx, db.APIKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, _, err := db.CreateAPIKey(ctx, db.APIKey{Scopes: []string{db.ScopeChat, db.ScopeAdmin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	err = db.InsertConversations(ctx, []db.Message{
+		{ConversationId: "c1", MessageId: "m1", SessionId: "anon-1", UserId: "u1", Prompt: "lane keeping", StartTime: now},
+		{ConversationId: "c2", MessageId: "m2", SessionId: chatKey.Session(), Prompt: "lane change", StartTime: now},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Service{}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	sessions, err := NewSessionManager(SessionConfig{Secrets: []string{"test-session-secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Use(Authenticate(nil))
+	r.Use(UserSession(sessions))
+	r.Group("", RequireScope(db.ScopeChat)).GET("/api/search", s.HandleSearch)
+	search := func(key, query string) []string {
+		req := httptest.NewRequest(http.MethodGet, "/api/search?q=lane&"+query, nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp struct {
+			Data db.SearchResult `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(w.Code, err)
+		}
+		ids := make([]string, 0)
+		for _, hit := range resp.Data.Hits {
+			ids = append(ids, hit.Message.MessageId)
+		}
+		if resp.Data.Total != len(ids) {
+			t.Fatal("total counts turns of other sessions", resp.Data.Total, ids)
+		}
+		return ids
+	}
+
+	//with auth off the filters of the query string are not taken
+	for _, query := range []string{"", "session=anon-1", "user=u1"} {
+		if ids := search("", query); len(ids) != 0 {
+			t.Fatal("anonymous caller found turns of other sessions", query, ids)
+		}
+	}
+	AuthConf = AuthConfig{Enable: true, Anonymous: true}
+	defer func() { AuthConf = AuthConfig{} }()
+	if ids := search("", "session=anon-1"); len(ids) != 0 {
+		t.Fatal("anonymous caller found turns of another session", ids)
+	}
+	if ids := search(chat, "session=anon-1"); len(ids) != 1 || ids[0] != "m2" {
+		t.Fatal("key should only find its own turns", ids)
+	}
+	if ids := search(admin, "session=anon-1"); len(ids) != 1 || ids[0] != "m1" {
+		t.Fatal("admin should search any session", ids)
+	}
+	if ids := search(admin, "user=u1"); len(ids) != 1 || ids[0] != "m1" {
+		t.Fatal("admin should search any user", ids)
+	}
+}
@@ -3,14 +3,32 @@ package rpc
 import (
 	"context"
 	"fmt"
+	"gateway/common"
 	"gateway/log"
 	selfdriving "gateway/self-driving"
 	"math/rand"
 	"time"
 )
 
-func (s *Service) handleBsQuestion(qu pendingQuestion) bool {
-	clients := s.bsApiClient[qu.data.Model]
+// isBsModel reports whether model is served by self hosted workers.
+func (s *Service) isBsModel(model string) bool {
+	s.bsClientMut.RLock()
+	defer s.bsClientMut.RUnlock()
+	_, ok := s.bsApiClient[model]
+	return ok
+}
+
+// bsClients copies the workers of model, so a question is asked without
+// holding bsClientMut and admin changes to the workers do not wait for it.
+func (s *Service) bsClients(model string) []*selfdriving.Client {
+	s.bsClientMut.RLock()
+	defer s.bsClientMut.RUnlock()
+	return append([]*selfdriving.Client(nil), s.bsApiClient[model]...)
+}
+
+// handleBsQuestion asks one of clients, a snapshot of the workers of the
+// question's model.
+func (s *Service) handleBsQuestion(qu pendingQuestion, clients []*selfdriving.Client) bool {
 	var client *selfdriving.Client
 	timer := time.NewTimer(time.Second * 60)
 loop:
@@ -19,44 +37,48 @@ loop:
 		case <-timer.C:
 			log.Error("timeout no available client for model %s", qu.data.Model)
 			qu.resp <- RelayResponse{
-				Url:            client.Url,
 				Text:           "",
 				MessageId:      "",
 				ConversationId: "",
 				Model:          qu.data.Model,
+				Telemetry:      qu.answerTelemetry(nil, "", 0, ErrNoFreeModel),
 			}
 			close(qu.resp)
 			return false
 		default:
 			idx := rand.Intn(len(clients))
 			client = clients[idx]
-			if client.Status == Avalible {
+			if client.Status == Avalible && !client.Disabled {
 				break loop
 			}
 		}
 	}
 
-	qa, err := client.GetAnswer(context.Background(), qu.data)
+	ctx, firstByte := common.TraceFirstByte(context.Background())
+	qa, err := client.GetAnswer(ctx, qu.data)
 	if err != nil {
-		log.Error("handle bs question error")
+		log.Error("handle bs question error", err)
 		qu.resp <- RelayResponse{
 			Url:            client.Url,
 			Text:           "",
 			MessageId:      "",
 			ConversationId: "",
 			Model:          qu.data.Model,
+			Telemetry:      qu.answerTelemetry(nil, client.Url, firstByte(), err),
 		}
 		close(qu.resp)
 		return false
 	}
 	res := RelayResponse{
 		Url:            client.Url,
-		Text:           qa.Answer,
+		Text:           qu.restore(qa.Answer),
 		MessageId:      qa.MessageId,
 		ConversationId: qa.ConversationId,
 		Model:          qu.data.Model,
+		Telemetry:      qu.answerTelemetry(qa, client.Url, firstByte(), nil),
 	}
-	log.Info(fmt.Sprintf("question: %s \n answer: %s \n model: %s", qu.data.Message, res.Text, res.Model))
+	//the texts may hold restored sensitive values, only their size is logged
+	log.Info(fmt.Sprintf("answered question model: %s conversation: %s message: %s question bytes: %d answer bytes: %d", res.Model, res.ConversationId, res.MessageId, len(qu.data.Message), len(res.Text)))
 	qu.resp <- res
 	close(qu.resp)
 	return false
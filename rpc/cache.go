@@ -0,0 +1,134 @@
+package rpc
+
+import (
+	"gateway/cache"
+	"gateway/common"
+	"gateway/log"
+	"gateway/metrics"
+	selfdriving "gateway/self-driving"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	CacheHeader        = "X-Cache"
+	CacheStateHit      = "HIT"
+	CacheStateMiss     = "MISS"
+	CacheStateBypass   = "BYPASS"
+	CacheStateSemantic = "SEMANTIC-HIT"
+	CacheStateSkipped  = ""
+)
+
+const (
+	CacheKindExact    = "exact"
+	CacheKindSemantic = "semantic"
+)
+
+var CacheConf cache.Config
+
+var CoalesceRequests bool
+
+var (
+	cacheRequests     = metrics.NewCounter("gateway_cache_requests_total", "response cache lookups by result", "model", "result")
+	coalescedRequests = metrics.NewCounter("gateway_coalesced_requests_total", "requests answered by an identical in-flight request", "model")
+)
+
+// cacheBypassed reports whether the client asked to skip the response cache.
+func cacheBypassed(c *gin.Context) bool {
+	cc := strings.ToLower(c.GetHeader("Cache-Control"))
+	return strings.Contains(cc, "no-cache") || strings.Contains(cc, "no-store")
+}
+
+// questionKey returns the key identifying q for the response cache and
+// request coalescing, or "" when q is neither. Only deterministic questions
+// to self hosted models qualify, the prompt built for the key is kept on q so
+// the worker does not rebuild it.
+func (s *Service) questionKey(q *common.Question) string {
+	if (s.respCache == nil && s.flight == nil) || !q.Deterministic() {
+		return ""
+	}
+	if !s.isBsModel(q.Model) {
+		return ""
+	}
+	q.Prompt = selfdriving.BuildPrompt(q)
+	return cache.Key(q.Model, q.Prompt, cache.Params{Temperature: q.Temperature, TopP: q.TopP})
+}
+
+// cacheKey returns the key to look up in the response cache and the cache
+// state to report for it.
+func (s *Service) cacheKey(c *gin.Context, key string, q *common.Question) (string, string) {
+	if s.respCache == nil || key == "" {
+		return "", CacheStateSkipped
+	}
+	if cacheBypassed(c) {
+		cacheRequests.Inc(q.Model, "bypass")
+		return "", CacheStateBypass
+	}
+	return key, CacheStateMiss
+}
+
+func (s *Service) cachedAnswer(key string, q *common.Question) (RelayResponse, bool) {
+	if key == "" {
+		return RelayResponse{}, false
+	}
+	entry, ok := s.respCache.Get(key)
+	if !ok {
+		cacheRequests.Inc(q.Model, "miss")
+		return RelayResponse{}, false
+	}
+	cacheRequests.Inc(q.Model, "hit")
+	log.Debug("response cache hit", q.Model, key)
+	return ownAnswer(RelayResponse{
+		Url:   entry.Url,
+		Text:  entry.Text,
+		Model: entry.Model,
+		Cache: CacheKindExact,
+	}, q), true
+}
+
+// ownAnswer gives an answer served from another request fresh message id and
+// the conversation of q.
+func ownAnswer(answer RelayResponse, q *common.Question) RelayResponse {
+	answer.MessageId = uuid.NewString()
+	answer.ConversationId = q.ConversationId
+	if answer.ConversationId == "" {
+		answer.ConversationId = uuid.NewString()
+	}
+	return answer
+}
+
+func (s *Service) storeCache(key string, answer RelayResponse) {
+	if key == "" || answer.Cache != "" || answer.Text == "" || answer.Text == InternalError {
+		return
+	}
+	s.respCache.Set(key, cache.Entry{
+		Text:  answer.Text,
+		Model: answer.Model,
+		Url:   answer.Url,
+	})
+}
+
+// askCoalesced asks q once for all concurrent callers with the same key.
+func (s *Service) askCoalesced(key string, q common.Question) (RelayResponse, error) {
+	if key == "" || s.flight == nil {
+		return s.askQuestion(q)
+	}
+	asked := false
+	answer, err, shared := s.flight.Do(key, func() (RelayResponse, error) {
+		asked = true
+		return s.askQuestion(q)
+	})
+	if err != nil || !shared {
+		return answer, err
+	}
+	if !asked {
+		//the tokens were used once, by the caller that asked
+		coalescedRequests.Inc(q.Model)
+		answer.Coalesced = true
+		answer.Telemetry.PromptTokens = 0
+		answer.Telemetry.CompletionTokens = 0
+	}
+	return ownAnswer(answer, &q), nil
+}
@@ -0,0 +1,193 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gateway/db"
+	"gateway/log"
+	"gateway/metrics"
+	"gateway/pricing"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	budgetAlertKind    = "budget"
+	budgetAlertTimeout = 10 * time.Second
+	maxAlertedBudgets  = 10000
+)
+
+var PricingConf pricing.Config
+
+var (
+	unpricedTurns = metrics.NewCounter("gateway_unpriced_turns_total", "answered turns of models without a price", "model")
+	budgetAlerts  = metrics.NewCounter("gateway_budget_alerts_total", "budget thresholds passed by tenants", "tenant")
+)
+
+// BudgetAlert is logged and posted to the alert webhook when a tenant's cost
+// in a month reaches a percent of its budget.
+type BudgetAlert struct {
+	Tenant   string  `json:"tenant"`
+	Month    string  `json:"month"` //2006-01, UTC
+	Percent  int     `json:"percent"`
+	Budget   float64 `json:"budget"`
+	Spent    float64 `json:"spent"`
+	Currency string  `json:"currency"`
+}
+
+func (a BudgetAlert) id() string {
+	return fmt.Sprintf("%s|%s|%s|%d", budgetAlertKind, a.Tenant, a.Month, a.Percent)
+}
+
+func (a BudgetAlert) String() string {
+	return fmt.Sprintf("tenant %s spent %.2f %s in %s, %d%% of its budget of %.2f", a.Tenant, a.Spent, a.Currency, a.Month, a.Percent, a.Budget)
+}
+
+// CostReport is the cost of tenants and models over a time range.
+type CostReport struct {
+	Currency string          `json:"currency"`
+	Totals   []db.UsageTotal `json:"totals"`
+}
+
+// alertedBudgets remembers the alerts this gateway sent or saw claimed, so
+// the store is asked once per threshold.
+var alertedBudgets = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+func budgetAlerted(id string) bool {
+	alertedBudgets.Lock()
+	defer alertedBudgets.Unlock()
+	return alertedBudgets.ids[id]
+}
+
+func markBudgetAlerted(id string) {
+	alertedBudgets.Lock()
+	defer alertedBudgets.Unlock()
+	if len(alertedBudgets.ids) >= maxAlertedBudgets {
+		alertedBudgets.ids = make(map[string]bool)
+	}
+	alertedBudgets.ids[id] = true
+}
+
+// priceTurn sets the cost of an answered turn from the price table. Cached
+// and coalesced turns used no tokens and cost nothing.
+func (s *Service) priceTurn(msg *db.Message) {
+	if s.prices == nil || msg.PromptTokens+msg.CompletionTokens == 0 {
+		return
+	}
+	cost, ok := s.prices.Cost(msg.Model, msg.Url, time.Unix(msg.StartTime, 0), msg.PromptTokens, msg.CompletionTokens)
+	if !ok {
+		unpricedTurns.Inc(msg.Model)
+		return
+	}
+	msg.Cost = cost
+	if _, ok := s.prices.Budget(msg.Tenant); msg.Tenant != "" && ok {
+		go s.checkBudget(msg.Tenant, cost, time.Now())
+	}
+}
+
+// checkBudget alerts once per month and threshold of the budget of tenant
+// its cost reached. The turn that cost cost is not metered yet. The alert
+// is claimed in the store so only one gateway sends it, stores without
+// alerts let every gateway send its own.
+func (s *Service) checkBudget(tenant string, cost float64, now time.Time) {
+	budget, _ := s.prices.Budget(tenant)
+	ctx, cancel := context.WithTimeout(context.Background(), budgetAlertTimeout)
+	defer cancel()
+	usage, err := monthUsage(ctx, tenant, now)
+	if err != nil {
+		log.Error("read tenant cost error", err)
+		return
+	}
+	spent := usage.Cost + cost
+	for _, pct := range budget.Reached(spent) {
+		alert := BudgetAlert{
+			Tenant:   tenant,
+			Month:    db.PeriodStart(db.UsageMonth, now).Format("2006-01"),
+			Percent:  pct,
+			Budget:   budget.Monthly,
+			Spent:    spent,
+			Currency: s.prices.Currency(),
+		}
+		id := alert.id()
+		if budgetAlerted(id) {
+			continue
+		}
+		claimed, err := db.ClaimAlert(ctx, db.Alert{Id: id, Kind: budgetAlertKind, Tenant: tenant, Message: alert.String(), CreatedAt: now})
+		if err != nil && !errors.Is(err, db.ErrAlertUnsupported) {
+			log.Error("claim budget alert error", err)
+			continue
+		}
+		markBudgetAlerted(id)
+		if err == nil && !claimed {
+			continue
+		}
+		s.sendBudgetAlert(ctx, alert)
+	}
+}
+
+func (s *Service) sendBudgetAlert(ctx context.Context, alert BudgetAlert) {
+	log.Warn("budget alert", alert.String())
+	budgetAlerts.Inc(alert.Tenant)
+	webhook := s.prices.AlertWebhook()
+	if webhook == "" {
+		return
+	}
+	data, err := json.Marshal(&alert)
+	if err != nil {
+		log.Error("marshal budget alert error", err)
+		return
+	}
+	if _, err := client.Post(ctx, webhook, data, budgetAlertTimeout, map[string]string{"Content-Type": "application/json"}); err != nil {
+		log.Error("post budget alert error", err)
+	}
+}
+
+// writeCosts answers with the cost of every tenant and model in the buckets
+// of q.
+func (s *Service) writeCosts(c *gin.Context, q db.UsageQuery) {
+	buckets, ok := readUsage(c, q)
+	if !ok {
+		return
+	}
+	currency := pricing.DefaultCurrency
+	if s.prices != nil {
+		currency = s.prices.Currency()
+	}
+	c.JSON(http.StatusOK, Resp{ResultCode: Success, ResultMsg: "", ResultBody: CostReport{Currency: currency, Totals: db.TotalUsage(buckets)}})
+}
+
+// HandleCostReport sums up the cost of every tenant per model, e.g.
+// /admin/costs?from=2024-05-01&to=2024-06-01&tenant=acme
+func (s *Service) HandleCostReport(c *gin.Context) {
+	q, err := usageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Resp{ResultCode: ErrorCodeParseReq, ResultMsg: err.Error(), ResultBody: ""})
+		return
+	}
+	q.Tenant = c.Query("tenant")
+	s.writeCosts(c, q)
+}
+
+// HandleTenantCosts sums up the cost of the caller's tenant per model.
+func (s *Service) HandleTenantCosts(c *gin.Context) {
+	tenant := tenantOf(c)
+	if tenant == "" {
+		c.JSON(http.StatusForbidden, Resp{ResultCode: ErrorCodeUnknow, ResultMsg: "costs are kept per tenant, these credentials have none", ResultBody: ""})
+		return
+	}
+	q, err := usageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Resp{ResultCode: ErrorCodeParseReq, ResultMsg: err.Error(), ResultBody: ""})
+		return
+	}
+	q.Tenant = tenant
+	s.writeCosts(c, q)
+}
@@ -0,0 +1,102 @@
+package rpc
+
+import (
+	"encoding/json"
+	"gateway/common"
+	"gateway/db"
+	"gateway/pricing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCostAndBudget(t *testing.T) {
+	db.Store = db.NewMemoryStore()
+	alerts := make(chan BudgetAlert, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert BudgetAlert
+		data, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &alert); err != nil {
+			t.Error(err)
+		}
+		alerts <- alert
+	}))
+	defer webhook.Close()
+	client = common.NewHttpClient(common.HttpConfig{})
+	prices, err := pricing.New(pricing.Config{
+		Prices:       []pricing.Price{{Model: "gpt", PromptPer1K: 10, CompletionPer1K: 20}},
+		Budgets:      map[string]pricing.Budget{"spender": {Monthly: 100}},
+		AlertWebhook: webhook.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{prices: prices}
+	now := time.Now()
+
+	turn := db.Message{ConversationId: "c1", MessageId: "m1", StartTime: now.Unix(), Model: "gpt", Tenant: "spender",
+		Telemetry: db.Telemetry{PromptTokens: 1000, CompletionTokens: 2000}}
+	s.priceTurn(&turn)
+	if turn.Cost != 50 {
+		t.Fatal("unexpected cost", turn.Cost)
+	}
+	select {
+	case alert := <-alerts:
+		if alert.Percent != 50 || alert.Spent != 50 || alert.Currency != pricing.DefaultCurrency {
+			t.Fatal("unexpected alert", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no budget alert")
+	}
+	cached := db.Message{ConversationId: "c1", MessageId: "m2", StartTime: now.Unix(), Model: "gpt", Tenant: "spender", Cache: CacheStateHit}
+	s.priceTurn(&cached)
+	unpriced := db.Message{ConversationId: "c1", MessageId: "m3", StartTime: now.Unix(), Model: "m1", Tenant: "spender",
+		Telemetry: db.Telemetry{PromptTokens: 10}}
+	s.priceTurn(&unpriced)
+	if cached.Cost != 0 || unpriced.Cost != 0 {
+		t.Fatal("cached or unpriced turn cost", cached.Cost, unpriced.Cost)
+	}
+	for _, msg := range []db.Message{turn, cached, unpriced} {
+		if err := db.WriteConversation(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//a threshold is alerted once, however many gateways reach it
+	usageCache.Lock()
+	delete(usageCache.tenants, "spender")
+	usageCache.Unlock()
+	s.checkBudget("spender", 0, now)
+	alertedBudgets.Lock()
+	alertedBudgets.ids = make(map[string]bool)
+	alertedBudgets.Unlock()
+	s.checkBudget("spender", 0, now)
+	select {
+	case alert := <-alerts:
+		t.Fatal("alert sent twice", alert)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/admin/costs", s.HandleCostReport)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/costs?period=month&tenant=spender", nil))
+	var rep struct {
+		Data CostReport `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil || w.Code != http.StatusOK {
+		t.Fatal("unexpected cost report", w.Code, w.Body.String())
+	}
+	if totals := rep.Data.Totals; len(totals) != 2 || totals[0].Model != "gpt" || totals[0].Cost != 50 || totals[0].Requests != 2 || totals[1].Cost != 0 {
+		t.Fatal("unexpected totals", totals)
+	}
+	if !strings.Contains(w.Body.String(), `"currency":"USD"`) {
+		t.Fatal("no currency", w.Body.String())
+	}
+}
@@ -0,0 +1,92 @@
+package rpc
+
+import (
+	"fmt"
+	"gateway/dataset"
+	"gateway/db"
+	"gateway/log"
+	"gateway/trie"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SplitTrain      = "train"
+	SplitValidation = "validation"
+)
+
+// HandleExportDataset streams one split of a fine-tuning dataset built from
+// the stored conversations, e.g.
+// /admin/export-dataset?format=openai&model=self-driving-v1&min_score=4&val_ratio=0.1&split=validation
+func (s *Service) HandleExportDataset(c *gin.Context) {
+	//it dumps every stored conversation, so it is never served openly
+	if !adminAllowed(c, db.RoleAdmin) {
+		return
+	}
+	rep := Resp{
+		ResultCode: ErrorCodeParseReq,
+		ResultMsg:  "",
+		ResultBody: "",
+	}
+	fail := func(msg string) {
+		rep.ResultMsg = msg
+		c.JSON(http.StatusBadRequest, rep)
+	}
+	opts := dataset.Options{
+		Format:          c.DefaultQuery("format", dataset.FormatShareGPT),
+		Models:          c.QueryArray("model"),
+		RequireFeedback: c.Query("require_feedback") == "true",
+		Sensitive:       c.Query("sensitive"),
+		Dedup:           c.Query("dedup") != "false",
+		System:          c.Query("system"),
+		IsSensitive:     trie.IsSensitive,
+	}
+	var err error
+	for name, field := range map[string]*int64{"from": &opts.From, "to": &opts.To} {
+		if *field, err = dataset.ParseTime(c.Query(name)); err != nil {
+			fail(err.Error())
+			return
+		}
+	}
+	for name, field := range map[string]*float64{"min_score": &opts.MinScore, "val_ratio": &opts.ValRatio} {
+		if value := c.Query(name); value != "" {
+			if *field, err = strconv.ParseFloat(value, 64); err != nil {
+				fail("invalid " + name)
+				return
+			}
+		}
+	}
+	if err := opts.Validate(); err != nil {
+		fail(err.Error())
+		return
+	}
+	split := c.DefaultQuery("split", SplitTrain)
+	var train, validation io.Writer = c.Writer, io.Discard
+	switch split {
+	case SplitTrain:
+	case SplitValidation:
+		train, validation = io.Discard, c.Writer
+	default:
+		fail("split must be train or validation")
+		return
+	}
+
+	c.Header("Content-Type", dataset.ContentType(opts.Format))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s%s", split, dataset.Ext(opts.Format)))
+	report, err := dataset.Export(c.Request.Context(), opts, train, validation)
+	if err != nil {
+		//nothing is written before the conversations are loaded and checked
+		log.Error("export dataset error", err)
+		if !c.Writer.Written() {
+			rep.ResultCode = ErrorCodeUnknow
+			rep.ResultMsg = err.Error()
+			c.Header("Content-Disposition", "")
+			c.JSON(http.StatusInternalServerError, rep)
+		}
+		return
+	}
+	log.Infof("exported dataset %+v", *report)
+}
@@ -0,0 +1,123 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"gateway/db"
+	"gateway/log"
+	"gateway/metrics"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const feedbackTimeout = 10 * time.Second
+
+var feedbackTotal = metrics.NewCounter("gateway_feedback_total", "answer feedback by thumb", "model", "thumb")
+
+type FeedbackReq struct {
+	MessageId string   `json:"message_id"`
+	Thumb     string   `json:"thumb"`  //up, down or empty
+	Rating    int      `json:"rating"` //1 to 5, 0 if not rated
+	Comment   string   `json:"comment"`
+	Tags      []string `json:"tags"`
+}
+
+var thumbs = map[string]int{"": db.ThumbNone, "up": db.ThumbUp, "down": db.ThumbDown}
+
+// HandleFeedback stores a user's judgement of an answer on its turn.
+func (s *Service) HandleFeedback(c *gin.Context) {
+	rep := Resp{
+		ResultCode: ErrorCodeParseReq,
+		ResultMsg:  "",
+		ResultBody: "",
+	}
+	req := FeedbackReq{}
+	if err := c.BindJSON(&req); err != nil || req.MessageId == "" {
+		rep.ResultMsg = "message_id required"
+		c.JSON(http.StatusBadRequest, rep)
+		return
+	}
+	thumb, ok := thumbs[req.Thumb]
+	if !ok {
+		rep.ResultMsg = "thumb must be up or down"
+		c.JSON(http.StatusBadRequest, rep)
+		return
+	}
+	fb := db.Feedback{
+		Thumb:     thumb,
+		Rating:    req.Rating,
+		Comment:   req.Comment,
+		Tags:      req.Tags,
+		SessionId: c.GetString(SesssionIdContextName),
+		UpdatedAt: time.Now().Unix(),
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), feedbackTimeout)
+	defer cancel()
+	msg, err := db.GetMessage(ctx, req.MessageId)
+	if err == nil && !canAccess(c, []db.Message{*msg}) {
+		err = db.ErrNotFound
+	}
+	if err == nil {
+		err = db.SetFeedback(ctx, req.MessageId, fb)
+	}
+	switch {
+	case errors.Is(err, db.ErrInvalidFeedback):
+		rep.ResultMsg = err.Error()
+		c.JSON(http.StatusBadRequest, rep)
+		return
+	case errors.Is(err, db.ErrNotFound):
+		rep.ResultMsg = "message not found"
+		c.JSON(http.StatusNotFound, rep)
+		return
+	case err != nil:
+		log.Error("store feedback error", err)
+		rep.ResultCode = ErrorCodeUnknow
+		rep.ResultMsg = err.Error()
+		c.JSON(http.StatusInternalServerError, rep)
+		return
+	}
+	feedbackTotal.Inc(msg.Model, req.Thumb)
+	rep.ResultCode = Success
+	rep.ResultBody = fb
+	c.JSON(http.StatusOK, rep)
+}
+
+// HandleFeedbackStats aggregates feedback per model or per worker, e.g.
+// /api/feedback/models?from=1700000000
+func (s *Service) HandleFeedbackStats(groupBy string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rep := Resp{
+			ResultCode: ErrorCodeParseReq,
+			ResultMsg:  "",
+			ResultBody: "",
+		}
+		q := db.FeedbackQuery{GroupBy: groupBy, Model: c.Query("model")}
+		var err error
+		for name, field := range map[string]*int64{"from": &q.From, "to": &q.To} {
+			if value := c.Query(name); value != "" {
+				if *field, err = strconv.ParseInt(value, 10, 64); err != nil {
+					rep.ResultMsg = "invalid " + name
+					c.JSON(http.StatusBadRequest, rep)
+					return
+				}
+			}
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), searchTimeout)
+		defer cancel()
+		stats, err := db.GetFeedbackStats(ctx, q)
+		if err != nil {
+			log.Error("aggregate feedback error", err)
+			rep.ResultCode = ErrorCodeUnknow
+			rep.ResultMsg = err.Error()
+			c.JSON(http.StatusInternalServerError, rep)
+			return
+		}
+		rep.ResultCode = Success
+		rep.ResultBody = stats
+		c.JSON(http.StatusOK, rep)
+	}
+}
@@ -0,0 +1,58 @@
+package rpc
+
+import (
+	"errors"
+	"sync"
+)
+
+var errFlightPanic = errors.New("coalesced question failed")
+
+type flightCall struct {
+	wg     sync.WaitGroup
+	answer RelayResponse
+	err    error
+	dups   int
+}
+
+// flightGroup coalesces concurrent calls with the same key into one call.
+type flightGroup struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// Do runs fn once per key at a time. Callers arriving while fn is in flight
+// wait for it and get its result with shared set. If fn panics the waiters
+// get errFlightPanic and the panic goes on in the caller that ran fn.
+func (g *flightGroup) Do(key string, fn func() (RelayResponse, error)) (answer RelayResponse, err error, shared bool) {
+	g.lock.Lock()
+	if call, ok := g.calls[key]; ok {
+		call.dups++
+		g.lock.Unlock()
+		call.wg.Wait()
+		return call.answer, call.err, true
+	}
+	call := &flightCall{err: errFlightPanic}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.lock.Unlock()
+	defer g.release(key, call)
+
+	call.answer, call.err = fn()
+
+	g.lock.Lock()
+	shared = call.dups > 0
+	g.lock.Unlock()
+	return call.answer, call.err, shared
+}
+
+// release lets the waiters of call go and the next call of key run.
+func (g *flightGroup) release(key string, call *flightCall) {
+	g.lock.Lock()
+	delete(g.calls, key)
+	g.lock.Unlock()
+	call.wg.Done()
+}
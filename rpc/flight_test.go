@@ -0,0 +1,95 @@
+package rpc
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupCoalesce(t *testing.T) {
+	g := newFlightGroup()
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (RelayResponse, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return RelayResponse{Text: "answer"}, nil
+	}
+	const waiters = 10
+	var wg sync.WaitGroup
+	var shared int32
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			answer, err, isShared := g.Do("key", fn)
+			if err != nil || answer.Text != "answer" {
+				t.Error("unexpected answer", answer, err)
+			}
+			if isShared {
+				atomic.AddInt32(&shared, 1)
+			}
+		}()
+	}
+	//let every waiter join the in-flight call
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("fn called %d times", calls)
+	}
+	if shared != waiters {
+		t.Fatalf("%d of %d callers shared the result", shared, waiters)
+	}
+}
+
+func TestFlightGroupSequential(t *testing.T) {
+	g := newFlightGroup()
+	calls := 0
+	fn := func() (RelayResponse, error) {
+		calls++
+		return RelayResponse{}, nil
+	}
+	g.Do("key", fn)
+	g.Do("key", fn)
+	if calls != 2 {
+		t.Fatalf("sequential calls coalesced, fn called %d times", calls)
+	}
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	waited := make(chan error)
+	go func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("panic of fn swallowed")
+			}
+		}()
+		g.Do("key", func() (RelayResponse, error) {
+			<-release
+			panic("upstream client bug")
+		})
+	}()
+	//join the call before it panics
+	time.Sleep(time.Millisecond * 20)
+	go func() {
+		_, err, _ := g.Do("key", func() (RelayResponse, error) { return RelayResponse{}, nil })
+		waited <- err
+	}()
+	time.Sleep(time.Millisecond * 20)
+	close(release)
+	select {
+	case err := <-waited:
+		if err != errFlightPanic {
+			t.Fatal("waiter did not get the failure", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter blocked after fn panicked")
+	}
+	if _, err, _ := g.Do("key", func() (RelayResponse, error) { return RelayResponse{Text: "ok"}, nil }); err != nil {
+		t.Fatal("key stuck after a panic", err)
+	}
+}
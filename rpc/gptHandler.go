@@ -6,12 +6,13 @@ import (
 	"fmt"
 	"gateway/common"
 	"gateway/log"
-	"time"
 )
 
 var (
 	ErrModelNotAvalible = errors.New("mode still in use")
 	ErrNoFreeModel      = errors.New("no free model")
+	ErrQueueTimeout     = errors.New("timeout waiting for a free slot")
+	ErrAnswerTimeout    = errors.New("timeout waiting for answer")
 )
 
 func (s *Service) handleOpenAIQuestion(qu pendingQuestion) error {
@@ -49,10 +50,15 @@ func (s *Service) handleOpenAIQuestion(qu pendingQuestion) error {
 func (s *Service) queryRelay(qu *pendingQuestion) *RelayResponse {
 	apiKey := qu.data.OpenAIKey
 	log.Debug("sending to relay apiKey", apiKey, "\n", qu.data)
-	qa, err := s.gptGetAnswer(apiKey, qu.data)
+	ctx, firstByte := common.TraceFirstByte(context.Background())
+	qa, err := s.gptGetAnswer(ctx, apiKey, qu.data)
 	qu.TriedTimes++
 	if err != nil || qa == nil {
 		log.Warn("relay res err  %v", apiKey)
+		if err == nil {
+			err = errors.New("empty answer")
+		}
+		qu.lastErr = err.Error()
 		qu.data.ConversationId = ""
 		qu.data.MessageId = ""
 		qu.data.OpenAIKey = ""
@@ -61,21 +67,22 @@ func (s *Service) queryRelay(qu *pendingQuestion) *RelayResponse {
 	//decode relay reponse put into channel
 	relayResponse := RelayResponse{
 		Url:            apiKey,
-		Text:           qa.Answer,
+		Text:           qu.restore(qa.Answer),
 		MessageId:      qa.MessageId,
 		ConversationId: qa.ConversationId,
 		Model:          "gpt",
+		Telemetry:      qu.answerTelemetry(qa, common.KeyHash(apiKey), firstByte(), nil),
 	}
 	log.Debug(fmt.Sprintf("question: %s \n answer: %s \n model: %s", qu.data.Message, relayResponse.Text, relayResponse.Model))
 	return &relayResponse
 }
 
-func (s *Service) gptGetAnswer(apiKey string, qu common.Question) (*common.QA, error) {
+func (s *Service) gptGetAnswer(ctx context.Context, apiKey string, qu common.Question) (*common.QA, error) {
 	cli, ok := s.gptApiClients[apiKey]
 	if !ok {
-		return nil, errors.New("no client at " + apiKey)
+		return nil, errors.New("no client at " + common.KeyHash(apiKey))
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*2)
+	ctx, cancel := context.WithTimeout(ctx, common.Upstream.TimeoutFor(qu.Model))
 	defer cancel()
 	return cli.GetAnswer(ctx, qu)
 }
@@ -0,0 +1,84 @@
+package rpc
+
+import (
+	"gateway/common"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QueuedQuestion is a question waiting for a worker slot or holding one.
+type QueuedQuestion struct {
+	Id         uint64 `json:"id"`
+	Model      string `json:"model"`
+	Tenant     string `json:"tenant,omitempty"`
+	SessionId  string `json:"sessionId,omitempty"`
+	EnqueuedAt int64  `json:"enqueuedAt"`          //unix ms
+	StartedAt  int64  `json:"startedAt,omitempty"` //unix ms, 0 while waiting
+}
+
+type QueueCounts struct {
+	Waiting int `json:"waiting"`
+	Running int `json:"running"`
+}
+
+// QueueStatus is what the questions of this gateway are doing, oldest
+// first.
+type QueueStatus struct {
+	QueueCounts
+	MaxPending int                    `json:"maxPending"` //questions handled at once
+	Models     map[string]QueueCounts `json:"models"`
+	Questions  []QueuedQuestion       `json:"questions"`
+}
+
+// questionQueue tracks the questions between askQuestion and their answer.
+type questionQueue struct {
+	sync.Mutex
+	next      uint64
+	questions map[uint64]*QueuedQuestion
+}
+
+func (q *questionQueue) add(data *common.Question, now time.Time) uint64 {
+	q.Lock()
+	defer q.Unlock()
+	if q.questions == nil {
+		q.questions = make(map[uint64]*QueuedQuestion)
+	}
+	q.next++
+	q.questions[q.next] = &QueuedQuestion{Id: q.next, Model: data.Model, Tenant: data.Tenant, SessionId: data.SessionId, EnqueuedAt: now.UnixMilli()}
+	return q.next
+}
+
+func (q *questionQueue) start(id uint64, now time.Time) {
+	q.Lock()
+	defer q.Unlock()
+	if question, ok := q.questions[id]; ok && question.StartedAt == 0 {
+		question.StartedAt = now.UnixMilli()
+	}
+}
+
+func (q *questionQueue) remove(id uint64) {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.questions, id)
+}
+
+func (q *questionQueue) status(maxPending int) QueueStatus {
+	q.Lock()
+	defer q.Unlock()
+	status := QueueStatus{MaxPending: maxPending, Models: make(map[string]QueueCounts), Questions: make([]QueuedQuestion, 0, len(q.questions))}
+	for _, question := range q.questions {
+		counts := status.Models[question.Model]
+		if question.StartedAt == 0 {
+			counts.Waiting++
+			status.Waiting++
+		} else {
+			counts.Running++
+			status.Running++
+		}
+		status.Models[question.Model] = counts
+		status.Questions = append(status.Questions, *question)
+	}
+	sort.Slice(status.Questions, func(i, j int) bool { return status.Questions[i].Id < status.Questions[j].Id })
+	return status
+}
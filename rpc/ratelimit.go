@@ -0,0 +1,81 @@
+package rpc
+
+import (
+	"context"
+	"gateway/db"
+	"gateway/log"
+	"gateway/metrics"
+	"gateway/ratelimit"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RateLimitHeaderPrefix = "X-RateLimit-"
+	rateLimitTimeout      = 2 * time.Second
+)
+
+var RateLimitConf ratelimit.Config
+
+var rateLimited = metrics.NewCounter("gateway_rate_limited_total", "questions refused by the rate limit", "model")
+
+// rateLimitId is who a request is limited as: its key or jwt user, else the
+// client address, since cookie sessions cost nothing to start.
+func rateLimitId(c *gin.Context) string {
+	if p := principalOf(c); p != nil {
+		return p.Session
+	}
+	return "ip:" + c.ClientIP()
+}
+
+func setQuotaHeaders(c *gin.Context, kind string, q ratelimit.Quota) {
+	if q.Limit <= 0 {
+		return
+	}
+	c.Header(RateLimitHeaderPrefix+"Limit-"+kind, strconv.Itoa(q.Limit))
+	c.Header(RateLimitHeaderPrefix+"Remaining-"+kind, strconv.Itoa(q.Remaining))
+	c.Header(RateLimitHeaderPrefix+"Reset-"+kind, strconv.Itoa(seconds(q.Reset)))
+}
+
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// allowQuestion takes a question to model from the caller's rate limit and
+// sets the X-RateLimit headers. Questions are let through when the limit
+// store fails.
+func (s *Service) allowQuestion(c *gin.Context, model string) bool {
+	if s.limiter == nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), rateLimitTimeout)
+	defer cancel()
+	d, err := s.limiter.Allow(ctx, rateLimitId(c), tenantOf(c), model)
+	if err != nil {
+		log.Error("rate limit error", err)
+		return true
+	}
+	setQuotaHeaders(c, "Requests", d.Requests)
+	setQuotaHeaders(c, "Tokens", d.Tokens)
+	if !d.Allowed {
+		rateLimited.Inc(model)
+		c.Header("Retry-After", strconv.Itoa(seconds(d.RetryAfter)))
+	}
+	return d.Allowed
+}
+
+// chargeTokens takes the tokens an answer used from the caller's limit.
+func (s *Service) chargeTokens(c *gin.Context, model string, telemetry db.Telemetry) {
+	if s.limiter == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), rateLimitTimeout)
+	defer cancel()
+	err := s.limiter.Charge(ctx, rateLimitId(c), tenantOf(c), model, telemetry.PromptTokens+telemetry.CompletionTokens)
+	if err != nil {
+		log.Error("charge rate limit tokens error", err)
+	}
+}
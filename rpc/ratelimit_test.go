@@ -0,0 +1,65 @@
+package rpc
+
+import (
+	"gateway/db"
+	"gateway/ratelimit"
+	selfdriving "gateway/self-driving"
+	"gateway/trie"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loadTestSensitive makes "forbidden" sensitive, such questions are
+// answered without a worker.
+func loadTestSensitive(t *testing.T) {
+	sensitive := filepath.Join(t.TempDir(), "sensitive.csv")
+	if err := os.WriteFile(sensitive, []byte("forbidden\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := trie.LoadSensitive(sensitive); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateLimitQuestion(t *testing.T) {
+	db.Store = db.NewMemoryStore()
+	loadTestSensitive(t)
+	s := &Service{
+		bsApiClient: map[string][]*selfdriving.Client{"m1": nil, "m2": nil},
+		limiter: ratelimit.NewLimiter(ratelimit.Config{
+			Default: ratelimit.Limit{RequestsPerMinute: 1, TokensPerMinute: 1000},
+			Models:  map[string]ratelimit.Limit{"m2": {RequestsPerMinute: 10}},
+		}, ratelimit.NewMemory()),
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/question", s.HandleQuestion)
+	ask := func(model, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/question", strings.NewReader(`{"message":"forbidden","model":"`+model+`"}`))
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := ask("m1", "10.0.0.1:1000")
+	if w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit-Requests") != "1" || w.Header().Get("X-RateLimit-Remaining-Requests") != "0" || w.Header().Get("X-RateLimit-Limit-Tokens") != "1000" {
+		t.Fatal("unexpected first answer", w.Code, w.Header())
+	}
+	w = ask("m1", "10.0.0.1:1001")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" || w.Header().Get("X-RateLimit-Reset-Requests") != "60" {
+		t.Fatal("second question not limited", w.Code, w.Header())
+	}
+	if w := ask("m1", "10.0.0.2:1000"); w.Code != http.StatusOK {
+		t.Fatal("other client limited", w.Code)
+	}
+	if w := ask("m2", "10.0.0.1:1000"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit-Requests") != "10" || w.Header().Get("X-RateLimit-Limit-Tokens") != "" {
+		t.Fatal("model limit not applied", w.Code, w.Header())
+	}
+}
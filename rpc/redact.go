@@ -0,0 +1,93 @@
+package rpc
+
+import (
+	chatapi "gateway/chat-api"
+	"gateway/common"
+	"gateway/log"
+	"gateway/metrics"
+	"gateway/redact"
+	selfdriving "gateway/self-driving"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+var RedactionConf redact.Config
+
+var redactions = metrics.NewCounter("gateway_redactions_total", "values replaced by placeholders before dispatch", "detector", "model")
+
+// redactQuestion replaces the sensitive values in the prompt of qu before it
+// goes upstream, the history included. It runs once per question, retries
+// reuse the redacted prompt and the session that restores the answer.
+func (s *Service) redactQuestion(qu *pendingQuestion) {
+	if s.redactor == nil || qu.redaction != nil {
+		return
+	}
+	session := s.redactor.Session(qu.data.Model)
+	if session == nil {
+		return
+	}
+	prompt := qu.data.Prompt
+	if prompt == nil {
+		if s.isBsModel(qu.data.Model) {
+			prompt = selfdriving.BuildPrompt(&qu.data)
+		} else {
+			prompt = chatapi.BuildPrompt(&qu.data)
+		}
+	}
+	//the prompt may be shared with the cache key of coalesced questions
+	redacted := make([]openai.ChatCompletionMessage, len(prompt))
+	for i, msg := range prompt {
+		msg.Content = session.Redact(msg.Content)
+		redacted[i] = msg
+	}
+	qu.data.Prompt = redacted
+	qu.redaction = session
+	for detector, n := range session.DetectorCount {
+		redactions.Add(float64(n), detector, qu.data.Model)
+	}
+	if session.Count() != 0 {
+		log.Debug("redacted", session.Count(), "values from question to", qu.data.Model)
+	}
+}
+
+// redactedMessage is the message of q with its sensitive values replaced,
+// the message itself when redaction is off.
+func (s *Service) redactedMessage(q *common.Question) string {
+	if s.redactor == nil {
+		return q.Message
+	}
+	session := s.redactor.Session(q.Model)
+	if session == nil {
+		return q.Message
+	}
+	return session.Redact(q.Message)
+}
+
+// restore puts the redacted values back into an upstream answer.
+func (qu *pendingQuestion) restore(answer string) string {
+	if qu.redaction == nil {
+		return answer
+	}
+	return qu.redaction.Restore(answer)
+}
+
+// redactedCounts is recorded with the turn, nil if nothing was replaced.
+func (qu *pendingQuestion) redactedCounts() map[string]int {
+	if qu.redaction == nil || qu.redaction.Count() == 0 {
+		return nil
+	}
+	return qu.redaction.DetectorCount
+}
+
+// newRedactor builds the redactor of the config, nil when redaction is off.
+func newRedactor(conf redact.Config) *redact.Redactor {
+	if !conf.Enable {
+		return nil
+	}
+	r, err := redact.New(conf)
+	if err != nil {
+		log.Error("init redaction error", err)
+		return nil
+	}
+	return r
+}
@@ -0,0 +1,70 @@
+package rpc
+
+import (
+	"context"
+	"gateway/db"
+	"gateway/log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const searchTimeout = 30 * time.Second
+
+// HandleSearch searches stored turns, e.g.
+// /api/search?q=lane+keeping&model=self-driving-v1&from=1700000000&page=2
+func (s *Service) HandleSearch(c *gin.Context) {
+	rep := Resp{
+		ResultCode: ErrorCodeParseReq,
+		ResultMsg:  "",
+		ResultBody: "",
+	}
+	q := db.SearchQuery{
+		Text:  c.Query("q"),
+		Model: c.Query("model"),
+		Url:   c.Query("url"),
+	}
+	//only admins search other sessions, everyone else their own turns
+	if isAdmin(c) {
+		q.UserId = c.Query("user")
+		q.SessionId = c.Query("session")
+	} else if q.SessionId = c.GetString(SesssionIdContextName); q.SessionId == "" {
+		abortUnauthorized(c, http.StatusUnauthorized, "session required")
+		return
+	}
+	var err error
+	for name, field := range map[string]*int64{"from": &q.From, "to": &q.To} {
+		if value := c.Query(name); value != "" {
+			if *field, err = strconv.ParseInt(value, 10, 64); err != nil {
+				rep.ResultMsg = "invalid " + name
+				c.JSON(http.StatusBadRequest, rep)
+				return
+			}
+		}
+	}
+	for name, field := range map[string]*int{"page": &q.Page, "page_size": &q.PageSize} {
+		if value := c.Query(name); value != "" {
+			if *field, err = strconv.Atoi(value); err != nil {
+				rep.ResultMsg = "invalid " + name
+				c.JSON(http.StatusBadRequest, rep)
+				return
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), searchTimeout)
+	defer cancel()
+	result, err := db.Search(ctx, q)
+	if err != nil {
+		log.Error("search conversations error", err)
+		rep.ResultCode = ErrorCodeUnknow
+		rep.ResultMsg = err.Error()
+		c.JSON(http.StatusInternalServerError, rep)
+		return
+	}
+	rep.ResultCode = Success
+	rep.ResultBody = result
+	c.JSON(http.StatusOK, rep)
+}
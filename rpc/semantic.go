@@ -0,0 +1,108 @@
+package rpc
+
+import (
+	"context"
+	"gateway/cache"
+	"gateway/common"
+	"gateway/log"
+	"gateway/metrics"
+	selfdriving "gateway/self-driving"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const embedTimeout = time.Second * 10
+
+var SemanticCacheConf cache.SemanticConfig
+
+var semanticRequests = metrics.NewCounter("gateway_semantic_cache_requests_total", "semantic cache lookups by result", "model", "result")
+
+type semanticCache struct {
+	conf     cache.SemanticConfig
+	embedder *selfdriving.EmbeddingClient
+	index    *cache.VectorIndex
+}
+
+func newSemanticCache(conf cache.SemanticConfig) *semanticCache {
+	return &semanticCache{
+		conf:     conf,
+		embedder: selfdriving.NewEmbeddingClient(conf.EmbeddingUrl, conf.EmbeddingModel),
+		index:    cache.NewVectorIndex(conf.MaxEntries, time.Second*time.Duration(conf.TTL)),
+	}
+}
+
+// semanticLookup is the outcome of one semantic cache lookup, kept so the
+// embedding can be indexed once the model has answered.
+type semanticLookup struct {
+	tenant string
+	vector []float32
+	match  *cache.Match
+	hit    bool
+}
+
+// semanticAnswer looks for a paraphrase of q answered before for the same
+// tenant. Only the first turn of a conversation is matched, follow-up
+// questions depend on history. The question is embedded redacted, sensitive
+// values never reach the embedding endpoint.
+func (s *Service) semanticAnswer(c *gin.Context, q *common.Question) (RelayResponse, *semanticLookup) {
+	if s.semantic == nil || !q.Deterministic() || cacheBypassed(c) {
+		return RelayResponse{}, nil
+	}
+	if !s.isBsModel(q.Model) {
+		return RelayResponse{}, nil
+	}
+	if q.Prompt == nil {
+		q.Prompt = selfdriving.BuildPrompt(q)
+	}
+	if len(q.Prompt) != 1 {
+		return RelayResponse{}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), embedTimeout)
+	defer cancel()
+	vector, err := s.semantic.embedder.Embed(ctx, s.redactedMessage(q))
+	if err != nil {
+		log.Warn("embed question error", err)
+		semanticRequests.Inc(q.Model, "error")
+		return RelayResponse{}, nil
+	}
+	lookup := &semanticLookup{tenant: q.Tenant, vector: vector}
+	lookup.match = s.semantic.index.Nearest(q.Tenant, q.Model, vector)
+	if lookup.match == nil || lookup.match.Similarity < s.semantic.conf.ThresholdFor(q.Model) {
+		semanticRequests.Inc(q.Model, "miss")
+		return RelayResponse{}, lookup
+	}
+	lookup.hit = true
+	semanticRequests.Inc(q.Model, "hit")
+	log.Debug("semantic cache hit", q.Model, lookup.match.Source, lookup.match.Similarity)
+	return ownAnswer(RelayResponse{
+		Url:         lookup.match.Entry.Url,
+		Text:        lookup.match.Entry.Text,
+		Model:       lookup.match.Entry.Model,
+		Cache:       CacheKindSemantic,
+		CacheSource: lookup.match.Source,
+		Similarity:  lookup.match.Similarity,
+	}, q), lookup
+}
+
+// storeSemantic indexes the question of a model answer. The best similarity
+// seen on the miss is kept on the answer for threshold tuning. Answers to
+// questions with redacted values are not indexed, they hold the restored
+// values.
+func (s *Service) storeSemantic(lookup *semanticLookup, answer *RelayResponse) {
+	if lookup == nil || lookup.hit {
+		return
+	}
+	if lookup.match != nil {
+		answer.Similarity = lookup.match.Similarity
+		answer.CacheSource = lookup.match.Source
+	}
+	if answer.Text == "" || answer.Text == InternalError || len(answer.Telemetry.Redacted) != 0 {
+		return
+	}
+	s.semantic.index.Add(lookup.tenant, answer.Model, lookup.vector, cache.Entry{
+		Text:  answer.Text,
+		Model: answer.Model,
+		Url:   answer.Url,
+	}, answer.MessageId)
+}
@@ -0,0 +1,68 @@
+package rpc
+
+import (
+	"encoding/json"
+	"gateway/cache"
+	"gateway/common"
+	"gateway/db"
+	"gateway/redact"
+	selfdriving "gateway/self-driving"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestSemanticCacheScope(t *testing.T) {
+	var lock sync.Mutex
+	embedded := make([]string, 0)
+	embedder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		lock.Lock()
+		embedded = append(embedded, req.Input...)
+		lock.Unlock()
+		w.Write([]byte(`{"data":[{"embedding":[1,0],"index":0}]}`))
+	}))
+	defer embedder.Close()
+	s := &Service{
+		bsApiClient: map[string][]*selfdriving.Client{"m1": nil},
+		semantic:    newSemanticCache(cache.SemanticConfig{Enable: true, EmbeddingUrl: embedder.URL}),
+		redactor:    newRedactor(redact.Config{Enable: true}),
+	}
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/question", nil)
+	ask := func(tenant, msg string) (RelayResponse, *semanticLookup) {
+		q := common.Question{Model: "m1", Tenant: tenant, Message: msg, Prompt: []openai.ChatCompletionMessage{{Role: "user", Content: msg}}}
+		return s.semanticAnswer(c, &q)
+	}
+
+	//sensitive values stay out of the embedding and the index
+	_, lookup := ask("t1", "mail dev@example.com about lane keeping")
+	if lookup == nil || lookup.hit {
+		t.Fatal("unexpected lookup", lookup)
+	}
+	if len(embedded) != 1 || strings.Contains(embedded[0], "dev@example.com") {
+		t.Fatal("question embedded unredacted", embedded)
+	}
+	s.storeSemantic(lookup, &RelayResponse{Text: "sent to dev@example.com", Model: "m1", Telemetry: db.Telemetry{Redacted: map[string]int{"email": 1}}})
+	if s.semantic.index.Len() != 0 {
+		t.Fatal("answer with restored values indexed")
+	}
+
+	_, lookup = ask("t1", "how does lane keeping work")
+	s.storeSemantic(lookup, &RelayResponse{Text: "it steers", Model: "m1", MessageId: "a1"})
+	if answer, lookup := ask("t1", "how does lane keeping work"); lookup == nil || !lookup.hit || answer.Text != "it steers" {
+		t.Fatal("paraphrase of the same tenant missed", lookup)
+	}
+	if _, lookup := ask("t2", "how does lane keeping work"); lookup == nil || lookup.hit {
+		t.Fatal("answer of another tenant served")
+	}
+}
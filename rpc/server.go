@@ -3,20 +3,25 @@ package rpc
 import (
 	"context"
 	"fmt"
+	"gateway/cache"
 	chatapi "gateway/chat-api"
 	"gateway/common"
 	"gateway/db"
+	"gateway/jwt"
 	"gateway/log"
+	"gateway/metrics"
+	"gateway/pricing"
+	"gateway/ratelimit"
+	"gateway/redact"
 	selfdriving "gateway/self-driving"
 	"gateway/trie"
 	"math/rand"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 	"github.com/goccy/go-json"
 )
@@ -32,6 +37,7 @@ const (
 	LastConversationContextName = "last_conv_id"
 	LastModelName               = "last_model_name"
 	LastRelayUrlContextName     = "last_url"
+	LastRelayHashContextName    = "last_relay_hash"
 	SesssionIdContextName       = "session_id"
 )
 
@@ -66,7 +72,7 @@ const (
 
 var once sync.Once
 
-var client *http.Client
+var client *common.HttpClient
 
 var RpcServer *Service
 
@@ -75,6 +81,11 @@ type pendingQuestion struct {
 	TriedTimes int
 	resp       chan (RelayResponse)
 	cancel     chan (struct{})
+	enqueuedAt time.Time
+	startedAt  time.Time //when a worker slot was taken
+	queueId    uint64
+	lastErr    string
+	redaction  *redact.Session
 }
 
 type Service struct {
@@ -87,11 +98,21 @@ type Service struct {
 	relaysStateLock  sync.RWMutex
 	questionCh       chan (pendingQuestion)
 	maxPendingLength int
+	respCache        cache.Backend
+	flight           *flightGroup
+	semantic         *semanticCache
+	redactor         *redact.Redactor
+	limiter          *ratelimit.Limiter
+	prices           *pricing.Table
+	queue            questionQueue
+	server           *http.Server
+	adminServer      *http.Server
+	cancel           context.CancelFunc
 }
 
 func InitRpcService(port string, relays []string, maxPendingLength int, bsModelConfig map[string][]string) {
 	once.Do(func() {
-		client = &http.Client{Timeout: time.Minute * 3}
+		client = common.NewHttpClient(common.Upstream.HttpConfig)
 		RpcServer = &Service{}
 		RpcServer.port = port
 		RpcServer.gptApiState = make(map[string]int)
@@ -100,6 +121,37 @@ func InitRpcService(port string, relays []string, maxPendingLength int, bsModelC
 		RpcServer.gptApiClients = make(map[string]*chatapi.Client)
 		RpcServer.bsApiClient = make(map[string][]*selfdriving.Client)
 		RpcServer.urls = make(map[string]int)
+		if CoalesceRequests {
+			RpcServer.flight = newFlightGroup()
+		}
+		if SemanticCacheConf.Enable {
+			RpcServer.semantic = newSemanticCache(SemanticCacheConf)
+		}
+		RpcServer.redactor = newRedactor(RedactionConf)
+		if CacheConf.Enable {
+			respCache, err := cache.New(CacheConf)
+			if err != nil {
+				log.Error("init response cache error", err)
+			} else {
+				RpcServer.respCache = respCache
+			}
+		}
+		if RateLimitConf.Enable {
+			limiter, err := ratelimit.New(RateLimitConf)
+			if err != nil {
+				log.Error("init rate limit error", err)
+			} else {
+				RpcServer.limiter = limiter
+			}
+		}
+		if PricingConf.Enable {
+			prices, err := pricing.New(PricingConf)
+			if err != nil {
+				log.Error("init pricing error", err)
+			} else {
+				RpcServer.prices = prices
+			}
+		}
 		RpcServer.relaysStateLock.Lock()
 		defer RpcServer.relaysStateLock.Unlock()
 		RpcServer.bsClientMut.Lock()
@@ -170,56 +222,150 @@ func (*LoggerMy) Write(p []byte) (n int, err error) {
 }
 
 func (c *Service) Start(ctx context.Context) error {
-	postQuestionsContext, _ := context.WithCancel(ctx)
+	verifier, err := NewJWTVerifier(AuthConf)
+	if err != nil {
+		return err
+	}
+	sessions, err := NewSessionManager(SessionConf)
+	if err != nil {
+		return err
+	}
+	postQuestionsContext, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
 	go c.StartChatService(postQuestionsContext)
+	go purgeSessions(postQuestionsContext)
 
 	//start gin
 	gin.DefaultWriter = &LoggerMy{}
 	r := gin.Default()
-	//session middelware
-	store := cookie.NewStore([]byte("secret11111")) //TODO:redis session store
-	store.Options(sessions.Options{
-		MaxAge: 20 * 60, //20min
-	})
 	//cors middleware
 	r.Use(Cors())
-	r.Use(sessions.Sessions("user", store))
-	r.Use(UserSession())
+	r.Use(Authenticate(verifier))
+	//session middelware
+	r.Use(UserSession(sessions))
 
 	r.SetTrustedProxies(nil)
 	r.GET("/healthcheck", func(c *gin.Context) {
 		c.String(http.StatusOK, "ok")
 	})
-	r.POST("/api/fake", c.HandleFake)
-	r.POST("/api/question", c.HandleQuestion)
-	r.POST("/api/register", c.HandleRegister)
-	r.POST("/api/register_worker", c.HandleRegisterWorker)
-	r.POST("/api/receive_heart_beat", c.HandleSendHeartBeat)
-	r.POST("/api/get_worker_address", c.HandleGetWorkerAddress)
-	r.POST("/api/refresh_all_workers", c.HandleRefreshAllWorkers)
-	r.POST("/api/list_language_models", c.HandleListModels)
-	r.POST("/api/list_multimodal_models", c.HandleListMultiModals)
-	r.POST("/api/worker_get_status", c.HandleWorkerGetStatus)
-	r.GET("/api/refresh", func(c *gin.Context) {
+	r.GET("/ready", func(c *gin.Context) {
+		health := db.GetHealth()
+		status := http.StatusOK
+		if !health.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, gin.H{"db": health})
+	})
+	r.GET("/metrics", metrics.Handler())
+	//share links are public
+	r.GET("/api/shares/:token", c.HandleGetShare)
+	r.GET(SharePath+":token", c.HandleSharePage)
+
+	chat := r.Group("", RequireScope(db.ScopeChat))
+	chat.POST("/api/fake", c.HandleFake)
+	chat.POST("/api/question", c.HandleQuestion)
+	chat.GET("/api/search", c.HandleSearch)
+	chat.POST("/api/feedback", c.HandleFeedback)
+	chat.GET("/api/feedback/models", c.HandleFeedbackStats(db.FeedbackByModel))
+	chat.GET("/api/feedback/workers", c.HandleFeedbackStats(db.FeedbackByUpstream))
+	chat.GET("/api/conversations/export", c.HandleExportConversations)
+	chat.GET("/api/conversations/:id/export", c.HandleExportConversation)
+	chat.POST("/api/conversations/import", c.HandleImportConversations)
+	chat.POST("/api/conversations/:id/share", c.HandleShareConversation)
+	chat.DELETE("/api/shares/:token", c.HandleRevokeShare)
+	chat.GET("/api/usage", c.HandleTenantUsage)
+	chat.GET("/api/costs", c.HandleTenantCosts)
+	chat.GET("/api/refresh", func(c *gin.Context) {
 		defer func() {
 			c.String(http.StatusOK, "success")
 		}()
-		session_id := c.GetString(SesssionIdContextName)
-		if session_id == "" {
+		if principalOf(c) != nil {
 			return
 		}
-		sess := sessions.Default(c)
-		sess.Delete(session_id)
-		sess.Save()
-		log.Info("session id delete", session_id)
+		clearUserSession(c)
 	})
+
+	worker := r.Group("", RequireScope(db.ScopeWorker))
+	worker.POST("/api/register", c.HandleRegister)
+	worker.POST("/api/register_worker", c.HandleRegisterWorker)
+	worker.POST("/api/receive_heart_beat", c.HandleSendHeartBeat)
+	worker.POST("/api/get_worker_address", c.HandleGetWorkerAddress)
+	worker.POST("/api/refresh_all_workers", c.HandleRefreshAllWorkers)
+	worker.POST("/api/list_language_models", c.HandleListModels)
+	worker.POST("/api/list_multimodal_models", c.HandleListMultiModals)
+	worker.POST("/api/worker_get_status", c.HandleWorkerGetStatus)
+
+	//admin calls are always authenticated, without auth there is no /admin
+	switch {
+	case !AuthConf.Enable:
+		log.Warn("auth is off, /admin is not served")
+	case AdminConf.Listen == "":
+		c.adminRoutes(r.Group("/admin", auditLog(), RequireScope(db.ScopeAdmin)))
+	default:
+		if err := c.startAdmin(verifier); err != nil {
+			return err
+		}
+	}
+
 	address := "0.0.0.0:" + c.port
 
-	r.Run(address)
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		c.stopAdmin(context.Background())
+		return err
+	}
+	c.server = &http.Server{Handler: r}
+	go func() {
+		if err := c.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Error("rpc server error", err)
+		}
+	}()
 	log.Info("start rpc on port:" + c.port)
 	return nil
 }
 
+// startAdmin serves /admin on the admin listen address.
+func (c *Service) startAdmin(verifier *jwt.Verifier) error {
+	r := gin.New()
+	r.Use(gin.Logger(), gin.Recovery())
+	r.Use(Authenticate(verifier))
+	r.SetTrustedProxies(nil)
+	c.adminRoutes(r.Group("/admin", auditLog(), RequireScope(db.ScopeAdmin)))
+	ln, err := net.Listen("tcp", AdminConf.Listen)
+	if err != nil {
+		return err
+	}
+	c.adminServer = &http.Server{Handler: r}
+	go func() {
+		if err := c.adminServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Error("admin server error", err)
+		}
+	}()
+	log.Info("start admin on " + AdminConf.Listen)
+	return nil
+}
+
+func (c *Service) stopAdmin(ctx context.Context) error {
+	if c.adminServer == nil {
+		return nil
+	}
+	return c.adminServer.Shutdown(ctx)
+}
+
+// Stop stops taking requests and waits for the in-flight ones until ctx is done.
+func (c *Service) Stop(ctx context.Context) error {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if err := c.stopAdmin(ctx); err != nil {
+		log.Error("stop admin server error", err)
+	}
+	if c.server == nil {
+		return nil
+	}
+	return c.server.Shutdown(ctx)
+}
+
 type Resp struct {
 	ResultCode int         `json:"ret"`
 	ResultMsg  string      `json:"msg"`
@@ -227,24 +373,26 @@ type Resp struct {
 }
 
 type QuestionReq struct {
-	Message        string `json:"message"`
-	MessageId      string `json:"message_id"`
-	ConversationId string `json:"conversation_id"`
-	Model          string `json:"model"`
+	Message        string  `json:"message"`
+	MessageId      string  `json:"message_id"`
+	ConversationId string  `json:"conversation_id"`
+	Model          string  `json:"model"`
+	Temperature    float32 `json:"temperature"`
+	TopP           float32 `json:"top_p"`
 }
 
 func (s *Service) HandleQuestion(c *gin.Context) {
-	sess := sessions.Default(c)
 	rep := Resp{
 		ResultCode: ErrorCodeUnknow,
 		ResultMsg:  "",
 		ResultBody: "",
 	}
+	status := http.StatusInternalServerError
 	defer func() {
 		if rep.ResultCode == Success {
 			c.JSON(http.StatusOK, rep)
 		} else {
-			c.JSON(http.StatusInternalServerError, rep)
+			c.JSON(status, rep)
 		}
 	}()
 	req := QuestionReq{}
@@ -261,28 +409,57 @@ func (s *Service) HandleQuestion(c *gin.Context) {
 			Text: "Cleared",
 		})
 		rep.ResultBody = string(data)
-		session_id := c.GetString(SesssionIdContextName)
-		if session_id == "" {
-			return
+		if principalOf(c) == nil {
+			clearUserSession(c)
 		}
-		sess := sessions.Default(c)
-		sess.Delete(session_id)
-		sess.Save()
-		log.Info("session id delete", session_id)
 		return
 	}
 	msg_id := req.MessageId
 	conv_id := req.ConversationId
 	modelName := req.Model
-	s.bsClientMut.RLock()
-	defer s.bsClientMut.RUnlock()
-	if _, ok := s.bsApiClient[modelName]; !ok {
+	if !s.isBsModel(modelName) {
 		if modelName != "" {
 			rep.ResultMsg = fmt.Sprintf("model %s not supported", modelName)
 			return
 		}
 		modelName = "gpt"
 	}
+	principal := principalOf(c)
+	if principal != nil && !principal.AllowsModel(modelName) {
+		status = http.StatusForbidden
+		rep.ResultMsg = fmt.Sprintf("model %s not allowed for these credentials", modelName)
+		return
+	}
+	if ok, msg := allowQuota(c); !ok {
+		status = http.StatusTooManyRequests
+		rep.ResultMsg = msg
+		return
+	}
+	if !s.allowQuestion(c, modelName) {
+		status = http.StatusTooManyRequests
+		rep.ResultMsg = "rate limit exceeded"
+		return
+	}
+
+	if modelName == c.GetString(LastModelName) {
+		if msg_id == "" {
+			msg_id = c.GetString(LastMessageContextName)
+		}
+		if conv_id == "" {
+			conv_id = c.GetString(LastConversationContextName)
+		}
+	}
+
+	if conv_id != "" {
+		if ok, err := canContinue(c, conv_id); err != nil {
+			log.Error("check conversation owner error", err)
+			return
+		} else if !ok {
+			status = http.StatusNotFound
+			rep.ResultMsg = "conversation not found"
+			return
+		}
+	}
 
 	//check sensitive
 	if trie.IsSensitive(msg) {
@@ -300,94 +477,102 @@ func (s *Service) HandleQuestion(c *gin.Context) {
 		return
 	}
 
-	if modelName == c.GetString(LastModelName) {
-		if msg_id == "" {
-			msg_id = c.GetString(LastMessageContextName)
-		}
-		if conv_id == "" {
-			conv_id = c.GetString(LastConversationContextName)
-		}
-	}
-
 	sesson_id := c.GetString(SesssionIdContextName)
 	q := common.Question{
 		Message:        msg,
 		MessageId:      msg_id,
 		ConversationId: conv_id,
-		OpenAIKey:      c.GetString(LastRelayUrlContextName),
+		OpenAIKey:      s.relayKey(c.GetString(LastRelayHashContextName)),
 		Model:          modelName,
+		Temperature:    req.Temperature,
+		TopP:           req.TopP,
+		SessionId:      sesson_id,
+		Tenant:         tenantOf(c),
+		UserId:         userOf(c),
 	}
+
+	start := time.Now()
+	key := s.questionKey(&q)
+	cacheKey, cacheState := s.cacheKey(c, key, &q)
+	answer, ok := s.cachedAnswer(cacheKey, &q)
+	var lookup *semanticLookup
+	if ok {
+		cacheState = CacheStateHit
+		answer.Telemetry = questionTelemetry(&q)
+	} else if answer, lookup = s.semanticAnswer(c, &q); lookup != nil && lookup.hit {
+		cacheState = CacheStateSemantic
+		answer.Telemetry = questionTelemetry(&q)
+	} else {
+		var err error
+		answer, err = s.askCoalesced(key, q)
+		if err != nil || answer.Text == "" {
+			s.writeFailedTurn(&q, answer, err, start)
+			if err == ErrAnswerTimeout && principal == nil {
+				clearUserSession(c)
+			}
+			return
+		}
+		s.storeCache(cacheKey, answer)
+		s.storeSemantic(lookup, &answer)
+		s.chargeTokens(c, modelName, answer.Telemetry)
+	}
+	if cacheState != CacheStateSkipped {
+		c.Header(CacheHeader, cacheState)
+	}
+
+	turn := newMessage(&q, answer, start)
+	s.priceTurn(&turn)
+	err := db.WriteConversation(turn)
+	if err != nil {
+		log.Error("insert into db error", err)
+	}
+
+	var data []byte
+	data, _ = json.Marshal(&ProxyResponse{
+		Text:           answer.Text,
+		MessageId:      answer.MessageId,
+		ConversationId: answer.ConversationId,
+		Model:          answer.Model,
+		Cached:         answer.Cache != "",
+	})
+
+	rep.ResultBody = string(data)
+	rep.ResultCode = Success
+	//update session, key and token clients keep no cookie state
+	if principal == nil {
+		if answer.Text == InternalError {
+			clearUserSession(c)
+			return
+		}
+		s.saveUserSession(c, answer)
+	}
+}
+
+// askQuestion queues q for a worker slot and waits for the answer.
+func (s *Service) askQuestion(q common.Question) (RelayResponse, error) {
 	qu := pendingQuestion{
-		data:   q,
-		resp:   make(chan RelayResponse, 1),
-		cancel: make(chan struct{}),
+		data:       q,
+		resp:       make(chan RelayResponse, 1),
+		cancel:     make(chan struct{}),
+		enqueuedAt: time.Now(),
 	}
 	defer close(qu.cancel)
+	qu.queueId = s.queue.add(&q, qu.enqueuedAt)
+	defer s.queue.remove(qu.queueId)
 
 	timer := time.NewTimer(WaitForAnswer)
+	defer timer.Stop()
 
 	select {
 	case <-timer.C:
 		log.Warn(fmt.Sprintf("pending question time out %v", q))
-		return
+		return RelayResponse{}, ErrQueueTimeout
 	case s.questionCh <- qu:
 		select {
 		case <-timer.C:
-			sess.Delete(sesson_id)
-			sess.Save()
-			return
+			return RelayResponse{}, ErrAnswerTimeout
 		case answer := <-qu.resp:
-			if answer.Text == "" {
-				return
-			}
-
-			go func() {
-				err := db.InsertSingleConversation(db.Message{
-					ConversationId: answer.ConversationId,
-					MessageId:      answer.MessageId,
-					Prompt:         q.Message,
-					Text:           answer.Text,
-					StartTime:      time.Now().Unix(),
-					Model:          answer.Model,
-					Url:            answer.Url,
-				})
-				if err != nil {
-					log.Error("insert into db error", err)
-				}
-			}()
-
-			var data []byte
-			data, _ = json.Marshal(&ProxyResponse{
-				Text:           answer.Text,
-				MessageId:      answer.MessageId,
-				ConversationId: answer.ConversationId,
-				Model:          answer.Model,
-			})
-
-			rep.ResultBody = string(data)
-			rep.ResultCode = Success
-			//update session
-			if sesson_id != "" {
-				if answer.Text == InternalError || answer.Text == "" {
-					sess.Delete(sesson_id)
-					sess.Save()
-					return
-				}
-				modelName := "gpt"
-				if _, ok := s.bsApiClient[answer.Model]; ok {
-					modelName = answer.Model
-				}
-				data, _ := json.Marshal(&UserStatus{
-					ConversationId: answer.ConversationId,
-					MessageId:      answer.MessageId,
-					Url:            answer.Url,
-					LastTime:       time.Now().Unix(),
-					Model:          modelName,
-				})
-				sess.Set(sesson_id, string(data))
-				sess.Save()
-			}
-			return
+			return answer, nil
 		}
 	}
 }
@@ -512,7 +697,7 @@ func (s *Service) HandleGetWorkerAddress(c *gin.Context) {
 		return
 	}
 	for _, cli := range bsClients {
-		if cli.Status == selfdriving.ModelAvalible {
+		if cli.Status == selfdriving.ModelAvalible && !cli.Disabled {
 			addr = cli.Url
 			break
 		}
@@ -582,6 +767,10 @@ func (s *Service) StartChatService(ctx context.Context) {
 			return
 		case qu := <-s.questionCh:
 			handling <- struct{}{}
+			if qu.startedAt.IsZero() {
+				qu.startedAt = time.Now()
+				s.queue.start(qu.queueId, qu.startedAt)
+			}
 			log.Debug("try send question to relay ", qu.data)
 			go func() {
 				s.checkOneQuestion(qu)
@@ -593,6 +782,7 @@ func (s *Service) StartChatService(ctx context.Context) {
 }
 
 func (s *Service) checkOneQuestion(qu pendingQuestion) {
+	s.redactQuestion(&qu)
 	//retry a MaxRetry times
 	for {
 		select {
@@ -601,16 +791,18 @@ func (s *Service) checkOneQuestion(qu pendingQuestion) {
 			return
 		default:
 			if qu.TriedTimes > MaxRetry {
+				qu.resp <- RelayResponse{
+					Model:     qu.data.Model,
+					Telemetry: qu.failureTelemetry(),
+				}
 				close(qu.resp)
 				return
 			}
 			if qu.TriedTimes != 0 {
 				log.Debug("retry question:", qu.data)
 			}
-			s.bsClientMut.RLock()
-			defer s.bsClientMut.RUnlock()
-			if clients, ok := s.bsApiClient[qu.data.Model]; ok && len(clients) != 0 {
-				if toRetry := s.handleBsQuestion(qu); toRetry {
+			if clients := s.bsClients(qu.data.Model); len(clients) != 0 {
+				if toRetry := s.handleBsQuestion(qu, clients); toRetry {
 					jitter := rand.Intn(500)
 					time.Sleep(time.Millisecond * (1000 + time.Duration(jitter)))
 					continue
@@ -0,0 +1,235 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"gateway/common"
+	"gateway/db"
+	"gateway/log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	DefaultSessionSecretEnv = "GATEWAY_SESSION_SECRET"
+	defaultSessionMaxAge    = 24 * 60 * 60
+	minSessionSecretLength  = 16
+	sessionTimeout          = 5 * time.Second
+	sessionPurgeInterval    = 10 * time.Minute
+)
+
+type SessionConfig struct {
+	// Secrets sign the session cookie. The first signs, the rest are only
+	// checked, so a secret is rotated by putting a new one first and dropping
+	// the old one once its cookies expired.
+	Secrets []string `yaml:"secrets"`
+	// SecretEnv names an environment variable of comma separated secrets, it
+	// takes the place of Secrets when set. Default GATEWAY_SESSION_SECRET.
+	SecretEnv string `yaml:"secret_env"`
+	MaxAge    int    `yaml:"max_age"` //seconds a session lives after its last request, default one day
+	Secure    bool   `yaml:"secure"`  //send the cookie over https only
+}
+
+var SessionConf SessionConfig
+
+func (conf SessionConfig) maxAge() int {
+	if conf.MaxAge > 0 {
+		return conf.MaxAge
+	}
+	return defaultSessionMaxAge
+}
+
+func (conf SessionConfig) secrets() []string {
+	env := conf.SecretEnv
+	if env == "" {
+		env = DefaultSessionSecretEnv
+	}
+	secrets := conf.Secrets
+	if value := os.Getenv(env); value != "" {
+		secrets = strings.Split(value, ",")
+	}
+	trimmed := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			trimmed = append(trimmed, secret)
+		}
+	}
+	return trimmed
+}
+
+// SessionManager signs and checks session cookies. The state of a session
+// is kept in the store, so every gateway sharing the store and secrets sees
+// the same sessions.
+type SessionManager struct {
+	codecs []securecookie.Codec //the first signs
+	maxAge int
+	secure bool
+}
+
+func NewSessionManager(conf SessionConfig) (*SessionManager, error) {
+	secrets := conf.secrets()
+	if len(secrets) == 0 {
+		log.Warn("no session secret configured, using a random one: sessions do not survive a restart or reach other gateways")
+		secrets = []string{string(securecookie.GenerateRandomKey(32))}
+	}
+	m := &SessionManager{maxAge: conf.maxAge(), secure: conf.Secure}
+	for _, secret := range secrets {
+		if len(secret) < minSessionSecretLength {
+			return nil, errors.New("session secrets need at least 16 characters")
+		}
+		codec := securecookie.New([]byte(secret), nil)
+		codec.MaxAge(m.maxAge)
+		m.codecs = append(m.codecs, codec)
+	}
+	return m, nil
+}
+
+// read returns the session id of the cookie, empty if there is none or its
+// signature does not check against any secret.
+func (m *SessionManager) read(c *gin.Context) string {
+	value, err := c.Cookie(SessionCookieName)
+	if err != nil || value == "" {
+		return ""
+	}
+	var id string
+	if err := securecookie.DecodeMulti(SessionCookieName, value, &id, m.codecs...); err != nil {
+		log.Debug("invalid session cookie", err)
+		return ""
+	}
+	return id
+}
+
+// write sets the cookie of id, signed with the current secret.
+func (m *SessionManager) write(c *gin.Context, id string) {
+	value, err := m.codecs[0].Encode(SessionCookieName, id)
+	if err != nil {
+		log.Error("sign session cookie error", err)
+		return
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(SessionCookieName, value, m.maxAge, "/", Host, m.secure, true)
+}
+
+// UserSession gives every cookie client a signed session id and loads the
+// conversation its last question went to.
+func UserSession(m *SessionManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		//key and token clients name their conversations, who they are is
+		//their session
+		if p := principalOf(c); p != nil {
+			c.Set(SesssionIdContextName, p.Session)
+			return
+		}
+		sessionId := m.read(c)
+		if sessionId == "" {
+			sessionId = uuid.New().String()
+		}
+		//sent every time, so the cookie lives as long as the session is used
+		//and cookies of an old secret move to the current one
+		m.write(c, sessionId)
+		c.Set(SesssionIdContextName, sessionId)
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), sessionTimeout)
+		defer cancel()
+		session, err := db.GetSession(ctx, sessionId)
+		if err != nil {
+			if !errors.Is(err, db.ErrNotFound) {
+				log.Error("get session error", err)
+			}
+			return
+		}
+		if time.Now().Unix()-session.UpdatedAt > SessionTimeout {
+			return
+		}
+		c.Set(LastMessageContextName, session.MessageId)
+		c.Set(LastConversationContextName, session.ConversationId)
+		c.Set(LastRelayUrlContextName, session.Url)
+		c.Set(LastRelayHashContextName, session.RelayHash)
+		c.Set(LastModelName, session.Model)
+	}
+}
+
+// saveUserSession remembers where the answer of a cookie session came from,
+// the next question of the session continues there.
+func (s *Service) saveUserSession(c *gin.Context, answer RelayResponse) {
+	sessionId := c.GetString(SesssionIdContextName)
+	if sessionId == "" {
+		return
+	}
+	now := time.Now()
+	session := db.Session{
+		Id:             sessionId,
+		ConversationId: answer.ConversationId,
+		MessageId:      answer.MessageId,
+		Model:          "gpt",
+		UpdatedAt:      now.Unix(),
+		ExpiresAt:      now.Add(time.Duration(SessionConf.maxAge()) * time.Second),
+	}
+	if s.isBsModel(answer.Model) {
+		session.Model = answer.Model
+		session.Url = answer.Url
+	} else if answer.Url != "" {
+		//openai keys stay out of the store
+		session.RelayHash = common.KeyHash(answer.Url)
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), sessionTimeout)
+	defer cancel()
+	if err := db.PutSession(ctx, session); err != nil {
+		log.Error("save session error", err)
+	}
+}
+
+// clearUserSession forgets the conversation of a cookie session.
+func clearUserSession(c *gin.Context) {
+	sessionId := c.GetString(SesssionIdContextName)
+	if sessionId == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), sessionTimeout)
+	defer cancel()
+	if err := db.DeleteSession(ctx, sessionId); err != nil {
+		log.Error("delete session error", err)
+		return
+	}
+	log.Info("session id delete", sessionId)
+}
+
+// relayKey returns the openai key with hash, empty if this gateway has none.
+func (s *Service) relayKey(hash string) string {
+	if hash == "" {
+		return ""
+	}
+	for apiKey := range s.gptApiClients {
+		if common.KeyHash(apiKey) == hash {
+			return apiKey
+		}
+	}
+	return ""
+}
+
+// purgeSessions drops expired sessions of stores without a ttl index.
+func purgeSessions(ctx context.Context) {
+	ticker := time.NewTicker(sessionPurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purgeCtx, cancel := context.WithTimeout(ctx, time.Minute)
+			n, err := db.DeleteExpiredSessions(purgeCtx)
+			cancel()
+			if err != nil && !errors.Is(err, db.ErrSessionUnsupported) {
+				log.Error("purge sessions error", err)
+			} else if n > 0 {
+				log.Info("expired sessions removed", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package rpc
+
+import (
+	chatapi "gateway/chat-api"
+	"gateway/db"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSessionAcrossGateways(t *testing.T) {
+	db.Store = db.NewMemoryStore()
+	s := &Service{gptApiClients: map[string]*chatapi.Client{"sk-test": nil}}
+	gin.SetMode(gin.TestMode)
+	gateway := func(secrets ...string) *gin.Engine {
+		sessions, err := NewSessionManager(SessionConfig{Secrets: secrets})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := gin.New()
+		r.Use(UserSession(sessions))
+		r.POST("/save", func(c *gin.Context) {
+			s.saveUserSession(c, RelayResponse{Url: "sk-test", ConversationId: "c1", MessageId: "m1", Model: "gpt"})
+		})
+		r.GET("/last", func(c *gin.Context) {
+			c.String(http.StatusOK, c.GetString(LastConversationContextName)+" "+c.GetString(LastMessageContextName)+" "+s.relayKey(c.GetString(LastRelayHashContextName)))
+		})
+		return r
+	}
+	do := func(r *gin.Engine, method string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, map[string]string{http.MethodPost: "/save", http.MethodGet: "/last"}[method], nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	sessionCookie := func(w *httptest.ResponseRecorder) *http.Cookie {
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == SessionCookieName {
+				return cookie
+			}
+		}
+		t.Fatal("no session cookie")
+		return nil
+	}
+
+	old := "old-session-secret-1"
+	current := "new-session-secret-2"
+	first := gateway(old)
+	cookie := sessionCookie(do(first, http.MethodPost, nil))
+	if !cookie.HttpOnly {
+		t.Fatal("session cookie readable by scripts")
+	}
+	//another replica with the same secret continues the conversation
+	if w := do(gateway(old), http.MethodGet, cookie); w.Body.String() != "c1 m1 sk-test" {
+		t.Fatal("session lost across gateways", w.Body.String())
+	}
+	//a forged cookie starts a new session
+	forged := &http.Cookie{Name: SessionCookieName, Value: cookie.Value[:len(cookie.Value)-2] + "xx"}
+	if w := do(first, http.MethodGet, forged); w.Body.String() != "  " {
+		t.Fatal("forged session accepted", w.Body.String())
+	}
+	//after rotation the old secret still verifies and the cookie is signed again
+	rotated := gateway(current, old)
+	w := do(rotated, http.MethodGet, cookie)
+	if w.Body.String() != "c1 m1 sk-test" {
+		t.Fatal("session lost on rotation", w.Body.String())
+	}
+	resigned := sessionCookie(w)
+	if w := do(gateway(current), http.MethodGet, resigned); w.Body.String() != "c1 m1 sk-test" {
+		t.Fatal("cookie not signed with the new secret", w.Body.String())
+	}
+	if w := do(gateway(current), http.MethodGet, cookie); w.Body.String() != "  " {
+		t.Fatal("retired secret accepted", w.Body.String())
+	}
+
+	if _, err := NewSessionManager(SessionConfig{Secrets: []string{"short"}}); err == nil {
+		t.Fatal("short secret accepted")
+	}
+	t.Setenv(DefaultSessionSecretEnv, current+", "+old)
+	if secrets := (SessionConfig{Secrets: []string{"ignored-config-secret"}}).secrets(); len(secrets) != 2 || secrets[0] != current {
+		t.Fatal("unexpected env secrets", secrets)
+	}
+}
@@ -0,0 +1,218 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"gateway/db"
+	"gateway/log"
+	"gateway/trie"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	shareTimeout = 10 * time.Second
+	SharePath    = "/share/"
+)
+
+type ShareReq struct {
+	Title     string `json:"title"`
+	ExpiresIn int64  `json:"expires_in"` //seconds, 0 never expires
+}
+
+type ShareResp struct {
+	Token     string `json:"token"`
+	Url       string `json:"url"` //html page, the json view is /api/shares/<token>
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+	Turns     int    `json:"turns"`
+	Hidden    int    `json:"hidden,omitempty"`
+}
+
+// SharedTurn is what a link shows of a turn.
+type SharedTurn struct {
+	Prompt      string `json:"prompt"`
+	Text        string `json:"text"`
+	Model       string `json:"model"`
+	StartTimeMs int64  `json:"startTimeMs"`
+}
+
+type SharedConversation struct {
+	Title     string       `json:"title,omitempty"`
+	CreatedAt int64        `json:"createdAt"`
+	ExpiresAt int64        `json:"expiresAt,omitempty"`
+	Hidden    int          `json:"hidden,omitempty"`
+	Turns     []SharedTurn `json:"turns"`
+}
+
+func sharedView(share *db.Share) SharedConversation {
+	view := SharedConversation{
+		Title:     share.Title,
+		CreatedAt: share.CreatedAt,
+		ExpiresAt: share.ExpiresAt,
+		Hidden:    share.Hidden,
+		Turns:     make([]SharedTurn, 0, len(share.Turns)),
+	}
+	for _, turn := range share.Turns {
+		view.Turns = append(view.Turns, SharedTurn{Prompt: turn.Prompt, Text: turn.Text, Model: turn.Model, StartTimeMs: turn.StartTimeMs})
+	}
+	return view
+}
+
+// shareStatus maps share errors to a status, unknown, expired and revoked
+// links all look the same.
+func shareStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound, "not found"
+	case errors.Is(err, db.ErrNotOwner):
+		return http.StatusForbidden, err.Error()
+	case errors.Is(err, db.ErrNothingToShare):
+		return http.StatusBadRequest, err.Error()
+	}
+	return http.StatusInternalServerError, err.Error()
+}
+
+// HandleShareConversation snapshots a conversation of the caller's session
+// behind a read-only link.
+func (s *Service) HandleShareConversation(c *gin.Context) {
+	rep := Resp{
+		ResultCode: ErrorCodeParseReq,
+		ResultMsg:  "",
+		ResultBody: "",
+	}
+	req := ShareReq{}
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&req); err != nil || req.ExpiresIn < 0 {
+			rep.ResultMsg = "invalid share request"
+			c.JSON(http.StatusBadRequest, rep)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), shareTimeout)
+	defer cancel()
+	token, share, err := db.CreateShare(ctx, c.Param("id"), c.GetString(SesssionIdContextName), req.Title,
+		time.Duration(req.ExpiresIn)*time.Second, trie.IsSensitive)
+	if err != nil {
+		status, msg := shareStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Error("share conversation error", err)
+			rep.ResultCode = ErrorCodeUnknow
+		}
+		rep.ResultMsg = msg
+		c.JSON(status, rep)
+		return
+	}
+	rep.ResultCode = Success
+	rep.ResultBody = ShareResp{
+		Token:     token,
+		Url:       SharePath + token,
+		ExpiresAt: share.ExpiresAt,
+		Turns:     len(share.Turns),
+		Hidden:    share.Hidden,
+	}
+	c.JSON(http.StatusOK, rep)
+}
+
+func (s *Service) HandleRevokeShare(c *gin.Context) {
+	rep := Resp{
+		ResultCode: Success,
+		ResultMsg:  "",
+		ResultBody: "",
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), shareTimeout)
+	defer cancel()
+	if err := db.RevokeShare(ctx, c.Param("token"), c.GetString(SesssionIdContextName)); err != nil {
+		status, msg := shareStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Error("revoke share error", err)
+		}
+		rep.ResultCode = ErrorCodeUnknow
+		rep.ResultMsg = msg
+		c.JSON(status, rep)
+		return
+	}
+	rep.ResultMsg = "revoked"
+	c.JSON(http.StatusOK, rep)
+}
+
+func loadShare(c *gin.Context) (*db.Share, error) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), shareTimeout)
+	defer cancel()
+	return db.GetShare(ctx, c.Param("token"), trie.IsSensitive)
+}
+
+// HandleGetShare serves a shared conversation as json, no session needed.
+func (s *Service) HandleGetShare(c *gin.Context) {
+	rep := Resp{
+		ResultCode: Success,
+		ResultMsg:  "",
+		ResultBody: "",
+	}
+	share, err := loadShare(c)
+	if err != nil {
+		status, msg := shareStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Error("get share error", err)
+		}
+		rep.ResultCode = ErrorCodeUnknow
+		rep.ResultMsg = msg
+		c.JSON(status, rep)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	rep.ResultBody = sharedView(share)
+	c.JSON(http.StatusOK, rep)
+}
+
+var shareTemplate = template.Must(template.New("share").Funcs(template.FuncMap{
+	"time": func(ms int64) string {
+		return time.UnixMilli(ms).Format("2006-01-02 15:04")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{if .Title}}{{.Title}}{{else}}Shared conversation{{end}}</title>
+<style>
+body { max-width: 760px; margin: 2em auto; padding: 0 1em; font-family: sans-serif; color: #222; }
+.turn { margin: 1.2em 0; }
+.role { font-size: 0.8em; color: #777; margin-bottom: 0.3em; }
+.text { white-space: pre-wrap; padding: 0.8em; border-radius: 6px; }
+.user .text { background: #eef3fb; }
+.assistant .text { background: #f4f4f4; }
+.note { color: #999; font-size: 0.85em; }
+</style>
+</head>
+<body>
+<h1>{{if .Title}}{{.Title}}{{else}}Shared conversation{{end}}</h1>
+{{range .Turns}}<div class="turn user"><div class="role">User{{if .StartTimeMs}} · {{time .StartTimeMs}}{{end}}</div><div class="text">{{.Prompt}}</div></div>
+<div class="turn assistant"><div class="role">Assistant{{if .Model}} · {{.Model}}{{end}}</div><div class="text">{{.Text}}</div></div>
+{{end}}{{if .Hidden}}<p class="note">{{.Hidden}} turn(s) withheld.</p>
+{{end}}</body>
+</html>
+`))
+
+// HandleSharePage renders a shared conversation as a page.
+func (s *Service) HandleSharePage(c *gin.Context) {
+	share, err := loadShare(c)
+	if err != nil {
+		status, msg := shareStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Error("get share error", err)
+		}
+		c.String(status, msg)
+		return
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Robots-Tag", "noindex")
+	c.Status(http.StatusOK)
+	if err := shareTemplate.Execute(c.Writer, sharedView(share)); err != nil {
+		log.Error("render share error", err)
+	}
+}
@@ -0,0 +1,138 @@
+package rpc
+
+import (
+	"errors"
+	"gateway/common"
+	"gateway/db"
+	"gateway/log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+)
+
+func promptMessages(prompt []openai.ChatCompletionMessage) []db.PromptMessage {
+	if len(prompt) == 0 {
+		return nil
+	}
+	msgs := make([]db.PromptMessage, 0, len(prompt))
+	for _, msg := range prompt {
+		msgs = append(msgs, db.PromptMessage{Role: msg.Role, Content: msg.Content})
+	}
+	return msgs
+}
+
+// questionTelemetry is what is known about a turn before any upstream call.
+func questionTelemetry(q *common.Question) db.Telemetry {
+	return db.Telemetry{
+		PromptSent:  promptMessages(q.Prompt),
+		Temperature: q.Temperature,
+		TopP:        q.TopP,
+	}
+}
+
+func (qu *pendingQuestion) retries() int {
+	if qu.TriedTimes <= 1 {
+		return 0
+	}
+	return qu.TriedTimes - 1
+}
+
+func (qu *pendingQuestion) queueWait() time.Duration {
+	if qu.enqueuedAt.IsZero() || qu.startedAt.IsZero() {
+		return 0
+	}
+	return qu.startedAt.Sub(qu.enqueuedAt)
+}
+
+// answerTelemetry records one upstream call. qa is nil if the call failed.
+func (qu *pendingQuestion) answerTelemetry(qa *common.QA, upstream string, ttft time.Duration, err error) db.Telemetry {
+	t := questionTelemetry(&qu.data)
+	t.Upstream = upstream
+	t.QueueWaitMs = qu.queueWait().Milliseconds()
+	t.TTFTMs = ttft.Milliseconds()
+	t.Retries = qu.retries()
+	t.Redacted = qu.redactedCounts()
+	if qa != nil {
+		if len(qa.Prompt) != 0 {
+			t.PromptSent = promptMessages(qa.Prompt)
+		}
+		t.FinishReason = qa.FinishReason
+		t.PromptTokens = qa.Usage.PromptTokens
+		t.CompletionTokens = qa.Usage.CompletionTokens
+	}
+	if err != nil {
+		t.Error = err.Error()
+	}
+	return t
+}
+
+// failureTelemetry records a question given up after its retries.
+func (qu *pendingQuestion) failureTelemetry() db.Telemetry {
+	t := questionTelemetry(&qu.data)
+	t.QueueWaitMs = qu.queueWait().Milliseconds()
+	t.Retries = qu.retries()
+	t.Redacted = qu.redactedCounts()
+	t.Error = qu.lastErr
+	if t.Error == "" {
+		t.Error = ErrNoFreeModel.Error()
+	}
+	return t
+}
+
+// newMessage builds the conversation record of an answered turn. Openai keys
+// are stored as their hash.
+func newMessage(q *common.Question, answer RelayResponse, start time.Time) db.Message {
+	now := time.Now()
+	url := answer.Url
+	if answer.Model == "gpt" && url != "" {
+		url = common.KeyHash(url)
+	}
+	t := answer.Telemetry
+	t.LatencyMs = now.Sub(start).Milliseconds()
+	return db.Message{
+		ConversationId: answer.ConversationId,
+		MessageId:      answer.MessageId,
+		Prompt:         q.Message,
+		Text:           answer.Text,
+		StartTime:      now.Unix(),
+		StartTimeMs:    now.UnixMilli(),
+		CreatedAt:      now,
+		Model:          answer.Model,
+		Url:            url,
+		Tenant:         q.Tenant,
+		UserId:         q.UserId,
+		SessionId:      q.SessionId,
+		Cache:          answer.Cache,
+		CacheSource:    answer.CacheSource,
+		Similarity:     answer.Similarity,
+		Coalesced:      answer.Coalesced,
+		Telemetry:      t,
+	}
+}
+
+// writeFailedTurn keeps a turn that got no answer for debugging. It joins the
+// asked conversation, or a new one if the question started none.
+func (s *Service) writeFailedTurn(q *common.Question, answer RelayResponse, err error, start time.Time) {
+	if answer.Telemetry.Error == "" {
+		if err == nil {
+			err = errors.New("empty answer")
+		}
+		answer.Telemetry = questionTelemetry(q)
+		answer.Telemetry.Error = err.Error()
+	}
+	if answer.Model == "" {
+		answer.Model = q.Model
+	}
+	answer.MessageId = uuid.NewString()
+	if answer.ConversationId == "" {
+		answer.ConversationId = q.ConversationId
+	}
+	if answer.ConversationId == "" {
+		answer.ConversationId = uuid.NewString()
+	}
+	answer.Text = ""
+	if werr := db.WriteConversation(newMessage(q, answer, start)); werr != nil {
+		log.Error("insert failed turn into db error", werr)
+	}
+}
@@ -0,0 +1,53 @@
+package rpc
+
+import (
+	"errors"
+	"gateway/common"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestAnswerTelemetry(t *testing.T) {
+	now := time.Now()
+	qu := pendingQuestion{
+		data:       common.Question{Message: "hi", Temperature: 0.5, TopP: 0.9},
+		enqueuedAt: now.Add(-time.Second),
+		startedAt:  now,
+		TriedTimes: 3,
+	}
+	qa := &common.QA{
+		Prompt:       []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}},
+		FinishReason: "stop",
+		Usage:        openai.Usage{PromptTokens: 4, CompletionTokens: 7},
+	}
+	tel := qu.answerTelemetry(qa, "http://worker", 20*time.Millisecond, nil)
+	if tel.QueueWaitMs != 1000 || tel.TTFTMs != 20 || tel.Retries != 2 {
+		t.Fatal("unexpected timing", tel)
+	}
+	if tel.PromptTokens != 4 || tel.CompletionTokens != 7 || tel.FinishReason != "stop" {
+		t.Fatal("unexpected usage", tel)
+	}
+	if len(tel.PromptSent) != 1 || tel.PromptSent[0].Content != "hi" || tel.Temperature != 0.5 {
+		t.Fatal("unexpected prompt", tel)
+	}
+
+	tel = qu.answerTelemetry(nil, "http://worker", 0, errors.New("boom"))
+	if tel.Error != "boom" || tel.Upstream != "http://worker" {
+		t.Fatal("unexpected failure telemetry", tel)
+	}
+}
+
+func TestNewMessageHashesKey(t *testing.T) {
+	q := common.Question{Message: "hi"}
+	msg := newMessage(&q, RelayResponse{Url: "sk-secret", Model: "gpt", Text: "hello"}, time.Now())
+	if !strings.HasPrefix(msg.Url, "sha256:") || strings.Contains(msg.Url, "secret") {
+		t.Fatal("api key stored in clear", msg.Url)
+	}
+	msg = newMessage(&q, RelayResponse{Url: "http://worker", Model: "m", Text: "hello"}, time.Now())
+	if msg.Url != "http://worker" {
+		t.Fatal("worker url changed", msg.Url)
+	}
+}
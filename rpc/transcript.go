@@ -0,0 +1,178 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gateway/db"
+	"gateway/log"
+	"gateway/transcript"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	transcriptTimeout = time.Minute
+	// maxExportTurns bounds the turns of an export of all conversations of a
+	// user or session.
+	maxExportTurns = 10000
+	maxImportBytes = 16 << 20
+)
+
+// HandleExportConversation downloads one conversation, e.g.
+// /api/conversations/<id>/export?format=markdown
+func (s *Service) HandleExportConversation(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), transcriptTimeout)
+	defer cancel()
+	msgs, err := db.GetConversation(ctx, c.Param("id"))
+	if err == nil && (len(msgs) == 0 || !canAccess(c, msgs)) {
+		err = db.ErrNotFound
+	}
+	s.writeTranscript(c, c.Param("id"), msgs, err)
+}
+
+// HandleExportConversations downloads all conversations of the caller's
+// session, oldest first. Admins may name any user, users only themselves.
+func (s *Service) HandleExportConversations(c *gin.Context) {
+	q := db.SearchQuery{PageSize: db.MaxSearchPageSize}
+	admin := isAdmin(c)
+	if user := c.Query("user"); admin {
+		q.UserId = user
+	} else if p := principalOf(c); p != nil && p.UserId != "" && p.UserId == user {
+		q.UserId = user
+	}
+	if !admin || q.UserId == "" {
+		q.SessionId = c.GetString(SesssionIdContextName)
+	}
+	if q.UserId == "" && q.SessionId == "" {
+		s.writeTranscript(c, "", nil, db.ErrNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), transcriptTimeout)
+	defer cancel()
+	ids := make([]string, 0)
+	seen := make(map[string]bool)
+	var err error
+	for q.Page = 1; (q.Page-1)*q.PageSize < maxExportTurns; q.Page++ {
+		var page *db.SearchResult
+		if page, err = db.Search(ctx, q); err != nil {
+			break
+		}
+		for _, hit := range page.Hits {
+			if !seen[hit.Message.ConversationId] {
+				seen[hit.Message.ConversationId] = true
+				ids = append(ids, hit.Message.ConversationId)
+			}
+		}
+		if len(page.Hits) < q.PageSize {
+			break
+		}
+	}
+	msgs := make([]db.Message, 0)
+	//search lists the newest first
+	for i := len(ids) - 1; i >= 0 && err == nil; i-- {
+		var turns []db.Message
+		if turns, err = db.GetConversation(ctx, ids[i]); err == nil && (admin || canAccess(c, turns)) {
+			msgs = append(msgs, turns...)
+		}
+	}
+	s.writeTranscript(c, "conversations", msgs, err)
+}
+
+func (s *Service) writeTranscript(c *gin.Context, name string, msgs []db.Message, err error) {
+	rep := Resp{
+		ResultCode: ErrorCodeParseReq,
+		ResultMsg:  "",
+		ResultBody: "",
+	}
+	format := c.DefaultQuery("format", transcript.FormatJSON)
+	switch {
+	case format != transcript.FormatJSON && format != transcript.FormatMarkdown && format != transcript.FormatJSONL:
+		rep.ResultMsg = transcript.ErrUnknownFormat.Error()
+		c.JSON(http.StatusBadRequest, rep)
+		return
+	case errors.Is(err, db.ErrNotFound), errors.Is(err, db.ErrConversationIdEmpty):
+		rep.ResultMsg = "conversation not found"
+		c.JSON(http.StatusNotFound, rep)
+		return
+	case err != nil:
+		log.Error("export conversations error", err)
+		rep.ResultCode = ErrorCodeUnknow
+		rep.ResultMsg = err.Error()
+		c.JSON(http.StatusInternalServerError, rep)
+		return
+	}
+	c.Header("Content-Type", transcript.ContentType(format))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s%s", name, transcript.Ext(format)))
+	c.Status(http.StatusOK)
+	if err := transcript.Encode(c.Writer, format, transcript.FromMessages(msgs)); err != nil {
+		log.Error("write transcript error", err)
+	}
+}
+
+type ImportedConversation struct {
+	ConversationId string `json:"conversationId"` //id to continue the conversation with
+	Source         string `json:"source,omitempty"`
+	Turns          int    `json:"turns"`
+}
+
+// HandleImportConversations stores the conversations of an uploaded
+// transcript under new ids, in the caller's session. Turns are stamped with
+// the import time so they are recent history for the next question.
+func (s *Service) HandleImportConversations(c *gin.Context) {
+	rep := Resp{
+		ResultCode: ErrorCodeParseReq,
+		ResultMsg:  "",
+		ResultBody: "",
+	}
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	convs, err := transcript.Decode(body, c.DefaultQuery("format", transcript.FormatJSON), c.Query("model"))
+	if err != nil {
+		rep.ResultMsg = err.Error()
+		c.JSON(http.StatusBadRequest, rep)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), transcriptTimeout)
+	defer cancel()
+	sessionId := c.GetString(SesssionIdContextName)
+	tenant, userId := tenantOf(c), userOf(c)
+	imported := make([]ImportedConversation, 0, len(convs))
+	for _, conv := range convs {
+		conversationId := uuid.NewString()
+		now := time.Now()
+		msgs := make([]db.Message, 0, len(conv.Turns))
+		for i, turn := range conv.Turns {
+			//the sequence keeps the order, distinct times keep it readable
+			at := now.Add(time.Duration(i-len(conv.Turns)+1) * time.Millisecond)
+			msgs = append(msgs, db.Message{
+				ConversationId: conversationId,
+				MessageId:      uuid.NewString(),
+				Prompt:         turn.Prompt,
+				Text:           turn.Text,
+				StartTime:      at.Unix(),
+				StartTimeMs:    at.UnixMilli(),
+				CreatedAt:      at,
+				Model:          turn.Model,
+				Tenant:         tenant,
+				UserId:         userId,
+				SessionId:      sessionId,
+			})
+		}
+		if err := db.InsertConversations(ctx, msgs); err != nil {
+			log.Error("import conversation error", err)
+			rep.ResultCode = ErrorCodeUnknow
+			rep.ResultMsg = err.Error()
+			rep.ResultBody = imported
+			c.JSON(http.StatusInternalServerError, rep)
+			return
+		}
+		imported = append(imported, ImportedConversation{ConversationId: conversationId, Source: conv.ConversationId, Turns: len(msgs)})
+	}
+	rep.ResultCode = Success
+	rep.ResultBody = imported
+	c.JSON(http.StatusOK, rep)
+}
@@ -0,0 +1,106 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"gateway/common"
+	"gateway/db"
+	selfdriving "gateway/self-driving"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestImportExportConversation(t *testing.T) {
+	db.Store = db.NewMemoryStore()
+	s := &Service{}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/conversations/:id/export", s.HandleExportConversation)
+	r.POST("/api/conversations/import", s.HandleImportConversations)
+
+	md := "# Conversation old\n\n## User\n\nWhat is ACC?\n\n## Assistant (self-driving-v1)\n\nAdaptive cruise control.\n\n## User\n\nAnd LKA?\n\n## Assistant (self-driving-v3)\n\nLane keeping assist.\n"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/conversations/import?format=markdown", strings.NewReader(md)))
+	var rep struct {
+		ResultCode int                    `json:"ret"`
+		ResultBody []ImportedConversation `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil || w.Code != http.StatusOK || len(rep.ResultBody) != 1 {
+		t.Fatal("unexpected import response", w.Code, w.Body.String())
+	}
+	imported := rep.ResultBody[0]
+	if imported.Source != "old" || imported.Turns != 2 || imported.ConversationId == "old" {
+		t.Fatal("unexpected import", imported)
+	}
+
+	//the next question continues the imported conversation
+	prompt := selfdriving.BuildPrompt(&common.Question{ConversationId: imported.ConversationId, Message: "Thanks"})
+	if len(prompt) != 5 || prompt[0].Content != "What is ACC?" || prompt[3].Content != "Lane keeping assist." {
+		t.Fatal("imported turns not in history", prompt)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/conversations/"+imported.ConversationId+"/export?format=jsonl", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"model":"self-driving-v3"`) {
+		t.Fatal("unexpected export", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/conversations/missing/export", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatal("missing conversation exported", w.Code)
+	}
+}
+
+func TestExportConversationsOfUser(t *testing.T) {
+	db.Store = db.NewMemoryStore()
+	ctx := context.Background()
+	chat, chatKey, err := db.CreateAPIKey(ctx, db.APIKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, _, err := db.CreateAPIKey(ctx, db.APIKey{Scopes: []string{db.ScopeChat, db.ScopeAdmin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.InsertConversations(ctx, []db.Message{
+		{ConversationId: "c1", MessageId: "m1", SessionId: "anon-1", UserId: "u1", Prompt: "secret of u1", Text: "a", StartTime: 1},
+		{ConversationId: "c2", MessageId: "m2", SessionId: chatKey.Session(), Prompt: "question of the key", Text: "b", StartTime: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	AuthConf = AuthConfig{Enable: true, Anonymous: true}
+	defer func() { AuthConf = AuthConfig{} }()
+	s := &Service{}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	sessions, err := NewSessionManager(SessionConfig{Secrets: []string{"test-session-secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Use(Authenticate(nil))
+	r.Use(UserSession(sessions))
+	r.Group("", RequireScope(db.ScopeChat)).GET("/api/conversations/export", s.HandleExportConversations)
+	export := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/conversations/export?format=jsonl&user=u1", nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	if w := export(""); strings.Contains(w.Body.String(), "secret of u1") {
+		t.Fatal("anonymous caller exported another user", w.Body.String())
+	}
+	if w := export(chat); strings.Contains(w.Body.String(), "secret of u1") || !strings.Contains(w.Body.String(), "question of the key") {
+		t.Fatal("key should export only its own session", w.Code, w.Body.String())
+	}
+	if w := export(admin); !strings.Contains(w.Body.String(), "secret of u1") {
+		t.Fatal("admin could not export the user", w.Code, w.Body.String())
+	}
+}
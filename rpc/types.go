@@ -1,21 +1,18 @@
 package rpc
 
-type RelayResponse struct {
-	Url            string `json:"url"` //bs url or openai key
-	Text           string `json:"text"`
-	MessageId      string `json:"messageId"`
-	ConversationId string `json:"conversationId"`
-	Model          string `json:"model"`
-}
+import "gateway/db"
 
-var emptyStatus UserStatus
-
-type UserStatus struct {
-	MessageId      string `json:"messageId"`
-	ConversationId string `json:"conversationId"`
-	Url            string `json:"url"` //bs url or apikey
-	LastTime       int64  `json:"lastTime"`
-	Model          string `json:"model"`
+type RelayResponse struct {
+	Url            string       `json:"url"` //bs url or openai key
+	Text           string       `json:"text"`
+	MessageId      string       `json:"messageId"`
+	ConversationId string       `json:"conversationId"`
+	Model          string       `json:"model"`
+	Cache          string       `json:"cache"`       //cache kind the answer came from
+	CacheSource    string       `json:"cacheSource"` //message id of a semantic match
+	Similarity     float32      `json:"similarity"`  //semantic match similarity
+	Coalesced      bool         `json:"-"`           //shared the answer of an identical question
+	Telemetry      db.Telemetry `json:"-"`
 }
 
 type ProxyResponse struct {
@@ -23,4 +20,5 @@ type ProxyResponse struct {
 	MessageId      string `json:"messageId"`
 	ConversationId string `json:"conversationId"`
 	Model          string `json:"model"`
+	Cached         bool   `json:"cached,omitempty"`
 }
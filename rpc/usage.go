@@ -0,0 +1,255 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gateway/dataset"
+	"gateway/db"
+	"gateway/log"
+	"gateway/metrics"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	QuotaWarningHeader    = "X-Quota-Warning"
+	defaultQuotaSoftPct   = 80
+	defaultQuotaCacheTime = 10 * time.Second
+	usageTimeout          = 30 * time.Second
+	usageFormatCSV        = "csv"
+	usageFormatJSON       = "json"
+	usageCSVContentType   = "text/csv; charset=utf-8"
+	quotaKindTokens       = "tokens"
+	quotaKindRequests     = "requests"
+	maxCachedQuotaTenants = 10000
+)
+
+// Quota bounds what a tenant may use in a calendar month (UTC), 0 does not
+// limit.
+type Quota struct {
+	MonthlyTokens   int64 `yaml:"monthly_tokens"`
+	MonthlyRequests int64 `yaml:"monthly_requests"`
+	// SoftPercent of a limit used adds a warning header to answers, default 80.
+	SoftPercent int `yaml:"soft_percent"`
+}
+
+type QuotaConfig struct {
+	Enable bool `yaml:"enable"`
+	// Default applies to tenants without their own quota. Callers without a
+	// tenant are not metered against any.
+	Default Quota            `yaml:"default"`
+	Tenants map[string]Quota `yaml:"tenants"`
+	// CacheSeconds is how long the month usage of a tenant is read from
+	// memory, default 10.
+	CacheSeconds int `yaml:"cache_seconds"`
+}
+
+var QuotaConf QuotaConfig
+
+var quotaRejected = metrics.NewCounter("gateway_quota_rejected_total", "questions refused by a tenant's monthly quota", "tenant")
+
+func (conf QuotaConfig) quotaOf(tenant string) Quota {
+	if quota, ok := conf.Tenants[tenant]; ok {
+		return quota
+	}
+	return conf.Default
+}
+
+func (conf QuotaConfig) cacheTime() time.Duration {
+	if conf.CacheSeconds > 0 {
+		return time.Duration(conf.CacheSeconds) * time.Second
+	}
+	return defaultQuotaCacheTime
+}
+
+type cachedUsage struct {
+	usage db.UsageCounts
+	read  time.Time
+}
+
+// usageCache keeps the month usage of tenants, so a question does not read
+// the store every time. Usage is written behind the answers anyway.
+var usageCache = struct {
+	sync.Mutex
+	tenants map[string]cachedUsage
+}{tenants: make(map[string]cachedUsage)}
+
+func monthUsage(ctx context.Context, tenant string, now time.Time) (db.UsageCounts, error) {
+	usageCache.Lock()
+	cached, ok := usageCache.tenants[tenant]
+	usageCache.Unlock()
+	month := db.PeriodStart(db.UsageMonth, now)
+	if ok && now.Sub(cached.read) < QuotaConf.cacheTime() && !cached.read.Before(month) {
+		return cached.usage, nil
+	}
+	usage, err := db.MonthUsage(ctx, tenant, now)
+	if err != nil {
+		return usage, err
+	}
+	usageCache.Lock()
+	if len(usageCache.tenants) >= maxCachedQuotaTenants {
+		usageCache.tenants = make(map[string]cachedUsage)
+	}
+	usageCache.tenants[tenant] = cachedUsage{usage: usage, read: now}
+	usageCache.Unlock()
+	return usage, nil
+}
+
+// checkLimit reports whether used reached limit, and the warning to send
+// when it passed the soft percent of it.
+func checkLimit(kind string, used, limit int64, softPct int) (bool, string) {
+	if limit <= 0 {
+		return false, ""
+	}
+	if used >= limit {
+		return true, ""
+	}
+	if used*100 >= limit*int64(softPct) {
+		return false, fmt.Sprintf("%d%% of the monthly %s quota used", used*100/limit, kind)
+	}
+	return false, ""
+}
+
+// allowQuota refuses questions of tenants over their monthly quota and warns
+// those past its soft limit. Questions are let through when usage can not
+// be read.
+func allowQuota(c *gin.Context) (bool, string) {
+	tenant := tenantOf(c)
+	if !QuotaConf.Enable || tenant == "" {
+		return true, ""
+	}
+	quota := QuotaConf.quotaOf(tenant)
+	if quota.MonthlyTokens <= 0 && quota.MonthlyRequests <= 0 {
+		return true, ""
+	}
+	softPct := quota.SoftPercent
+	if softPct <= 0 {
+		softPct = defaultQuotaSoftPct
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), authTimeout)
+	defer cancel()
+	usage, err := monthUsage(ctx, tenant, time.Now())
+	if err != nil {
+		log.Error("read tenant usage error", err)
+		return true, ""
+	}
+	for _, limit := range []struct {
+		kind  string
+		used  int64
+		limit int64
+	}{
+		{quotaKindTokens, usage.Tokens(), quota.MonthlyTokens},
+		{quotaKindRequests, usage.Requests, quota.MonthlyRequests},
+	} {
+		exceeded, warning := checkLimit(limit.kind, limit.used, limit.limit, softPct)
+		if exceeded {
+			quotaRejected.Inc(tenant)
+			return false, fmt.Sprintf("monthly %s quota of tenant %s exceeded", limit.kind, tenant)
+		}
+		if warning != "" {
+			log.Warn("tenant near its quota", tenant, warning)
+			c.Header(QuotaWarningHeader, warning)
+		}
+	}
+	return true, ""
+}
+
+// usageQuery reads the period, from, to and model params of a usage request.
+func usageQuery(c *gin.Context) (db.UsageQuery, error) {
+	q := db.UsageQuery{
+		Period: c.DefaultQuery("period", db.UsageDay),
+		Model:  c.Query("model"),
+	}
+	if err := db.ValidatePeriod(q.Period); err != nil {
+		return q, err
+	}
+	var err error
+	for name, field := range map[string]*int64{"from": &q.From, "to": &q.To} {
+		if *field, err = dataset.ParseTime(c.Query(name)); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// readUsage returns the buckets of q, or answers with the error reading
+// them.
+func readUsage(c *gin.Context, q db.UsageQuery) ([]db.UsageBucket, bool) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), usageTimeout)
+	defer cancel()
+	buckets, err := db.GetUsage(ctx, q)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, db.ErrUsageUnsupported) {
+			status = http.StatusNotImplemented
+		} else {
+			log.Error("read usage error", err)
+		}
+		c.JSON(status, Resp{ResultCode: ErrorCodeUnknow, ResultMsg: err.Error(), ResultBody: ""})
+		return nil, false
+	}
+	return buckets, true
+}
+
+// writeUsage answers with the buckets of q, as csv unless format=json.
+func writeUsage(c *gin.Context, q db.UsageQuery) {
+	rep := Resp{
+		ResultCode: ErrorCodeParseReq,
+		ResultMsg:  "",
+		ResultBody: "",
+	}
+	format := c.DefaultQuery("format", usageFormatCSV)
+	if format != usageFormatCSV && format != usageFormatJSON {
+		rep.ResultMsg = "format must be csv or json"
+		c.JSON(http.StatusBadRequest, rep)
+		return
+	}
+	buckets, ok := readUsage(c, q)
+	if !ok {
+		return
+	}
+	if format == usageFormatJSON {
+		rep.ResultCode = Success
+		rep.ResultBody = buckets
+		c.JSON(http.StatusOK, rep)
+		return
+	}
+	c.Header("Content-Type", usageCSVContentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=usage-%s.csv", q.Period))
+	c.Status(http.StatusOK)
+	if err := db.WriteUsageCSV(c.Writer, buckets); err != nil {
+		log.Error("write usage csv error", err)
+	}
+}
+
+// HandleUsageReport exports the usage of every tenant, e.g.
+// /admin/usage?period=day&from=2024-05-01&to=2024-06-01&tenant=acme
+func (s *Service) HandleUsageReport(c *gin.Context) {
+	q, err := usageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Resp{ResultCode: ErrorCodeParseReq, ResultMsg: err.Error(), ResultBody: ""})
+		return
+	}
+	q.Tenant = c.Query("tenant")
+	writeUsage(c, q)
+}
+
+// HandleTenantUsage exports the usage of the caller's tenant.
+func (s *Service) HandleTenantUsage(c *gin.Context) {
+	tenant := tenantOf(c)
+	if tenant == "" {
+		c.JSON(http.StatusForbidden, Resp{ResultCode: ErrorCodeUnknow, ResultMsg: "usage is kept per tenant, these credentials have none", ResultBody: ""})
+		return
+	}
+	q, err := usageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Resp{ResultCode: ErrorCodeParseReq, ResultMsg: err.Error(), ResultBody: ""})
+		return
+	}
+	q.Tenant = tenant
+	writeUsage(c, q)
+}
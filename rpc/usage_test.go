@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"context"
+	"gateway/db"
+	selfdriving "gateway/self-driving"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestQuotaAndUsage(t *testing.T) {
+	db.Store = db.NewMemoryStore()
+	loadTestSensitive(t)
+	AuthConf = AuthConfig{Enable: true, Anonymous: true}
+	QuotaConf = QuotaConfig{Enable: true, Tenants: map[string]Quota{
+		"acme": {MonthlyTokens: 1000},
+		"big":  {MonthlyRequests: 10, SoftPercent: 50},
+	}}
+	defer func() {
+		AuthConf = AuthConfig{}
+		QuotaConf = QuotaConfig{}
+	}()
+	ctx := context.Background()
+	acme, _, err := db.CreateAPIKey(ctx, db.APIKey{Tenant: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	big, _, err := db.CreateAPIKey(ctx, db.APIKey{Tenant: "big"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	month := db.PeriodStart(db.UsageMonth, now).Unix()
+	err = db.Store.(db.UsageStore).AddUsage(ctx, []db.UsageBucket{
+		{UsageKey: db.UsageKey{Period: db.UsageMonth, Start: month, Tenant: "acme", Model: "m1"}, UsageCounts: db.UsageCounts{Requests: 2, PromptTokens: 600, CompletionTokens: 400}},
+		{UsageKey: db.UsageKey{Period: db.UsageMonth, Start: month, Tenant: "big", Model: "m1"}, UsageCounts: db.UsageCounts{Requests: 6}},
+		{UsageKey: db.UsageKey{Period: db.UsageDay, Start: db.PeriodStart(db.UsageDay, now).Unix(), Tenant: "acme", Model: "m1"}, UsageCounts: db.UsageCounts{Requests: 2, PromptTokens: 600, CompletionTokens: 400, LatencyMs: 50}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Service{bsApiClient: map[string][]*selfdriving.Client{"m1": nil}}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Authenticate(nil))
+	chat := r.Group("", RequireScope(db.ScopeChat))
+	chat.POST("/api/question", s.HandleQuestion)
+	chat.GET("/api/usage", s.HandleTenantUsage)
+	do := func(method, url, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	question := `{"message":"forbidden","model":"m1"}`
+
+	if w := do(http.MethodPost, "/api/question", acme, question); w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "quota") {
+		t.Fatal("question over the hard limit answered", w.Code, w.Body.String())
+	}
+	w := do(http.MethodPost, "/api/question", big, question)
+	if w.Code != http.StatusOK || w.Header().Get(QuotaWarningHeader) != "60% of the monthly requests quota used" {
+		t.Fatal("no soft limit warning", w.Code, w.Header())
+	}
+	if w := do(http.MethodPost, "/api/question", "", question); w.Code != http.StatusOK {
+		t.Fatal("caller without tenant limited", w.Code)
+	}
+
+	w = do(http.MethodGet, "/api/usage?period=day", acme, "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != usageCSVContentType || !strings.Contains(w.Body.String(), ",acme,m1,,2,0,0,600,400,1000,25") {
+		t.Fatal("unexpected usage csv", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodGet, "/api/usage?period=day", big, ""); strings.Contains(w.Body.String(), "acme") {
+		t.Fatal("usage of another tenant exported", w.Body.String())
+	}
+	if w := do(http.MethodGet, "/api/usage", "", ""); w.Code != http.StatusForbidden {
+		t.Fatal("usage without tenant", w.Code)
+	}
+	if w := do(http.MethodGet, "/api/usage?period=week", acme, ""); w.Code != http.StatusBadRequest {
+		t.Fatal("unknown period accepted", w.Code)
+	}
+}
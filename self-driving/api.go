@@ -17,7 +17,10 @@ import (
 const MaxMsgLogLength = 20
 const MaxPromtLength = 2048
 const MaxTimeOut = 180
+const HealthPath = "/health"
+const HealthTimeout = time.Second * 10
 
+var HealthInterval = time.Second * 10
 var CheckMsgLogDuration = time.Minute * 2
 var MaxConversactionSuspend = 60 * 60
 
@@ -47,38 +50,72 @@ type BSResponse struct {
 
 type Client struct {
 	Status        int
+	Disabled      bool //gets no questions, health checks go on
 	Url           string
 	logUpdateTime map[string]int64
 	ModelName     string
+	httpClient    *common.HttpClient
+	timeout       time.Duration
+	cancel        context.CancelFunc
 }
 
+// NewClient checks the health of the worker at url until ctx is done or the
+// client is closed.
 func NewClient(url, modelName string, ctx context.Context) *Client {
+	ctx, cancel := context.WithCancel(ctx)
 	c := &Client{
 		Status:        ModelDown,
 		Url:           url,
 		logUpdateTime: make(map[string]int64),
 		ModelName:     modelName,
+		httpClient:    common.NewHttpClient(common.Upstream.HttpConfig),
+		timeout:       common.Upstream.TimeoutFor(modelName),
+		cancel:        cancel,
 	}
-	go c.checkHealth()
+	go c.checkHealth(ctx)
 	return c
 }
 
-func (c *Client) checkHealth() {
+// Close stops the health checks of a removed worker.
+func (c *Client) Close() {
+	c.cancel()
+}
+
+func (c *Client) checkHealth(ctx context.Context) {
 	for {
-		// _, err := common.HttpPost(c.Url+"/health", "", 10, nil)
-		var err error
-		if err != nil {
+		_, err := c.httpClient.Get(ctx, c.Url+HealthPath, HealthTimeout)
+		if ctx.Err() != nil {
+			return
+		}
+		if !healthy(err) {
+			log.Warn("worker health check failed", c.Url, err)
 			c.Status = ModelDown
 		} else {
 			if c.Status == ModelDown {
 				c.Status = ModelAvalible
 			}
 		}
-		time.Sleep(time.Second * 10)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(HealthInterval):
+		}
 	}
 }
 
-func (c *Client) buildPromt(q *common.Question) []openai.ChatCompletionMessage {
+// healthy tells whether a health check answered. A 4xx status still means
+// the worker is up, it may just not serve the health path; 5xx means it is
+// failing.
+func healthy(err error) bool {
+	var upErr *common.UpstreamError
+	if errors.As(err, &upErr) {
+		return upErr.StatusCode < 500
+	}
+	return err == nil
+}
+
+// BuildPrompt assembles the recent conversation history and the question.
+func BuildPrompt(q *common.Question) []openai.ChatCompletionMessage {
 	promtLen := 0
 	promt := []openai.ChatCompletionMessage{}
 	conversationFrom := time.Now().Unix() - int64(MaxConversactionSuspend)
@@ -89,6 +126,10 @@ func (c *Client) buildPromt(q *common.Question) []openai.ChatCompletionMessage {
 	if err == nil {
 		for i := len(msgLog) - 1; i >= 0; i-- {
 			msg := msgLog[i]
+			//failed turns have no answer to continue from
+			if msg.Error != "" {
+				continue
+			}
 			userMsg := openai.ChatCompletionMessage{
 				Role:    UserRole,
 				Content: msg.Prompt,
@@ -122,13 +163,16 @@ func (c *Client) GetAnswer(ctx context.Context, q common.Question) (*common.QA,
 	defer func() {
 		c.Status = ModelAvalible
 	}()
-	prompt := c.buildPromt(&q)
+	prompt := q.Prompt
+	if prompt == nil {
+		prompt = BuildPrompt(&q)
+	}
 	log.Debug("self driving model", q.Model, "prompt:\n", fmt.Sprintf("%v", prompt))
 	req := openai.ChatCompletionRequest{
 		Model:       q.Model,
 		Messages:    prompt,
-		Temperature: 0,
-		TopP:        0,
+		Temperature: q.Temperature,
+		TopP:        q.TopP,
 		N:           0,
 		Stream:      false,
 		User:        UserRole,
@@ -138,7 +182,7 @@ func (c *Client) GetAnswer(ctx context.Context, q common.Question) (*common.QA,
 		log.Info(err.Error())
 		return nil, err
 	}
-	resp, err := common.HttpPost(c.Url, string(promptData), MaxTimeOut, map[string]string{
+	resp, err := c.httpClient.Post(ctx, c.Url, promptData, c.timeout, map[string]string{
 		"Content-Type":  "application/json",
 		"Authorization": "",
 	})
@@ -166,6 +210,9 @@ func (c *Client) GetAnswer(ctx context.Context, q common.Question) (*common.QA,
 		MessageId:      uuid.NewString(),
 		ConversationId: q.ConversationId,
 		Model:          c.ModelName,
+		Prompt:         prompt,
+		FinishReason:   bsResp.Choices[0].FinishReason,
+		Usage:          bsResp.Usage,
 	}
 	return &qa, nil
 }
@@ -0,0 +1,43 @@
+package selfdriving
+
+import (
+	"context"
+	"gateway/log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.InitLog(log.InfoLog)
+}
+
+func waitStatus(t *testing.T, c *Client, want int) {
+	deadline := time.Now().Add(time.Second * 2)
+	for c.Status != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("status %d, want %d", c.Status, want)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func TestHealthCheckStatus(t *testing.T) {
+	HealthInterval = time.Millisecond * 10
+	defer func() { HealthInterval = time.Second * 10 }()
+	var code int32 = http.StatusNotFound
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&code)))
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, "m1", context.Background())
+	defer c.Close()
+	//a worker without the health path is up
+	waitStatus(t, c, ModelAvalible)
+	atomic.StoreInt32(&code, http.StatusServiceUnavailable)
+	waitStatus(t, c, ModelDown)
+	atomic.StoreInt32(&code, http.StatusOK)
+	waitStatus(t, c, ModelAvalible)
+}
@@ -0,0 +1,60 @@
+package selfdriving
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gateway/common"
+	"strings"
+)
+
+type embeddingRequest struct {
+	Input []string `json:"input"`
+	Model string   `json:"model"`
+}
+
+type embeddingResponse struct {
+	Data []struct {
+		Embedding []float32 `json:"embedding"`
+		Index     int       `json:"index"`
+	} `json:"data"`
+}
+
+// EmbeddingClient calls an openai compatible /embeddings endpoint of a worker.
+type EmbeddingClient struct {
+	Url        string
+	ModelName  string
+	httpClient *common.HttpClient
+}
+
+func NewEmbeddingClient(url, modelName string) *EmbeddingClient {
+	return &EmbeddingClient{
+		Url:        url,
+		ModelName:  modelName,
+		httpClient: common.NewHttpClient(common.Upstream.HttpConfig),
+	}
+}
+
+func (c *EmbeddingClient) Embed(ctx context.Context, text string) ([]float32, error) {
+	body, err := json.Marshal(&embeddingRequest{
+		Input: []string{strings.ReplaceAll(text, "\n", " ")},
+		Model: c.ModelName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Post(ctx, c.Url, body, common.Upstream.TimeoutFor(c.ModelName), map[string]string{
+		"Content-Type": "application/json",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var embResp embeddingResponse
+	if err := json.Unmarshal(resp, &embResp); err != nil {
+		return nil, err
+	}
+	if len(embResp.Data) == 0 || len(embResp.Data[0].Embedding) == 0 {
+		return nil, errors.New("no embedding in response")
+	}
+	return embResp.Data[0].Embedding, nil
+}
@@ -0,0 +1,209 @@
+package transcript
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+type jsonFile struct {
+	Conversations []Conversation `json:"conversations"`
+}
+
+func encodeJSON(w io.Writer, convs []Conversation) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(jsonFile{Conversations: convs})
+}
+
+func decodeJSON(r io.Reader) ([]Conversation, error) {
+	var file jsonFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, fmt.Errorf("decode json transcript: %w", err)
+	}
+	return file.Conversations, nil
+}
+
+// messagesLine is an openai chat messages record. Model attribution goes on
+// the assistant messages, readers that only know role and content skip it.
+type messagesLine struct {
+	ConversationId string    `json:"conversationId,omitempty"`
+	Messages       []message `json:"messages"`
+}
+
+type message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	Model   string `json:"model,omitempty"`
+}
+
+func encodeJSONL(w io.Writer, convs []Conversation) error {
+	bw := bufio.NewWriter(w)
+	for _, conv := range convs {
+		line := messagesLine{ConversationId: conv.ConversationId, Messages: make([]message, 0, 2*len(conv.Turns))}
+		for _, turn := range conv.Turns {
+			line.Messages = append(line.Messages,
+				message{Role: RoleUser, Content: turn.Prompt},
+				message{Role: RoleAssistant, Content: turn.Text, Model: turn.Model})
+		}
+		data, err := json.Marshal(&line)
+		if err != nil {
+			return err
+		}
+		bw.Write(data)
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// decodeJSONL pairs each user message with the assistant message after it.
+// System messages are skipped, a user message without an answer is dropped.
+func decodeJSONL(r io.Reader) ([]Conversation, error) {
+	convs := make([]Conversation, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+		var line messagesLine
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			return nil, fmt.Errorf("decode jsonl transcript line %d: %w", n, err)
+		}
+		conv := Conversation{ConversationId: line.ConversationId, Turns: make([]Turn, 0)}
+		var pending *message
+		for i := range line.Messages {
+			msg := &line.Messages[i]
+			switch msg.Role {
+			case RoleUser:
+				pending = msg
+			case RoleAssistant:
+				if pending == nil {
+					continue
+				}
+				conv.Turns = append(conv.Turns, Turn{Prompt: pending.Content, Text: msg.Content, Model: msg.Model})
+				pending = nil
+			}
+		}
+		convs = append(convs, conv)
+	}
+	return convs, scanner.Err()
+}
+
+const (
+	mdConversation = "# Conversation"
+	mdUser         = "## User"
+	mdAssistant    = "## Assistant"
+)
+
+// mdHeading reports whether a content line would be read back as one of our
+// headings, such lines are escaped with a backslash.
+func mdHeading(line string) bool {
+	for _, heading := range []string{mdConversation, mdUser, mdAssistant} {
+		if strings.HasPrefix(strings.TrimLeft(line, "\\"), heading) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeMarkdownBody(w *bufio.Writer, text string) {
+	for _, line := range strings.Split(text, "\n") {
+		if mdHeading(line) {
+			w.WriteString("\\")
+		}
+		w.WriteString(line)
+		w.WriteString("\n")
+	}
+}
+
+// encodeMarkdown writes every conversation under a level one heading and
+// every message under a level two heading naming the role, and the model for
+// answers.
+func encodeMarkdown(w io.Writer, convs []Conversation) error {
+	bw := bufio.NewWriter(w)
+	for i, conv := range convs {
+		if i > 0 {
+			bw.WriteString("\n")
+		}
+		fmt.Fprintf(bw, "%s %s\n", mdConversation, conv.ConversationId)
+		for _, turn := range conv.Turns {
+			fmt.Fprintf(bw, "\n%s\n\n", mdUser)
+			writeMarkdownBody(bw, turn.Prompt)
+			if turn.Model != "" {
+				fmt.Fprintf(bw, "\n%s (%s)\n\n", mdAssistant, turn.Model)
+			} else {
+				fmt.Fprintf(bw, "\n%s\n\n", mdAssistant)
+			}
+			writeMarkdownBody(bw, turn.Text)
+		}
+	}
+	return bw.Flush()
+}
+
+func decodeMarkdown(r io.Reader) ([]Conversation, error) {
+	convs := make([]Conversation, 0)
+	var conv *Conversation
+	var turn *Turn
+	var body []string
+	role := ""
+	flush := func() {
+		//the encoder puts one blank line after each heading and before the next
+		text := strings.Trim(strings.Join(body, "\n"), "\n")
+		body = body[:0]
+		switch role {
+		case RoleUser:
+			turn = &Turn{Prompt: text}
+		case RoleAssistant:
+			if turn != nil {
+				turn.Text = text
+				conv.Turns = append(conv.Turns, *turn)
+				turn = nil
+			}
+		}
+		role = ""
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case strings.HasPrefix(line, mdConversation):
+			flush()
+			convs = append(convs, Conversation{ConversationId: strings.TrimSpace(line[len(mdConversation):])})
+			conv = &convs[len(convs)-1]
+			turn = nil
+		case line == mdUser:
+			flush()
+			if conv == nil {
+				convs = append(convs, Conversation{})
+				conv = &convs[len(convs)-1]
+			}
+			role = RoleUser
+		case strings.HasPrefix(line, mdAssistant):
+			flush()
+			if turn == nil {
+				continue
+			}
+			model := strings.TrimSpace(line[len(mdAssistant):])
+			turn.Model = strings.TrimSuffix(strings.TrimPrefix(model, "("), ")")
+			role = RoleAssistant
+		case role != "":
+			if strings.HasPrefix(line, "\\") && mdHeading(line[1:]) {
+				line = line[1:]
+			}
+			body = append(body, line)
+		}
+	}
+	flush()
+	return convs, scanner.Err()
+}
@@ -0,0 +1,142 @@
+package transcript
+
+import (
+	"errors"
+	"gateway/db"
+	"io"
+	"sort"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatMarkdown = "markdown"
+	FormatJSONL    = "jsonl" //openai messages, one conversation per line
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown transcript format, want json, markdown or jsonl")
+	ErrEmpty         = errors.New("no conversation turns found")
+)
+
+// Turn is one question and its answer.
+type Turn struct {
+	MessageId   string `json:"messageId,omitempty"`
+	Prompt      string `json:"prompt"`
+	Text        string `json:"text"`
+	Model       string `json:"model,omitempty"`
+	StartTimeMs int64  `json:"startTimeMs,omitempty"`
+}
+
+// Conversation is a portable copy of a stored conversation, turns oldest
+// first.
+type Conversation struct {
+	ConversationId string `json:"conversationId,omitempty"`
+	Turns          []Turn `json:"turns"`
+}
+
+// FromMessages groups stored turns into conversations, in the order the
+// conversations first appear and by sequence within each. Failed turns have
+// no answer and are left out.
+func FromMessages(msgs []db.Message) []Conversation {
+	order := make([]string, 0)
+	grouped := make(map[string][]db.Message)
+	for _, msg := range msgs {
+		if msg.Error != "" {
+			continue
+		}
+		if _, ok := grouped[msg.ConversationId]; !ok {
+			order = append(order, msg.ConversationId)
+		}
+		grouped[msg.ConversationId] = append(grouped[msg.ConversationId], msg)
+	}
+	convs := make([]Conversation, 0, len(order))
+	for _, id := range order {
+		turns := grouped[id]
+		sort.SliceStable(turns, func(i, j int) bool {
+			return turns[i].Seq < turns[j].Seq
+		})
+		conv := Conversation{ConversationId: id, Turns: make([]Turn, 0, len(turns))}
+		for _, msg := range turns {
+			conv.Turns = append(conv.Turns, Turn{
+				MessageId:   msg.MessageId,
+				Prompt:      msg.Prompt,
+				Text:        msg.Text,
+				Model:       msg.Model,
+				StartTimeMs: msg.StartTimeMs,
+			})
+		}
+		convs = append(convs, conv)
+	}
+	return convs
+}
+
+// Encode writes convs in format.
+func Encode(w io.Writer, format string, convs []Conversation) error {
+	switch format {
+	case FormatJSON:
+		return encodeJSON(w, convs)
+	case FormatMarkdown:
+		return encodeMarkdown(w, convs)
+	case FormatJSONL:
+		return encodeJSONL(w, convs)
+	}
+	return ErrUnknownFormat
+}
+
+// Decode reads the conversations written by Encode. Turns without a model
+// are attributed to defaultModel.
+func Decode(r io.Reader, format, defaultModel string) ([]Conversation, error) {
+	var convs []Conversation
+	var err error
+	switch format {
+	case FormatJSON:
+		convs, err = decodeJSON(r)
+	case FormatMarkdown:
+		convs, err = decodeMarkdown(r)
+	case FormatJSONL:
+		convs, err = decodeJSONL(r)
+	default:
+		return nil, ErrUnknownFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	kept := make([]Conversation, 0, len(convs))
+	for _, conv := range convs {
+		if len(conv.Turns) == 0 {
+			continue
+		}
+		for i := range conv.Turns {
+			if conv.Turns[i].Model == "" {
+				conv.Turns[i].Model = defaultModel
+			}
+		}
+		kept = append(kept, conv)
+	}
+	if len(kept) == 0 {
+		return nil, ErrEmpty
+	}
+	return kept, nil
+}
+
+// ContentType is the mime type of a format.
+func ContentType(format string) string {
+	switch format {
+	case FormatMarkdown:
+		return "text/markdown; charset=utf-8"
+	case FormatJSONL:
+		return "application/x-ndjson"
+	}
+	return "application/json"
+}
+
+// Ext is the file extension of a format.
+func Ext(format string) string {
+	switch format {
+	case FormatMarkdown:
+		return ".md"
+	case FormatJSONL:
+		return ".jsonl"
+	}
+	return ".json"
+}
@@ -0,0 +1,69 @@
+package transcript
+
+import (
+	"bytes"
+	"gateway/db"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	msgs := []db.Message{
+		{ConversationId: "c1", MessageId: "m2", Seq: 2, Prompt: "And in code?", Text: "```go\n## User\nfmt.Println()\n```", Model: "gpt"},
+		{ConversationId: "c1", MessageId: "m1", Seq: 1, Prompt: "# Conversation title?\nsecond line", Text: "Hello.\n\nTwo paragraphs.", Model: "self-driving-v1"},
+		{ConversationId: "c1", MessageId: "m3", Seq: 3, Prompt: "lost", Telemetry: db.Telemetry{Error: "timeout"}},
+		{ConversationId: "c2", MessageId: "m4", Seq: 1, Prompt: "你好", Text: "你好！", Model: "self-driving-v3"},
+	}
+	convs := FromMessages(msgs)
+	if len(convs) != 2 || len(convs[0].Turns) != 2 || convs[0].Turns[0].MessageId != "m1" {
+		t.Fatal("unexpected conversations", convs)
+	}
+	for _, format := range []string{FormatJSON, FormatMarkdown, FormatJSONL} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, format, convs); err != nil {
+			t.Fatal(format, err)
+		}
+		got, err := Decode(&buf, format, "")
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		if len(got) != len(convs) {
+			t.Fatal(format, "unexpected conversations", got)
+		}
+		for i := range convs {
+			if got[i].ConversationId != convs[i].ConversationId || len(got[i].Turns) != len(convs[i].Turns) {
+				t.Fatal(format, "unexpected conversation", got[i])
+			}
+			for j, want := range convs[i].Turns {
+				turn := got[i].Turns[j]
+				if turn.Prompt != want.Prompt || turn.Text != want.Text || turn.Model != want.Model {
+					t.Fatalf("%s: turn %d.%d got %+v want %+v", format, i, j, turn, want)
+				}
+			}
+		}
+		if format == FormatJSON && !reflect.DeepEqual(got, convs) {
+			t.Fatal("json lost fields", got)
+		}
+	}
+}
+
+func TestDecodeForeign(t *testing.T) {
+	//plain openai messages without model or ids
+	jsonl := `{"messages":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"},{"role":"assistant","content":"hello"},{"role":"user","content":"unanswered"}]}` + "\n"
+	convs, err := Decode(strings.NewReader(jsonl), FormatJSONL, "self-driving-v1")
+	if err != nil || len(convs) != 1 || len(convs[0].Turns) != 1 || convs[0].Turns[0].Model != "self-driving-v1" {
+		t.Fatal("unexpected conversations", convs, err)
+	}
+	md := "## User\n\nhi\n\n## Assistant\n\nhello\n"
+	convs, err = Decode(strings.NewReader(md), FormatMarkdown, "gpt")
+	if err != nil || len(convs) != 1 || convs[0].Turns[0].Text != "hello" || convs[0].Turns[0].Model != "gpt" {
+		t.Fatal("unexpected markdown conversations", convs, err)
+	}
+	if _, err := Decode(strings.NewReader("{}"), FormatJSON, ""); err != ErrEmpty {
+		t.Fatal("empty transcript accepted", err)
+	}
+	if _, err := Decode(strings.NewReader(""), "csv", ""); err != ErrUnknownFormat {
+		t.Fatal("unknown format accepted", err)
+	}
+}
@@ -2,71 +2,229 @@ package trie
 
 import (
 	"encoding/csv"
+	"errors"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type strmap map[string]bool
 
-var SensitiveRoot *node
-var SensitiveMap map[string]strmap
-var SingleSensitive map[string]bool
+var ErrNoSensitiveFile = errors.New("no sensitive file loaded")
 
-func LoadSensitive(filePath string) error {
-	SensitiveRoot = new(node)
-	SensitiveMap = make(map[string]strmap)
-	SingleSensitive = make(map[string]bool)
+// sensitiveList is a loaded list, it is replaced as a whole when it changes
+// so questions never see half of one.
+type sensitiveList struct {
+	root   *node
+	pairs  map[string]strmap
+	single map[string]bool
+	rows   map[string][]string //entry -> csv row, written back as read
+}
+
+var (
+	current       atomic.Value //*sensitiveList
+	changeLock    sync.Mutex
+	sensitivePath string
+)
+
+func newSensitiveList(rows map[string][]string) *sensitiveList {
+	l := &sensitiveList{root: new(node), pairs: make(map[string]strmap), single: make(map[string]bool), rows: rows}
+	for sensitive := range rows {
+		words := strings.SplitN(sensitive, " ", 2)
+		for _, word := range words {
+			if word == "" {
+				continue
+			}
+			l.root.add(word)
+		}
+		if len(words) == 1 {
+			l.single[words[0]] = true
+		}
+		if len(words) == 2 {
+			if m, ok := l.pairs[words[0]]; ok {
+				m[words[1]] = true
+			} else {
+				l.pairs[words[0]] = map[string]bool{words[1]: true}
+			}
+		}
+	}
+	return l
+}
 
+func readSensitive(filePath string) (map[string][]string, error) {
 	f, err := os.Open(filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
 	csvReader := csv.NewReader(f)
+	csvReader.FieldsPerRecord = -1
 	records, err := csvReader.ReadAll()
 	if err != nil {
-		return err
+		return nil, err
 	}
-
+	rows := make(map[string][]string)
 	for _, record := range records {
-		if len(record) == 0 {
+		if len(record) == 0 || record[0] == "" {
 			continue
 		}
-		sensitive := record[0]
-		if sensitive == "" {
-			continue
+		rows[record[0]] = record
+	}
+	return rows, nil
+}
+
+// writeSensitive replaces the file with rows, through a temporary file so a
+// crash leaves the old or the new list.
+func writeSensitive(filePath string, rows map[string][]string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := csv.NewWriter(tmp)
+	for _, entry := range sortedEntries(rows) {
+		if err := w.Write(rows[entry]); err != nil {
+			tmp.Close()
+			return err
 		}
-		words := strings.SplitN(sensitive, " ", 2)
-		for _, word := range words {
-			if word == "" {
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+func sortedEntries(rows map[string][]string) []string {
+	entries := make([]string, 0, len(rows))
+	for entry := range rows {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+func loaded() *sensitiveList {
+	l, _ := current.Load().(*sensitiveList)
+	return l
+}
+
+// LoadSensitive reads the csv list at filePath, its first column are words
+// or two words separated by a space that are sensitive together.
+func LoadSensitive(filePath string) error {
+	changeLock.Lock()
+	defer changeLock.Unlock()
+	rows, err := readSensitive(filePath)
+	if err != nil {
+		return err
+	}
+	current.Store(newSensitiveList(rows))
+	sensitivePath = filePath
+	return nil
+}
+
+// ReloadSensitive reads the loaded file again and returns its entry count.
+func ReloadSensitive() (int, error) {
+	changeLock.Lock()
+	path := sensitivePath
+	changeLock.Unlock()
+	if path == "" {
+		return 0, ErrNoSensitiveFile
+	}
+	if err := LoadSensitive(path); err != nil {
+		return 0, err
+	}
+	return len(loaded().rows), nil
+}
+
+// SensitiveEntries returns the loaded entries in order.
+func SensitiveEntries() []string {
+	l := loaded()
+	if l == nil {
+		return []string{}
+	}
+	return sortedEntries(l.rows)
+}
+
+// changeSensitive applies change to a copy of the loaded rows, writes them to
+// the file and swaps the list in.
+func changeSensitive(change func(rows map[string][]string) int) (int, error) {
+	changeLock.Lock()
+	defer changeLock.Unlock()
+	if sensitivePath == "" {
+		return 0, ErrNoSensitiveFile
+	}
+	rows := make(map[string][]string)
+	if l := loaded(); l != nil {
+		for entry, row := range l.rows {
+			rows[entry] = row
+		}
+	}
+	changed := change(rows)
+	if changed == 0 {
+		return 0, nil
+	}
+	if err := writeSensitive(sensitivePath, rows); err != nil {
+		return 0, err
+	}
+	current.Store(newSensitiveList(rows))
+	return changed, nil
+}
+
+// AddSensitive adds entries to the list and its file, it returns how many
+// were new.
+func AddSensitive(entries ...string) (int, error) {
+	return changeSensitive(func(rows map[string][]string) int {
+		added := 0
+		for _, entry := range entries {
+			entry = strings.TrimSpace(entry)
+			if _, ok := rows[entry]; ok || entry == "" {
 				continue
 			}
-			SensitiveRoot.add(word)
-		}
-		if len(words) == 1 {
-			SingleSensitive[words[0]] = true
+			rows[entry] = []string{entry}
+			added++
 		}
-		if len(words) == 2 {
-			if m, ok := SensitiveMap[words[0]]; ok {
-				m[words[1]] = true
-			} else {
-				SensitiveMap[words[0]] = map[string]bool{words[1]: true}
+		return added
+	})
+}
+
+// RemoveSensitive drops entries from the list and its file, it returns how
+// many it had.
+func RemoveSensitive(entries ...string) (int, error) {
+	return changeSensitive(func(rows map[string][]string) int {
+		removed := 0
+		for _, entry := range entries {
+			entry = strings.TrimSpace(entry)
+			if _, ok := rows[entry]; ok {
+				delete(rows, entry)
+				removed++
 			}
 		}
-	}
-	return nil
+		return removed
+	})
 }
 
 func IsSensitive(content string) bool {
-	words := SensitiveRoot.getAllEdges(content)
+	l := loaded()
+	if l == nil {
+		return false
+	}
+	words := l.root.getAllEdges(content)
 	if len(words) == 0 {
 		return false
 	}
 	for _, word := range words {
-		if _, ok := SingleSensitive[word]; ok {
+		if _, ok := l.single[word]; ok {
 			return true
 		}
-		if m, ok := SensitiveMap[word]; ok {
+		if m, ok := l.pairs[word]; ok {
 			for _, moreWord := range words {
 				if _, ok := m[moreWord]; ok {
 					return true
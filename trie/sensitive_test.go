@@ -0,0 +1,45 @@
+package trie
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSensitiveList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sensitive.csv")
+	if err := os.WriteFile(path, []byte("forbidden\nred apple,fruit\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadSensitive(path); err != nil {
+		t.Fatal(err)
+	}
+	if !IsSensitive("this is forbidden") || !IsSensitive("an apple that is red") || IsSensitive("a red car") {
+		t.Fatal("unexpected matches")
+	}
+
+	if added, err := AddSensitive("secret", "forbidden", " "); err != nil || added != 1 {
+		t.Fatal("unexpected add", added, err)
+	}
+	if removed, err := RemoveSensitive("forbidden", "missing"); err != nil || removed != 1 {
+		t.Fatal("unexpected remove", removed, err)
+	}
+	if !IsSensitive("a secret") || IsSensitive("this is forbidden") {
+		t.Fatal("changes not applied")
+	}
+	if entries := SensitiveEntries(); !reflect.DeepEqual(entries, []string{"red apple", "secret"}) {
+		t.Fatal("unexpected entries", entries)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "red apple,fruit\nsecret\n" {
+		t.Fatal("unexpected file", string(data), err)
+	}
+
+	if err := os.WriteFile(path, []byte("other\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ReloadSensitive(); err != nil || n != 1 || !IsSensitive("the other one") || IsSensitive("a secret") {
+		t.Fatal("unexpected reload", n, err)
+	}
+}